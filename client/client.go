@@ -0,0 +1,455 @@
+// Package client is a Go client of the database text protocol
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/protocol/text"
+	"github.com/JaneJavannie/in_memory_key_value_db/utils"
+)
+
+// Errors returned by the server, check them with errors.Is
+var (
+	ErrUnknownCommand     = consts.ErrUnknownCommand
+	ErrReadOnly           = consts.ErrReadOnly
+	ErrRecoveryReadOnly   = consts.ErrRecoveryReadOnly
+	ErrMessageTooLarge    = consts.ErrMessageTooLarge
+	ErrIdleTimeout        = consts.ErrIdleTimeout
+	ErrRequestTimeout     = consts.ErrRequestTimeout
+	ErrMaxConnections     = consts.ErrMaxConnections
+	ErrAuthRequired       = consts.ErrAuthRequired
+	ErrInvalidCredentials = consts.ErrInvalidCredentials
+	ErrPermissionDenied   = consts.ErrPermissionDenied
+	ErrInvalidRequestID   = consts.ErrInvalidRequestID
+	ErrRequestIDConflict  = consts.ErrRequestIDConflict
+)
+
+var (
+	// ErrInvalidArgument is returned before sending a key or a value the protocol can't carry
+	ErrInvalidArgument = errors.New("invalid argument")
+	// ErrInvalidResponse is returned when a response is not in the protocol format
+	ErrInvalidResponse = errors.New("invalid response")
+	// ErrClientClosed is returned by requests after Close
+	ErrClientClosed = errors.New("client is closed")
+
+	// errNotSent marks failures after which the server surely didn't process the request
+	errNotSent = errors.New("request was not processed")
+)
+
+// serverErrors are matched against the error text of a response
+var serverErrors = []error{
+	ErrUnknownCommand,
+	ErrReadOnly,
+	ErrRecoveryReadOnly,
+	ErrMessageTooLarge,
+	ErrIdleTimeout,
+	ErrRequestTimeout,
+	ErrMaxConnections,
+	ErrAuthRequired,
+	ErrInvalidCredentials,
+	ErrPermissionDenied,
+	ErrInvalidRequestID,
+	ErrRequestIDConflict,
+}
+
+const (
+	responsePrefix    = "query result: [ "
+	responseSeparator = " ] error: [ "
+	responseSuffix    = " ]"
+	noError           = "<nil>"
+	pong              = "PONG"
+)
+
+const (
+	defaultMinConnections      = 1
+	defaultMaxConnections      = 10
+	defaultRetries             = 3
+	defaultRetryDelay          = 50 * time.Millisecond
+	defaultHealthCheckInterval = 30 * time.Second
+	defaultHealthCheckTimeout  = time.Second
+)
+
+// Client is safe for concurrent use by many goroutines.
+// Requests are sent over a pool of connections, broken connections are reopened with exponential backoff.
+// Setters must be called before the first request.
+type Client struct {
+	address   string
+	tlsConfig *tls.Config
+	user      string
+	password  string
+
+	minConnections      int
+	maxConnections      int
+	retries             int
+	retryDelay          time.Duration
+	retryWrites         bool
+	healthCheckInterval time.Duration
+
+	once sync.Once
+	pool *pool
+}
+
+// New creates a client of the server at address, "unix:///path" addresses are unix domain sockets
+func New(address string) *Client {
+	return &Client{
+		address:             address,
+		minConnections:      defaultMinConnections,
+		maxConnections:      defaultMaxConnections,
+		retries:             defaultRetries,
+		retryDelay:          defaultRetryDelay,
+		healthCheckInterval: defaultHealthCheckInterval,
+	}
+}
+
+// SetTLSConfig makes the client connect over tls
+func (c *Client) SetTLSConfig(cfg *tls.Config) {
+	c.tlsConfig = cfg
+}
+
+// SetCredentials makes every connection authenticate with AUTH when it's opened
+func (c *Client) SetCredentials(user string, password string) {
+	c.user = user
+	c.password = password
+}
+
+// Auth sets the credentials and checks them on a new connection. Like setters, it must be called before
+// the first request.
+//
+// Deprecated: use SetCredentials, pooled connections authenticate when they're opened.
+func (c *Client) Auth(ctx context.Context, user string, password string) error {
+	err := validateArguments(user, password)
+	if err != nil {
+		return err
+	}
+
+	c.SetCredentials(user, password)
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// SetPoolSize keeps at least min and at most max connections open.
+// A max below 1 is raised to 1, a min above max is lowered to max.
+func (c *Client) SetPoolSize(min int, max int) {
+	c.minConnections = min
+	c.maxConnections = max
+}
+
+// SetRetries sets the number of attempts of a request and of opening a connection,
+// delays between attempts grow exponentially from initialDelay
+func (c *Client) SetRetries(attempts int, initialDelay time.Duration) {
+	c.retries = attempts
+	c.retryDelay = initialDelay
+}
+
+// SetRetryWrites enables retries of SET and DEL after network errors.
+// Every attempt carries the same request id, so a server can recognize a write it has already applied.
+func (c *Client) SetRetryWrites(retry bool) {
+	c.retryWrites = retry
+}
+
+// SetHealthCheckInterval sets how often idle connections are checked with PING, 0 disables checks
+func (c *Client) SetHealthCheckInterval(interval time.Duration) {
+	c.healthCheckInterval = interval
+}
+
+// Get returns the value of key, found is false when there is no such key
+func (c *Client) Get(ctx context.Context, key string) (value string, found bool, err error) {
+	err = validateArguments(key)
+	if err != nil {
+		return "", false, err
+	}
+
+	value, err = c.do(ctx, true, consts.CommandGet, key)
+	if err != nil {
+		return "", false, err
+	}
+
+	return value, value != "", nil
+}
+
+func (c *Client) Set(ctx context.Context, key string, value string) error {
+	err := validateArguments(key, value)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.do(ctx, c.retryWrites, consts.CommandSet, key, value)
+	return err
+}
+
+func (c *Client) Del(ctx context.Context, key string) error {
+	err := validateArguments(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.do(ctx, c.retryWrites, consts.CommandDel, key)
+	return err
+}
+
+// Stats returns server statistics as json
+func (c *Client) Stats(ctx context.Context) (string, error) {
+	return c.do(ctx, true, consts.CommandStats)
+}
+
+// Ping checks that the server answers
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.do(ctx, true, consts.CommandPing)
+	return err
+}
+
+// BackupResult describes a backup written by the server
+type BackupResult struct {
+	Directory string `json:"directory"`
+	Snapshot  string `json:"snapshot"` // path of the snapshot file in the directory
+	Keys      int    `json:"keys"`
+	Files     int    `json:"files"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// Backup makes the server write a backup to dir on its filesystem, dir must be missing or empty.
+// It's never retried, a retry would find the directory of the first attempt.
+func (c *Client) Backup(ctx context.Context, dir string) (BackupResult, error) {
+	err := validateArguments(dir)
+	if err != nil {
+		return BackupResult{}, err
+	}
+
+	result, err := c.do(ctx, false, consts.CommandBackup, dir)
+	if err != nil {
+		return BackupResult{}, err
+	}
+
+	res := BackupResult{}
+
+	err = json.Unmarshal([]byte(result), &res)
+	if err != nil {
+		return BackupResult{}, fmt.Errorf("%w: backup: %w", ErrInvalidResponse, err)
+	}
+
+	return res, nil
+}
+
+// Role is the replication role of a server
+type Role struct {
+	Role string        // "master" or "slave"
+	Lag  time.Duration // time since a slave has synced with the master
+}
+
+type roleResponse struct {
+	Role  string `json:"role"`
+	LagMs int64  `json:"lag_ms"`
+}
+
+// Role returns the replication role of the server
+func (c *Client) Role(ctx context.Context) (Role, error) {
+	result, err := c.do(ctx, true, consts.CommandRole)
+	if err != nil {
+		return Role{}, err
+	}
+
+	res := roleResponse{}
+
+	err = json.Unmarshal([]byte(result), &res)
+	if err != nil {
+		return Role{}, fmt.Errorf("%w: role: %w", ErrInvalidResponse, err)
+	}
+
+	return Role{Role: res.Role, Lag: time.Duration(res.LagMs) * time.Millisecond}, nil
+}
+
+// Close closes idle connections, connections in use are closed when their requests finish
+func (c *Client) Close() error {
+	c.once.Do(c.init)
+
+	return c.pool.close()
+}
+
+func (c *Client) init() {
+	c.pool = newPool(c.minConnections, c.maxConnections, c.dial, ping)
+	c.pool.startHealthCheck(c.healthCheckInterval, defaultHealthCheckTimeout)
+}
+
+// do sends a request. Requests that failed before reaching the server are always retried,
+// other network errors are retried only when retry is set. Error responses are never retried.
+func (c *Client) do(ctx context.Context, retry bool, command string, args ...string) (string, error) {
+	c.once.Do(c.init)
+
+	request := strings.Join(append([]string{command}, args...), " ")
+	if retry && c.retryWrites && command != consts.CommandGet {
+		request = text.WithRequestID(utils.GetRequestUUID(), request)
+	}
+
+	var result string
+	var final error
+
+	err := utils.WithRetries(ctx, max(c.retries, 1), c.retryDelay, func() error {
+		response, err := c.roundTrip(ctx, request)
+		if err != nil {
+			if (retry || errors.Is(err, errNotSent)) && !errors.Is(err, ErrClientClosed) {
+				return err
+			}
+
+			final = err
+			return nil
+		}
+
+		result, final = ParseResponse(response)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", command, err)
+	}
+	if final != nil {
+		return "", fmt.Errorf("%s: %w", command, final)
+	}
+
+	return result, nil
+}
+
+func (c *Client) roundTrip(ctx context.Context, request string) (string, error) {
+	conn, err := c.pool.get(ctx)
+	if err != nil {
+		return "", fmt.Errorf("%w: get connection: %w", errNotSent, err)
+	}
+
+	response, err := conn.Send(ctx, request)
+	if err != nil {
+		// the connection state is unknown after a failed request
+		c.pool.put(conn, true)
+		return "", fmt.Errorf("send: %w", err)
+	}
+
+	// the server closes a connection after these responses without processing the request
+	_, err = ParseResponse(response)
+	if errors.Is(err, ErrIdleTimeout) || errors.Is(err, ErrMaxConnections) {
+		c.pool.put(conn, true)
+		return "", fmt.Errorf("%w: %w", errNotSent, err)
+	}
+
+	c.pool.put(conn, false)
+
+	return response, nil
+}
+
+// dial opens a connection with retries and authenticates it when credentials are set
+func (c *Client) dial(ctx context.Context) (*text.Client, error) {
+	conn := text.NewTextClient(c.address)
+	conn.SetTLSConfig(c.tlsConfig)
+
+	err := utils.WithRetries(ctx, max(c.retries, 1), c.retryDelay, func() error {
+		return conn.Connect(ctx)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+
+	if c.user == "" {
+		return conn, nil
+	}
+
+	response, err := conn.Send(ctx, strings.Join([]string{consts.CommandAuth, c.user, c.password}, " "))
+	if err == nil {
+		_, err = ParseResponse(response)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+
+	return conn, nil
+}
+
+func ping(ctx context.Context, conn *text.Client) error {
+	response, err := conn.Send(ctx, consts.CommandPing)
+	if err != nil {
+		return err
+	}
+
+	result, err := ParseResponse(response)
+	if err != nil {
+		return err
+	}
+	if result != pong {
+		return fmt.Errorf("%w: ping: %s", ErrInvalidResponse, result)
+	}
+
+	return nil
+}
+
+// ParseResponse splits a response built by the server into the result and the error.
+// A malformed response gives ErrInvalidResponse, other errors are answered by the server.
+func ParseResponse(response string) (string, error) {
+	response = strings.TrimSpace(response)
+
+	body, ok := strings.CutPrefix(response, responsePrefix)
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrInvalidResponse, response)
+	}
+
+	body, ok = strings.CutSuffix(body, responseSuffix)
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrInvalidResponse, response)
+	}
+
+	// results never contain the separator, error texts may
+	i := strings.Index(body, responseSeparator)
+	if i < 0 {
+		return "", fmt.Errorf("%w: %q", ErrInvalidResponse, response)
+	}
+
+	result, errText := body[:i], body[i+len(responseSeparator):]
+	if errText == noError {
+		return result, nil
+	}
+
+	return "", serverError(errText)
+}
+
+// serverError turns an error text into an error matching one of the exported errors
+func serverError(errText string) error {
+	for _, err := range serverErrors {
+		if strings.Contains(errText, err.Error()) {
+			return &responseError{err: fmt.Errorf("%w: %s", err, errText)}
+		}
+	}
+
+	return &responseError{err: errors.New(errText)}
+}
+
+// responseError is an error answered by the server, unlike network errors it says nothing about the server's health
+type responseError struct {
+	err error
+}
+
+func (e *responseError) Error() string {
+	return e.err.Error()
+}
+
+func (e *responseError) Unwrap() error {
+	return e.err
+}
+
+// validateArguments rejects arguments that would be split or would end the request early
+func validateArguments(args ...string) error {
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\r\n") {
+			return fmt.Errorf("%w: %q", ErrInvalidArgument, arg)
+		}
+	}
+
+	return nil
+}
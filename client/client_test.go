@@ -0,0 +1,329 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/protocol/text"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer runs a text server with a map instead of a database
+func startServer(t *testing.T, readOnly bool) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	mu := sync.Mutex{}
+	data := map[string]string{}
+
+	server := text.NewTcpServer(10, address, slog.Default())
+	server.SetOnReceive(func(_ context.Context, request string) string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		args := strings.Fields(request)
+
+		switch {
+		case len(args) == 3 && args[0] == consts.CommandAuth:
+			if args[1] != "admin" || args[2] != "secret" {
+				return text.FormatResponse("", fmt.Errorf("auth: %w", consts.ErrInvalidCredentials))
+			}
+			return text.FormatResponse("", nil)
+		case len(args) == 2 && args[0] == consts.CommandGet:
+			return text.FormatResponse(data[args[1]], nil)
+		case readOnly:
+			return text.FormatResponse("", fmt.Errorf("process command: %w", consts.ErrReadOnly))
+		case len(args) == 3 && args[0] == consts.CommandSet:
+			data[args[1]] = args[2]
+			return text.FormatResponse("", nil)
+		case len(args) == 2 && args[0] == consts.CommandDel:
+			delete(data, args[1])
+			return text.FormatResponse("", nil)
+		default:
+			return text.FormatResponse("", fmt.Errorf("compute: %w: %s", consts.ErrUnknownCommand, args[0]))
+		}
+	})
+
+	require.NoError(t, server.Start())
+	t.Cleanup(func() { server.Stop() })
+
+	return address
+}
+
+// startFlakyServer drops the connection instead of answering the first request,
+// it returns the address and the received requests
+func startFlakyServer(t *testing.T) (string, func() []string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	mu := sync.Mutex{}
+	var requests []string
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				reader := bufio.NewReader(conn)
+
+				for {
+					request, err := reader.ReadString('\r')
+					if err != nil {
+						return
+					}
+					request = strings.TrimSuffix(request, "\r")
+
+					mu.Lock()
+					requests = append(requests, request)
+					first := len(requests) == 1
+					mu.Unlock()
+
+					if first {
+						return
+					}
+
+					_, err = conn.Write([]byte(text.FormatResponse("world", nil) + "\r"))
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return append([]string(nil), requests...)
+	}
+}
+
+func newTestClient(address string) *Client {
+	c := New(address)
+	c.SetPoolSize(0, 2)
+	c.SetRetries(3, time.Millisecond)
+	c.SetHealthCheckInterval(0)
+
+	return c
+}
+
+func TestClient_SetGetDel(t *testing.T) {
+	ctx := context.Background()
+
+	c := newTestClient(startServer(t, false))
+	defer c.Close()
+
+	_, found, err := c.Get(ctx, "hello")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	require.NoError(t, c.Set(ctx, "hello", "world"))
+
+	value, found, err := c.Get(ctx, "hello")
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "world", value)
+
+	require.NoError(t, c.Del(ctx, "hello"))
+
+	_, found, err = c.Get(ctx, "hello")
+	require.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestClient_ServerError(t *testing.T) {
+	c := newTestClient(startServer(t, true))
+	defer c.Close()
+
+	err := c.Set(context.Background(), "hello", "world")
+	assert.ErrorIs(t, err, ErrReadOnly)
+
+	// the connection stays usable after an error response
+	_, found, err := c.Get(context.Background(), "hello")
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestClient_RetryGet(t *testing.T) {
+	address, requests := startFlakyServer(t)
+
+	c := newTestClient(address)
+	defer c.Close()
+
+	value, found, err := c.Get(context.Background(), "hello")
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "world", value)
+	assert.Equal(t, []string{"GET hello", "GET hello"}, requests())
+}
+
+func TestClient_NoRetrySet(t *testing.T) {
+	address, requests := startFlakyServer(t)
+
+	c := newTestClient(address)
+	defer c.Close()
+
+	// the server may have applied the write, it's not repeated
+	err := c.Set(context.Background(), "hello", "world")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"SET hello world"}, requests())
+}
+
+func TestClient_RetryWrites(t *testing.T) {
+	address, requests := startFlakyServer(t)
+
+	c := newTestClient(address)
+	c.SetRetryWrites(true)
+	defer c.Close()
+
+	require.NoError(t, c.Set(context.Background(), "hello", "world"))
+
+	got := requests()
+	require.Len(t, got, 2)
+	assert.Regexp(t, `^@[0-9a-f-]{36} SET hello world$`, got[0])
+	assert.Equal(t, got[0], got[1], "attempts must carry the same request id")
+}
+
+func TestClient_Closed(t *testing.T) {
+	c := newTestClient(startServer(t, false))
+	require.NoError(t, c.Close())
+
+	err := c.Set(context.Background(), "hello", "world")
+	assert.ErrorIs(t, err, ErrClientClosed)
+}
+
+func TestClient_InvalidArgument(t *testing.T) {
+	c := New("127.0.0.1:1") // never dialed
+	defer c.Close()
+
+	assert.ErrorIs(t, c.Set(context.Background(), "hello", "two words"), ErrInvalidArgument)
+	assert.ErrorIs(t, c.Del(context.Background(), ""), ErrInvalidArgument)
+}
+
+func TestClient_Auth(t *testing.T) {
+	ctx := context.Background()
+	address := startServer(t, false)
+
+	c := newTestClient(address)
+	defer c.Close()
+
+	assert.ErrorIs(t, c.Auth(ctx, "admin", "wrong"), ErrInvalidCredentials)
+	assert.ErrorIs(t, c.Auth(ctx, "admin", ""), ErrInvalidArgument)
+
+	c = newTestClient(address)
+	defer c.Close()
+
+	require.NoError(t, c.Auth(ctx, "admin", "secret"))
+	require.NoError(t, c.Set(ctx, "hello", "world"))
+}
+
+func TestClient_Concurrent(t *testing.T) {
+	ctx := context.Background()
+
+	c := newTestClient(startServer(t, false))
+	defer c.Close()
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 20)
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			key := "key_" + strconv.Itoa(i)
+
+			err := c.Set(ctx, key, strconv.Itoa(i))
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			value, _, err := c.Get(ctx, key)
+			if err == nil && value != strconv.Itoa(i) {
+				err = fmt.Errorf("%s = %s", key, value)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		response   string
+		wantResult string
+		wantErr    error
+	}{
+		{
+			name:       "result",
+			response:   text.FormatResponse("world", nil),
+			wantResult: "world",
+		},
+		{
+			name:     "empty result",
+			response: text.FormatResponse("", nil),
+		},
+		{
+			name:     "known error",
+			response: text.FormatResponse("", fmt.Errorf("authorize: %w: user bob", consts.ErrPermissionDenied)),
+			wantErr:  ErrPermissionDenied,
+		},
+		{
+			name:     "invalid",
+			response: "hello",
+			wantErr:  ErrInvalidResponse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ParseResponse(tt.response)
+
+			assert.Equal(t, tt.wantResult, result)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+			} else if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ParseResponse() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// unknown errors keep their text
+	_, err := ParseResponse(text.FormatResponse("", errors.New("disk is full")))
+	assert.EqualError(t, err, "disk is full")
+}
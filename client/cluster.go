@@ -0,0 +1,305 @@
+package client
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts/defaults"
+)
+
+// ReadPreference chooses the servers a Cluster reads from
+type ReadPreference int
+
+const (
+	// ReadPrimary reads from the master only
+	ReadPrimary ReadPreference = iota
+	// ReadPrimaryPreferred reads from the master and from replicas when the master is down
+	ReadPrimaryPreferred
+	// ReadReplica reads from replicas only
+	ReadReplica
+	// ReadNearest reads from the server with the lowest latency
+	ReadNearest
+)
+
+var readPreferences = map[string]ReadPreference{
+	"primary":          ReadPrimary,
+	"primaryPreferred": ReadPrimaryPreferred,
+	"replica":          ReadReplica,
+	"nearest":          ReadNearest,
+}
+
+// ErrNoServers is returned when a read preference has no server to read from
+var ErrNoServers = errors.New("no servers for read preference")
+
+const (
+	defaultMaxLag            = 30 * time.Second
+	defaultNodeCheckInterval = 5 * time.Second
+	defaultNodeCheckTimeout  = time.Second
+	latencySmoothing         = 4 // a new sample is 1/latencySmoothing of the average latency
+)
+
+// ParseReadPreference parses "primary", "primaryPreferred", "replica" and "nearest"
+func ParseReadPreference(s string) (ReadPreference, error) {
+	p, ok := readPreferences[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown read preference: %s", s)
+	}
+
+	return p, nil
+}
+
+// Cluster sends writes to the master and reads to servers chosen by the read preference.
+// Servers are checked with ROLE before the first request and then in the background, a server that fails a request or a check
+// and a replica lagging more than the max lag are not read from until they pass a check.
+// Cluster is safe for concurrent use, setters must be called before the first request.
+type Cluster struct {
+	master   *node
+	replicas []*node
+
+	readPreference ReadPreference
+	maxLag         time.Duration
+	checkInterval  time.Duration
+
+	next atomic.Uint64 // round robin over replicas
+
+	once   sync.Once
+	stop   chan struct{}
+	wg     sync.WaitGroup
+	closed atomic.Bool
+}
+
+type node struct {
+	address string
+	client  *Client
+	down    atomic.Bool
+	latency atomic.Int64 // moving average of the check latency in nanoseconds
+}
+
+// NewCluster creates a client of a master and its replicas
+func NewCluster(master string, replicas []string) *Cluster {
+	c := &Cluster{
+		master:         newNode(master),
+		readPreference: ReadPrimary,
+		maxLag:         defaultMaxLag,
+		checkInterval:  defaultNodeCheckInterval,
+		stop:           make(chan struct{}),
+	}
+
+	for _, address := range replicas {
+		c.replicas = append(c.replicas, newNode(address))
+	}
+
+	return c
+}
+
+func newNode(address string) *node {
+	return &node{
+		address: address,
+		client:  New(address),
+	}
+}
+
+// Configure runs configure for the client of every server, e.g. to set tls or credentials
+func (c *Cluster) Configure(configure func(client *Client)) {
+	for _, n := range c.nodes() {
+		configure(n.client)
+	}
+}
+
+func (c *Cluster) SetReadPreference(preference ReadPreference) {
+	c.readPreference = preference
+}
+
+// SetMaxLag sets how far a replica can be behind the master to be read from
+func (c *Cluster) SetMaxLag(lag time.Duration) {
+	c.maxLag = lag
+}
+
+// SetCheckInterval sets how often servers are checked with ROLE
+func (c *Cluster) SetCheckInterval(interval time.Duration) {
+	c.checkInterval = interval
+}
+
+// Get reads a key from servers chosen by the read preference, trying the next one after a network error
+func (c *Cluster) Get(ctx context.Context, key string) (value string, found bool, err error) {
+	c.once.Do(c.init)
+
+	candidates := c.readCandidates()
+	if len(candidates) == 0 {
+		return "", false, ErrNoServers
+	}
+
+	for _, n := range candidates {
+		value, found, err = n.client.Get(ctx, key)
+		if err == nil {
+			return value, found, nil
+		}
+
+		var respErr *responseError
+		if errors.As(err, &respErr) || errors.Is(err, ErrInvalidArgument) || ctx.Err() != nil {
+			return "", false, err
+		}
+
+		n.down.Store(true)
+		err = fmt.Errorf("%s: %w", n.address, err)
+	}
+
+	return "", false, err
+}
+
+// Set writes to the master
+func (c *Cluster) Set(ctx context.Context, key string, value string) error {
+	c.once.Do(c.init)
+
+	return c.master.client.Set(ctx, key, value)
+}
+
+// Del deletes on the master
+func (c *Cluster) Del(ctx context.Context, key string) error {
+	c.once.Do(c.init)
+
+	return c.master.client.Del(ctx, key)
+}
+
+func (c *Cluster) Close() error {
+	c.once.Do(c.init)
+
+	if c.closed.Swap(true) {
+		return nil
+	}
+
+	close(c.stop)
+	c.wg.Wait()
+
+	var err error
+	for _, n := range c.nodes() {
+		err = errors.Join(err, n.client.Close())
+	}
+
+	return err
+}
+
+func (c *Cluster) nodes() []*node {
+	return append([]*node{c.master}, c.replicas...)
+}
+
+// readCandidates returns servers to read from in the order they are tried.
+// When all of them are down they are returned anyway, a down mark may be stale.
+func (c *Cluster) readCandidates() []*node {
+	var candidates []*node
+
+	switch c.readPreference {
+	case ReadPrimary:
+		return []*node{c.master}
+
+	case ReadPrimaryPreferred:
+		candidates = append([]*node{c.master}, c.rotatedReplicas()...)
+
+	case ReadReplica:
+		candidates = c.rotatedReplicas()
+
+	case ReadNearest:
+		// latencies are updated concurrently, the sort needs a stable snapshot
+		latencies := make(map[*node]int64)
+		for _, n := range c.nodes() {
+			latencies[n] = n.latency.Load()
+			candidates = append(candidates, n)
+		}
+
+		slices.SortStableFunc(candidates, func(a, b *node) int {
+			return cmp.Compare(latencies[a], latencies[b])
+		})
+	}
+
+	up := make([]*node, 0, len(candidates))
+	for _, n := range candidates {
+		if !n.down.Load() {
+			up = append(up, n)
+		}
+	}
+
+	if len(up) == 0 {
+		return candidates
+	}
+
+	return up
+}
+
+// rotatedReplicas spreads reads over replicas
+func (c *Cluster) rotatedReplicas() []*node {
+	if len(c.replicas) == 0 {
+		return nil
+	}
+
+	start := int(c.next.Add(1) % uint64(len(c.replicas)))
+
+	return append(slices.Clone(c.replicas[start:]), c.replicas[:start]...)
+}
+
+// init checks servers before the first request, so it's already routed by their state
+func (c *Cluster) init() {
+	c.checkNodes()
+
+	c.wg.Add(1)
+
+	go func() {
+		defer c.wg.Done()
+
+		ticker := time.NewTicker(c.checkInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				c.checkNodes()
+			}
+		}
+	}()
+}
+
+func (c *Cluster) checkNodes() {
+	wg := sync.WaitGroup{}
+
+	for _, n := range c.nodes() {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			c.checkNode(n)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// checkNode marks a server down when ROLE fails or a replica lags too much, and measures its latency
+func (c *Cluster) checkNode(n *node) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultNodeCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	role, err := n.client.Role(ctx)
+	latency := time.Since(start)
+
+	if err != nil {
+		n.down.Store(true)
+		return
+	}
+
+	if previous := n.latency.Load(); previous != 0 {
+		latency = time.Duration(previous) + (latency-time.Duration(previous))/latencySmoothing
+	}
+	n.latency.Store(int64(latency))
+
+	lagging := role.Role == defaults.ReplicationTypeSlave && role.Lag > c.maxLag
+	n.down.Store(lagging)
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/protocol/text"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNode answers GET with its name and ROLE with its role and lag
+type fakeNode struct {
+	name    string
+	address string
+	server  *text.TcpServer
+	lag     atomic.Int64 // milliseconds
+	delay   time.Duration
+
+	mu     sync.Mutex
+	writes []string
+}
+
+func startFakeNode(t *testing.T, name string, role string, delay time.Duration) *fakeNode {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	n := &fakeNode{name: name, address: address, delay: delay}
+
+	n.server = text.NewTcpServer(10, address, slog.Default())
+	n.server.SetOnReceive(func(_ context.Context, request string) string {
+		time.Sleep(n.delay)
+
+		args := strings.Fields(request)
+
+		switch args[0] {
+		case consts.CommandRole:
+			return text.FormatResponse(fmt.Sprintf(`{"role":%q,"lag_ms":%d}`, role, n.lag.Load()), nil)
+		case consts.CommandGet:
+			return text.FormatResponse(n.name, nil)
+		case consts.CommandPing:
+			return text.FormatResponse("PONG", nil)
+		default:
+			n.mu.Lock()
+			n.writes = append(n.writes, request)
+			n.mu.Unlock()
+
+			return text.FormatResponse("", nil)
+		}
+	})
+
+	require.NoError(t, n.server.Start())
+	t.Cleanup(func() { n.server.Stop() })
+
+	return n
+}
+
+func newTestCluster(t *testing.T, master *fakeNode, replicas ...*fakeNode) *Cluster {
+	t.Helper()
+
+	addresses := make([]string, 0, len(replicas))
+	for _, r := range replicas {
+		addresses = append(addresses, r.address)
+	}
+
+	c := NewCluster(master.address, addresses)
+	c.SetCheckInterval(10 * time.Millisecond)
+	c.Configure(func(client *Client) {
+		client.SetPoolSize(0, 2)
+		client.SetRetries(1, time.Millisecond)
+		client.SetHealthCheckInterval(0)
+	})
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func readFrom(t *testing.T, c *Cluster) string {
+	t.Helper()
+
+	value, _, err := c.Get(context.Background(), "key")
+	require.NoError(t, err)
+
+	return value
+}
+
+func TestCluster_WritesToMasterReadsFromReplicas(t *testing.T) {
+	master := startFakeNode(t, "master", "master", 0)
+	replica1 := startFakeNode(t, "replica1", "slave", 0)
+	replica2 := startFakeNode(t, "replica2", "slave", 0)
+
+	c := newTestCluster(t, master, replica1, replica2)
+	c.SetReadPreference(ReadReplica)
+
+	require.NoError(t, c.Set(context.Background(), "key", "value"))
+	assert.Equal(t, []string{"SET key value"}, master.writes)
+	assert.Empty(t, replica1.writes)
+
+	reads := map[string]int{}
+	for i := 0; i < 10; i++ {
+		reads[readFrom(t, c)]++
+	}
+
+	assert.Equal(t, map[string]int{"replica1": 5, "replica2": 5}, reads)
+}
+
+func TestCluster_LaggingReplica(t *testing.T) {
+	master := startFakeNode(t, "master", "master", 0)
+	replica1 := startFakeNode(t, "replica1", "slave", 0)
+	replica2 := startFakeNode(t, "replica2", "slave", 0)
+	replica1.lag.Store(time.Minute.Milliseconds())
+
+	c := newTestCluster(t, master, replica1, replica2)
+	c.SetReadPreference(ReadReplica)
+	c.SetMaxLag(time.Second)
+
+	// servers are checked before the first request
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "replica2", readFrom(t, c))
+	}
+
+	// the replica catches up
+	replica1.lag.Store(0)
+	require.Eventually(t, func() bool { return !c.replicas[0].down.Load() }, time.Second, time.Millisecond)
+}
+
+func TestCluster_PrimaryPreferredFailover(t *testing.T) {
+	master := startFakeNode(t, "master", "master", 0)
+	replica := startFakeNode(t, "replica", "slave", 0)
+
+	c := newTestCluster(t, master, replica)
+	c.SetReadPreference(ReadPrimaryPreferred)
+
+	assert.Equal(t, "master", readFrom(t, c))
+
+	require.NoError(t, master.server.Stop())
+
+	// the failed master is skipped in the same request
+	assert.Equal(t, "replica", readFrom(t, c))
+	require.Eventually(t, func() bool { return c.master.down.Load() }, time.Second, time.Millisecond)
+}
+
+func TestCluster_Nearest(t *testing.T) {
+	master := startFakeNode(t, "master", "master", 20*time.Millisecond)
+	replica := startFakeNode(t, "replica", "slave", 0)
+
+	c := newTestCluster(t, master, replica)
+	c.SetReadPreference(ReadNearest)
+
+	// servers are checked before the first request
+	assert.Equal(t, "replica", readFrom(t, c))
+	assert.Greater(t, c.master.latency.Load(), c.replicas[0].latency.Load())
+}
+
+func TestParseReadPreference(t *testing.T) {
+	p, err := ParseReadPreference("primaryPreferred")
+	require.NoError(t, err)
+	assert.Equal(t, ReadPrimaryPreferred, p)
+
+	_, err = ParseReadPreference("secondary")
+	assert.Error(t, err)
+}
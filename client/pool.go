@@ -0,0 +1,182 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/protocol/text"
+)
+
+// pool keeps up to max open connections, at least min of them are kept open by the health check
+type pool struct {
+	dial  func(ctx context.Context) (*text.Client, error)
+	check func(ctx context.Context, conn *text.Client) error
+	min   int
+
+	idle  chan *text.Client
+	slots chan struct{} // a token per open connection
+
+	mu     sync.Mutex
+	closed bool
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// newPool keeps at least one slot, so requests never wait for a connection that can't be opened, and min is clamped to 0..max
+func newPool(minConns int, maxConns int, dial func(ctx context.Context) (*text.Client, error), check func(ctx context.Context, conn *text.Client) error) *pool {
+	maxConns = max(maxConns, 1)
+	minConns = min(max(minConns, 0), maxConns)
+
+	return &pool{
+		dial:  dial,
+		check: check,
+		min:   minConns,
+		idle:  make(chan *text.Client, maxConns),
+		slots: make(chan struct{}, maxConns),
+		stop:  make(chan struct{}),
+	}
+}
+
+// get returns an idle connection, opens a new one when there is a free slot or waits for a connection to be returned
+func (p *pool) get(ctx context.Context) (*text.Client, error) {
+	select {
+	case <-p.stop:
+		return nil, ErrClientClosed
+	case conn := <-p.idle:
+		return conn, nil
+	default:
+	}
+
+	select {
+	case conn := <-p.idle:
+		return conn, nil
+
+	case p.slots <- struct{}{}:
+		conn, err := p.dial(ctx)
+		if err != nil {
+			<-p.slots
+			return nil, err
+		}
+
+		return conn, nil
+
+	case <-p.stop:
+		return nil, ErrClientClosed
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// put returns a connection to the pool, a broken connection is closed and frees its slot
+func (p *pool) put(conn *text.Client, broken bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if broken || p.closed {
+		conn.Close()
+		<-p.slots
+		return
+	}
+
+	// never blocks, idle has room for every open connection
+	p.idle <- conn
+}
+
+// startHealthCheck opens min connections and then pings idle connections every interval,
+// broken connections are replaced. interval <= 0 disables pings.
+func (p *pool) startHealthCheck(interval time.Duration, timeout time.Duration) {
+	p.wg.Add(1)
+
+	go func() {
+		defer p.wg.Done()
+
+		p.fill(timeout)
+
+		if interval <= 0 {
+			return
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.stop:
+				return
+
+			case <-ticker.C:
+				p.checkIdle(timeout)
+				p.fill(timeout)
+			}
+		}
+	}()
+}
+
+func (p *pool) checkIdle(timeout time.Duration) {
+	for i := len(p.idle); i > 0; i-- {
+		var conn *text.Client
+
+		select {
+		case conn = <-p.idle:
+		default:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := p.check(ctx, conn)
+		cancel()
+
+		p.put(conn, err != nil)
+	}
+}
+
+// fill opens connections until min are open
+func (p *pool) fill(timeout time.Duration) {
+	for len(p.slots) < p.min {
+		select {
+		case p.slots <- struct{}{}:
+		case <-p.stop:
+			return
+		default:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		conn, err := p.dial(ctx)
+		cancel()
+
+		if err != nil {
+			<-p.slots
+			return
+		}
+
+		p.put(conn, false)
+	}
+}
+
+func (p *pool) close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+
+	p.closed = true
+	close(p.stop)
+	p.mu.Unlock()
+
+	p.wg.Wait()
+
+	// connections in use are closed when they are returned
+	for {
+		select {
+		case conn := <-p.idle:
+			conn.Close()
+			<-p.slots
+		default:
+			return nil
+		}
+	}
+}
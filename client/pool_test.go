@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/protocol/text"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool_HealthCheck(t *testing.T) {
+	dialed := atomic.Int64{}
+	healthy := atomic.Bool{}
+	healthy.Store(true)
+
+	p := newPool(2, 3,
+		func(context.Context) (*text.Client, error) {
+			dialed.Add(1)
+			return text.NewTextClient(""), nil
+		},
+		func(context.Context, *text.Client) error {
+			if healthy.Load() {
+				return nil
+			}
+			return errors.New("broken")
+		},
+	)
+
+	p.startHealthCheck(5*time.Millisecond, time.Second)
+	defer p.close()
+
+	// min connections are opened at start
+	require.Eventually(t, func() bool { return len(p.idle) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, int64(2), dialed.Load())
+
+	// broken connections are replaced
+	healthy.Store(false)
+	require.Eventually(t, func() bool { return dialed.Load() >= 4 }, time.Second, time.Millisecond)
+	healthy.Store(true)
+
+	require.Eventually(t, func() bool { return len(p.idle) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, 2, len(p.slots))
+}
+
+func TestPool_MaxConnections(t *testing.T) {
+	p := newPool(0, 1,
+		func(context.Context) (*text.Client, error) { return text.NewTextClient(""), nil },
+		func(context.Context, *text.Client) error { return nil },
+	)
+	defer p.close()
+
+	conn, err := p.get(context.Background())
+	require.NoError(t, err)
+
+	// the only connection is in use
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err = p.get(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	p.put(conn, false)
+
+	got, err := p.get(context.Background())
+	require.NoError(t, err)
+	assert.Same(t, conn, got)
+
+	// a broken connection frees its slot
+	p.put(got, true)
+	assert.Equal(t, 0, len(p.slots))
+}
+
+func TestPool_DialError(t *testing.T) {
+	p := newPool(0, 1,
+		func(context.Context) (*text.Client, error) { return nil, errors.New("connection refused") },
+		func(context.Context, *text.Client) error { return nil },
+	)
+	defer p.close()
+
+	_, err := p.get(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, 0, len(p.slots), "failed dial must free its slot")
+}
+
+func TestPool_InvalidSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max int
+		wantMin  int
+		wantMax  int
+	}{
+		{name: "zero max", min: 0, max: 0, wantMin: 0, wantMax: 1},
+		{name: "negative max", min: 1, max: -1, wantMin: 1, wantMax: 1},
+		{name: "min above max", min: 5, max: 2, wantMin: 2, wantMax: 2},
+		{name: "negative min", min: -1, max: 2, wantMin: 0, wantMax: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPool(tt.min, tt.max,
+				func(context.Context) (*text.Client, error) { return text.NewTextClient(""), nil },
+				func(context.Context, *text.Client) error { return nil },
+			)
+			defer p.close()
+
+			assert.Equal(t, tt.wantMin, p.min)
+			assert.Equal(t, tt.wantMax, cap(p.slots))
+			assert.Equal(t, tt.wantMax, cap(p.idle))
+
+			// a request gets a connection instead of waiting for its context
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			conn, err := p.get(ctx)
+			require.NoError(t, err)
+			p.put(conn, false)
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/client"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+)
+
+const (
+	commandHelp = "help"
+	commandExit = "exit"
+	commandQuit = "quit"
+)
+
+type commandHelpText struct {
+	usage       string
+	description string
+}
+
+// commands are the server commands known to help and tab completion
+var commands = map[string]commandHelpText{
+	consts.CommandSet:   {usage: "SET <key> <value>", description: "sets the value of a key"},
+	consts.CommandGet:   {usage: "GET <key>", description: "returns the value of a key, (nil) when there is no such key"},
+	consts.CommandDel:   {usage: "DEL <key>", description: "deletes a key"},
+	consts.CommandAuth:  {usage: "AUTH <user> <password>", description: "authenticates the connection, the line is not saved to history"},
+	consts.CommandStats: {usage: "STATS", description: "returns server statistics, admin users only"},
+	consts.CommandPing:  {usage: "PING", description: "checks that the server answers"},
+	consts.CommandRole:  {usage: "ROLE", description: "returns the replication role of the server and the replication lag"},
+
+	consts.CommandSave:   {usage: "SAVE", description: "takes a snapshot and returns its file name, admin users only"},
+	consts.CommandBgSave: {usage: "BGSAVE", description: "starts taking a snapshot in the background, admin users only"},
+	consts.CommandBackup: {usage: "BACKUP <dir>", description: "writes a backup to an empty directory on the server, admin users only"},
+}
+
+// localCommands are handled by the client itself
+var localCommands = map[string]commandHelpText{
+	commandHelp: {usage: "help [command]", description: "lists commands or describes one of them"},
+	commandExit: {usage: "exit", description: "exits the client, Ctrl-D does the same"},
+	commandQuit: {usage: "quit", description: "exits the client"},
+}
+
+func commandNames() []string {
+	names := make([]string, 0, len(commands)+len(localCommands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	for name := range localCommands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func printHelp(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		for _, name := range commandNames() {
+			help := lookupHelp(name)
+			fmt.Fprintf(w, "  %-24s %s\n", help.usage, help.description)
+		}
+
+		fmt.Fprintln(w, "\nA request may start with a request id, \"@<id> SET key value\", so a retried write is applied once.")
+
+		return nil
+	}
+
+	if !isCommand(args[0]) {
+		return fmt.Errorf("%w: %s", consts.ErrUnknownCommand, args[0])
+	}
+
+	help := lookupHelp(args[0])
+	fmt.Fprintf(w, "%s\n  %s\n", help.usage, help.description)
+
+	return nil
+}
+
+func lookupHelp(name string) commandHelpText {
+	if help, ok := commands[strings.ToUpper(name)]; ok {
+		return help
+	}
+
+	return localCommands[strings.ToLower(name)]
+}
+
+func isCommand(name string) bool {
+	_, server := commands[strings.ToUpper(name)]
+	_, local := localCommands[strings.ToLower(name)]
+
+	return server || local
+}
+
+// complete returns the candidates for the word being typed at the end of line
+func complete(line string) (prefix string, candidates []string) {
+	fields := strings.Fields(line)
+	endsWithSpace := line == "" || strings.HasSuffix(line, " ")
+
+	word := ""
+	if !endsWithSpace {
+		word = fields[len(fields)-1]
+		fields = fields[:len(fields)-1]
+	}
+
+	// request ids are not completed, the command after them is
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+		fields = fields[1:]
+	}
+
+	switch {
+	case len(fields) == 0:
+	case len(fields) == 1 && strings.EqualFold(fields[0], commandHelp):
+	default:
+		return "", nil
+	}
+
+	for _, name := range commandNames() {
+		if strings.HasPrefix(strings.ToUpper(name), strings.ToUpper(word)) {
+			candidates = append(candidates, name)
+		}
+	}
+
+	return line[:len(line)-len(word)], candidates
+}
+
+// output modes
+const (
+	outputRaw    = "raw"
+	outputPretty = "pretty"
+	outputJSON   = "json"
+)
+
+type printer struct {
+	mode string
+	out  io.Writer
+}
+
+func newPrinter(mode string, out io.Writer) (*printer, error) {
+	switch mode {
+	case outputRaw, outputPretty, outputJSON:
+		return &printer{mode: mode, out: out}, nil
+	default:
+		return nil, fmt.Errorf("unknown output mode: %s", mode)
+	}
+}
+
+type jsonOutput struct {
+	Request string  `json:"request"`
+	Result  string  `json:"result"`
+	Error   *string `json:"error"`
+}
+
+// print writes the response to a request and returns the error answered by the server
+func (p *printer) print(request string, response string) error {
+	result, err := client.ParseResponse(response)
+
+	switch p.mode {
+	case outputRaw:
+		fmt.Fprintln(p.out, strings.TrimRight(response, " \n"))
+
+	case outputJSON:
+		out := jsonOutput{Request: request, Result: result}
+		if err != nil {
+			errText := err.Error()
+			out.Error = &errText
+		}
+
+		encoded, marshalErr := json.Marshal(out)
+		if marshalErr != nil {
+			return fmt.Errorf("marshal output: %w", marshalErr)
+		}
+
+		fmt.Fprintln(p.out, string(encoded))
+
+	default:
+		switch {
+		case err != nil:
+			fmt.Fprintf(p.out, "(error) %v\n", err)
+		case result == "" && isGet(request):
+			fmt.Fprintln(p.out, "(nil)")
+		case result == "":
+			fmt.Fprintln(p.out, "OK")
+		default:
+			fmt.Fprintln(p.out, indentJSON(result))
+		}
+	}
+
+	return err
+}
+
+// printError writes an error of the client itself, e.g. a failed help lookup
+func (p *printer) printError(request string, err error) {
+	switch p.mode {
+	case outputJSON:
+		errText := err.Error()
+		encoded, _ := json.Marshal(jsonOutput{Request: request, Error: &errText})
+		fmt.Fprintln(p.out, string(encoded))
+	default:
+		fmt.Fprintf(p.out, "(error) %v\n", err)
+	}
+}
+
+func isGet(request string) bool {
+	fields := strings.Fields(request)
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+		fields = fields[1:]
+	}
+
+	return len(fields) > 0 && strings.EqualFold(fields[0], consts.CommandGet)
+}
+
+// indentJSON indents json results like STATS and ROLE, other results are returned as is
+func indentJSON(result string) string {
+	if !strings.HasPrefix(result, "{") {
+		return result
+	}
+
+	buf := bytes.Buffer{}
+
+	err := json.Indent(&buf, []byte(result), "", "  ")
+	if err != nil {
+		return result
+	}
+
+	return buf.String()
+}
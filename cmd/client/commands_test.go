@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/client"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/protocol/text"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComplete(t *testing.T) {
+	tests := []struct {
+		line       string
+		prefix     string
+		candidates []string
+	}{
+		{line: "", prefix: "", candidates: commandNames()},
+		{line: "S", prefix: "", candidates: []string{"SAVE", "SET", "STATS"}},
+		{line: "se", prefix: "", candidates: []string{"SET"}},
+		{line: "b", prefix: "", candidates: []string{"BACKUP", "BGSAVE"}},
+		{line: "ex", prefix: "", candidates: []string{"exit"}},
+		{line: "x", prefix: "", candidates: nil},
+		{line: "help g", prefix: "help ", candidates: []string{"GET"}},
+		{line: "HELP ", prefix: "HELP ", candidates: commandNames()},
+		{line: "@req-1 G", prefix: "@req-1 ", candidates: []string{"GET"}},
+		{line: "GET k", prefix: "", candidates: nil},
+		{line: "SET ", prefix: "", candidates: nil},
+	}
+
+	for _, tt := range tests {
+		prefix, candidates := complete(tt.line)
+		assert.Equal(t, tt.prefix, prefix, tt.line)
+		assert.Equal(t, tt.candidates, candidates, tt.line)
+	}
+}
+
+func TestPrinter_Print(t *testing.T) {
+	readOnly := text.FormatResponse("", fmt.Errorf("process command: %w", consts.ErrReadOnly))
+	_, readOnlyErr := client.ParseResponse(readOnly)
+	require.Error(t, readOnlyErr)
+	_, invalidErr := client.ParseResponse("garbage")
+	require.Error(t, invalidErr)
+
+	tests := []struct {
+		mode     string
+		request  string
+		response string
+		want     string
+		wantErr  error
+	}{
+		{mode: outputPretty, request: "GET a", response: text.FormatResponse("1", nil), want: "1\n"},
+		{mode: outputPretty, request: "GET a", response: text.FormatResponse("", nil), want: "(nil)\n"},
+		{mode: outputPretty, request: "@req-1 get a", response: text.FormatResponse("", nil), want: "(nil)\n"},
+		{mode: outputPretty, request: "SET a 1", response: text.FormatResponse("", nil), want: "OK\n"},
+		{mode: outputPretty, request: "STATS", response: text.FormatResponse(`{"keys":1}`, nil), want: "{\n  \"keys\": 1\n}\n"},
+		{mode: outputPretty, request: "SET a 1", response: readOnly, want: fmt.Sprintf("(error) %v\n", readOnlyErr), wantErr: consts.ErrReadOnly},
+		{mode: outputRaw, request: "GET a", response: text.FormatResponse("1", nil), want: "query result: [ 1 ] error: [ <nil> ]\n"},
+		{mode: outputRaw, request: "SET a 1", response: readOnly, want: "query result: [  ] error: [ process command: " + consts.ErrReadOnly.Error() + " ]\n", wantErr: consts.ErrReadOnly},
+		{mode: outputJSON, request: "GET a", response: text.FormatResponse("1", nil), want: `{"request":"GET a","result":"1","error":null}` + "\n"},
+		{mode: outputJSON, request: "SET a 1", response: readOnly, want: fmt.Sprintf(`{"request":"SET a 1","result":"","error":%q}`+"\n", readOnlyErr), wantErr: consts.ErrReadOnly},
+		{mode: outputPretty, request: "GET a", response: "garbage", want: fmt.Sprintf("(error) %v\n", invalidErr), wantErr: client.ErrInvalidResponse},
+	}
+
+	for _, tt := range tests {
+		out := bytes.Buffer{}
+
+		p, err := newPrinter(tt.mode, &out)
+		require.NoError(t, err)
+
+		err = p.print(tt.request, tt.response)
+		if tt.wantErr != nil {
+			assert.ErrorIs(t, err, tt.wantErr, tt.mode+" "+tt.request)
+		} else {
+			assert.NoError(t, err, tt.mode+" "+tt.request)
+		}
+
+		assert.Equal(t, tt.want, out.String(), tt.mode+" "+tt.request)
+	}
+
+	_, err := newPrinter("yaml", &bytes.Buffer{})
+	assert.Error(t, err)
+}
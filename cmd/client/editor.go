@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	keyCtrlA     = 1
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyBackspace = 8
+	keyTab       = 9
+	keyCtrlK     = 11
+	keyCtrlL     = 12
+	keyCtrlU     = 21
+	keyCtrlW     = 23
+	keyEscape    = 27
+	keyDelete    = 127
+)
+
+// lineEditor reads lines from a terminal in raw mode with cursor movement, history and tab completion
+type lineEditor struct {
+	fd       int
+	in       *bufio.Reader
+	out      io.Writer
+	history  *history
+	complete func(line string) (prefix string, candidates []string)
+
+	mu  sync.Mutex
+	raw *terminalState
+}
+
+func newLineEditor(fd int, in io.Reader, out io.Writer, h *history) *lineEditor {
+	return &lineEditor{
+		fd:       fd,
+		in:       bufio.NewReader(in),
+		out:      out,
+		history:  h,
+		complete: complete,
+	}
+}
+
+// lineState is the line being edited
+type lineState struct {
+	prompt string
+	buf    []rune
+	pos    int
+}
+
+// readLine returns the entered line, io.EOF after Ctrl-D on an empty line.
+// The terminal is in raw mode only while the line is being read.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	err := e.makeRaw()
+	if err != nil {
+		return "", fmt.Errorf("make raw: %w", err)
+	}
+	defer e.restore()
+
+	line := &lineState{prompt: prompt}
+
+	// index of the history entry shown, len(entries) is the new line saved in draft
+	index := len(e.history.entries)
+	draft := ""
+
+	e.refresh(line)
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\n")
+			return string(line.buf), nil
+
+		case keyCtrlC:
+			fmt.Fprint(e.out, "^C\n")
+			line.buf, line.pos = nil, 0
+			index = len(e.history.entries)
+
+		case keyCtrlD:
+			if len(line.buf) == 0 {
+				fmt.Fprint(e.out, "\n")
+				return "", io.EOF
+			}
+			line.deleteAt(line.pos)
+
+		case keyBackspace, keyDelete:
+			if line.pos > 0 {
+				line.pos--
+				line.deleteAt(line.pos)
+			}
+
+		case keyCtrlA:
+			line.pos = 0
+
+		case keyCtrlE:
+			line.pos = len(line.buf)
+
+		case keyCtrlK:
+			line.buf = line.buf[:line.pos]
+
+		case keyCtrlU:
+			line.buf = line.buf[line.pos:]
+			line.pos = 0
+
+		case keyCtrlW:
+			start := line.pos
+			for start > 0 && line.buf[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && line.buf[start-1] != ' ' {
+				start--
+			}
+			line.buf = append(line.buf[:start], line.buf[line.pos:]...)
+			line.pos = start
+
+		case keyCtrlL:
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+
+		case keyTab:
+			e.completeLine(line)
+
+		case keyEscape:
+			switch e.readEscape() {
+			case 'A':
+				if index > 0 {
+					if index == len(e.history.entries) {
+						draft = string(line.buf)
+					}
+					index--
+					line.set(e.history.entries[index])
+				}
+			case 'B':
+				if index < len(e.history.entries) {
+					index++
+					if index == len(e.history.entries) {
+						line.set(draft)
+					} else {
+						line.set(e.history.entries[index])
+					}
+				}
+			case 'C':
+				line.pos = min(line.pos+1, len(line.buf))
+			case 'D':
+				line.pos = max(line.pos-1, 0)
+			case 'H':
+				line.pos = 0
+			case 'F':
+				line.pos = len(line.buf)
+			case '3':
+				line.deleteAt(line.pos)
+			}
+
+		default:
+			if unicode.IsPrint(r) {
+				line.insert(r)
+			}
+		}
+
+		e.refresh(line)
+	}
+}
+
+// readEscape reads the rest of an escape sequence and returns its final key:
+// arrows A-D, Home H, End F and Delete 3. Unknown sequences give 0.
+func (e *lineEditor) readEscape() rune {
+	r, _, err := e.in.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return 0
+	}
+
+	r, _, err = e.in.ReadRune()
+	if err != nil {
+		return 0
+	}
+
+	if r < '0' || r > '9' {
+		return r
+	}
+
+	// "ESC [ n ~" sequences
+	code := r
+	for r != '~' {
+		r, _, err = e.in.ReadRune()
+		if err != nil || !(unicode.IsDigit(r) || r == ';' || r == '~') {
+			return 0
+		}
+	}
+
+	switch code {
+	case '1', '7':
+		return 'H'
+	case '4', '8':
+		return 'F'
+	case '3':
+		return '3'
+	default:
+		return 0
+	}
+}
+
+// completeLine completes the word before the cursor, candidates are listed when it's ambiguous
+func (e *lineEditor) completeLine(line *lineState) {
+	prefix, candidates := e.complete(string(line.buf[:line.pos]))
+
+	switch len(candidates) {
+	case 0:
+		fmt.Fprint(e.out, "\a")
+		return
+
+	case 1:
+		line.replaceBeforeCursor(prefix + candidates[0] + " ")
+		return
+	}
+
+	common := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(strings.ToUpper(c), strings.ToUpper(common)) {
+			common = common[:len(common)-1]
+		}
+	}
+
+	word := string(line.buf[len([]rune(prefix)):line.pos])
+	if len(common) > len(word) {
+		line.replaceBeforeCursor(prefix + common)
+		return
+	}
+
+	fmt.Fprintf(e.out, "\n%s\n", strings.Join(candidates, "  "))
+}
+
+func (e *lineEditor) refresh(line *lineState) {
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K", line.prompt, string(line.buf))
+
+	if n := len(line.buf) - line.pos; n > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", n)
+	}
+}
+
+// makeRaw puts the terminal into raw mode, input that is not a terminal is read as is
+func (e *lineEditor) makeRaw() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !isTerminal(e.fd) {
+		return nil
+	}
+
+	raw, err := makeRaw(e.fd)
+	if err != nil {
+		return err
+	}
+
+	e.raw = raw
+
+	return nil
+}
+
+// restore returns the terminal to the state before readLine, it's safe to call many times
+func (e *lineEditor) restore() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.raw == nil {
+		return
+	}
+
+	restoreTerminal(e.fd, e.raw)
+	e.raw = nil
+}
+
+func (l *lineState) insert(r rune) {
+	l.buf = append(l.buf[:l.pos], append([]rune{r}, l.buf[l.pos:]...)...)
+	l.pos++
+}
+
+func (l *lineState) deleteAt(pos int) {
+	if pos < len(l.buf) {
+		l.buf = append(l.buf[:pos], l.buf[pos+1:]...)
+	}
+}
+
+func (l *lineState) set(s string) {
+	l.buf = []rune(s)
+	l.pos = len(l.buf)
+}
+
+func (l *lineState) replaceBeforeCursor(s string) {
+	rest := l.buf[l.pos:]
+	l.buf = append([]rune(s), rest...)
+	l.pos = len([]rune(s))
+}
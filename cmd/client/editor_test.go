@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestEditor reads keys from input instead of a terminal
+func newTestEditor(input string, entries ...string) (*lineEditor, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+
+	return newLineEditor(-1, bytes.NewReader([]byte(input)), out, &history{entries: entries}), out
+}
+
+func TestReadEscape(t *testing.T) {
+	tests := []struct {
+		input string
+		want  rune
+	}{
+		{input: "[A", want: 'A'},
+		{input: "[B", want: 'B'},
+		{input: "OC", want: 'C'},
+		{input: "OD", want: 'D'},
+		{input: "[H", want: 'H'},
+		{input: "OF", want: 'F'},
+		{input: "[1~", want: 'H'},
+		{input: "[7~", want: 'H'},
+		{input: "[4~", want: 'F'},
+		{input: "[8~", want: 'F'},
+		{input: "[3~", want: '3'},
+		{input: "[5~", want: 0},
+		{input: "[1;5C", want: 0},
+		{input: "x", want: 0},
+		{input: "[", want: 0},
+		{input: "", want: 0},
+	}
+
+	for _, tt := range tests {
+		e, _ := newTestEditor(tt.input)
+		assert.Equal(t, tt.want, e.readEscape(), "%q", tt.input)
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	entries := []string{"SET a 1", "GET a"}
+
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "enter", input: "SET a 1\r", want: "SET a 1"},
+		{name: "newline", input: "GET a\n", want: "GET a"},
+		{name: "backspace", input: "abc\x7f\x7fd\r", want: "ad"},
+		{name: "ctrl-h", input: "abc\x08\r", want: "ab"},
+		{name: "ctrl-a", input: "world\x01hello \r", want: "hello world"},
+		{name: "ctrl-e", input: "ab\x01\x05c\r", want: "abc"},
+		{name: "ctrl-k", input: "abc\x1b[D\x1b[D\x0b\r", want: "a"},
+		{name: "ctrl-u", input: "abc\x1b[D\x15\r", want: "c"},
+		{name: "ctrl-w", input: "SET key value\x17\r", want: "SET key "},
+		{name: "ctrl-c", input: "abc\x03x\r", want: "x"},
+		{name: "ctrl-d deletes", input: "abc\x01\x04\r", want: "bc"},
+		{name: "arrows", input: "GET a\x1b[D\x1b[D\x1b[Db\x1b[C!\r", want: "GEbT! a"},
+		{name: "home and delete", input: "abc\x1b[H\x1b[3~\r", want: "bc"},
+		{name: "end", input: "bc\x1b[1~a\x1b[4~d\r", want: "abcd"},
+		{name: "history up", input: "\x1b[A\x1b[A\r", want: "SET a 1"},
+		{name: "history down", input: "\x1b[A\x1b[A\x1b[B\r", want: "GET a"},
+		{name: "history draft", input: "DEL\x1b[A\x1b[B\r", want: "DEL"},
+		{name: "history top", input: "\x1b[A\x1b[A\x1b[A\r", want: "SET a 1"},
+		{name: "tab", input: "se\t\r", want: "SET "},
+		{name: "tab common prefix", input: "B\t\r", want: "B"},
+		{name: "tab common prefix extends", input: "sa\t\r", want: "SAVE "},
+		{name: "unprintable", input: "a\x02b\r", want: "ab"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, _ := newTestEditor(tt.input, entries...)
+
+			line, err := e.readLine("> ")
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, line)
+		})
+	}
+}
+
+func TestReadLine_EOF(t *testing.T) {
+	// Ctrl-D on an empty line
+	e, out := newTestEditor("\x04")
+
+	_, err := e.readLine("> ")
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, "\r> \x1b[K\n", out.String())
+
+	// the input ends before enter
+	e, _ = newTestEditor("GET")
+
+	_, err = e.readLine("> ")
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestReadLine_CompletionCandidates(t *testing.T) {
+	e, out := newTestEditor("S\t\r")
+
+	line, err := e.readLine("> ")
+	require.NoError(t, err)
+	assert.Equal(t, "S", line)
+	assert.Contains(t, out.String(), "\nSAVE  SET  STATS\n")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+)
+
+const maxHistory = 1000
+
+// history keeps entered lines, it's saved to a file when the path is set
+type history struct {
+	path    string
+	entries []string
+}
+
+// loadHistory reads saved lines, a missing file is an empty history.
+// The file is rewritten when it holds more than maxHistory lines.
+func loadHistory(path string) (*history, error) {
+	h := &history{path: path}
+	if path == "" {
+		return h, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return h, nil
+		}
+
+		return nil, fmt.Errorf("open history: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			h.entries = append(h.entries, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read history: %w", err)
+	}
+
+	if len(h.entries) > maxHistory {
+		h.entries = h.entries[len(h.entries)-maxHistory:]
+
+		data := strings.Join(h.entries, "\n") + "\n"
+
+		err = os.WriteFile(path, []byte(data), 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite history: %w", err)
+		}
+	}
+
+	return h, nil
+}
+
+// add remembers a line unless it repeats the previous one. AUTH lines carry passwords and are not saved.
+func (h *history) add(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" || isAuth(line) {
+		return nil
+	}
+
+	if len(h.entries) > 0 && h.entries[len(h.entries)-1] == line {
+		return nil
+	}
+
+	h.entries = append(h.entries, line)
+	if len(h.entries) > maxHistory {
+		h.entries = h.entries[1:]
+	}
+
+	if h.path == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(h.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("open history: %w", err)
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(line + "\n")
+	if err != nil {
+		return fmt.Errorf("write history: %w", err)
+	}
+
+	return nil
+}
+
+func isAuth(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+		fields = fields[1:]
+	}
+
+	return len(fields) > 0 && strings.EqualFold(fields[0], consts.CommandAuth)
+}
@@ -1,99 +1,131 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
-	"time"
 
 	tcpclient "github.com/JaneJavannie/in_memory_key_value_db/internal/protocol/text"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/tlsconfig"
 )
 
 const (
 	defaultServerAddress = "127.0.0.1:8088"
+	historyFileName      = ".kvdb_history"
 )
 
 // --server_address="localhost:8088"
+// --tls --tls_ca=./ca.pem --tls_cert=./client.pem --tls_key=./client.key
+// --eval="GET key" --file=./script.txt --output=json
 
 func main() {
+	os.Exit(run())
+}
+
+func run() int {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
 	// Define the command-line options
 	address := flag.String("server_address", defaultServerAddress, "db server address")
+	useTLS := flag.Bool("tls", false, "connect over tls")
+	tlsCA := flag.String("tls_ca", "", "CA file to verify the server certificate, system pool when empty")
+	tlsCert := flag.String("tls_cert", "", "client certificate file for mutual tls")
+	tlsKey := flag.String("tls_key", "", "client key file for mutual tls")
+	tlsServerName := flag.String("tls_server_name", "", "server name to verify, taken from the address when empty")
+	output := flag.String("output", outputPretty, "output mode: raw, pretty or json")
+	file := flag.String("file", "", "run commands from a file, - for stdin")
+	historyFile := flag.String("history_file", defaultHistoryFile(), "file of the interactive history, disabled when empty")
+
+	var evals []string
+	flag.Func("eval", "run a command and exit, may be repeated", func(s string) error {
+		evals = append(evals, s)
+		return nil
+	})
 
 	// Parse the command-line options
 	flag.Parse()
 
+	p, err := newPrinter(*output, os.Stdout)
+	if err != nil {
+		slog.Error(err.Error())
+		return exitFailure
+	}
+
 	// Connect to the server
 	client := tcpclient.NewTextClient(*address)
 	defer client.Close()
 
-	err := HandleInput(ctx, client)
-	if err != nil {
-		if !errors.Is(err, context.Canceled) {
-			slog.Error("handle input: " + err.Error())
+	if *useTLS {
+		tlsConfig, err := tlsconfig.NewClientConfig(*tlsCA, *tlsCert, *tlsKey, *tlsServerName)
+		if err != nil {
+			slog.Error("tls config: " + err.Error())
+			return exitFailure
 		}
-	}
-
-	slog.Info("bye")
-}
 
-func HandleInput(ctx context.Context, client *tcpclient.Client) error {
-	err := client.Connect(ctx)
-	if err != nil {
-		return fmt.Errorf("connect: %w", err)
+		client.SetTLSConfig(tlsConfig)
 	}
 
-	for {
-		if ctx.Err() != nil {
-			return ctx.Err()
+	s := &session{conn: client, printer: p, help: os.Stdout}
+
+	// non-interactive runs
+	if len(evals) > 0 || *file != "" {
+		code := runScript(ctx, s, strings.NewReader(strings.Join(evals, "\n")))
+		if code == exitFailure || *file == "" {
+			return code
 		}
 
-		fmt.Printf("%s: ENTER TEXT: ", time.Now().Format(time.TimeOnly))
-		text, err := readRequestStringWithContext(ctx)
+		input, err := openScript(*file)
 		if err != nil {
-			return fmt.Errorf("read string: %w", err)
+			slog.Error(err.Error())
+			return exitFailure
 		}
+		defer input.Close()
 
-		// Send data to the server
+		return max(code, runScript(ctx, s, input))
+	}
 
-		resp, err := client.Send(ctx, text)
-		if err != nil {
-			return fmt.Errorf("client send: %w", err)
-		}
+	fd := int(os.Stdin.Fd())
+	if !isTerminal(fd) {
+		return runScript(ctx, s, os.Stdin)
+	}
 
-		fmt.Printf("%s RESPONSE: %+v\n", time.Now().Format(time.TimeOnly), resp)
+	h, err := loadHistory(*historyFile)
+	if err != nil {
+		slog.Warn("history is not loaded", "err", err)
+		h, _ = loadHistory("")
 	}
+
+	editor := newLineEditor(fd, os.Stdin, os.Stdout, h)
+
+	return runREPL(ctx, s, editor, *address+"> ")
 }
 
-func readRequestStringWithContext(ctx context.Context) (string, error) {
-	type result struct {
-		text string
-		err  error
+func openScript(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
 	}
-	done := make(chan result, 1)
-
-	go func() {
-		reader := bufio.NewReader(os.Stdin)
-		text, err := reader.ReadString('\n')
-		done <- result{
-			text: text,
-			err:  err,
-		}
-	}()
 
-	select {
-	case <-ctx.Done():
-		return "", ctx.Err()
-	case r := <-done:
-		return strings.Replace(r.text, "\n", "\r", 1), r.err
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open script: %w", err)
 	}
+
+	return file, nil
+}
+
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, historyFileName)
 }
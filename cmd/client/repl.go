@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/client"
+	tcpclient "github.com/JaneJavannie/in_memory_key_value_db/internal/protocol/text"
+)
+
+// exit codes
+const (
+	exitOK          = 0
+	exitCommandFail = 1 // a command got an error response
+	exitFailure     = 2 // connection, input or usage error
+)
+
+var (
+	// errCommandFailed marks commands answered with an error, the session goes on after them
+	errCommandFailed = errors.New("command failed")
+	errExit          = errors.New("exit")
+)
+
+type session struct {
+	conn      *tcpclient.Client
+	connected bool
+	printer   *printer
+	help      io.Writer
+}
+
+func (s *session) connect(ctx context.Context) error {
+	err := s.conn.Connect(ctx)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+
+	s.connected = true
+
+	return nil
+}
+
+// execute runs a line. It returns errCommandFailed for error responses, errExit for exit,
+// other errors mean the connection is broken and it's reopened by the next command.
+func (s *session) execute(ctx context.Context, line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	switch strings.ToLower(fields[0]) {
+	case commandExit, commandQuit:
+		return errExit
+
+	case commandHelp:
+		err := printHelp(s.help, fields[1:])
+		if err != nil {
+			s.printer.printError(line, err)
+			return fmt.Errorf("%w: %w", errCommandFailed, err)
+		}
+
+		return nil
+	}
+
+	if !s.connected {
+		err := s.connect(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	response, err := s.conn.Send(ctx, line)
+	if err != nil {
+		s.connected = false
+		return fmt.Errorf("send: %w", err)
+	}
+
+	err = s.printer.print(line, response)
+	if err != nil {
+		if errors.Is(err, client.ErrInvalidResponse) {
+			return err
+		}
+
+		return fmt.Errorf("%w: %w", errCommandFailed, err)
+	}
+
+	return nil
+}
+
+// runScript executes lines one by one, empty lines and lines starting with # are skipped.
+// It stops at the first connection error and goes on after error responses.
+func runScript(ctx context.Context, s *session, input io.Reader) int {
+	code := exitOK
+
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return exitFailure
+		}
+
+		err := s.execute(ctx, line)
+		switch {
+		case err == nil:
+		case errors.Is(err, errExit):
+			return code
+		case errors.Is(err, errCommandFailed):
+			code = exitCommandFail
+		default:
+			slog.Error("execute", "request", line, "err", err)
+			return exitFailure
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		slog.Error("read input", "err", err)
+		return exitFailure
+	}
+
+	return code
+}
+
+// runREPL reads lines from a terminal until exit, Ctrl-D or a signal
+func runREPL(ctx context.Context, s *session, editor *lineEditor, prompt string) int {
+	err := s.connect(ctx)
+	if err != nil {
+		slog.Error(err.Error())
+		return exitFailure
+	}
+
+	fmt.Fprintln(s.help, `type "help" for commands, "exit" or Ctrl-D to quit`)
+
+	type result struct {
+		line string
+		err  error
+	}
+
+	for {
+		done := make(chan result, 1)
+
+		go func() {
+			line, err := editor.readLine(prompt)
+			done <- result{line: line, err: err}
+		}()
+
+		var r result
+
+		select {
+		case <-ctx.Done():
+			editor.restore()
+			fmt.Fprintln(s.help)
+			return exitOK
+		case r = <-done:
+		}
+
+		if errors.Is(r.err, io.EOF) {
+			return exitOK
+		}
+		if r.err != nil {
+			slog.Error("read line", "err", r.err)
+			return exitFailure
+		}
+
+		err = editor.history.add(r.line)
+		if err != nil {
+			slog.Warn("save history", "err", err)
+		}
+
+		err = s.execute(ctx, r.line)
+		switch {
+		case err == nil, errors.Is(err, errCommandFailed):
+		case errors.Is(err, errExit):
+			return exitOK
+		default:
+			if ctx.Err() != nil {
+				return exitOK
+			}
+
+			s.printer.printError(r.line, err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts/defaults"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/protocol/text"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer runs a text server that answers GET and SET, other commands get an error
+func startServer(t *testing.T) string {
+	t.Helper()
+
+	address := defaults.UnixSocketScheme + filepath.Join(t.TempDir(), "db.sock")
+
+	server := text.NewTcpServer(10, address, slog.Default())
+	server.SetOnReceive(func(_ context.Context, request string) string {
+		args := strings.Fields(request)
+
+		switch args[0] {
+		case consts.CommandGet:
+			return text.FormatResponse("1", nil)
+		case consts.CommandSet:
+			return text.FormatResponse("", nil)
+		default:
+			return text.FormatResponse("", fmt.Errorf("compute: %w: %s", consts.ErrUnknownCommand, args[0]))
+		}
+	})
+
+	require.NoError(t, server.Start())
+	t.Cleanup(func() { server.Stop() })
+
+	return address
+}
+
+func newTestSession(address string, out io.Writer) *session {
+	return &session{
+		conn:    text.NewTextClient(address),
+		printer: &printer{mode: outputRaw, out: out},
+		help:    io.Discard,
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	address := startServer(t)
+
+	tests := []struct {
+		name     string
+		script   string
+		want     int
+		requests int
+	}{
+		{name: "ok", script: "SET a 1\nGET a\n", want: exitOK, requests: 2},
+		{name: "comments and empty lines", script: "# set a\n\n  SET a 1  \n", want: exitOK, requests: 1},
+		{name: "error response", script: "FLUSH\nGET a\n", want: exitCommandFail, requests: 2},
+		{name: "unknown help", script: "help FLUSH\nGET a\n", want: exitCommandFail, requests: 1},
+		{name: "exit", script: "GET a\nexit\nGET a\n", want: exitOK, requests: 1},
+		{name: "exit after error", script: "FLUSH\nquit\nGET a\n", want: exitCommandFail, requests: 1},
+		{name: "empty", script: "", want: exitOK, requests: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := bytes.Buffer{}
+
+			s := newTestSession(address, &out)
+			defer s.conn.Close()
+
+			code := runScript(context.Background(), s, strings.NewReader(tt.script))
+			assert.Equal(t, tt.want, code)
+			assert.Equal(t, tt.requests, strings.Count(out.String(), "query result:"))
+		})
+	}
+}
+
+func TestRunScript_Failure(t *testing.T) {
+	// the server is not running
+	s := newTestSession(defaults.UnixSocketScheme+filepath.Join(t.TempDir(), "db.sock"), io.Discard)
+	assert.Equal(t, exitFailure, runScript(context.Background(), s, strings.NewReader("GET a\n")))
+
+	// the run is interrupted
+	s = newTestSession(startServer(t), io.Discard)
+	defer s.conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.Equal(t, exitFailure, runScript(ctx, s, strings.NewReader("GET a\n")))
+
+	// the input can't be read
+	s = newTestSession(startServer(t), io.Discard)
+	defer s.conn.Close()
+
+	long := strings.Repeat("a", bufio.MaxScanTokenSize+1)
+	assert.Equal(t, exitFailure, runScript(context.Background(), s, strings.NewReader(long)))
+}
@@ -0,0 +1,20 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package main
+
+import "errors"
+
+type terminalState struct{}
+
+// isTerminal is false where raw mode is not supported, lines are then read without editing
+func isTerminal(int) bool {
+	return false
+}
+
+func makeRaw(int) (*terminalState, error) {
+	return nil, errors.New("raw terminal mode is not supported")
+}
+
+func restoreTerminal(int, *terminalState) error {
+	return nil
+}
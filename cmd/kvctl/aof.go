@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/resp"
+)
+
+// runImportAOF replays a redis append-only file. Writes of strings become SET and DEL, other commands are counted
+// and reported in the summary. A command cut off at the end of a file, e.g. by a crash of redis, is skipped with a warning.
+func runImportAOF(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("import-aof", flag.ExitOnError)
+	address := flags.String("address", defaultAddress, "db server address")
+	input := flags.String("file", "", "append-only file or the appendonlydir of redis 7")
+	db := flags.Int("db", 0, "redis database to import")
+	batchSize := flags.Int("batch_size", defaultBatchSize, "operations read before they are written")
+	concurrency := flags.Int("concurrency", defaultConcurrency, "concurrent requests of a batch")
+	progressInterval := flags.Duration("progress_interval", defaultProgressInterval, "how often progress is reported")
+	user := flags.String("user", "", "user name")
+	password := flags.String("password", "", "password")
+	tlsFlags := addTLSFlags(flags)
+	flags.Parse(args)
+
+	if *input == "" {
+		return errors.New("--file is required")
+	}
+
+	files, err := resp.AOFFiles(*input)
+	if err != nil {
+		return fmt.Errorf("aof files: %w", err)
+	}
+
+	imp, err := newImporter(*address, *concurrency, *user, *password, tlsFlags)
+	if err != nil {
+		return err
+	}
+	defer imp.close()
+
+	translator := resp.NewTranslator(*db)
+	lastReport := time.Now()
+	batch := make([]operation, 0, *batchSize)
+
+	flush := func() {
+		imp.write(ctx, batch)
+		batch = batch[:0]
+
+		if time.Since(lastReport) >= *progressInterval {
+			lastReport = time.Now()
+			imp.report("import progress")
+		}
+	}
+
+	for _, path := range files {
+		err = replayAOF(path, translator, imp, func(op operation) {
+			batch = append(batch, op)
+			if len(batch) >= max(*batchSize, 1) {
+				flush()
+			}
+		})
+
+		// operations read before an error are still written
+		flush()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	imp.report("import finished")
+	reportSummary(translator.Summary())
+
+	if failed := imp.failed.Load(); failed > 0 {
+		return fmt.Errorf("%w: %d failed", errNotImported, failed)
+	}
+
+	return nil
+}
+
+// replayAOF translates the commands of a file and passes their operations to add
+func replayAOF(path string, translator *resp.Translator, imp *importer, add func(operation)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open aof: %w", err)
+	}
+	defer file.Close()
+
+	reader := resp.NewReader(file)
+
+	for {
+		args, err := reader.ReadCommand()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if errors.Is(err, resp.ErrTruncated) {
+			slog.Warn("aof is truncated, the last command is skipped", "file", path, "err", err)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+
+		source := fmt.Sprintf("%s:%d", path, reader.Offset())
+
+		ops, err := translator.Translate(args)
+		if err != nil {
+			imp.fail(source, "err", err)
+			continue
+		}
+
+		for _, op := range ops {
+			add(operation{source: source, command: op.Command, key: op.Key, value: op.Value})
+		}
+	}
+}
+
+func reportSummary(s resp.Summary) {
+	slog.Info("aof summary",
+		"commands", s.Commands,
+		"operations", s.Operations,
+		"ignored", s.Ignored,
+		"invalid", s.Invalid,
+		"other_db", s.OtherDB,
+		"ttl_dropped", s.TTLDropped,
+		"expired", s.Expired,
+	)
+
+	if len(s.Unsupported) == 0 {
+		return
+	}
+
+	counts := make([]string, 0, len(s.Unsupported))
+	for _, name := range s.UnsupportedNames() {
+		counts = append(counts, fmt.Sprintf("%s=%d", name, s.Unsupported[name]))
+	}
+
+	slog.Warn("unsupported commands are skipped", "commands", strings.Join(counts, " "))
+}
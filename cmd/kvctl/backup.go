@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/client"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/backup"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/configs"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/dirlock"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/encryption"
+)
+
+// runBackup makes a running server write a backup with BACKUP, the directory is on the server's filesystem
+func runBackup(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	address := flags.String("address", defaultAddress, "db server address")
+	dir := flags.String("dir", "", "missing or empty backup directory on the server")
+	user := flags.String("user", "", "user name")
+	password := flags.String("password", "", "password")
+	tlsFlags := addTLSFlags(flags)
+	flags.Parse(args)
+
+	if *dir == "" {
+		return errors.New("--dir is required")
+	}
+
+	tlsConfig, err := tlsFlags.config()
+	if err != nil {
+		return err
+	}
+
+	c := client.New(*address)
+	c.SetPoolSize(1, 1)
+	if tlsConfig != nil {
+		c.SetTLSConfig(tlsConfig)
+	}
+	if *user != "" {
+		c.SetCredentials(*user, *password)
+	}
+	defer c.Close()
+
+	start := time.Now()
+
+	result, err := c.Backup(ctx, *dir)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("backup finished", "directory", result.Directory, "snapshot", result.Snapshot, "keys", result.Keys,
+		"files", result.Files, "bytes", result.Bytes, "duration", time.Since(start))
+
+	return nil
+}
+
+// runRestore validates a backup and copies it to the data directories of a stopped server
+func runRestore(_ context.Context, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dir := flags.String("dir", "", "backup directory")
+	configPath := flags.String("config", "", "server config, the backup is restored to its wal and snapshot data directories and read with its encryption keys")
+	walDir := flags.String("wal_dir", "", "wal data directory, overrides the config")
+	snapshotDir := flags.String("snapshot_dir", "", "snapshot data directory, overrides the config")
+	verifyOnly := flags.Bool("verify", false, "only validate the backup")
+	flags.Parse(args)
+
+	if *dir == "" {
+		return errors.New("--dir is required")
+	}
+
+	var cfg *configs.Config
+	if *configPath != "" {
+		var err error
+		cfg, err = configs.NewConfig(*configPath)
+		if err != nil {
+			return fmt.Errorf("load config: %w", err)
+		}
+
+		// an encrypted snapshot is verified with the keys of the server
+		err = encryption.Configure(cfg.Wal)
+		if err != nil {
+			return fmt.Errorf("load encryption keys: %w", err)
+		}
+	}
+
+	if *verifyOnly {
+		m, err := backup.Verify(*dir)
+		if err != nil {
+			return err
+		}
+
+		return printManifest(m)
+	}
+
+	if cfg != nil {
+		// without snapshots the server would replay only the wal after the snapshot
+		if cfg.Wal == nil || cfg.Snapshot == nil {
+			return errors.New("the config must have wal and snapshot sections to boot from a backup")
+		}
+
+		if *walDir == "" {
+			*walDir = cfg.Wal.DataDir
+		}
+		if *snapshotDir == "" {
+			*snapshotDir = cfg.Snapshot.DataDir
+		}
+	}
+
+	if *walDir == "" || *snapshotDir == "" {
+		return errors.New("--config or both --wal_dir and --snapshot_dir are required")
+	}
+
+	// a running server holds the locks, it would overwrite the restored files
+	locks, err := dirlock.AcquireAll(*walDir, *snapshotDir)
+	if err != nil {
+		return fmt.Errorf("lock data dirs: %w", err)
+	}
+	defer dirlock.ReleaseAll(locks)
+
+	start := time.Now()
+
+	m, err := backup.Restore(*dir, *walDir, *snapshotDir)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("restore finished", "snapshot", m.Snapshot, "keys", m.Keys, "files", len(m.Files),
+		"wal_dir", *walDir, "snapshot_dir", *snapshotDir, "duration", time.Since(start))
+
+	return nil
+}
+
+func printManifest(m backup.Manifest) error {
+	encoded, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+
+	_, err = fmt.Fprintln(os.Stdout, string(encoded))
+
+	return err
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/configs"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/dirlock"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/dump"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/encryption"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/storage/engine"
+)
+
+const (
+	defaultHTTPAddress = "http://127.0.0.1:8080"
+	exportPath         = "/v1/export"
+)
+
+// runExport writes a consistent snapshot of all keys, taken by a running server over the http api
+// or read from the wal of a stopped one with --config
+func runExport(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	httpAddress := flags.String("http_address", defaultHTTPAddress, "http api of the server")
+	configPath := flags.String("config", "", "server config, keys are read from the wal of a stopped server instead of the server")
+	output := flags.String("output", "-", "output file, - for stdout")
+	format := flags.String("format", "", "jsonl or csv, taken from the output file extension when empty")
+	user := flags.String("user", "", "user name for basic auth")
+	password := flags.String("password", "", "password for basic auth")
+	tlsFlags := addTLSFlags(flags)
+	flags.Parse(args)
+
+	if *format == "" {
+		*format = dump.FormatJSONL
+		if *output != "-" {
+			var err error
+			*format, err = dump.FormatFromPath(*output)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	start := time.Now()
+
+	var out io.Writer = os.Stdout
+	var file *os.File
+	if *output != "-" {
+		var err error
+		file, err = os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("create output: %w", err)
+		}
+
+		out = file
+	}
+
+	w, err := dump.NewWriter(out, *format)
+	if err != nil {
+		return err
+	}
+
+	exported := 0
+	write := func(record dump.Record) error {
+		exported++
+		return w.Write(record)
+	}
+
+	if *configPath != "" {
+		err = exportWal(*configPath, write)
+	} else {
+		err = exportHTTP(ctx, *httpAddress, *user, *password, tlsFlags, write)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if file != nil {
+		err = errors.Join(err, file.Close())
+
+		// a partial export must not be taken for a complete one
+		if err != nil {
+			os.Remove(file.Name())
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	slog.Info("export finished", "keys", exported, "format", *format, "duration", time.Since(start))
+
+	return nil
+}
+
+// exportWal replays the wal of a server config into memory
+func exportWal(configPath string, write func(dump.Record) error) error {
+	cfg, err := configs.NewConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+
+	err = encryption.Configure(cfg.Wal)
+	if err != nil {
+		return fmt.Errorf("load encryption keys: %w", err)
+	}
+
+	// loading the storage finishes an interrupted compaction, it would remove the merged file of a running server
+	locks, err := dirlock.AcquireAll(cfg.DataDirs()...)
+	if err != nil {
+		return fmt.Errorf("lock data dirs: %w", err)
+	}
+	defer dirlock.ReleaseAll(locks)
+
+	storage, err := engine.NewInMemoryStorage(cfg)
+	if err != nil {
+		return fmt.Errorf("load storage: %w", err)
+	}
+
+	for _, kv := range storage.Snapshot() {
+		err = write(dump.Record{Key: kv.Key, Value: kv.Value})
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func exportHTTP(ctx context.Context, address string, user string, password string, tlsFlags *tlsFlags, write func(dump.Record) error) error {
+	tlsConfig, err := tlsFlags.config()
+	if err != nil {
+		return err
+	}
+
+	if tlsConfig != nil && strings.HasPrefix(address, "http://") {
+		address = "https://" + strings.TrimPrefix(address, "http://")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(address, "/")+exportPath, nil)
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request export: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("request export: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	reader, err := dump.NewReader(resp.Body, dump.FormatJSONL)
+	if err != nil {
+		return err
+	}
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			// the server aborts the response on errors, a row error means the stream is broken too
+			return fmt.Errorf("read export: %w", err)
+		}
+
+		err = write(record)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/dump"
+)
+
+const (
+	defaultAddress          = "127.0.0.1:8088"
+	defaultBatchSize        = 500
+	defaultConcurrency      = 8
+	defaultProgressInterval = time.Second
+)
+
+var errNotImported = errors.New("some writes were not imported")
+
+// runImport loads a file with SET requests. Rows are read in batches, a batch is written by concurrent
+// requests over a pool of connections. A failed row is reported and skipped.
+func runImport(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	address := flags.String("address", defaultAddress, "db server address")
+	input := flags.String("file", "", "input file, - for stdin")
+	format := flags.String("format", "", "jsonl or csv, taken from the file extension when empty")
+	batchSize := flags.Int("batch_size", defaultBatchSize, "rows read before they are written")
+	concurrency := flags.Int("concurrency", defaultConcurrency, "concurrent requests of a batch")
+	progressInterval := flags.Duration("progress_interval", defaultProgressInterval, "how often progress is reported")
+	user := flags.String("user", "", "user name")
+	password := flags.String("password", "", "password")
+	tlsFlags := addTLSFlags(flags)
+	flags.Parse(args)
+
+	if *input == "" {
+		return errors.New("--file is required")
+	}
+
+	if *format == "" {
+		if *input == "-" {
+			return errors.New("--format is required for stdin")
+		}
+
+		var err error
+		*format, err = dump.FormatFromPath(*input)
+		if err != nil {
+			return err
+		}
+	}
+
+	var in io.Reader = os.Stdin
+	if *input != "-" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return fmt.Errorf("open input: %w", err)
+		}
+		defer file.Close()
+
+		in = file
+	}
+
+	reader, err := dump.NewReader(in, *format)
+	if err != nil {
+		return err
+	}
+
+	imp, err := newImporter(*address, *concurrency, *user, *password, tlsFlags)
+	if err != nil {
+		return err
+	}
+	defer imp.close()
+
+	lastReport := time.Now()
+	batch := make([]operation, 0, *batchSize)
+	done := false
+
+	for !done {
+		batch = batch[:0]
+
+		for len(batch) < max(*batchSize, 1) {
+			record, err := reader.Read()
+			if errors.Is(err, io.EOF) {
+				done = true
+				break
+			}
+
+			var rowErr *dump.RowError
+			if errors.As(err, &rowErr) {
+				imp.fail(fmt.Sprintf("%s:%d", *input, rowErr.Line), "err", rowErr.Err)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("read input: %w", err)
+			}
+
+			batch = append(batch, operation{
+				source:  fmt.Sprintf("%s:%d", *input, reader.Line()),
+				command: consts.CommandSet,
+				key:     record.Key,
+				value:   record.Value,
+			})
+		}
+
+		imp.write(ctx, batch)
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if time.Since(lastReport) >= *progressInterval {
+			lastReport = time.Now()
+			imp.report("import progress")
+		}
+	}
+
+	imp.report("import finished")
+
+	if failed := imp.failed.Load(); failed > 0 {
+		return fmt.Errorf("%w: %d failed", errNotImported, failed)
+	}
+
+	return nil
+}
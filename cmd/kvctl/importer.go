@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/client"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+)
+
+// operation is a write of an imported row or command
+type operation struct {
+	source  string // file with a line or an offset, for error reports
+	command string
+	key     string
+	value   string
+}
+
+// importer writes batches of operations by concurrent requests over a pool of connections.
+// Operations on the same key are written by one worker, so they keep their order.
+type importer struct {
+	client      *client.Client
+	concurrency int
+
+	start    time.Time
+	imported atomic.Int64
+	failed   atomic.Int64
+}
+
+func newImporter(address string, concurrency int, user string, password string, tlsFlags *tlsFlags) (*importer, error) {
+	tlsConfig, err := tlsFlags.config()
+	if err != nil {
+		return nil, err
+	}
+
+	concurrency = max(concurrency, 1)
+
+	c := client.New(address)
+	c.SetPoolSize(1, concurrency)
+	// retried writes carry request ids, so they are applied once
+	c.SetRetryWrites(true)
+	if tlsConfig != nil {
+		c.SetTLSConfig(tlsConfig)
+	}
+	if user != "" {
+		c.SetCredentials(user, password)
+	}
+
+	return &importer{
+		client:      c,
+		concurrency: concurrency,
+		start:       time.Now(),
+	}, nil
+}
+
+// write writes a batch and returns when all of its operations are done, failed operations are logged and counted
+func (i *importer) write(ctx context.Context, batch []operation) {
+	workers := make([]chan operation, i.concurrency)
+	wg := sync.WaitGroup{}
+
+	for w := range workers {
+		workers[w] = make(chan operation)
+		wg.Add(1)
+
+		go func(ops chan operation) {
+			defer wg.Done()
+
+			for op := range ops {
+				err := i.apply(ctx, op)
+				if err != nil {
+					i.fail(op.source, "key", op.key, "err", err)
+					continue
+				}
+
+				i.imported.Add(1)
+			}
+		}(workers[w])
+	}
+
+	for _, op := range batch {
+		if ctx.Err() != nil {
+			break
+		}
+
+		workers[shard(op.key, len(workers))] <- op
+	}
+
+	for _, ops := range workers {
+		close(ops)
+	}
+	wg.Wait()
+}
+
+func (i *importer) apply(ctx context.Context, op operation) error {
+	switch op.command {
+	case consts.CommandSet:
+		return i.client.Set(ctx, op.key, op.value)
+	case consts.CommandDel:
+		return i.client.Del(ctx, op.key)
+	default:
+		return fmt.Errorf("%w: %s", consts.ErrUnknownCommand, op.command)
+	}
+}
+
+// fail counts and logs an operation or a source row that is not imported
+func (i *importer) fail(source string, args ...any) {
+	i.failed.Add(1)
+	slog.Warn("not imported", append([]any{"at", source}, args...)...)
+}
+
+func (i *importer) report(msg string) {
+	elapsed := time.Since(i.start)
+	imported := i.imported.Load()
+
+	slog.Info(msg,
+		"imported", imported,
+		"failed", i.failed.Load(),
+		"per_second", int64(float64(imported)/max(elapsed.Seconds(), 0.001)),
+		"duration", elapsed,
+	)
+}
+
+func (i *importer) close() error {
+	return i.client.Close()
+}
+
+func shard(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return int(h.Sum32() % uint32(n))
+}
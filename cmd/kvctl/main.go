@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/tlsconfig"
+)
+
+// kvctl export --http_address=http://127.0.0.1:8080 --output=data.jsonl
+// kvctl export --config=./config.yaml --output=data.csv
+// kvctl import --address=127.0.0.1:8088 --file=data.jsonl
+// kvctl import-aof --address=127.0.0.1:8088 --file=./appendonlydir
+// kvctl backup --address=127.0.0.1:8088 --dir=/var/backups/kvdb_1
+// kvctl restore --dir=/var/backups/kvdb_1 --config=./config.yaml
+// kvctl wal verify --config=./config.yaml
+
+const usage = `usage: kvctl <command> [flags]
+
+commands:
+  export      write all keys and values to jsonl or csv
+  import      load keys and values from jsonl or csv
+  import-aof  replay a redis append-only file
+  backup      make a running server write a backup
+  restore     validate a backup and restore it for a stopped server
+  wal         list, dump, verify, repair and convert wal segments
+
+run "kvctl <command> -h" for flags of a command`
+
+type command func(ctx context.Context, args []string) error
+
+var commands = map[string]command{
+	"export":     runExport,
+	"import":     runImport,
+	"import-aof": runImportAOF,
+	"backup":     runBackup,
+	"restore":    runRestore,
+	"wal":        runWal,
+}
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	err := run(ctx, os.Args[2:])
+	if err != nil {
+		slog.Error(os.Args[1], "err", err)
+		os.Exit(1)
+	}
+}
+
+// tlsFlags are the client tls flags shared by commands
+type tlsFlags struct {
+	enabled    *bool
+	ca         *string
+	cert       *string
+	key        *string
+	serverName *string
+}
+
+func addTLSFlags(flags *flag.FlagSet) *tlsFlags {
+	return &tlsFlags{
+		enabled:    flags.Bool("tls", false, "connect over tls"),
+		ca:         flags.String("tls_ca", "", "CA file to verify the server certificate, system pool when empty"),
+		cert:       flags.String("tls_cert", "", "client certificate file for mutual tls"),
+		key:        flags.String("tls_key", "", "client key file for mutual tls"),
+		serverName: flags.String("tls_server_name", "", "server name to verify, taken from the address when empty"),
+	}
+}
+
+// config returns nil when tls is disabled
+func (f *tlsFlags) config() (*tls.Config, error) {
+	if !*f.enabled {
+		return nil, nil
+	}
+
+	cfg, err := tlsconfig.NewClientConfig(*f.ca, *f.cert, *f.key, *f.serverName)
+	if err != nil {
+		return nil, fmt.Errorf("tls config: %w", err)
+	}
+
+	return cfg, nil
+}
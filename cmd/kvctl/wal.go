@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/configs"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts/defaults"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/dirlock"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/encryption"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/wal"
+)
+
+// kvctl wal list --config=./config.yaml
+// kvctl wal dump --dir=/data/wal --key=user_1 --since=2024-06-01T15:00:00Z --format=json
+// kvctl wal verify --config=./config.yaml
+// kvctl wal repair --config=./config.yaml
+// kvctl wal convert --config=./config.yaml --to=gz.enc
+
+const walUsage = `usage: kvctl wal <command> [flags]
+
+commands:
+  list     segments with their format, sizes, record counts and lsn ranges
+  dump     records filtered by key, command, time or lsn, as text or json
+  verify   read every segment, check gzip checksums, encrypted frames and records
+  repair   cut the wal after its last valid record, the server must be stopped
+  convert  rewrite segments compressed, encrypted or plain, the server must be stopped
+
+run "kvctl wal <command> -h" for flags of a command`
+
+const (
+	walFormatText = "text"
+	walFormatJSON = "json"
+)
+
+var walCommands = map[string]command{
+	"list":    runWalList,
+	"dump":    runWalDump,
+	"verify":  runWalVerify,
+	"repair":  runWalRepair,
+	"convert": runWalConvert,
+}
+
+// runWal inspects and repairs wal segments on the disk, reading them with the wal reader of the server
+func runWal(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, walUsage)
+		os.Exit(2)
+	}
+
+	run, ok := walCommands[args[0]]
+	if !ok {
+		fmt.Fprintln(os.Stderr, walUsage)
+		os.Exit(2)
+	}
+
+	return run(ctx, args[1:])
+}
+
+// walDirFlags are the flags of the wal directory shared by wal commands
+type walDirFlags struct {
+	dir    *string
+	config *string
+}
+
+func addWalDirFlags(flags *flag.FlagSet) *walDirFlags {
+	return &walDirFlags{
+		dir:    flags.String("dir", "", "wal data directory, overrides the config"),
+		config: flags.String("config", "", "server config, its wal data directory is read with its encryption keys"),
+	}
+}
+
+// load returns the wal directory and configures the encryption keys of the config
+func (f *walDirFlags) load() (string, error) {
+	dir := *f.dir
+
+	if *f.config != "" {
+		cfg, err := configs.NewConfig(*f.config)
+		if err != nil {
+			return "", fmt.Errorf("load config: %w", err)
+		}
+
+		err = encryption.Configure(cfg.Wal)
+		if err != nil {
+			return "", fmt.Errorf("load encryption keys: %w", err)
+		}
+
+		if dir == "" {
+			switch {
+			case cfg.Replication != nil && cfg.Replication.Type == defaults.ReplicationTypeSlave:
+				dir = cfg.Replication.ReplicatedDataDir
+			case cfg.Wal != nil:
+				dir = cfg.Wal.DataDir
+			}
+		}
+	}
+
+	if dir == "" {
+		return "", errors.New("--dir or --config with a wal section is required")
+	}
+
+	return dir, nil
+}
+
+// walSegment is a segment in the output of list and verify
+type walSegment struct {
+	wal.SegmentInfo
+	Format string `json:"format"`
+	Error  string `json:"error,omitempty"`
+}
+
+// inspectSegments reads every segment of dir, damaged segments are reported in the error field
+func inspectSegments(dir string) ([]walSegment, error) {
+	segments, err := wal.Segments(dir)
+	if err != nil {
+		return nil, fmt.Errorf("segments: %w", err)
+	}
+
+	result := make([]walSegment, 0, len(segments))
+	for _, name := range segments {
+		info, err := wal.InspectSegment(dir, name, nil)
+		if err != nil && !errors.Is(err, wal.ErrDamaged) {
+			return nil, fmt.Errorf("inspect %s: %w", name, err)
+		}
+
+		segment := walSegment{SegmentInfo: info, Format: info.Format()}
+		if err != nil {
+			segment.Error = err.Error()
+		}
+
+		result = append(result, segment)
+	}
+
+	return result, nil
+}
+
+func runWalList(_ context.Context, args []string) error {
+	flags := flag.NewFlagSet("wal list", flag.ExitOnError)
+	dirFlags := addWalDirFlags(flags)
+	format := flags.String("format", walFormatText, "text or json")
+	flags.Parse(args)
+
+	dir, err := dirFlags.load()
+	if err != nil {
+		return err
+	}
+
+	segments, err := inspectSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case walFormatJSON:
+		encoded, err := json.MarshalIndent(segments, "", "  ")
+		if err != nil {
+			return fmt.Errorf("marshal segments: %w", err)
+		}
+
+		_, err = fmt.Fprintln(os.Stdout, string(encoded))
+
+		return err
+
+	case walFormatText:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SEGMENT\tFORMAT\tFILE BYTES\tBYTES\tRECORDS\tLSN RANGE\tFIRST TIME\tLAST TIME\tSTATUS")
+
+		for _, s := range segments {
+			status := "ok"
+			if s.Error != "" {
+				status = "damaged"
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d-%d\t%s\t%s\t%s\n", s.Name, s.Format, s.FileSize, s.Size, s.Records,
+				s.Start.Offset, s.End.Offset, formatWalTime(s.FirstTime), formatWalTime(s.LastTime), status)
+		}
+
+		return w.Flush()
+
+	default:
+		return fmt.Errorf("unknown format %q, text or json", *format)
+	}
+}
+
+func formatWalTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return t.Format(time.RFC3339Nano)
+}
+
+// dumpedRecord is a record in the json output of dump
+type dumpedRecord struct {
+	LSN       string     `json:"lsn"`
+	Time      *time.Time `json:"time,omitempty"` // nil for records written before timestamps
+	ID        string     `json:"id"`
+	Command   string     `json:"command"`
+	Arguments []string   `json:"arguments"`
+}
+
+// dumpFilter selects records of dump, zero fields match every record
+type dumpFilter struct {
+	key     string
+	command string
+	since   wal.Target
+	until   wal.Target
+}
+
+// match reports whether a record is selected. Records without a time were written before timestamps,
+// they are before any time.
+func (f dumpFilter) match(record wal.Record, position wal.Position) bool {
+	if f.key != "" && record.Query.Arguments[0] != f.key {
+		return false
+	}
+	if f.command != "" && record.Query.Command != f.command {
+		return false
+	}
+
+	if !f.since.Time.IsZero() && (record.Time.IsZero() || record.Time.Before(f.since.Time)) {
+		return false
+	}
+	if f.since.Position.Segment != "" && position.Compare(f.since.Position) < 0 {
+		return false
+	}
+
+	if !f.until.Time.IsZero() && record.Time.After(f.until.Time) {
+		return false
+	}
+	if f.until.Position.Segment != "" && position.Compare(f.until.Position) >= 0 {
+		return false
+	}
+
+	return true
+}
+
+func runWalDump(_ context.Context, args []string) error {
+	flags := flag.NewFlagSet("wal dump", flag.ExitOnError)
+	dirFlags := addWalDirFlags(flags)
+	key := flags.String("key", "", "only records of the key")
+	command := flags.String("command", "", "only records of the command, SET or DEL")
+	since := flags.String("since", "", "only records from a time (RFC 3339) or an lsn (<segment>:<offset>)")
+	until := flags.String("until", "", "only records up to a time (RFC 3339) or before an lsn (<segment>:<offset>)")
+	format := flags.String("format", walFormatText, "text (the lsn and the wal line) or json (an object per line)")
+	flags.Parse(args)
+
+	if *format != walFormatText && *format != walFormatJSON {
+		return fmt.Errorf("unknown format %q, text or json", *format)
+	}
+
+	filter := dumpFilter{key: *key, command: strings.ToUpper(*command)}
+
+	var err error
+	if *since != "" {
+		filter.since, err = wal.ParseTarget(*since)
+		if err != nil {
+			return fmt.Errorf("--since: %w", err)
+		}
+	}
+	if *until != "" {
+		filter.until, err = wal.ParseTarget(*until)
+		if err != nil {
+			return fmt.Errorf("--until: %w", err)
+		}
+	}
+
+	dir, err := dirFlags.load()
+	if err != nil {
+		return err
+	}
+
+	segments, err := wal.Segments(dir)
+	if err != nil {
+		return fmt.Errorf("segments: %w", err)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	encoder := json.NewEncoder(out)
+
+	write := func(record wal.Record, position wal.Position) error {
+		if !filter.match(record, position) {
+			return nil
+		}
+
+		if *format == walFormatJSON {
+			dumped := dumpedRecord{
+				LSN:       position.String(),
+				ID:        record.ID,
+				Command:   record.Query.Command,
+				Arguments: record.Query.Arguments,
+			}
+			if !record.Time.IsZero() {
+				dumped.Time = &record.Time
+			}
+
+			return encoder.Encode(dumped)
+		}
+
+		line := fmt.Sprintf("%s %s %s %s", position, record.ID, record.Query.Command, strings.Join(record.Query.Arguments, " "))
+		if !record.Time.IsZero() {
+			line = fmt.Sprintf("%s %s %s %s %s", position, record.Time.Format(time.RFC3339Nano), record.ID,
+				record.Query.Command, strings.Join(record.Query.Arguments, " "))
+		}
+
+		_, err := fmt.Fprintln(out, line)
+
+		return err
+	}
+
+	for _, segment := range segments {
+		if segment < filter.since.Position.Segment {
+			continue
+		}
+		if filter.until.Position.Segment != "" && segment > filter.until.Position.Segment {
+			break
+		}
+
+		// the records before a damage are dumped, then the damage is reported
+		_, err = wal.InspectSegment(dir, segment, write)
+		if err != nil {
+			return errors.Join(fmt.Errorf("dump %s: %w", segment, err), out.Flush())
+		}
+	}
+
+	return out.Flush()
+}
+
+func runWalVerify(_ context.Context, args []string) error {
+	flags := flag.NewFlagSet("wal verify", flag.ExitOnError)
+	dirFlags := addWalDirFlags(flags)
+	flags.Parse(args)
+
+	dir, err := dirFlags.load()
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+
+	segments, err := inspectSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	records := 0
+	damaged := 0
+
+	for _, segment := range segments {
+		records += segment.Records
+
+		if segment.Error != "" {
+			damaged++
+			slog.Error("segment damaged", "segment", segment.Name, "valid_records", segment.Records,
+				"valid_lsn", segment.End.String(), "err", segment.Error)
+		}
+	}
+
+	if damaged > 0 {
+		return fmt.Errorf("%d of %d segments are damaged, stop the server and run kvctl wal repair", damaged, len(segments))
+	}
+
+	slog.Info("wal verified", "dir", dir, "segments", len(segments), "records", records, "duration", time.Since(start))
+
+	return nil
+}
+
+func runWalRepair(_ context.Context, args []string) error {
+	flags := flag.NewFlagSet("wal repair", flag.ExitOnError)
+	dirFlags := addWalDirFlags(flags)
+	dropLater := flags.Bool("drop_later_segments", false, "for damage before the last segment, remove the segments after it")
+	flags.Parse(args)
+
+	dir, err := dirFlags.load()
+	if err != nil {
+		return err
+	}
+
+	// a running server holds the lock, it would keep writing to the segments
+	lock, err := dirlock.Acquire(dir)
+	if err != nil {
+		return fmt.Errorf("lock wal dir: %w", err)
+	}
+	defer lock.Release()
+
+	// the server would finish an interrupted compaction on start as well
+	err = wal.RecoverCompaction(dir)
+	if err != nil {
+		return fmt.Errorf("recover compaction: %w", err)
+	}
+
+	repair, err := wal.RepairWal(dir, *dropLater)
+	if errors.Is(err, wal.ErrDamagedHistory) {
+		return fmt.Errorf("%w: rerun with --drop_later_segments to end the wal at the damage", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if repair == nil {
+		slog.Info("wal is not damaged", "dir", dir)
+		return nil
+	}
+
+	slog.Warn("wal cut after the last valid record", "segment", repair.Damaged.Name, "file", repair.Damaged.File,
+		"records", repair.Damaged.Records, "lsn", repair.End.String(), "dropped_segments", len(repair.Dropped))
+
+	return nil
+}
+
+func runWalConvert(_ context.Context, args []string) error {
+	flags := flag.NewFlagSet("wal convert", flag.ExitOnError)
+	dirFlags := addWalDirFlags(flags)
+	to := flags.String("to", "", "format of the segments: plain, gz, enc or gz.enc, encrypted with the active key of the config")
+	segment := flags.String("segment", "", "only the segment, all segments when empty")
+	flags.Parse(args)
+
+	var compress, encrypt bool
+	switch *to {
+	case "plain":
+	case "gz":
+		compress = true
+	case "enc":
+		encrypt = true
+	case "gz.enc":
+		compress, encrypt = true, true
+	default:
+		return fmt.Errorf("--to must be plain, gz, enc or gz.enc, got %q", *to)
+	}
+
+	dir, err := dirFlags.load()
+	if err != nil {
+		return err
+	}
+
+	lock, err := dirlock.Acquire(dir)
+	if err != nil {
+		return fmt.Errorf("lock wal dir: %w", err)
+	}
+	defer lock.Release()
+
+	// the swap of an interrupted compaction would remove the converted file of its last segment
+	err = wal.RecoverCompaction(dir)
+	if err != nil {
+		return fmt.Errorf("recover compaction: %w", err)
+	}
+
+	segments := []string{*segment}
+	if *segment == "" {
+		segments, err = wal.Segments(dir)
+		if err != nil {
+			return fmt.Errorf("segments: %w", err)
+		}
+	}
+
+	start := time.Now()
+	converted := 0
+
+	for _, name := range segments {
+		from, fileName, err := wal.ConvertSegment(dir, name, compress, encrypt)
+		if errors.Is(err, wal.ErrDamaged) {
+			return fmt.Errorf("convert %s: %w, run kvctl wal repair first", name, err)
+		}
+		if err != nil {
+			return fmt.Errorf("convert %s: %w", name, err)
+		}
+
+		if from != fileName {
+			converted++
+			slog.Debug("segment converted", "from", from, "to", fileName)
+		}
+	}
+
+	slog.Info("wal converted", "dir", dir, "format", *to, "segments", len(segments), "converted", converted,
+		"duration", time.Since(start))
+
+	return nil
+}
@@ -5,15 +5,24 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/JaneJavannie/in_memory_key_value_db/internal"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/auth"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/configs"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts/defaults"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/dirlock"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/encryption"
 	mylogger "github.com/JaneJavannie/in_memory_key_value_db/internal/logger"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/protocol/rest"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/protocol/text"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/stats"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/storage/engine"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/tlsconfig"
 	wals "github.com/JaneJavannie/in_memory_key_value_db/internal/wal"
 	"github.com/JaneJavannie/in_memory_key_value_db/replication"
 )
@@ -32,10 +41,22 @@ func main() {
 
 	// Define the command-line options
 	configPath := flag.String("config", defaultSlaveConfigPath, "config path")
+	hashPassword := flag.String("hash_password", "", "print a password hash for the auth config and exit")
+	recoverUntil := flag.String("recover-until", "", "recover the state as of a time (RFC 3339) or an lsn (<segment>:<offset>) and start read-only")
 
 	// Parse the command-line options
 	flag.Parse()
 
+	if *hashPassword != "" {
+		hash, err := auth.HashPassword(*hashPassword)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println(hash)
+		return
+	}
+
 	cfg, err := configs.NewConfig(*configPath)
 	if err != nil {
 		log.Fatal(err)
@@ -47,7 +68,31 @@ func main() {
 	}
 	logger.Info("config loaded")
 
-	storage, err := engine.NewInMemoryStorage(cfg)
+	// a second server with the same data directories stops here, before it reads or writes them
+	locks, err := dirlock.AcquireAll(cfg.DataDirs()...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// wal segments and snapshots are read with the keys from the start
+	err = encryption.Configure(cfg.Wal)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if keyring := encryption.Current(); keyring != nil {
+		logger.Info("encryption at rest enabled", "active_key", keyring.Active())
+	}
+
+	var until wals.Target
+	if *recoverUntil != "" {
+		until, err = wals.ParseTarget(*recoverUntil)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	recovery := !until.IsZero()
+
+	storage, err := engine.RecoverInMemoryStorage(cfg, until)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -57,17 +102,20 @@ func main() {
 	replicationType := ""
 	masterAddress := ""
 	if replicationCfg != nil {
+		replicationType = replicationCfg.Type
 		masterAddress = replicationCfg.MasterAddress
 	}
 
 	client := text.NewTextClient(masterAddress)
 	replicationServer := text.NewTcpServer(defaults.ReplicationMaxConnections, masterAddress, logger)
 
-	if replicationCfg != nil {
-		replicationType = replicationCfg.Type
-		masterAddress = replicationCfg.MasterAddress
+	var newReplication *replication.Replication
+	switch {
+	case replicationCfg != nil && recovery:
+		logger.Warn("replication is disabled in recovery mode")
 
-		newReplication, err := replication.NewReplication(cfg, client, replicationServer, storage, logger)
+	case replicationCfg != nil:
+		newReplication, err = replication.NewReplication(cfg, client, replicationServer, storage, logger)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -84,30 +132,75 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	wal.Start(cfg.Wal)
+	// the wal after the recovery target must not be compacted or written to
+	if !recovery {
+		wal.Start(cfg.Wal)
+	}
 
 	inMemoryEngine, err := engine.NewInMemoryEngine(storage, wal, logger, cfg.Wal, replicationType)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if recovery {
+		inMemoryEngine.SetReadOnly()
+		logger.Warn("recovery mode, the database is read-only", "until", until.String())
+	} else {
+		inMemoryEngine.SetSnapshots(cfg.Snapshot)
+	}
+	inMemoryEngine.Start()
+
+	var authenticator *auth.Authenticator
+	if cfg.Auth != nil {
+		authenticator, err = auth.NewAuthenticator(cfg.Auth)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		logger.Info("authentication enabled")
+	}
 
-	db, err := internal.NewDatabase(inMemoryEngine, logger)
+	statsRegistry := stats.NewRegistry()
+	if cfg.Wal != nil {
+		statsRegistry.Register("wal", func() any { return wal.Stats() })
+	}
+
+	db, err := internal.NewDatabase(inMemoryEngine, authenticator, statsRegistry, logger)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if newReplication != nil {
+		db.SetRoleProvider(newReplication.Role)
+	}
 
 	logger.Info("db configured")
 
+	var tlsReloader *tlsconfig.Reloader
+	if cfg.Network.TLS != nil {
+		tlsReloader, err = tlsconfig.NewReloader(cfg.Network.TLS)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go reloadTLSOnSignal(ctx, tlsReloader, logger)
+	}
+
 	server := text.NewTcpServer(cfg.Network.MaxConnections, cfg.Network.Address, logger)
+	server.SetSocketPermissions(cfg.Network.SocketFileMode)
+	server.SetAcceptBacklog(*cfg.Network.AcceptBacklog, cfg.Network.QueueTimeout)
+	server.SetMaxMessageSize(cfg.Network.MaxMessageSizeBytes)
+	server.SetIdleTimeout(cfg.Network.IdleTimeout)
+	server.SetRequestTimeout(cfg.App.Timeout)
+	if tlsReloader != nil {
+		server.SetTLSConfig(tlsReloader.ServerConfig())
+	}
+	statsRegistry.Register("server", func() any { return server.Stats() })
 	server.SetOnReceive(func(ctx context.Context, request string) string {
 		// Process the data
 		result, err := db.HandleRequest(ctx, request)
 		if err != nil {
 			logger.Error("handle client: db: handle request", "error", err)
 		}
-		resp := fmt.Sprintf("query result: [ %s ] error: [ %v ] \n", result, err)
-
-		return resp
+		return text.FormatResponse(result, err)
 	})
 
 	logger.Info("server configured")
@@ -118,22 +211,99 @@ func main() {
 		return
 	}
 
+	var httpServer *rest.Server
+	if cfg.Network.HTTPAddress != "" {
+		httpServer = rest.NewServer(cfg.Network.HTTPAddress, db, logger)
+		httpServer.SetRequestTimeout(cfg.App.Timeout)
+		httpServer.SetMaxMessageSize(cfg.Network.MaxMessageSizeBytes)
+		httpServer.SetIdleTimeout(cfg.Network.IdleTimeout)
+		if tlsReloader != nil {
+			httpServer.SetTLSConfig(tlsReloader.ServerConfig())
+		}
+
+		err = httpServer.Start()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	<-ctx.Done()
 
-	logger.Info("database is shutting down...")
+	logger.Info("database is shutting down...", "timeout", cfg.App.ShutdownTimeout)
 
-	// shutdown components
-	err = server.Stop()
+	shutdownStart := time.Now()
+	drained := server.Stats().Active
+	clean := true
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.App.ShutdownTimeout)
+	defer cancel()
+
+	// stop accepting requests first, so nothing is written to the wal after it's flushed
+	err = server.Shutdown(shutdownCtx)
 	if err != nil {
-		logger.Warn("server stop: %v", err)
+		clean = false
+		logger.Warn("server shutdown", "error", err)
+	}
+
+	if httpServer != nil {
+		err = httpServer.Shutdown(shutdownCtx)
+		if err != nil {
+			clean = false
+			logger.Warn("http server shutdown", "error", err)
+		}
 	}
 
-	err = replicationServer.Stop()
+	if newReplication != nil {
+		err = newReplication.Stop(shutdownCtx)
+		if err != nil {
+			clean = false
+			logger.Warn("replication stop", "error", err)
+		}
+	}
+
+	// a background snapshot needs the wal position it has read to stay valid
+	inMemoryEngine.Stop()
+
+	err = wal.Stop(cfg.Wal)
 	if err != nil {
-		logger.Warn("server stop: %v", err)
+		clean = false
+		logger.Warn("wal stop", "error", err)
+	}
+
+	logger.Info("database stopped",
+		"duration", time.Since(shutdownStart),
+		"requests_served", server.Stats().Requests,
+		"connections_drained", drained,
+		"clean", clean,
+	)
+
+	for _, lock := range locks {
+		err = lock.Release()
+		if err != nil {
+			logger.Warn("release data directory lock", "error", err)
+		}
 	}
+}
 
-	wal.Stop(cfg.Wal)
+// reloadTLSOnSignal rereads tls certificates on SIGHUP, so they can be rotated without a restart
+func reloadTLSOnSignal(ctx context.Context, reloader *tlsconfig.Reloader, logger *slog.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
 
-	logger.Warn("bb")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-hup:
+			err := reloader.Reload()
+			if err != nil {
+				logger.Error("reload tls certificates", "error", err)
+				continue
+			}
+
+			logger.Info("tls certificates reloaded")
+		}
+	}
 }
@@ -0,0 +1,359 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/compute"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/configs"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"golang.org/x/crypto/argon2"
+	"gopkg.in/yaml.v3"
+)
+
+// auth - user accounts and access control lists
+
+const (
+	CategoryRead  = "read"
+	CategoryWrite = "write"
+	CategoryAdmin = "admin"
+
+	categoryPrefix = "@"
+	categoryAll    = "all"
+
+	// passwords are hashed with argon2id, the scheme starts the hash so the format can change
+	hashScheme     = "argon2id"
+	hashFormat     = "argon2id$v=<version>$m=<memory KiB>,t=<passes>,p=<threads>$<base64 salt>$<base64 hash>"
+	hashSaltLength = 16
+	hashKeyLength  = 32
+)
+
+// hashParams are the argon2id parameters of new hashes, the minimum recommended by OWASP
+var hashParams = passwordParams{memory: 19 * 1024, time: 2, threads: 1}
+
+// passwordParams are the argon2id parameters of a hash, stored in it
+type passwordParams struct {
+	memory  uint32 // KiB
+	time    uint32
+	threads uint8
+}
+
+// commandCategories maps commands to acl categories, commands without a category are allowed to everyone
+var commandCategories = map[string]string{
+	consts.CommandGet: CategoryRead,
+	consts.CommandSet: CategoryWrite,
+	consts.CommandDel: CategoryWrite,
+
+	consts.CommandStats:  CategoryAdmin,
+	consts.CommandExport: CategoryAdmin,
+	consts.CommandSave:   CategoryAdmin,
+	consts.CommandBgSave: CategoryAdmin,
+	consts.CommandBackup: CategoryAdmin,
+}
+
+type Authenticator struct {
+	users map[string]*user
+}
+
+type user struct {
+	name     string
+	params   passwordParams
+	salt     []byte
+	hash     []byte
+	commands []rule
+	keys     []rule
+}
+
+// rule allows or denies a command, a category or a key pattern
+type rule struct {
+	allow   bool
+	pattern string
+}
+
+type aclFile struct {
+	Users []configs.User `yaml:"users"`
+}
+
+func NewAuthenticator(cfg *configs.Auth) (*Authenticator, error) {
+	a := &Authenticator{
+		users: make(map[string]*user),
+	}
+
+	users := cfg.Users
+
+	if cfg.ACLFile != "" {
+		fileUsers, err := readACLFile(cfg.ACLFile)
+		if err != nil {
+			return nil, fmt.Errorf("read acl file: %w", err)
+		}
+
+		// users from the acl file override users with the same name from the config
+		users = append(users, fileUsers...)
+	}
+
+	for _, u := range users {
+		parsed, err := parseUser(u)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", u.Name, err)
+		}
+
+		a.users[parsed.name] = parsed
+	}
+
+	return a, nil
+}
+
+// Authenticate checks a user's password
+func (a *Authenticator) Authenticate(name string, password string) error {
+	u, ok := a.users[name]
+	if !ok || u.hash == nil {
+		// hash anyway so unknown users take as long as known ones
+		subtle.ConstantTimeCompare(hashPassword(hashParams, make([]byte, hashSaltLength), password), make([]byte, hashKeyLength))
+		return consts.ErrInvalidCredentials
+	}
+
+	if subtle.ConstantTimeCompare(hashPassword(u.params, u.salt, password), u.hash) != 1 {
+		return consts.ErrInvalidCredentials
+	}
+
+	return nil
+}
+
+// Authorize checks that the session's user may run the query
+func (a *Authenticator) Authorize(session *Session, query compute.Query) error {
+	category, ok := commandCategories[query.Command]
+	if !ok {
+		return nil
+	}
+
+	name := ""
+	if session != nil {
+		name = session.User()
+	}
+
+	if name == "" {
+		return consts.ErrAuthRequired
+	}
+
+	u, ok := a.users[name]
+	if !ok {
+		return fmt.Errorf("%w: unknown user %s", consts.ErrPermissionDenied, name)
+	}
+
+	if !u.commandAllowed(query.Command, category) {
+		return fmt.Errorf("%w: user %s can't run %s", consts.ErrPermissionDenied, name, query.Command)
+	}
+
+	// arguments of admin commands are not keys, e.g. the directory of BACKUP
+	if category != CategoryAdmin && len(query.Arguments) > 0 && !u.keyAllowed(query.Arguments[0]) {
+		return fmt.Errorf("%w: user %s can't access key %s", consts.ErrPermissionDenied, name, query.Arguments[0])
+	}
+
+	return nil
+}
+
+// commandAllowed applies command rules in order, the last matching rule wins
+func (u *user) commandAllowed(command string, category string) bool {
+	allowed := false
+
+	for _, r := range u.commands {
+		switch r.pattern {
+		case categoryPrefix + categoryAll, categoryPrefix + category, command:
+			allowed = r.allow
+		}
+	}
+
+	return allowed
+}
+
+// keyAllowed checks key patterns, a matching deny pattern always wins
+func (u *user) keyAllowed(key string) bool {
+	allowed := false
+
+	for _, r := range u.keys {
+		if !matchKey(r.pattern, key) {
+			continue
+		}
+		if !r.allow {
+			return false
+		}
+		allowed = true
+	}
+
+	return allowed
+}
+
+// matchKey matches a key with an exact pattern or a prefix pattern ending with "*"
+func matchKey(pattern string, key string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(key, prefix)
+	}
+
+	return pattern == key
+}
+
+func parseUser(cfg configs.User) (*user, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("empty name")
+	}
+
+	u := &user{name: cfg.Name}
+
+	// users without a password can only be authenticated with a client certificate
+	if cfg.Password != "" {
+		err := u.parsePassword(cfg.Password)
+		if err != nil {
+			return nil, fmt.Errorf("password must be in format %s: %w", hashFormat, err)
+		}
+	}
+
+	for _, c := range cfg.Commands {
+		r, err := parseRule(c)
+		if err != nil {
+			return nil, fmt.Errorf("command rule: %w", err)
+		}
+
+		if name, ok := strings.CutPrefix(r.pattern, categoryPrefix); ok {
+			if name != categoryAll && name != CategoryRead && name != CategoryWrite && name != CategoryAdmin {
+				return nil, fmt.Errorf("unknown category: %s", name)
+			}
+		} else {
+			r.pattern = strings.ToUpper(r.pattern)
+		}
+
+		u.commands = append(u.commands, r)
+	}
+
+	for _, k := range cfg.Keys {
+		r, err := parseRule(k)
+		if err != nil {
+			return nil, fmt.Errorf("key rule: %w", err)
+		}
+
+		u.keys = append(u.keys, r)
+	}
+
+	return u, nil
+}
+
+// parseRule parses "+pattern" and "pattern" as allow rules and "-pattern" as a deny rule
+func parseRule(s string) (rule, error) {
+	r := rule{allow: true, pattern: s}
+
+	if pattern, ok := strings.CutPrefix(s, "-"); ok {
+		r = rule{allow: false, pattern: pattern}
+	} else if pattern, ok := strings.CutPrefix(s, "+"); ok {
+		r.pattern = pattern
+	}
+
+	if r.pattern == "" {
+		return rule{}, fmt.Errorf("empty rule: %q", s)
+	}
+
+	return r, nil
+}
+
+func readACLFile(path string) ([]configs.User, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer file.Close()
+
+	acl := aclFile{}
+
+	err = yaml.NewDecoder(file).Decode(&acl)
+	if err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+
+	return acl.Users, nil
+}
+
+// HashPassword returns a password hash in the format used by the config
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, hashSaltLength)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", fmt.Errorf("generate salt: %w", err)
+	}
+
+	hash := hashPassword(hashParams, salt, password)
+
+	return fmt.Sprintf("%s$v=%d$m=%d,t=%d,p=%d$%s$%s", hashScheme, argon2.Version,
+		hashParams.memory, hashParams.time, hashParams.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+func hashPassword(params passwordParams, salt []byte, password string) []byte {
+	return argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, hashKeyLength)
+}
+
+// parsePassword reads the parameters, the salt and the hash of a password hash
+func (u *user) parsePassword(password string) error {
+	parts := strings.Split(password, "$")
+	if len(parts) != 5 || parts[0] != hashScheme {
+		return fmt.Errorf("unknown hash scheme")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[1], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return fmt.Errorf("unsupported argon2 version: %s", parts[1])
+	}
+
+	_, err = fmt.Sscanf(parts[2], "m=%d,t=%d,p=%d", &u.params.memory, &u.params.time, &u.params.threads)
+	if err != nil || u.params.time == 0 || u.params.threads == 0 || u.params.memory < 8*uint32(u.params.threads) {
+		return fmt.Errorf("invalid argon2 parameters: %s", parts[2])
+	}
+
+	u.salt, err = base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(u.salt) == 0 {
+		return fmt.Errorf("invalid salt")
+	}
+
+	u.hash, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(u.hash) != hashKeyLength {
+		return fmt.Errorf("invalid hash")
+	}
+
+	return nil
+}
+
+// Session is the authentication state of one client connection
+type Session struct {
+	mu   sync.RWMutex
+	user string
+}
+
+// NewSession creates a session, a verified client certificate identity authenticates it as the user with the same name
+func NewSession(identity string) *Session {
+	return &Session{user: identity}
+}
+
+// SessionFromContext returns the session of the request's connection or nil
+func SessionFromContext(ctx context.Context) *Session {
+	session, _ := ctx.Value(consts.Session).(*Session)
+	return session
+}
+
+func (s *Session) User() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.user
+}
+
+func (s *Session) SetUser(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.user = name
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/compute"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/configs"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthenticator_Authenticate(t *testing.T) {
+	hash, err := HashPassword("secret")
+	require.NoError(t, err)
+
+	a, err := NewAuthenticator(&configs.Auth{
+		Users: []configs.User{
+			{Name: "alice", Password: hash},
+			{Name: "service"}, // client certificate only
+		},
+	})
+	require.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(hash, "argon2id$v=19$m=19456,t=2,p=1$"), hash)
+
+	assert.NoError(t, a.Authenticate("alice", "secret"))
+	assert.ErrorIs(t, a.Authenticate("alice", "wrong"), consts.ErrInvalidCredentials)
+	assert.ErrorIs(t, a.Authenticate("bob", "secret"), consts.ErrInvalidCredentials)
+	assert.ErrorIs(t, a.Authenticate("service", ""), consts.ErrInvalidCredentials)
+}
+
+func TestAuthenticator_Authorize(t *testing.T) {
+	a, err := NewAuthenticator(&configs.Auth{
+		Users: []configs.User{
+			{Name: "reader", Commands: []string{"+@read"}, Keys: []string{"*"}},
+			{Name: "writer", Commands: []string{"+@all", "-DEL"}, Keys: []string{"user_*", "-user_secret*"}},
+		},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		user    string
+		query   compute.Query
+		wantErr error
+	}{
+		{
+			name:    "no user",
+			query:   compute.Query{Command: consts.CommandGet, Arguments: []string{"a"}},
+			wantErr: consts.ErrAuthRequired,
+		},
+		{
+			name:    "unknown user",
+			user:    "bob",
+			query:   compute.Query{Command: consts.CommandGet, Arguments: []string{"a"}},
+			wantErr: consts.ErrPermissionDenied,
+		},
+		{
+			name:  "reader get",
+			user:  "reader",
+			query: compute.Query{Command: consts.CommandGet, Arguments: []string{"a"}},
+		},
+		{
+			name:    "reader set",
+			user:    "reader",
+			query:   compute.Query{Command: consts.CommandSet, Arguments: []string{"a", "b"}},
+			wantErr: consts.ErrPermissionDenied,
+		},
+		{
+			name:  "writer set allowed prefix",
+			user:  "writer",
+			query: compute.Query{Command: consts.CommandSet, Arguments: []string{"user_1", "b"}},
+		},
+		{
+			name:    "writer set other prefix",
+			user:    "writer",
+			query:   compute.Query{Command: consts.CommandSet, Arguments: []string{"order_1", "b"}},
+			wantErr: consts.ErrPermissionDenied,
+		},
+		{
+			name:    "writer set denied prefix",
+			user:    "writer",
+			query:   compute.Query{Command: consts.CommandSet, Arguments: []string{"user_secret_1", "b"}},
+			wantErr: consts.ErrPermissionDenied,
+		},
+		{
+			name:    "writer denied command",
+			user:    "writer",
+			query:   compute.Query{Command: consts.CommandDel, Arguments: []string{"user_1"}},
+			wantErr: consts.ErrPermissionDenied,
+		},
+		{
+			name:  "admin command argument is not a key",
+			user:  "writer",
+			query: compute.Query{Command: consts.CommandBackup, Arguments: []string{"/backups/1"}},
+		},
+		{
+			name:    "reader backup",
+			user:    "reader",
+			query:   compute.Query{Command: consts.CommandBackup, Arguments: []string{"/backups/1"}},
+			wantErr: consts.ErrPermissionDenied,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := a.Authorize(NewSession(tt.user), tt.query)
+
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+			} else if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Authorize() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewAuthenticator_ACLFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.yaml")
+
+	err := os.WriteFile(path, []byte("users:\n  - name: reader\n    commands: [\"+@all\"]\n    keys: [\"*\"]\n"), 0600)
+	require.NoError(t, err)
+
+	a, err := NewAuthenticator(&configs.Auth{
+		ACLFile: path,
+		Users:   []configs.User{{Name: "reader", Commands: []string{"+@read"}, Keys: []string{"*"}}},
+	})
+	require.NoError(t, err)
+
+	// the acl file overrides the config
+	err = a.Authorize(NewSession("reader"), compute.Query{Command: consts.CommandSet, Arguments: []string{"a", "b"}})
+	assert.NoError(t, err)
+}
+
+func TestNewAuthenticator_InvalidUser(t *testing.T) {
+	tests := []configs.User{
+		{Name: ""},
+		{Name: "alice", Password: "plain"},
+		{Name: "alice", Password: "sha256$salt$zz"},
+		{Name: "alice", Password: "argon2id$v=19$m=19456,t=2,p=1$c2FsdA$zz"},
+		{Name: "alice", Password: "argon2id$v=16$m=19456,t=2,p=1$c2FsdA$c2FsdA"},
+		{Name: "alice", Password: "argon2id$v=19$m=0,t=0,p=1$c2FsdA$c2FsdA"},
+		{Name: "alice", Commands: []string{"+@unknown"}},
+		{Name: "alice", Keys: []string{"-"}},
+	}
+
+	for _, u := range tests {
+		_, err := NewAuthenticator(&configs.Auth{Users: []configs.User{u}})
+		assert.Error(t, err, "user %+v", u)
+	}
+}
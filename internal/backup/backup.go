@@ -0,0 +1,469 @@
+// Package backup writes and restores backups: a snapshot, the wal segments after it and a manifest with checksums
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/dirlock"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/encryption"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/storage/snapshot"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/wal"
+)
+
+// layout of a backup directory
+const (
+	ManifestName = "manifest.json"
+	SnapshotDir  = "snapshot"
+	WalDir       = "wal"
+
+	manifestVersion = 1
+)
+
+// ErrInvalidBackup is returned for backups with missing, altered or unexpected files
+var ErrInvalidBackup = errors.New("invalid backup")
+
+// Manifest describes a backup, it's written after all other files
+type Manifest struct {
+	Version   int          `json:"version"`
+	CreatedAt time.Time    `json:"created_at"`
+	Snapshot  string       `json:"snapshot"` // path of the snapshot file in the backup
+	Keys      int          `json:"keys"`     // keys in the snapshot
+	Position  wal.Position `json:"position"` // wal position covered by the snapshot
+	End       wal.Position `json:"end"`      // wal position covered by the backup
+	Files     []File       `json:"files"`
+}
+
+// File is a file of a backup, its path is relative to the backup directory
+type File struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Source is the state a backup is made of
+type Source struct {
+	Snapshot     *snapshot.Snapshot // taken for the backup, nil when SnapshotPath is copied
+	SnapshotPath string             // a snapshot file written earlier
+	WalDir       string
+	End          wal.Position // the wal is copied up to End, later writes are not in the backup
+
+	// OpenSegments opens the wal segments to copy at once, e.g. Wal.OpenSegments of a running wal.
+	// The files of WalDir are opened when it's nil.
+	OpenSegments func(from string, to string) ([]wal.OpenedSegment, error)
+}
+
+// Size returns the total size of the backup files
+func (m Manifest) Size() int64 {
+	size := int64(0)
+	for _, file := range m.Files {
+		size += file.Size
+	}
+
+	return size
+}
+
+// Create writes a backup to dir, which must be missing or empty. A failed backup is removed.
+func Create(dir string, src Source) (Manifest, error) {
+	err := prepareDir(dir)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	m, err := create(dir, src)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return Manifest{}, err
+	}
+
+	return m, nil
+}
+
+func create(dir string, src Source) (Manifest, error) {
+	m := Manifest{Version: manifestVersion, CreatedAt: time.Now().UTC(), End: src.End}
+
+	for _, sub := range []string{SnapshotDir, WalDir} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0755)
+		if err != nil {
+			return Manifest{}, fmt.Errorf("mkdir all: %w", err)
+		}
+	}
+
+	snapshotPath, err := writeSnapshot(dir, src)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	file, err := checksum(dir, snapshotPath)
+	if err != nil {
+		return Manifest{}, err
+	}
+	m.Files = append(m.Files, file)
+	m.Snapshot = snapshotPath
+
+	header, err := snapshot.ReadHeader(filepath.Join(dir, snapshotPath))
+	if err != nil {
+		return Manifest{}, fmt.Errorf("read snapshot: %w", err)
+	}
+	m.Position = header.Position
+
+	m.Keys, err = snapshot.Verify(filepath.Join(dir, snapshotPath))
+	if err != nil {
+		return Manifest{}, fmt.Errorf("verify snapshot: %w", err)
+	}
+
+	// the snapshot segment is copied too, a snapshot is loaded only when its position exists in the wal
+	segments, err := openSegments(src, m.Position.Segment)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("open wal segments: %w", err)
+	}
+	defer wal.CloseSegments(segments)
+
+	for _, segment := range segments {
+		file, err := copySegment(segment, dir, src.End)
+		if err != nil {
+			return Manifest{}, fmt.Errorf("copy wal segment %s: %w", segment.Name, err)
+		}
+
+		m.Files = append(m.Files, file)
+	}
+
+	err = writeManifest(dir, m)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("write manifest: %w", err)
+	}
+
+	return m, nil
+}
+
+func writeSnapshot(dir string, src Source) (string, error) {
+	if src.Snapshot != nil {
+		name, err := snapshot.Write(filepath.Join(dir, SnapshotDir), *src.Snapshot)
+		if err != nil {
+			return "", fmt.Errorf("write snapshot: %w", err)
+		}
+
+		return filepath.Join(SnapshotDir, name), nil
+	}
+
+	path := filepath.Join(SnapshotDir, filepath.Base(src.SnapshotPath))
+
+	_, err := copyFile(src.SnapshotPath, dir, path, -1)
+	if err != nil {
+		return "", fmt.Errorf("copy snapshot: %w", err)
+	}
+
+	return path, nil
+}
+
+// Verify checks the manifest, the sizes and checksums of the files and the snapshot
+func Verify(dir string) (Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return Manifest{}, fmt.Errorf("%w: read manifest: %w", ErrInvalidBackup, err)
+	}
+
+	m := Manifest{}
+
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("%w: decode manifest: %w", ErrInvalidBackup, err)
+	}
+	if m.Version != manifestVersion {
+		return Manifest{}, fmt.Errorf("%w: unknown manifest version %d", ErrInvalidBackup, m.Version)
+	}
+
+	hasSnapshot := false
+
+	for _, file := range m.Files {
+		if !validPath(file.Path) {
+			return Manifest{}, fmt.Errorf("%w: unexpected file %s", ErrInvalidBackup, file.Path)
+		}
+
+		actual, err := checksum(dir, file.Path)
+		if err != nil {
+			return Manifest{}, fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+		}
+		if actual != file {
+			return Manifest{}, fmt.Errorf("%w: %s: size or checksum mismatch", ErrInvalidBackup, file.Path)
+		}
+
+		hasSnapshot = hasSnapshot || file.Path == m.Snapshot
+	}
+
+	if !hasSnapshot || filepath.Dir(m.Snapshot) != SnapshotDir {
+		return Manifest{}, fmt.Errorf("%w: no snapshot", ErrInvalidBackup)
+	}
+
+	_, err = snapshot.Verify(filepath.Join(dir, m.Snapshot))
+	if err != nil {
+		return Manifest{}, fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+	}
+
+	if !wal.Exists(filepath.Join(dir, WalDir), m.Position) {
+		return Manifest{}, fmt.Errorf("%w: wal segment %s of the snapshot is missing", ErrInvalidBackup, m.Position.Segment)
+	}
+
+	return m, nil
+}
+
+// Restore verifies a backup and copies it to the wal and snapshot directories of a server, both must be missing or empty
+func Restore(dir string, walDir string, snapshotDir string) (Manifest, error) {
+	if filepath.Clean(walDir) == filepath.Clean(snapshotDir) {
+		return Manifest{}, fmt.Errorf("wal and snapshot directories must differ")
+	}
+
+	m, err := Verify(dir)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	for _, target := range []string{walDir, snapshotDir} {
+		err = prepareDir(target)
+		if err != nil {
+			return Manifest{}, err
+		}
+	}
+
+	for _, file := range m.Files {
+		target := filepath.Join(walDir, filepath.Base(file.Path))
+		if filepath.Dir(file.Path) == SnapshotDir {
+			target = filepath.Join(snapshotDir, filepath.Base(file.Path))
+		}
+
+		_, err = copyFile(filepath.Join(dir, file.Path), filepath.Dir(target), filepath.Base(target), -1)
+		if err != nil {
+			// the directories were empty, a partial restore must not be booted from
+			_ = os.RemoveAll(walDir)
+			_ = os.RemoveAll(snapshotDir)
+			return Manifest{}, fmt.Errorf("copy %s: %w", file.Path, err)
+		}
+	}
+
+	for _, target := range []string{walDir, snapshotDir} {
+		err = syncDir(target)
+		if err != nil {
+			return Manifest{}, fmt.Errorf("sync dir: %w", err)
+		}
+	}
+
+	return m, nil
+}
+
+// validPath accepts only the files a backup is made of
+func validPath(path string) bool {
+	dir, name := filepath.Split(path)
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return false
+	}
+
+	return dir == SnapshotDir+string(filepath.Separator) || dir == WalDir+string(filepath.Separator)
+}
+
+// prepareDir creates dir, an existing dir must be empty but for the lock file of a stopped server
+func prepareDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("read dir: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != dirlock.FileName {
+			return fmt.Errorf("%w: %s", consts.ErrDirectoryNotEmpty, dir)
+		}
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("mkdir all: %w", err)
+	}
+
+	return nil
+}
+
+// openSegments opens the segments from the snapshot segment to the end of the backup
+func openSegments(src Source, from string) ([]wal.OpenedSegment, error) {
+	if src.End.Segment == "" {
+		return nil, nil
+	}
+
+	if src.OpenSegments != nil {
+		return src.OpenSegments(from, src.End.Segment)
+	}
+
+	return wal.OpenSegments(src.WalDir, from, src.End.Segment)
+}
+
+// copySegment copies a closed segment file as is, compressed, encrypted or not. The segment at end is being written,
+// its records up to the end offset are copied uncompressed, and encrypted again when the segment is encrypted.
+func copySegment(segment wal.OpenedSegment, dir string, end wal.Position) (File, error) {
+	if segment.Name != end.Segment {
+		return copyReader(segment.File, dir, filepath.Join(WalDir, segment.FileName), -1)
+	}
+
+	in, err := segment.Records()
+	if err != nil {
+		return File{}, fmt.Errorf("open: %w", err)
+	}
+
+	if wal.IsEncryptedSegment(segment.FileName) {
+		return copyEncrypted(in, dir, filepath.Join(WalDir, wal.EncryptedFile(segment.Name)), end.Offset)
+	}
+
+	return copyReader(in, dir, filepath.Join(WalDir, segment.Name), end.Offset)
+}
+
+// copyEncrypted encrypts the first size bytes of in with the active key to path in dir
+func copyEncrypted(in io.Reader, dir string, path string, size int64) (File, error) {
+	keyring := encryption.Current()
+	if keyring == nil {
+		return File{}, fmt.Errorf("%s: %w", path, encryption.ErrUnknownKey)
+	}
+
+	out, err := os.OpenFile(filepath.Join(dir, path), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return File{}, fmt.Errorf("create: %w", err)
+	}
+
+	hash := sha256.New()
+
+	w, err := encryption.NewWriter(io.MultiWriter(out, hash), keyring)
+	if err == nil {
+		_, err = io.CopyN(w, in, size)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+
+	var info os.FileInfo
+	if err == nil {
+		info, err = out.Stat()
+	}
+
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return File{}, fmt.Errorf("copy: %w", err)
+	}
+
+	return File{Path: path, Size: info.Size(), SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// copyFile copies the first size bytes of src, or all of it when size is negative, to path in dir
+func copyFile(src string, dir string, path string, size int64) (File, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return File{}, fmt.Errorf("open: %w", err)
+	}
+	defer in.Close()
+
+	return copyReader(in, dir, path, size)
+}
+
+func copyReader(in io.Reader, dir string, path string, size int64) (File, error) {
+	out, err := os.OpenFile(filepath.Join(dir, path), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return File{}, fmt.Errorf("create: %w", err)
+	}
+
+	hash := sha256.New()
+	w := io.MultiWriter(out, hash)
+
+	var n int64
+	if size < 0 {
+		n, err = io.Copy(w, in)
+	} else {
+		n, err = io.CopyN(w, in, size)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return File{}, fmt.Errorf("copy: %w", err)
+	}
+
+	return File{Path: path, Size: n, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+func checksum(dir string, path string) (File, error) {
+	file, err := os.Open(filepath.Join(dir, path))
+	if err != nil {
+		return File{}, fmt.Errorf("open: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+
+	n, err := io.Copy(hash, file)
+	if err != nil {
+		return File{}, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	return File{Path: path, Size: n, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+func writeManifest(dir string, m Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, ManifestName)
+
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range []string{SnapshotDir, WalDir, "."} {
+		err = syncDir(filepath.Join(dir, sub))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
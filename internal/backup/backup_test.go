@@ -0,0 +1,234 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/encryption"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/storage/snapshot"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/wal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	firstSegment  = "20240601_153053.00000"
+	secondSegment = "20240601_153054.00000"
+	thirdSegment  = "20240601_153055.00000"
+)
+
+func testSource(t *testing.T) Source {
+	walDir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(walDir, firstSegment), []byte("1 SET a 1 \n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(walDir, secondSegment), []byte("2 SET b 2 \n3 SET c 3 \n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(walDir, thirdSegment), []byte("4 DEL a \n"), 0644))
+
+	return Source{
+		Snapshot: &snapshot.Snapshot{
+			Position:  wal.Position{Segment: secondSegment, Offset: 11},
+			CreatedAt: time.Now(),
+			Buckets:   []map[string]string{{"a": "1", "b": "2"}},
+		},
+		WalDir: walDir,
+		// the write to the third segment came after the backup had started
+		End: wal.Position{Segment: secondSegment, Offset: 22},
+	}
+}
+
+func TestCreateVerifyRestore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "backup")
+
+	m, err := Create(dir, testSource(t))
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, m.Keys)
+	assert.Equal(t, wal.Position{Segment: secondSegment, Offset: 11}, m.Position)
+	require.Len(t, m.Files, 2)
+	assert.Equal(t, filepath.Join(WalDir, secondSegment), m.Files[1].Path)
+	assert.Equal(t, int64(22), m.Files[1].Size)
+
+	verified, err := Verify(dir)
+	require.NoError(t, err)
+	assert.Equal(t, m.Files, verified.Files)
+
+	walDir := filepath.Join(t.TempDir(), "wal")
+	snapshotDir := filepath.Join(t.TempDir(), "snapshots")
+
+	_, err = Restore(dir, walDir, snapshotDir)
+	require.NoError(t, err)
+
+	segments, err := wal.Segments(walDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{secondSegment}, segments)
+
+	s, _, found, err := snapshot.LoadLatest(snapshotDir, func(header snapshot.Snapshot) error { return nil })
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, "2", s.Buckets[0]["b"])
+	assert.True(t, wal.Exists(walDir, s.Position))
+
+	// restoring over existing data is refused
+	_, err = Restore(dir, walDir, filepath.Join(t.TempDir(), "other"))
+	assert.ErrorIs(t, err, consts.ErrDirectoryNotEmpty)
+}
+
+func TestCreate_CompressedSegments(t *testing.T) {
+	src := testSource(t)
+
+	// a closed segment compressed by the wal is copied as is
+	compressed := bytes.Buffer{}
+	writer := gzip.NewWriter(&compressed)
+	_, err := writer.Write([]byte("2 SET b 2 \n3 SET c 3 \n"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	require.NoError(t, os.WriteFile(filepath.Join(src.WalDir, secondSegment+".gz"), compressed.Bytes(), 0644))
+	require.NoError(t, os.Remove(filepath.Join(src.WalDir, secondSegment)))
+	src.End = wal.Position{Segment: thirdSegment, Offset: 9}
+
+	dir := filepath.Join(t.TempDir(), "backup")
+
+	m, err := Create(dir, src)
+	require.NoError(t, err)
+	require.Len(t, m.Files, 3)
+	assert.Equal(t, filepath.Join(WalDir, secondSegment+".gz"), m.Files[1].Path)
+
+	walDir := filepath.Join(t.TempDir(), "wal")
+
+	_, err = Restore(dir, walDir, filepath.Join(t.TempDir(), "snapshots"))
+	require.NoError(t, err)
+
+	ids := make([]string, 0)
+	_, _, err = wal.Replay(walDir, m.Position, wal.Target{}, func(record wal.Record) error {
+		ids = append(ids, record.ID)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"3", "4"}, ids)
+}
+
+func TestCreate_SegmentCompressedWhileCopied(t *testing.T) {
+	src := testSource(t)
+	src.End = wal.Position{Segment: thirdSegment, Offset: 9}
+
+	// the wal compresses the second segment after the backup has opened it
+	src.OpenSegments = func(from string, to string) ([]wal.OpenedSegment, error) {
+		segments, err := wal.OpenSegments(src.WalDir, from, to)
+		if err != nil {
+			return nil, err
+		}
+
+		require.NoError(t, os.WriteFile(filepath.Join(src.WalDir, secondSegment+".gz"), nil, 0644))
+		require.NoError(t, os.Remove(filepath.Join(src.WalDir, secondSegment)))
+
+		return segments, nil
+	}
+
+	dir := filepath.Join(t.TempDir(), "backup")
+
+	m, err := Create(dir, src)
+	require.NoError(t, err)
+	require.Len(t, m.Files, 3)
+	assert.Equal(t, filepath.Join(WalDir, secondSegment), m.Files[1].Path)
+	assert.Equal(t, int64(22), m.Files[1].Size)
+
+	_, err = Verify(dir)
+	require.NoError(t, err)
+}
+
+func TestCreate_EncryptedSegments(t *testing.T) {
+	keyring, err := encryption.NewKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	require.NoError(t, err)
+
+	encryption.SetKeyring(keyring)
+	t.Cleanup(func() { encryption.SetKeyring(nil) })
+
+	src := testSource(t)
+
+	encrypted := bytes.Buffer{}
+	writer, err := encryption.NewWriter(&encrypted, keyring)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("2 SET b 2 \n3 SET c 3 \n"))
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(src.WalDir, secondSegment+".enc"), encrypted.Bytes(), 0644))
+	require.NoError(t, os.Remove(filepath.Join(src.WalDir, secondSegment)))
+
+	dir := filepath.Join(t.TempDir(), "backup")
+
+	// the records of the segment being written are encrypted again up to the end
+	m, err := Create(dir, src)
+	require.NoError(t, err)
+	require.Len(t, m.Files, 2)
+	assert.Equal(t, filepath.Join(WalDir, secondSegment+".enc"), m.Files[1].Path)
+
+	for _, file := range m.Files {
+		data, err := os.ReadFile(filepath.Join(dir, file.Path))
+		require.NoError(t, err)
+		assert.True(t, encryption.IsEncrypted(data), file.Path)
+	}
+
+	_, err = Verify(dir)
+	require.NoError(t, err)
+
+	walDir := filepath.Join(t.TempDir(), "wal")
+
+	_, err = Restore(dir, walDir, filepath.Join(t.TempDir(), "snapshots"))
+	require.NoError(t, err)
+
+	data, err := wal.ReadSegment(walDir, secondSegment)
+	require.NoError(t, err)
+	assert.Equal(t, "2 SET b 2 \n3 SET c 3 \n", string(data))
+}
+
+func TestCreate_NotEmptyDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), nil, 0644))
+
+	_, err := Create(dir, testSource(t))
+	assert.ErrorIs(t, err, consts.ErrDirectoryNotEmpty)
+	assert.FileExists(t, filepath.Join(dir, "file"))
+}
+
+func TestVerify_Invalid(t *testing.T) {
+	tests := map[string]func(dir string, m Manifest){
+		"altered segment": func(dir string, m Manifest) {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, m.Files[1].Path), []byte("2 SET b 9 \n3 SET c 3 \n"), 0644))
+		},
+		"missing segment": func(dir string, m Manifest) {
+			require.NoError(t, os.Remove(filepath.Join(dir, m.Files[1].Path)))
+		},
+		"missing manifest": func(dir string, m Manifest) {
+			require.NoError(t, os.Remove(filepath.Join(dir, ManifestName)))
+		},
+		"file outside the backup": func(dir string, m Manifest) {
+			m.Files[1].Path = "../" + m.Files[1].Path
+			require.NoError(t, writeManifest(dir, m))
+		},
+		"segment of the snapshot is not listed": func(dir string, m Manifest) {
+			require.NoError(t, os.Remove(filepath.Join(dir, m.Files[1].Path)))
+			m.Files = m.Files[:1]
+			require.NoError(t, writeManifest(dir, m))
+		},
+	}
+
+	for name, corrupt := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "backup")
+
+			m, err := Create(dir, testSource(t))
+			require.NoError(t, err)
+
+			corrupt(dir, m)
+
+			_, err = Verify(dir)
+			assert.ErrorIs(t, err, ErrInvalidBackup)
+		})
+	}
+}
@@ -60,8 +60,32 @@ func (a *Analyzer) validate(ctx context.Context, parsed []string) error {
 		if len(parsed) != 2 {
 			return consts.ErrInvalidDelQueryArgs
 		}
+	case consts.CommandAuth:
+		if len(parsed) != 3 {
+			return consts.ErrInvalidAuthQueryArgs
+		}
+	case consts.CommandStats:
+		if len(parsed) != 1 {
+			return consts.ErrInvalidStatsQueryArgs
+		}
+	case consts.CommandPing:
+		if len(parsed) != 1 {
+			return consts.ErrInvalidPingQueryArgs
+		}
+	case consts.CommandRole:
+		if len(parsed) != 1 {
+			return consts.ErrInvalidRoleQueryArgs
+		}
+	case consts.CommandSave, consts.CommandBgSave:
+		if len(parsed) != 1 {
+			return consts.ErrInvalidSaveQueryArgs
+		}
+	case consts.CommandBackup:
+		if len(parsed) != 2 {
+			return consts.ErrInvalidBackupQueryArgs
+		}
 	default:
-		return fmt.Errorf("unknown command: %s", command)
+		return fmt.Errorf("%w: %s", consts.ErrUnknownCommand, command)
 	}
 
 	return nil
@@ -83,6 +83,15 @@ func TestValidate(t *testing.T) {
 		}
 	})
 
+	t.Run("TestValidate_PingCommandInvalidArgs", func(t *testing.T) {
+		parsed := []string{"PING", "hello"}
+		err := a.validate(context.Background(), parsed)
+
+		if err == nil {
+			t.Errorf("Expected error: %v, got: %v", consts.ErrInvalidPingQueryArgs, err)
+		}
+	})
+
 	t.Run("TestValidate_UnknownCommand", func(t *testing.T) {
 		parsed := []string{"UNKNOWN"}
 		err := a.validate(context.Background(), parsed)
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"strings"
 
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
 )
@@ -37,7 +38,7 @@ func NewComputer(logger *slog.Logger) Computer {
 }
 
 func (c *Computer) Compute(ctx context.Context, text string) (Query, error) {
-	c.logger.Debug("parsing text", consts.RequestID, ctx.Value(consts.RequestID).(string), "text", text)
+	c.logger.Debug("parsing text", consts.RequestID, ctx.Value(consts.RequestID).(string), "text", Redact(text))
 
 	result, err := c.parser.parse(text)
 	if err != nil {
@@ -46,7 +47,7 @@ func (c *Computer) Compute(ctx context.Context, text string) (Query, error) {
 
 	c.logger.Debug("parse success", consts.RequestID, ctx.Value(consts.RequestID).(string))
 
-	c.logger.Debug("analyzing parse result", consts.RequestID, ctx.Value(consts.RequestID).(string), "result", result)
+	c.logger.Debug("analyzing parse result", consts.RequestID, ctx.Value(consts.RequestID).(string), "result", Redact(strings.Join(result, " ")))
 
 	query, err := c.analyzer.analyzeQuery(ctx, result)
 	if err != nil {
@@ -57,3 +58,13 @@ func (c *Computer) Compute(ctx context.Context, text string) (Query, error) {
 
 	return query, nil
 }
+
+// Redact hides the password of an AUTH request, so it can be logged
+func Redact(text string) string {
+	fields := strings.Fields(text)
+	if len(fields) < 3 || strings.ToUpper(fields[0]) != consts.CommandAuth {
+		return text
+	}
+
+	return fmt.Sprintf("%s %s ***", fields[0], fields[1])
+}
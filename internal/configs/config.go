@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -25,19 +26,75 @@ type Wal struct {
 	MaxSegmentSize       string        `yaml:"max_segment_size"`
 	MaxSegmentSizeBytes  int           `yaml:"max_segment_size_bytes"`
 	DataDir              string        `yaml:"data_directory"`
+	Fsync                string        `yaml:"fsync"`          // always, interval or never, see README
+	FsyncInterval        time.Duration `yaml:"fsync_interval"` // between fsyncs in the interval mode
+	Compression          string        `yaml:"compression"`    // none, segments or batches, see README
+	Encryption           *Encryption   `yaml:"encryption"`     // optional, wal segments and snapshots are not encrypted when empty
+}
+
+type Encryption struct {
+	ActiveKey string          `yaml:"active_key"` // id of the key new files are encrypted with, may be omitted with a single key
+	Keys      []EncryptionKey `yaml:"keys"`       // old keys stay here until no file encrypted with them is left
+}
+
+// EncryptionKey is a base64 encoded aes key of 16, 24 or 32 bytes read from a file or an environment variable
+type EncryptionKey struct {
+	ID   string `yaml:"id"`
+	File string `yaml:"file"`
+	Env  string `yaml:"env"`
+}
+
+type Snapshot struct {
+	DataDir  string        `yaml:"data_directory"`
+	Interval time.Duration `yaml:"interval"`  // between periodic snapshots, < 0 disables them, SAVE and BGSAVE still work
+	Retain   int           `yaml:"retain"`    // number of kept snapshots, 0 keeps defaults.SnapshotRetain
+	PruneWal bool          `yaml:"prune_wal"` // remove wal segments older than the oldest kept snapshot
 }
 
 type Network struct {
-	Address        string `yaml:"address"`
-	MaxConnections int    `yaml:"max_connections"`
+	Address           string      `yaml:"address"` // "host:port" or "unix:///path/to.sock"
+	MaxConnections    int         `yaml:"max_connections"`
+	HTTPAddress       string      `yaml:"http_address"`       // optional, http gateway is disabled when empty
+	SocketPermissions string      `yaml:"socket_permissions"` // octal file mode of a unix socket, e.g. "0660"
+	SocketFileMode    os.FileMode `yaml:"socket_file_mode"`
+	TLS               *TLS        `yaml:"tls"` // optional, connections are not encrypted when empty
+
+	AcceptBacklog *int          `yaml:"accept_backlog"` // connections waiting for a free slot when max_connections is reached, 0 rejects them at once
+	QueueTimeout  time.Duration `yaml:"queue_timeout"`  // waiting connections are rejected after the timeout, 0 keeps the default
+
+	IdleTimeout         time.Duration `yaml:"idle_timeout"`     // connections without requests are closed after the timeout
+	MaxMessageSize      string        `yaml:"max_message_size"` // e.g. "1KB"
+	MaxMessageSizeBytes int           `yaml:"max_message_size_bytes"`
+}
+
+type TLS struct {
+	CertFile          string `yaml:"cert_file"`
+	KeyFile           string `yaml:"key_file"`
+	CAFile            string `yaml:"ca_file"`     // CA to verify client certificates
+	MinVersion        string `yaml:"min_version"` // "1.2" or "1.3"
+	RequireClientCert bool   `yaml:"require_client_cert"`
+}
+
+type Auth struct {
+	ACLFile string `yaml:"acl_file"` // optional yaml file with a "users" list, overrides users with the same name
+	Users   []User `yaml:"users"`
+}
+
+type User struct {
+	Name     string   `yaml:"name"`
+	Password string   `yaml:"password"` // "argon2id$v=19$m=<KiB>,t=<passes>,p=<threads>$<salt>$<hash>", base64
+	Commands []string `yaml:"commands"` // "+@read", "-DEL", "+@all", the last matching rule wins
+	Keys     []string `yaml:"keys"`     // "user_*", "-user_secret*", a matching deny rule always wins
 }
 
 type Engine struct {
-	Type string `yaml:"type"`
+	Type      string `yaml:"type"`
+	DedupSize int    `yaml:"dedup_size"` // number of recent writes remembered by request id, < 0 disables
 }
 
 type App struct {
-	Timeout time.Duration `yaml:"timeout"`
+	Timeout         time.Duration `yaml:"timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"` // in-flight requests are cancelled after the timeout
 }
 
 type Replication struct {
@@ -50,10 +107,12 @@ type Replication struct {
 type Config struct {
 	App App `yaml:"app"`
 
-	Engine Engine `yaml:"engine"`
-	Wal    *Wal   `yaml:"wal"`
+	Engine   Engine    `yaml:"engine"`
+	Wal      *Wal      `yaml:"wal"`
+	Snapshot *Snapshot `yaml:"snapshot"` // optional, the whole wal is replayed on start when empty
 
 	Network     Network      `yaml:"network"`
+	Auth        *Auth        `yaml:"auth"` // optional, every client has full access when empty
 	Replication *Replication `yaml:"replication"`
 
 	Logger Logger `yaml:"logger"`
@@ -77,19 +136,89 @@ func NewConfig(configPath string) (*Config, error) {
 	return cfg, nil
 }
 
+// DataDirs returns the directories the server writes to: the wal and snapshots, or the replicated wal of a slave
+func (c *Config) DataDirs() []string {
+	if c.Replication != nil && c.Replication.Type == defaults.ReplicationTypeSlave {
+		return []string{c.Replication.ReplicatedDataDir}
+	}
+
+	dirs := make([]string, 0, 2)
+	if c.Wal != nil {
+		dirs = append(dirs, c.Wal.DataDir)
+	}
+	if c.Snapshot != nil {
+		dirs = append(dirs, c.Snapshot.DataDir)
+	}
+
+	return dirs
+}
+
 func (c *Config) SetDefaults() error {
 	if c.App.Timeout == 0 {
 		c.App.Timeout = defaults.AppTimeout * time.Second
 	}
+	if c.App.ShutdownTimeout == 0 {
+		c.App.ShutdownTimeout = defaults.ShutdownTimeout
+	}
 	if c.Engine.Type == "" {
 		c.Engine.Type = defaults.EngineType
 	}
+	if c.Engine.DedupSize == 0 {
+		c.Engine.DedupSize = defaults.EngineDedupSize
+	}
 	if c.Network.Address == "" {
 		c.Network.Address = defaults.MasterServerAddress
 	}
 	if c.Network.MaxConnections == 0 {
 		c.Network.MaxConnections = defaults.MaxConnections
 	}
+	if c.Network.AcceptBacklog == nil {
+		backlog := defaults.AcceptBacklog
+		c.Network.AcceptBacklog = &backlog
+	}
+	if *c.Network.AcceptBacklog < 0 {
+		return fmt.Errorf("network accept_backlog must be non-negative")
+	}
+	if c.Network.QueueTimeout < 0 {
+		return fmt.Errorf("network queue_timeout must be non-negative")
+	}
+	if c.Network.QueueTimeout == 0 {
+		c.Network.QueueTimeout = defaults.QueueTimeout
+	}
+	if c.Network.IdleTimeout == 0 {
+		c.Network.IdleTimeout = defaults.IdleTimeout
+	}
+	if c.Network.MaxMessageSize == "" {
+		c.Network.MaxMessageSizeBytes = defaults.MaxMessageSize
+	} else {
+		bytesSize, err := parseToBytes(c.Network.MaxMessageSize)
+		if err != nil {
+			return fmt.Errorf("parse network max message size to bytes: %w", err)
+		}
+		c.Network.MaxMessageSizeBytes = bytesSize
+	}
+	if strings.HasPrefix(c.Network.Address, defaults.UnixSocketScheme) {
+		if c.Network.SocketPermissions == "" {
+			c.Network.SocketPermissions = defaults.SocketPermissions
+		}
+
+		mode, err := strconv.ParseUint(c.Network.SocketPermissions, 8, 32)
+		if err != nil {
+			return fmt.Errorf("parse socket permissions: %w", err)
+		}
+		c.Network.SocketFileMode = os.FileMode(mode)
+	}
+	if c.Network.TLS != nil {
+		if c.Network.TLS.CertFile == "" || c.Network.TLS.KeyFile == "" {
+			return fmt.Errorf("tls: cert_file and key_file are required")
+		}
+		if c.Network.TLS.RequireClientCert && c.Network.TLS.CAFile == "" {
+			return fmt.Errorf("tls: ca_file is required to verify client certificates")
+		}
+		if c.Network.TLS.MinVersion == "" {
+			c.Network.TLS.MinVersion = defaults.TLSMinVersion
+		}
+	}
 	if c.Logger.Level == "" {
 		c.Logger.Level = defaults.LogLevel
 	}
@@ -112,12 +241,51 @@ func (c *Config) SetDefaults() error {
 		if c.Wal.FlushingBatchTimeout == 0 {
 			c.Wal.FlushingBatchTimeout = defaults.WalFlushingBatchTimeout
 		}
+		// a lone write waits for the batch timeout, it must be flushed before the request times out
+		if c.Wal.FlushingBatchTimeout >= c.App.Timeout {
+			return fmt.Errorf("wal flushing_batch_timeout %s must be less than app timeout %s",
+				c.Wal.FlushingBatchTimeout, c.App.Timeout)
+		}
 		if c.Wal.MaxSegmentSize == "" {
 			c.Wal.MaxSegmentSize = defaults.WalMaxSegmentSize
 		}
 		if c.Wal.DataDir == "" {
 			c.Wal.DataDir = defaults.WalDataDir
 		}
+		if c.Wal.Fsync == "" {
+			c.Wal.Fsync = defaults.WalFsync
+		}
+		if c.Wal.FsyncInterval == 0 {
+			c.Wal.FsyncInterval = defaults.WalFsyncInterval
+		}
+
+		switch c.Wal.Fsync {
+		case defaults.FsyncAlways, defaults.FsyncInterval, defaults.FsyncNever:
+		default:
+			return fmt.Errorf("unknown wal fsync mode: %s", c.Wal.Fsync)
+		}
+
+		if c.Wal.Compression == "" {
+			c.Wal.Compression = defaults.WalCompression
+		}
+
+		switch c.Wal.Compression {
+		case defaults.CompressionNone, defaults.CompressionSegments, defaults.CompressionBatches:
+		default:
+			return fmt.Errorf("unknown wal compression: %s", c.Wal.Compression)
+		}
+
+		if c.Wal.Encryption != nil {
+			err := c.Wal.Encryption.setDefaults()
+			if err != nil {
+				return fmt.Errorf("wal encryption: %w", err)
+			}
+
+			// encrypted data doesn't compress, batches are compressed before they are encrypted
+			if c.Wal.Compression == defaults.CompressionSegments {
+				return fmt.Errorf("wal encryption: use the %s compression instead of %s", defaults.CompressionBatches, defaults.CompressionSegments)
+			}
+		}
 
 		bytesSize, err := parseToBytes(c.Wal.MaxSegmentSize)
 		if err != nil {
@@ -126,6 +294,36 @@ func (c *Config) SetDefaults() error {
 		c.Wal.MaxSegmentSizeBytes = bytesSize
 	}
 
+	if c.Snapshot != nil {
+		if c.Wal == nil {
+			return fmt.Errorf("snapshots require the wal")
+		}
+		// compaction rewrites the segments a snapshot position points to
+		if c.Wal.Compaction {
+			return fmt.Errorf("compaction and snapshots can't be used at the same time")
+		}
+		// slaves fetch the whole wal from the master
+		if c.Snapshot.PruneWal && c.Replication != nil {
+			return fmt.Errorf("snapshot prune_wal and replication can't be used at the same time")
+		}
+		if c.Snapshot.DataDir != "" && filepath.Clean(c.Snapshot.DataDir) == filepath.Clean(c.Wal.DataDir) {
+			return fmt.Errorf("snapshot and wal data directories must differ")
+		}
+		if c.Snapshot.Retain < 0 {
+			return fmt.Errorf("snapshot retain must be non-negative, 0 means the default")
+		}
+
+		if c.Snapshot.DataDir == "" {
+			c.Snapshot.DataDir = defaults.SnapshotDataDir
+		}
+		if c.Snapshot.Interval == 0 {
+			c.Snapshot.Interval = defaults.SnapshotInterval
+		}
+		if c.Snapshot.Retain == 0 {
+			c.Snapshot.Retain = defaults.SnapshotRetain
+		}
+	}
+
 	if c.Replication != nil {
 		if c.Replication.SyncInterval == 0 {
 			c.Replication.SyncInterval = defaults.ReplicationSyncInterval
@@ -218,3 +416,38 @@ func validateConfigPath(path string) error {
 	}
 	return nil
 }
+
+func (e *Encryption) setDefaults() error {
+	if len(e.Keys) == 0 {
+		return fmt.Errorf("no keys")
+	}
+
+	ids := make(map[string]bool, len(e.Keys))
+	for _, key := range e.Keys {
+		if key.ID == "" || len(key.ID) > 255 {
+			return fmt.Errorf("key id must be 1 to 255 bytes long: %q", key.ID)
+		}
+		if ids[key.ID] {
+			return fmt.Errorf("duplicate key id: %s", key.ID)
+		}
+		if (key.File == "") == (key.Env == "") {
+			return fmt.Errorf("key %s: set either file or env", key.ID)
+		}
+
+		ids[key.ID] = true
+	}
+
+	if e.ActiveKey == "" {
+		if len(e.Keys) > 1 {
+			return fmt.Errorf("active_key is required with several keys")
+		}
+
+		e.ActiveKey = e.Keys[0].ID
+	}
+
+	if !ids[e.ActiveKey] {
+		return fmt.Errorf("unknown active key: %s", e.ActiveKey)
+	}
+
+	return nil
+}
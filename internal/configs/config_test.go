@@ -28,14 +28,20 @@ func TestNewConfig(t *testing.T) {
 			input: fmt.Sprintf("%s/testdata/config_default.yaml", cwd),
 			want: &Config{
 				App: App{
-					Timeout: defaults.AppTimeout * time.Second,
+					Timeout:         defaults.AppTimeout * time.Second,
+					ShutdownTimeout: defaults.ShutdownTimeout,
 				},
 				Engine: Engine{
-					Type: defaults.EngineType,
+					Type:      defaults.EngineType,
+					DedupSize: defaults.EngineDedupSize,
 				},
 				Network: Network{
-					Address:        defaults.MasterServerAddress,
-					MaxConnections: defaults.MaxConnections,
+					Address:             defaults.MasterServerAddress,
+					MaxConnections:      defaults.MaxConnections,
+					AcceptBacklog:       intPtr(defaults.AcceptBacklog),
+					QueueTimeout:        defaults.QueueTimeout,
+					IdleTimeout:         defaults.IdleTimeout,
+					MaxMessageSizeBytes: defaults.MaxMessageSize,
 				},
 				Logger: Logger{
 					Level:    defaults.LogLevel,
@@ -47,14 +53,21 @@ func TestNewConfig(t *testing.T) {
 			input: fmt.Sprintf("%s/testdata/config_custom.yaml", cwd),
 			want: &Config{
 				App: App{
-					Timeout: 15 * time.Second,
+					Timeout:         15 * time.Second,
+					ShutdownTimeout: defaults.ShutdownTimeout,
 				},
 				Engine: Engine{
-					Type: "custom",
+					Type:      "custom",
+					DedupSize: defaults.EngineDedupSize,
 				},
 				Network: Network{
-					Address:        "127.0.0.1:8080",
-					MaxConnections: 10,
+					Address:             "127.0.0.1:8080",
+					MaxConnections:      10,
+					AcceptBacklog:       intPtr(defaults.AcceptBacklog),
+					QueueTimeout:        defaults.QueueTimeout,
+					IdleTimeout:         time.Minute,
+					MaxMessageSize:      "2KB",
+					MaxMessageSizeBytes: 2048,
 				},
 				Logger: Logger{
 					Level:    "error",
@@ -143,3 +156,179 @@ func TestParseToBytes(t *testing.T) {
 		}
 	}
 }
+
+func TestSetDefaults_Snapshot(t *testing.T) {
+	cfg := &Config{Wal: &Wal{}, Snapshot: &Snapshot{}}
+
+	err := cfg.SetDefaults()
+	if err != nil {
+		t.Fatalf("SetDefaults: %v", err)
+	}
+
+	want := Snapshot{
+		DataDir:  defaults.SnapshotDataDir,
+		Interval: defaults.SnapshotInterval,
+		Retain:   defaults.SnapshotRetain,
+	}
+	if *cfg.Snapshot != want {
+		t.Errorf("expected %+v, got %+v", want, *cfg.Snapshot)
+	}
+
+	invalid := []*Config{
+		{Snapshot: &Snapshot{}},
+		{Wal: &Wal{Compaction: true}, Snapshot: &Snapshot{}},
+		{Wal: &Wal{}, Snapshot: &Snapshot{PruneWal: true}, Replication: &Replication{}},
+		{Wal: &Wal{}, Snapshot: &Snapshot{Retain: -1}},
+	}
+
+	for _, cfg := range invalid {
+		if err := cfg.SetDefaults(); err == nil {
+			t.Errorf("SetDefaults(%+v): expected an error, got nil", *cfg.Snapshot)
+		}
+	}
+
+	for retain, want := range map[int]int{0: defaults.SnapshotRetain, 1: 1, 5: 5} {
+		cfg := &Config{Wal: &Wal{}, Snapshot: &Snapshot{Retain: retain}}
+		if err := cfg.SetDefaults(); err != nil {
+			t.Fatalf("SetDefaults(retain %d): %v", retain, err)
+		}
+		if cfg.Snapshot.Retain != want {
+			t.Errorf("retain %d: expected %d, got %d", retain, want, cfg.Snapshot.Retain)
+		}
+	}
+}
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestSetDefaults_AcceptBacklog(t *testing.T) {
+	file, err := ioutil.TempFile("", "config_test_accept_backlog")
+	if err != nil {
+		t.Fatalf("create temp file: %v", err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString("network:\n  accept_backlog: 0\n")
+	if err != nil {
+		t.Fatalf("write to temp file: %v", err)
+	}
+	_ = file.Close()
+
+	// an explicit 0 rejects connections over max_connections at once
+	cfg, err := NewConfig(file.Name())
+	if err != nil {
+		t.Fatalf("NewConfig: %v", err)
+	}
+	if *cfg.Network.AcceptBacklog != 0 || cfg.Network.QueueTimeout != defaults.QueueTimeout {
+		t.Errorf("expected backlog 0 and queue timeout %s, got %d and %s",
+			defaults.QueueTimeout, *cfg.Network.AcceptBacklog, cfg.Network.QueueTimeout)
+	}
+
+	invalid := map[string]Network{
+		"negative backlog":       {AcceptBacklog: intPtr(-1)},
+		"negative queue timeout": {QueueTimeout: -time.Second},
+	}
+
+	for name, network := range invalid {
+		cfg := &Config{Network: network}
+		if err := cfg.SetDefaults(); err == nil {
+			t.Errorf("%s: expected an error, got nil", name)
+		}
+	}
+}
+
+func TestSetDefaults_WalFsync(t *testing.T) {
+	cfg := &Config{Wal: &Wal{}}
+
+	err := cfg.SetDefaults()
+	if err != nil {
+		t.Fatalf("SetDefaults: %v", err)
+	}
+
+	if cfg.Wal.Fsync != defaults.WalFsync || cfg.Wal.FsyncInterval != defaults.WalFsyncInterval {
+		t.Errorf("expected fsync %s every %s, got %s every %s",
+			defaults.WalFsync, defaults.WalFsyncInterval, cfg.Wal.Fsync, cfg.Wal.FsyncInterval)
+	}
+
+	cfg = &Config{App: App{Timeout: time.Second}, Wal: &Wal{FlushingBatchTimeout: time.Second}}
+	if err := cfg.SetDefaults(); err == nil {
+		t.Errorf("SetDefaults: expected an error for a batch timeout not less than the app timeout, got nil")
+	}
+
+	cfg = &Config{Wal: &Wal{Fsync: "sometimes"}}
+	if err := cfg.SetDefaults(); err == nil {
+		t.Errorf("SetDefaults: expected an error for an unknown fsync mode, got nil")
+	}
+}
+
+func TestSetDefaults_WalCompression(t *testing.T) {
+	cfg := &Config{Wal: &Wal{}}
+
+	err := cfg.SetDefaults()
+	if err != nil {
+		t.Fatalf("SetDefaults: %v", err)
+	}
+	if cfg.Wal.Compression != defaults.WalCompression {
+		t.Errorf("expected compression %s, got %s", defaults.WalCompression, cfg.Wal.Compression)
+	}
+
+	cfg = &Config{Wal: &Wal{Compression: "zstd"}}
+	if err := cfg.SetDefaults(); err == nil {
+		t.Errorf("SetDefaults: expected an error for an unknown compression, got nil")
+	}
+}
+
+func TestSetDefaults_WalEncryption(t *testing.T) {
+	cfg := &Config{Wal: &Wal{Encryption: &Encryption{Keys: []EncryptionKey{{ID: "k1", File: "/etc/kvdb/k1"}}}}}
+
+	err := cfg.SetDefaults()
+	if err != nil {
+		t.Fatalf("SetDefaults: %v", err)
+	}
+	if cfg.Wal.Encryption.ActiveKey != "k1" {
+		t.Errorf("expected the single key to be active, got %q", cfg.Wal.Encryption.ActiveKey)
+	}
+
+	invalid := map[string]*Wal{
+		"no keys":             {Encryption: &Encryption{}},
+		"no source":           {Encryption: &Encryption{Keys: []EncryptionKey{{ID: "k1"}}}},
+		"file and env":        {Encryption: &Encryption{Keys: []EncryptionKey{{ID: "k1", File: "k1", Env: "K1"}}}},
+		"duplicate id":        {Encryption: &Encryption{ActiveKey: "k1", Keys: []EncryptionKey{{ID: "k1", Env: "K1"}, {ID: "k1", Env: "K2"}}}},
+		"no active key":       {Encryption: &Encryption{Keys: []EncryptionKey{{ID: "k1", Env: "K1"}, {ID: "k2", Env: "K2"}}}},
+		"unknown active key":  {Encryption: &Encryption{ActiveKey: "k3", Keys: []EncryptionKey{{ID: "k1", Env: "K1"}}}},
+		"segment compression": {Compression: "segments", Encryption: &Encryption{Keys: []EncryptionKey{{ID: "k1", Env: "K1"}}}},
+	}
+
+	for name, wal := range invalid {
+		cfg := &Config{Wal: wal}
+		if err := cfg.SetDefaults(); err == nil {
+			t.Errorf("%s: expected an error, got nil", name)
+		}
+	}
+}
+
+func TestDataDirs(t *testing.T) {
+	tests := []struct {
+		cfg  *Config
+		want []string
+	}{
+		{cfg: &Config{}, want: []string{}},
+		{cfg: &Config{Wal: &Wal{DataDir: "wal"}, Snapshot: &Snapshot{DataDir: "snapshots"}}, want: []string{"wal", "snapshots"}},
+		{
+			cfg: &Config{
+				Wal:         &Wal{DataDir: "wal"},
+				Snapshot:    &Snapshot{DataDir: "snapshots"},
+				Replication: &Replication{Type: defaults.ReplicationTypeSlave, ReplicatedDataDir: "replicated"},
+			},
+			want: []string{"replicated"},
+		},
+	}
+
+	for _, tt := range tests {
+		got := tt.cfg.DataDirs()
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("DataDirs() = %v, want %v", got, tt.want)
+		}
+	}
+}
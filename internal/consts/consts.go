@@ -2,18 +2,60 @@ package consts
 
 import "errors"
 
-const RequestID = "request_id"
+const (
+	RequestID      = "request_id"
+	ClientIdentity = "client_identity" // common name of a verified tls client certificate
+	Session        = "session"         // authentication state of a connection
+)
 
 const (
-	CommandSet = "SET"
-	CommandGet = "GET"
-	CommandDel = "DEL"
+	CommandSet  = "SET"
+	CommandGet  = "GET"
+	CommandDel  = "DEL"
+	CommandAuth = "AUTH"
+
+	CommandStats = "STATS"
+	CommandPing  = "PING"
+	CommandRole  = "ROLE"
+
+	CommandSave   = "SAVE"
+	CommandBgSave = "BGSAVE"
+	CommandBackup = "BACKUP"
+
+	// CommandExport is not a query, it names the export of all keys in acl rules
+	CommandExport = "EXPORT"
 )
 
 var (
-	ErrParseSymbol = errors.New("parse error")
+	ErrParseSymbol      = errors.New("parse error")
+	ErrUnknownCommand   = errors.New("unknown command")
+	ErrReadOnly         = errors.New("cannot perform modifying operation on slave")
+	ErrRecoveryReadOnly = errors.New("database is read-only in recovery mode")
+
+	ErrMessageTooLarge   = errors.New("message too large")
+	ErrIdleTimeout       = errors.New("connection closed after idle timeout")
+	ErrRequestTimeout    = errors.New("request timeout")
+	ErrMaxConnections    = errors.New("max connections reached")
+	ErrWalClosed         = errors.New("wal is closed")
+	ErrInvalidRequestID  = errors.New("invalid request id")
+	ErrRequestIDConflict = errors.New("request id is already used by another request")
+
+	ErrSnapshotInProgress = errors.New("snapshot is already in progress")
+	ErrSnapshotsDisabled  = errors.New("snapshots are disabled")
+	ErrDirectoryNotEmpty  = errors.New("directory is not empty")
+
+	ErrAuthRequired       = errors.New("authentication required")
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrPermissionDenied   = errors.New("permission denied")
+
+	ErrInvalidSetQueryArgs  = errors.New("invalid set query args")
+	ErrInvalidGetQueryArgs  = errors.New("invalid get query args")
+	ErrInvalidDelQueryArgs  = errors.New("invalid del query args")
+	ErrInvalidAuthQueryArgs = errors.New("invalid auth query args")
 
-	ErrInvalidSetQueryArgs = errors.New("invalid set query args")
-	ErrInvalidGetQueryArgs = errors.New("invalid get query args")
-	ErrInvalidDelQueryArgs = errors.New("invalid del query args")
+	ErrInvalidStatsQueryArgs  = errors.New("invalid stats query args")
+	ErrInvalidPingQueryArgs   = errors.New("invalid ping query args")
+	ErrInvalidRoleQueryArgs   = errors.New("invalid role query args")
+	ErrInvalidSaveQueryArgs   = errors.New("invalid save query args")
+	ErrInvalidBackupQueryArgs = errors.New("invalid backup query args")
 )
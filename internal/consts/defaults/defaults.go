@@ -4,9 +4,15 @@ import "time"
 
 const (
 	AppTimeout          = 3
+	ShutdownTimeout     = 10 * time.Second
 	EngineType          = "in_memory"
+	EngineDedupSize     = 10000
 	MasterServerAddress = "127.0.0.1:8088"
 	MaxConnections      = 10
+	UnixSocketScheme    = "unix://"
+	SocketPermissions   = "0660"
+	TLSMinVersion       = "1.2"
+	TLSHandshakeTimeout = 10 * time.Second
 
 	ReplicationSyncInterval   = 5 * time.Second
 	ReplicationTypeSlave      = "slave"
@@ -17,12 +23,33 @@ const (
 
 	LogLevel       = "info"
 	MaxMessageSize = 1024
+	IdleTimeout    = 5 * time.Minute
+	AcceptBacklog  = 10
+	QueueTimeout   = time.Second
 
 	WalCompactionTimeout    = 30 * time.Second
+	WalCompactionWindow     = 8 // max segment sizes merged by one compaction
 	WalMaxSegmentSize       = "10MB"
 	WalFlushingBatchSize    = 100
 	WalFlushingBatchTimeout = 10 * time.Millisecond
 	WalDataDir              = "/data/wal"
+	WalFsync                = FsyncAlways
+	WalFsyncInterval        = time.Second
+	WalCompression          = CompressionNone
+
+	// wal fsync modes
+	FsyncAlways   = "always"
+	FsyncInterval = "interval"
+	FsyncNever    = "never"
+
+	// wal compression modes
+	CompressionNone     = "none"
+	CompressionSegments = "segments"
+	CompressionBatches  = "batches"
+
+	SnapshotInterval = 10 * time.Minute
+	SnapshotRetain   = 2
+	SnapshotDataDir  = "/data/snapshots"
 
 	RetriesCount = 3
 	RetriesDelay = 500 * time.Millisecond
@@ -2,14 +2,23 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"time"
 
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/auth"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/compute"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts/defaults"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/stats"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/storage/engine"
 )
 
+// pong is the result of PING, clients use it to check a connection
+const pong = "PONG"
+
 type computeLayer interface {
 	Compute(ctx context.Context, text string) (compute.Query, error)
 }
@@ -23,16 +32,26 @@ type databaseLayer interface {
 }
 
 type Database struct {
-	engine       *engine.Engine
-	computeLayer compute.Computer
-	logger       *slog.Logger
+	engine        *engine.Engine
+	computeLayer  compute.Computer
+	authenticator *auth.Authenticator // nil when authentication is disabled
+	statsRegistry *stats.Registry
+	role          func() (string, time.Duration) // replication role and lag behind the master
+	logger        *slog.Logger
+}
+
+type roleResponse struct {
+	Role  string `json:"role"`
+	LagMs int64  `json:"lag_ms"`
 }
 
-func NewDatabase(engine *engine.Engine, logger *slog.Logger) (*Database, error) {
+func NewDatabase(engine *engine.Engine, authenticator *auth.Authenticator, statsRegistry *stats.Registry, logger *slog.Logger) (*Database, error) {
 	return &Database{
-		engine:       engine,
-		computeLayer: compute.NewComputer(logger),
-		logger:       logger,
+		engine:        engine,
+		computeLayer:  compute.NewComputer(logger),
+		authenticator: authenticator,
+		statsRegistry: statsRegistry,
+		logger:        logger,
 	}, nil
 }
 
@@ -42,10 +61,33 @@ func (d *Database) HandleRequest(ctx context.Context, text string) (string, erro
 		return "", fmt.Errorf("compute: %w", err)
 	}
 
+	switch query.Command {
+	case consts.CommandAuth:
+		return d.authenticate(ctx, query)
+	case consts.CommandPing:
+		return pong, nil
+	case consts.CommandRole:
+		return d.replicationRole()
+	}
+
 	d.logger.Info("computed successfully", consts.RequestID, ctx.Value(consts.RequestID).(string), "query", query)
 
+	if d.authenticator != nil {
+		err = d.authenticator.Authorize(auth.SessionFromContext(ctx), query)
+		if err != nil {
+			return "", fmt.Errorf("authorize: %w", err)
+		}
+	}
+
+	if query.Command == consts.CommandStats {
+		return d.stats()
+	}
+
 	result, err := d.engine.ProcessCommand(ctx, query)
 	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return "", fmt.Errorf("process command: %w: %w", consts.ErrRequestTimeout, err)
+		}
 		return "", fmt.Errorf("process command: %w", err)
 	}
 
@@ -53,3 +95,88 @@ func (d *Database) HandleRequest(ctx context.Context, text string) (string, erro
 
 	return result, nil
 }
+
+// authenticate binds a user to the connection's session
+func (d *Database) authenticate(ctx context.Context, query compute.Query) (string, error) {
+	if d.authenticator == nil {
+		return "", fmt.Errorf("authenticate: authentication is not configured")
+	}
+
+	session := auth.SessionFromContext(ctx)
+	if session == nil {
+		return "", fmt.Errorf("authenticate: connection has no session")
+	}
+
+	name := query.Arguments[0]
+
+	err := d.authenticator.Authenticate(name, query.Arguments[1])
+	if err != nil {
+		d.logger.Warn("authentication failed", consts.RequestID, ctx.Value(consts.RequestID).(string), "user", name)
+		return "", fmt.Errorf("authenticate: %w", err)
+	}
+
+	session.SetUser(name)
+	d.logger.Info("authenticated", consts.RequestID, ctx.Value(consts.RequestID).(string), "user", name)
+
+	return "OK", nil
+}
+
+// SetRoleProvider sets the source of the ROLE command, a database without one reports itself as a master
+func (d *Database) SetRoleProvider(role func() (string, time.Duration)) {
+	d.role = role
+}
+
+// replicationRole reports the replication role and lag as json, clients use it to route requests
+func (d *Database) replicationRole() (string, error) {
+	res := roleResponse{Role: defaults.ReplicationTypeMaster}
+	if d.role != nil {
+		var lag time.Duration
+		res.Role, lag = d.role()
+		res.LagMs = lag.Milliseconds()
+	}
+
+	encoded, err := json.Marshal(res)
+	if err != nil {
+		return "", fmt.Errorf("marshal role: %w", err)
+	}
+
+	return string(encoded), nil
+}
+
+// stats reports statistics of all registered components as json
+func (d *Database) stats() (string, error) {
+	encoded, err := json.Marshal(d.statsRegistry.Snapshot())
+	if err != nil {
+		return "", fmt.Errorf("marshal stats: %w", err)
+	}
+
+	return string(encoded), nil
+}
+
+// Export calls write for every key of a point-in-time snapshot in key order, it stops at the first error of write.
+// Exporting requires the admin acl category when authentication is enabled.
+func (d *Database) Export(ctx context.Context, write func(key string, value string) error) error {
+	if d.authenticator != nil {
+		err := d.authenticator.Authorize(auth.SessionFromContext(ctx), compute.Query{Command: consts.CommandExport})
+		if err != nil {
+			return fmt.Errorf("authorize: %w", err)
+		}
+	}
+
+	snapshot := d.engine.Snapshot()
+
+	d.logger.Info("export started", consts.RequestID, ctx.Value(consts.RequestID), "keys", len(snapshot))
+
+	for _, kv := range snapshot {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := write(kv.Key, kv.Value)
+		if err != nil {
+			return fmt.Errorf("export %s: %w", kv.Key, err)
+		}
+	}
+
+	return nil
+}
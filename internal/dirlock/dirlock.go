@@ -0,0 +1,129 @@
+// Package dirlock takes an exclusive lock on a data directory, so two processes never write to it at once
+package dirlock
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FileName is the lock file in a locked directory, it holds the pid of the process that locked it
+const FileName = "LOCK"
+
+// ErrLocked is returned when another process holds the lock of a directory
+var ErrLocked = errors.New("data directory is locked by another process")
+
+// Lock is an exclusive advisory lock on a directory, held until Release or the exit of the process
+type Lock struct {
+	file *os.File
+}
+
+// Acquire creates dir and locks it. A directory locked by another process fails at once, the error names its pid.
+func Acquire(dir string) (*Lock, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("mkdir all: %w", err)
+	}
+
+	path := filepath.Join(dir, FileName)
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open lock file: %w", err)
+	}
+
+	err = lockFile(file)
+	if errors.Is(err, ErrLocked) {
+		pid := readPID(file)
+		file.Close()
+
+		if pid == 0 {
+			return nil, fmt.Errorf("%w: %s", ErrLocked, dir)
+		}
+
+		return nil, fmt.Errorf("%w: %s, pid %d", ErrLocked, dir, pid)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+
+	// the pid is for the error of the next process, the lock itself is the flock
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("write lock file: %w", err)
+	}
+
+	return &Lock{file: file}, nil
+}
+
+// AcquireAll locks every directory once, on a failure the acquired locks are released.
+// A directory listed twice is locked once, a second flock of the file would fail in the same process.
+func AcquireAll(dirs ...string) ([]*Lock, error) {
+	locks := make([]*Lock, 0, len(dirs))
+	seen := make(map[string]bool, len(dirs))
+
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+
+		lock, err := Acquire(dir)
+		if err != nil {
+			ReleaseAll(locks)
+			return nil, err
+		}
+
+		locks = append(locks, lock)
+	}
+
+	return locks, nil
+}
+
+// ReleaseAll releases locks, errors are ignored: the locks go away with the process anyway
+func ReleaseAll(locks []*Lock) {
+	for _, lock := range locks {
+		_ = lock.Release()
+	}
+}
+
+// Release unlocks the directory. The lock file stays: another process may have it open already,
+// removing it would let a third one lock a new file next to it.
+func (l *Lock) Release() error {
+	err := l.file.Truncate(0)
+
+	closeErr := l.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// readPID returns the pid written by the holder of the lock, 0 when the file has none yet
+func readPID(file *os.File) int {
+	data, err := io.ReadAll(io.NewSectionReader(file, 0, 32))
+	if err != nil {
+		return 0
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+
+	return pid
+}
@@ -0,0 +1,10 @@
+//go:build !unix || solaris || aix
+
+package dirlock
+
+import "os"
+
+// lockFile is a no-op where flock is not available, only the pid is written
+func lockFile(_ *os.File) error {
+	return nil
+}
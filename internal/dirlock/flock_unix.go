@@ -0,0 +1,19 @@
+//go:build unix && !solaris && !aix
+
+package dirlock
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile takes a flock without waiting, it's released when the file is closed or the process exits
+func lockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrLocked
+	}
+
+	return err
+}
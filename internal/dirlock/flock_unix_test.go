@@ -0,0 +1,62 @@
+//go:build unix && !solaris && !aix
+
+package dirlock
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquire(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wal")
+
+	lock, err := Acquire(dir)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(dir, FileName))
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%d\n", os.Getpid()), string(data))
+
+	// a flock is held by the open file, a second one fails even in the same process
+	_, err = Acquire(dir)
+	assert.ErrorIs(t, err, ErrLocked)
+	assert.ErrorContains(t, err, fmt.Sprintf("pid %d", os.Getpid()))
+
+	require.NoError(t, lock.Release())
+	assert.FileExists(t, filepath.Join(dir, FileName))
+
+	lock, err = Acquire(dir)
+	require.NoError(t, err)
+	require.NoError(t, lock.Release())
+}
+
+func TestAcquireAll(t *testing.T) {
+	root := t.TempDir()
+	wal := filepath.Join(root, "wal")
+	snapshots := filepath.Join(root, "snapshots")
+
+	// the same directory is locked once
+	locks, err := AcquireAll(wal, snapshots, wal+"/")
+	require.NoError(t, err)
+	assert.Len(t, locks, 2)
+
+	ReleaseAll(locks)
+
+	held, err := Acquire(snapshots)
+	require.NoError(t, err)
+
+	// the wal lock is released when the snapshots are held by another process
+	_, err = AcquireAll(wal, snapshots)
+	assert.ErrorIs(t, err, ErrLocked)
+
+	lock, err := Acquire(wal)
+	require.NoError(t, err)
+
+	require.NoError(t, lock.Release())
+	require.NoError(t, held.Release())
+}
@@ -0,0 +1,223 @@
+// Package dump reads and writes keys with their values as jsonl or csv
+package dump
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	FormatJSONL = "jsonl" // a {"key":"...","value":"..."} object per line
+	FormatCSV   = "csv"   // key,value rows after a key,value header
+)
+
+var ErrUnknownFormat = errors.New("unknown format")
+
+var csvHeader = []string{"key", "value"}
+
+type Record struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// RowError is a malformed row, reading goes on with the next one
+type RowError struct {
+	Line int
+	Err  error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// FormatFromPath picks a format by the file extension: .jsonl, .ndjson or .csv
+func FormatFromPath(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".ndjson":
+		return FormatJSONL, nil
+	case ".csv":
+		return FormatCSV, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownFormat, path)
+	}
+}
+
+type Writer interface {
+	Write(record Record) error
+	// Flush writes buffered records, it must be called after the last Write
+	Flush() error
+}
+
+func NewWriter(w io.Writer, format string) (Writer, error) {
+	switch format {
+	case FormatJSONL:
+		buf := bufio.NewWriter(w)
+		encoder := json.NewEncoder(buf)
+		encoder.SetEscapeHTML(false)
+
+		return &jsonlWriter{buf: buf, encoder: encoder}, nil
+
+	case FormatCSV:
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, format)
+	}
+}
+
+type jsonlWriter struct {
+	buf     *bufio.Writer
+	encoder *json.Encoder
+}
+
+func (w *jsonlWriter) Write(record Record) error {
+	return w.encoder.Encode(record)
+}
+
+func (w *jsonlWriter) Flush() error {
+	return w.buf.Flush()
+}
+
+type csvWriter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+func (w *csvWriter) Write(record Record) error {
+	err := w.writeHeader()
+	if err != nil {
+		return err
+	}
+
+	return w.w.Write([]string{record.Key, record.Value})
+}
+
+func (w *csvWriter) Flush() error {
+	err := w.writeHeader()
+	if err != nil {
+		return err
+	}
+
+	w.w.Flush()
+
+	return w.w.Error()
+}
+
+// writeHeader writes the header once, an empty export still has it
+func (w *csvWriter) writeHeader() error {
+	if w.wroteHeader {
+		return nil
+	}
+
+	w.wroteHeader = true
+
+	return w.w.Write(csvHeader)
+}
+
+type Reader interface {
+	// Read returns the next record, io.EOF at the end and *RowError for a malformed row
+	Read() (Record, error)
+	// Line returns the line of the last record
+	Line() int
+}
+
+func NewReader(r io.Reader, format string) (Reader, error) {
+	switch format {
+	case FormatJSONL:
+		return &jsonlReader{r: bufio.NewReader(r)}, nil
+
+	case FormatCSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+
+		return &csvReader{r: reader}, nil
+
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, format)
+	}
+}
+
+type jsonlReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+func (r *jsonlReader) Read() (Record, error) {
+	for {
+		text, err := r.r.ReadString('\n')
+		if err != nil && (!errors.Is(err, io.EOF) || text == "") {
+			return Record{}, err
+		}
+
+		r.line++
+
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		record := Record{}
+
+		err = json.Unmarshal([]byte(text), &record)
+		if err != nil {
+			return Record{}, &RowError{Line: r.line, Err: err}
+		}
+
+		return record, nil
+	}
+}
+
+func (r *jsonlReader) Line() int {
+	return r.line
+}
+
+type csvReader struct {
+	r     *csv.Reader
+	first bool
+	line  int
+}
+
+func (r *csvReader) Line() int {
+	return r.line
+}
+
+func (r *csvReader) Read() (Record, error) {
+	for {
+		row, err := r.r.Read()
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				return Record{}, &RowError{Line: parseErr.Line, Err: parseErr.Err}
+			}
+
+			return Record{}, err
+		}
+
+		r.line, _ = r.r.FieldPos(0)
+
+		// the header is optional
+		if !r.first {
+			r.first = true
+
+			if len(row) == 2 && row[0] == csvHeader[0] && row[1] == csvHeader[1] {
+				continue
+			}
+		}
+
+		if len(row) != 2 {
+			return Record{}, &RowError{Line: r.line, Err: fmt.Errorf("want 2 fields, got %d", len(row))}
+		}
+
+		return Record{Key: row[0], Value: row[1]}, nil
+	}
+}
@@ -0,0 +1,97 @@
+package dump
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAll(t *testing.T, r Reader) ([]Record, []int) {
+	t.Helper()
+
+	var records []Record
+	var badLines []int
+
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return records, badLines
+		}
+
+		var rowErr *RowError
+		if errors.As(err, &rowErr) {
+			badLines = append(badLines, rowErr.Line)
+			continue
+		}
+		require.NoError(t, err)
+
+		records = append(records, record)
+	}
+}
+
+func TestWriterReader_RoundTrip(t *testing.T) {
+	records := []Record{{Key: "a", Value: "1"}, {Key: "b,c", Value: `say "hi" <b>`}}
+
+	for _, format := range []string{FormatJSONL, FormatCSV} {
+		t.Run(format, func(t *testing.T) {
+			buf := bytes.Buffer{}
+
+			w, err := NewWriter(&buf, format)
+			require.NoError(t, err)
+
+			for _, record := range records {
+				require.NoError(t, w.Write(record))
+			}
+			require.NoError(t, w.Flush())
+
+			r, err := NewReader(&buf, format)
+			require.NoError(t, err)
+
+			got, badLines := readAll(t, r)
+			assert.Equal(t, records, got)
+			assert.Empty(t, badLines)
+		})
+	}
+}
+
+func TestReader_RowErrors(t *testing.T) {
+	r, err := NewReader(strings.NewReader("{\"key\":\"a\",\"value\":\"1\"}\n\nnot json\n{\"key\":\"b\",\"value\":\"2\"}"), FormatJSONL)
+	require.NoError(t, err)
+
+	got, badLines := readAll(t, r)
+	assert.Equal(t, []Record{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}, got)
+	assert.Equal(t, []int{3}, badLines)
+	assert.Equal(t, 4, r.Line())
+
+	// csv without a header
+	r, err = NewReader(strings.NewReader("a,1\nb\nc,3\n"), FormatCSV)
+	require.NoError(t, err)
+
+	got, badLines = readAll(t, r)
+	assert.Equal(t, []Record{{Key: "a", Value: "1"}, {Key: "c", Value: "3"}}, got)
+	assert.Equal(t, []int{2}, badLines)
+}
+
+func TestCSVWriter_EmptyHasHeader(t *testing.T) {
+	buf := bytes.Buffer{}
+
+	w, err := NewWriter(&buf, FormatCSV)
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+
+	assert.Equal(t, "key,value\n", buf.String())
+}
+
+func TestFormatFromPath(t *testing.T) {
+	format, err := FormatFromPath("data/export.NDJSON")
+	require.NoError(t, err)
+	assert.Equal(t, FormatJSONL, format)
+
+	_, err = FormatFromPath("export.txt")
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+}
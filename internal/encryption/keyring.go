@@ -0,0 +1,132 @@
+// Package encryption encrypts data at rest with AES-GCM: wal segments and snapshots
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/configs"
+)
+
+// ErrUnknownKey is returned for data encrypted with a key that is not in the keyring
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// Keyring holds AES-GCM keys by id, new data is encrypted with the active key.
+// Keys of older data stay in the keyring to read it after a rotation.
+type Keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+// the keyring of the process, set once on start
+var current atomic.Pointer[Keyring]
+
+// SetKeyring sets the keyring used to write and read files, nil turns encryption off
+func SetKeyring(keyring *Keyring) {
+	current.Store(keyring)
+}
+
+// Current returns the keyring of the process, nil when encryption is off
+func Current() *Keyring {
+	return current.Load()
+}
+
+// Configure loads the keys of wal.encryption and sets the keyring of the process
+func Configure(cfg *configs.Wal) error {
+	if cfg == nil || cfg.Encryption == nil {
+		SetKeyring(nil)
+		return nil
+	}
+
+	keyring, err := LoadKeyring(cfg.Encryption)
+	if err != nil {
+		return err
+	}
+
+	SetKeyring(keyring)
+
+	return nil
+}
+
+// LoadKeyring reads base64 encoded keys from files and environment variables
+func LoadKeyring(cfg *configs.Encryption) (*Keyring, error) {
+	keys := make(map[string][]byte, len(cfg.Keys))
+
+	for _, key := range cfg.Keys {
+		var encoded string
+
+		switch {
+		case key.File != "":
+			data, err := os.ReadFile(key.File)
+			if err != nil {
+				return nil, fmt.Errorf("read key %s: %w", key.ID, err)
+			}
+
+			encoded = string(data)
+
+		case key.Env != "":
+			encoded = os.Getenv(key.Env)
+			if encoded == "" {
+				return nil, fmt.Errorf("key %s: environment variable %s is empty", key.ID, key.Env)
+			}
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("decode key %s: %w", key.ID, err)
+		}
+
+		keys[key.ID] = decoded
+	}
+
+	return NewKeyring(cfg.ActiveKey, keys)
+}
+
+// NewKeyring creates a keyring of 16, 24 or 32 byte keys, active is the id of the key new data is encrypted with
+func NewKeyring(active string, keys map[string][]byte) (*Keyring, error) {
+	k := &Keyring{active: active, keys: make(map[string]cipher.AEAD, len(keys))}
+
+	for id, key := range keys {
+		if id == "" || len(id) > maxKeyIDLength {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", id, err)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", id, err)
+		}
+
+		k.keys[id] = aead
+	}
+
+	if _, ok := k.keys[active]; !ok {
+		return nil, fmt.Errorf("%w: active key %q", ErrUnknownKey, active)
+	}
+
+	return k, nil
+}
+
+// Active returns the id of the key new data is encrypted with
+func (k *Keyring) Active() string {
+	return k.active
+}
+
+func (k *Keyring) aead(id string) (cipher.AEAD, error) {
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+
+	return aead, nil
+}
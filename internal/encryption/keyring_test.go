@@ -0,0 +1,51 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/configs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKeyring(t *testing.T, active string) *Keyring {
+	keyring, err := NewKeyring(active, map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 16),
+	})
+	require.NoError(t, err)
+
+	return keyring
+}
+
+func TestNewKeyring_Invalid(t *testing.T) {
+	_, err := NewKeyring("k1", map[string][]byte{"k1": []byte("short")})
+	assert.Error(t, err)
+
+	_, err = NewKeyring("k2", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestLoadKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "k1")
+	require.NoError(t, os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))+"\n"), 0600))
+	t.Setenv("KVDB_TEST_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 24)))
+
+	keyring, err := LoadKeyring(&configs.Encryption{
+		ActiveKey: "k2",
+		Keys:      []configs.EncryptionKey{{ID: "k1", File: path}, {ID: "k2", Env: "KVDB_TEST_KEY"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "k2", keyring.Active())
+
+	_, err = LoadKeyring(&configs.Encryption{ActiveKey: "k1", Keys: []configs.EncryptionKey{{ID: "k1", Env: "KVDB_TEST_MISSING"}}})
+	assert.Error(t, err)
+
+	t.Setenv("KVDB_TEST_KEY", "not base64")
+	_, err = LoadKeyring(&configs.Encryption{ActiveKey: "k1", Keys: []configs.EncryptionKey{{ID: "k1", Env: "KVDB_TEST_KEY"}}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,224 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// file layout: magic "\x00KVENC", version byte, key id length byte, key id, random file id (16 bytes),
+// then frames: ciphertext length uint32 big endian, nonce, ciphertext with the gcm tag.
+// The additional data of a frame is the key id, the file id and the frame number,
+// so frames can't be reordered or moved to another file.
+const (
+	magic   = "\x00KVENC" // text files never start with a zero byte
+	version = 1
+
+	maxKeyIDLength = 255
+	fileIDLength   = 16
+	maxFrameLength = 1 << 30
+)
+
+// ErrCorrupted is returned for encrypted data that is truncated, altered or of an unknown version
+var ErrCorrupted = errors.New("encrypted data is corrupted")
+
+// IsEncrypted reports whether data starts like an encrypted file
+func IsEncrypted(head []byte) bool {
+	return bytes.HasPrefix(head, []byte(magic))
+}
+
+// MagicLength is the number of bytes IsEncrypted needs
+const MagicLength = len(magic)
+
+// Writer encrypts every Write as a frame
+type Writer struct {
+	w      io.Writer
+	aead   aeadCipher
+	aad    []byte // key id and file id, the frame number is appended
+	frames uint64
+}
+
+type aeadCipher interface {
+	NonceSize() int
+	Overhead() int
+	Seal(dst, nonce, plaintext, additionalData []byte) []byte
+	Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// NewWriter writes the header of a new file encrypted with the active key of the keyring
+func NewWriter(w io.Writer, keyring *Keyring) (*Writer, error) {
+	aead, err := keyring.aead(keyring.active)
+	if err != nil {
+		return nil, err
+	}
+
+	fileID := make([]byte, fileIDLength)
+
+	_, err = rand.Read(fileID)
+	if err != nil {
+		return nil, fmt.Errorf("file id: %w", err)
+	}
+
+	header := bytes.Buffer{}
+	header.WriteString(magic)
+	header.WriteByte(version)
+	header.WriteByte(byte(len(keyring.active)))
+	header.WriteString(keyring.active)
+	header.Write(fileID)
+
+	_, err = w.Write(header.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{w: w, aead: aead, aad: additionalData(keyring.active, fileID)}, nil
+}
+
+// ResumeWriter appends frames to a file read to the end by r
+func ResumeWriter(w io.Writer, r *Reader) *Writer {
+	return &Writer{w: w, aead: r.aead, aad: r.aad, frames: r.frames}
+}
+
+// Write encrypts p as one frame
+func (w *Writer) Write(p []byte) (int, error) {
+	nonce := make([]byte, w.aead.NonceSize(), w.aead.NonceSize()+len(p)+w.aead.Overhead()+4)
+
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return 0, fmt.Errorf("nonce: %w", err)
+	}
+
+	sealed := w.aead.Seal(nonce, nonce, p, w.frameData())
+
+	frame := make([]byte, 4, 4+len(sealed))
+	binary.BigEndian.PutUint32(frame, uint32(len(sealed)))
+	frame = append(frame, sealed...)
+
+	_, err = w.w.Write(frame)
+	if err != nil {
+		return 0, err
+	}
+
+	w.frames++
+
+	return len(p), nil
+}
+
+func (w *Writer) frameData() []byte {
+	return binary.BigEndian.AppendUint64(w.aad, w.frames)
+}
+
+// Reader decrypts a file written by Writer
+type Reader struct {
+	r      io.Reader
+	aead   aeadCipher
+	aad    []byte
+	keyID  string
+	frames uint64
+
+	plain []byte // decrypted and not read yet
+}
+
+// NewReader reads the header and finds the key of the file in the keyring
+func NewReader(r io.Reader, keyring *Keyring) (*Reader, error) {
+	head := make([]byte, len(magic)+2)
+
+	_, err := io.ReadFull(r, head)
+	if err != nil {
+		return nil, fmt.Errorf("%w: header: %w", ErrCorrupted, err)
+	}
+	if !IsEncrypted(head) {
+		return nil, fmt.Errorf("%w: not an encrypted file", ErrCorrupted)
+	}
+	if head[len(magic)] != version {
+		return nil, fmt.Errorf("%w: unknown version %d", ErrCorrupted, head[len(magic)])
+	}
+
+	rest := make([]byte, int(head[len(magic)+1])+fileIDLength)
+
+	_, err = io.ReadFull(r, rest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: header: %w", ErrCorrupted, err)
+	}
+
+	keyID := string(rest[:len(rest)-fileIDLength])
+
+	if keyring == nil {
+		return nil, fmt.Errorf("%w: %q, encryption keys are not configured", ErrUnknownKey, keyID)
+	}
+
+	aead, err := keyring.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{r: r, aead: aead, aad: additionalData(keyID, rest[len(rest)-fileIDLength:]), keyID: keyID}, nil
+}
+
+// KeyID returns the id of the key the file is encrypted with
+func (r *Reader) KeyID() string {
+	return r.keyID
+}
+
+// Read returns the decrypted data frame by frame
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		err := r.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+
+	return n, nil
+}
+
+func (r *Reader) next() error {
+	length := make([]byte, 4)
+
+	_, err := io.ReadFull(r.r, length)
+	if errors.Is(err, io.EOF) {
+		return io.EOF
+	}
+	if err != nil {
+		return fmt.Errorf("%w: frame %d: %w", ErrCorrupted, r.frames, err)
+	}
+
+	size := binary.BigEndian.Uint32(length)
+	if size < uint32(r.aead.NonceSize()+r.aead.Overhead()) || size > maxFrameLength {
+		return fmt.Errorf("%w: frame %d: invalid length %d", ErrCorrupted, r.frames, size)
+	}
+
+	sealed := make([]byte, size)
+
+	_, err = io.ReadFull(r.r, sealed)
+	if err != nil {
+		return fmt.Errorf("%w: frame %d: %w", ErrCorrupted, r.frames, err)
+	}
+
+	nonce := sealed[:r.aead.NonceSize()]
+
+	plain, err := r.aead.Open(nil, nonce, sealed[len(nonce):], binary.BigEndian.AppendUint64(r.aad, r.frames))
+	if err != nil {
+		return fmt.Errorf("%w: frame %d: %w", ErrCorrupted, r.frames, err)
+	}
+
+	r.frames++
+	r.plain = plain
+
+	return nil
+}
+
+func additionalData(keyID string, fileID []byte) []byte {
+	aad := make([]byte, 0, len(keyID)+len(fileID)+8)
+	aad = append(aad, keyID...)
+	aad = append(aad, fileID...)
+
+	// the frame number is appended to a copy, the capacity is left for it
+	return aad[:len(aad):len(aad)]
+}
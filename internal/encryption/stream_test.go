@@ -0,0 +1,112 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encryptFrames(t *testing.T, keyring *Keyring, frames ...string) []byte {
+	buf := bytes.Buffer{}
+
+	w, err := NewWriter(&buf, keyring)
+	require.NoError(t, err)
+
+	for _, frame := range frames {
+		_, err = w.Write([]byte(frame))
+		require.NoError(t, err)
+	}
+
+	return buf.Bytes()
+}
+
+func decrypt(keyring *Keyring, data []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(data), keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(r)
+}
+
+func TestWriterReader(t *testing.T) {
+	keyring := testKeyring(t, "k1")
+
+	data := encryptFrames(t, keyring, "first SET a 1 \n", "second DEL a \n")
+	assert.True(t, IsEncrypted(data))
+	assert.NotContains(t, string(data), "SET a 1")
+
+	r, err := NewReader(bytes.NewReader(data), keyring)
+	require.NoError(t, err)
+	assert.Equal(t, "k1", r.KeyID())
+
+	plain, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "first SET a 1 \nsecond DEL a \n", string(plain))
+
+	// frames appended after a restart continue the numbering
+	buf := bytes.NewBuffer(data)
+	_, err = ResumeWriter(buf, r).Write([]byte("third SET b 2 \n"))
+	require.NoError(t, err)
+
+	plain, err = decrypt(keyring, buf.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, "first SET a 1 \nsecond DEL a \nthird SET b 2 \n", string(plain))
+}
+
+func TestReader_Rotation(t *testing.T) {
+	old := encryptFrames(t, testKeyring(t, "k1"), "old")
+
+	// the rotated key stays in the keyring to read old files
+	plain, err := decrypt(testKeyring(t, "k2"), old)
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(plain))
+
+	withoutOld, err := NewKeyring("k2", map[string][]byte{"k2": bytes.Repeat([]byte{2}, 16)})
+	require.NoError(t, err)
+
+	_, err = decrypt(withoutOld, old)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	_, err = decrypt(nil, old)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestReader_Corrupted(t *testing.T) {
+	keyring := testKeyring(t, "k1")
+	data := encryptFrames(t, keyring, "first frame", "second frame")
+
+	header := len(magic) + 2 + len("k1") + fileIDLength
+	firstFrame := 4 + int(binary.BigEndian.Uint32(data[header:]))
+
+	swapped := append([]byte{}, data[:header]...)
+	swapped = append(swapped, data[header+firstFrame:]...)
+	swapped = append(swapped, data[header:header+firstFrame]...)
+
+	// the same key and another file id
+	other := encryptFrames(t, keyring, "first frame", "second frame")
+	moved := append(append([]byte{}, data[:header]...), other[header:]...)
+
+	flipped := append([]byte{}, data...)
+	flipped[len(flipped)-1] ^= 0xff
+
+	tests := map[string][]byte{
+		"truncated":       data[:len(data)-3],
+		"flipped byte":    flipped,
+		"swapped frames":  swapped,
+		"frames moved":    moved,
+		"short header":    data[:5],
+		"unknown version": append(append([]byte(magic), 9), data[len(magic)+1:]...),
+	}
+
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := decrypt(keyring, content)
+			assert.ErrorIs(t, err, ErrCorrupted)
+		})
+	}
+}
@@ -0,0 +1,459 @@
+package rest
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/auth"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts/defaults"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/dump"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/tlsconfig"
+	"github.com/JaneJavannie/in_memory_key_value_db/utils"
+)
+
+// rest - HTTP/JSON gateway in front of the database layer
+
+const (
+	requestIDHeader = "X-Request-ID"
+	exportPath      = "/v1/export"
+)
+
+var errInvalidArgument = errors.New("invalid argument")
+
+type databaseLayer interface {
+	HandleRequest(ctx context.Context, text string) (string, error)
+	Export(ctx context.Context, write func(key string, value string) error) error
+}
+
+type Server struct {
+	address        string
+	tlsConfig      *tls.Config
+	requestTimeout time.Duration
+	maxMessageSize int
+	db             databaseLayer
+	server         *http.Server
+	listener       net.Listener
+
+	log *slog.Logger
+
+	wg sync.WaitGroup
+}
+
+type keyResponse struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type setRequest struct {
+	Value string `json:"value"`
+}
+
+type queryRequest struct {
+	Query string `json:"query"`
+}
+
+type queryResponse struct {
+	Result string `json:"result"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+func NewServer(address string, db databaseLayer, logger *slog.Logger) *Server {
+	s := &Server{
+		address:        address,
+		maxMessageSize: defaults.MaxMessageSize,
+		db:             db,
+		log:            logger,
+	}
+
+	s.server = &http.Server{
+		Handler:           s.withTimeout(s.routes()),
+		ReadHeaderTimeout: defaults.IdleTimeout,
+		IdleTimeout:       defaults.IdleTimeout,
+	}
+
+	return s
+}
+
+// SetTLSConfig enables https
+func (s *Server) SetTLSConfig(cfg *tls.Config) {
+	s.tlsConfig = cfg
+}
+
+// SetRequestTimeout sets the deadline of a request context passed to the database
+func (s *Server) SetRequestTimeout(timeout time.Duration) {
+	s.requestTimeout = timeout
+}
+
+// SetMaxMessageSize limits request bodies, like requests of the text protocol
+func (s *Server) SetMaxMessageSize(size int) {
+	s.maxMessageSize = size
+}
+
+// SetIdleTimeout closes connections that send no request or headers for the timeout
+func (s *Server) SetIdleTimeout(timeout time.Duration) {
+	s.server.ReadHeaderTimeout = timeout
+	s.server.IdleTimeout = timeout
+}
+
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+
+	s.listener = listener
+	s.log.Info("http server started", "address", s.address, "tls", s.tlsConfig != nil)
+
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+
+		err := s.server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.log.Error("http server: serve", "error", err)
+		}
+	}()
+
+	return nil
+}
+
+func (s *Server) Stop() error {
+	if s.listener == nil {
+		return nil
+	}
+
+	err := s.server.Close()
+	s.wg.Wait()
+
+	return err
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests until ctx is done,
+// then closes the remaining connections
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.listener == nil {
+		return nil
+	}
+
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		err = errors.Join(err, s.server.Close())
+	}
+
+	s.wg.Wait()
+
+	return err
+}
+
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /v1/keys/{key}", s.handleGet)
+	mux.HandleFunc("PUT /v1/keys/{key}", s.handleSet)
+	mux.HandleFunc("DELETE /v1/keys/{key}", s.handleDel)
+	mux.HandleFunc("POST /v1/query", s.handleQuery)
+	mux.HandleFunc("GET "+exportPath, s.handleExport)
+
+	return mux
+}
+
+// withTimeout limits requests by the request timeout, except exports that take as long as all keys take
+func (s *Server) withTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.requestTimeout > 0 && r.URL.Path != exportPath {
+			ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+			defer cancel()
+
+			r = r.WithContext(ctx)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	ctx, ok := s.requestContext(w, r)
+	if !ok {
+		return
+	}
+	key := r.PathValue("key")
+
+	if err := validateArgument(key); err != nil {
+		s.writeError(ctx, w, err)
+		return
+	}
+
+	result, err := s.db.HandleRequest(ctx, fmt.Sprintf("%s %s", consts.CommandGet, key))
+	if err != nil {
+		s.writeError(ctx, w, err)
+		return
+	}
+
+	// values can't be empty, so an empty result means that the key does not exist
+	if result == "" {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "key not found", Code: "not_found"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, keyResponse{Key: key, Value: result})
+}
+
+func (s *Server) handleSet(w http.ResponseWriter, r *http.Request) {
+	ctx, ok := s.requestContext(w, r)
+	if !ok {
+		return
+	}
+	key := r.PathValue("key")
+
+	req := setRequest{}
+	if err := decodeBody(w, r, s.maxMessageSize, &req); err != nil {
+		s.writeError(ctx, w, err)
+		return
+	}
+
+	for _, arg := range []string{key, req.Value} {
+		if err := validateArgument(arg); err != nil {
+			s.writeError(ctx, w, err)
+			return
+		}
+	}
+
+	_, err := s.db.HandleRequest(ctx, fmt.Sprintf("%s %s %s", consts.CommandSet, key, req.Value))
+	if err != nil {
+		s.writeError(ctx, w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, keyResponse{Key: key, Value: req.Value})
+}
+
+func (s *Server) handleDel(w http.ResponseWriter, r *http.Request) {
+	ctx, ok := s.requestContext(w, r)
+	if !ok {
+		return
+	}
+	key := r.PathValue("key")
+
+	if err := validateArgument(key); err != nil {
+		s.writeError(ctx, w, err)
+		return
+	}
+
+	_, err := s.db.HandleRequest(ctx, fmt.Sprintf("%s %s", consts.CommandDel, key))
+	if err != nil {
+		s.writeError(ctx, w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
+	ctx, ok := s.requestContext(w, r)
+	if !ok {
+		return
+	}
+
+	req := queryRequest{}
+	if err := decodeBody(w, r, s.maxMessageSize, &req); err != nil {
+		s.writeError(ctx, w, err)
+		return
+	}
+
+	result, err := s.db.HandleRequest(ctx, req.Query)
+	if err != nil {
+		s.writeError(ctx, w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, queryResponse{Result: result})
+}
+
+// handleExport streams a snapshot of all keys as jsonl. An error after the first key aborts the response,
+// so a client never takes a truncated export for a complete one.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	ctx, ok := s.requestContext(w, r)
+	if !ok {
+		return
+	}
+
+	var out dump.Writer
+
+	start := func() {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		out, _ = dump.NewWriter(w, dump.FormatJSONL)
+	}
+
+	err := s.db.Export(ctx, func(key string, value string) error {
+		if out == nil {
+			start()
+		}
+
+		return out.Write(dump.Record{Key: key, Value: value})
+	})
+	if err != nil {
+		if out == nil {
+			s.writeError(ctx, w, err)
+			return
+		}
+
+		s.log.Error("http server: export", consts.RequestID, ctx.Value(consts.RequestID), "error", err)
+		panic(http.ErrAbortHandler)
+	}
+
+	if out == nil {
+		start()
+	}
+
+	err = out.Flush()
+	if err != nil {
+		s.log.Error("http server: export", consts.RequestID, ctx.Value(consts.RequestID), "error", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// requestContext prepares a request context, the request is rejected when basic auth credentials
+// or a client request id are invalid. A client request id makes a retried write be applied once.
+func (s *Server) requestContext(w http.ResponseWriter, r *http.Request) (context.Context, bool) {
+	requestID := r.Header.Get(requestIDHeader)
+
+	var err error
+	if requestID == "" {
+		requestID = utils.GetRequestUUID()
+	} else if err = utils.ValidateRequestID(requestID); err != nil {
+		// an invalid id is not echoed back
+		requestID = utils.GetRequestUUID()
+	}
+
+	w.Header().Set(requestIDHeader, requestID)
+
+	ctx := context.WithValue(r.Context(), consts.RequestID, requestID)
+
+	if err != nil {
+		s.writeError(ctx, w, err)
+		return nil, false
+	}
+
+	identity := ""
+	if r.TLS != nil {
+		identity = tlsconfig.Identity(*r.TLS)
+		if identity != "" {
+			ctx = context.WithValue(ctx, consts.ClientIdentity, identity)
+		}
+	}
+
+	ctx = context.WithValue(ctx, consts.Session, auth.NewSession(identity))
+
+	if user, password, ok := r.BasicAuth(); ok {
+		_, err := s.db.HandleRequest(ctx, fmt.Sprintf("%s %s %s", consts.CommandAuth, user, password))
+		if err != nil {
+			s.writeError(ctx, w, err)
+			return nil, false
+		}
+	}
+
+	return ctx, true
+}
+
+func (s *Server) writeError(ctx context.Context, w http.ResponseWriter, err error) {
+	status, code := statusCode(err)
+	if status == http.StatusInternalServerError {
+		s.log.Error("http server: handle request", consts.RequestID, ctx.Value(consts.RequestID), "error", err)
+	}
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="kvdb"`)
+	}
+
+	writeJSON(w, status, errorResponse{Error: err.Error(), Code: code})
+}
+
+// statusCode maps database errors to http status codes and machine-readable error codes
+func statusCode(err error) (int, string) {
+	switch {
+	case errors.Is(err, errInvalidArgument),
+		errors.Is(err, consts.ErrParseSymbol),
+		errors.Is(err, consts.ErrUnknownCommand),
+		errors.Is(err, consts.ErrInvalidSetQueryArgs),
+		errors.Is(err, consts.ErrInvalidGetQueryArgs),
+		errors.Is(err, consts.ErrInvalidDelQueryArgs),
+		errors.Is(err, consts.ErrInvalidAuthQueryArgs),
+		errors.Is(err, consts.ErrInvalidSaveQueryArgs),
+		errors.Is(err, consts.ErrSnapshotsDisabled),
+		errors.Is(err, consts.ErrInvalidBackupQueryArgs),
+		errors.Is(err, consts.ErrDirectoryNotEmpty),
+		errors.Is(err, consts.ErrInvalidRequestID):
+		return http.StatusBadRequest, "bad_request"
+
+	case errors.Is(err, consts.ErrRequestIDConflict):
+		return http.StatusConflict, "request_id_conflict"
+
+	case errors.Is(err, consts.ErrSnapshotInProgress):
+		return http.StatusConflict, "snapshot_in_progress"
+
+	case errors.Is(err, consts.ErrAuthRequired):
+		return http.StatusUnauthorized, "auth_required"
+
+	case errors.Is(err, consts.ErrInvalidCredentials):
+		return http.StatusUnauthorized, "invalid_credentials"
+
+	case errors.Is(err, consts.ErrPermissionDenied):
+		return http.StatusForbidden, "permission_denied"
+
+	case errors.Is(err, consts.ErrReadOnly), errors.Is(err, consts.ErrRecoveryReadOnly):
+		return http.StatusForbidden, "read_only"
+
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "timeout"
+
+	default:
+		return http.StatusInternalServerError, "internal"
+	}
+}
+
+func validateArgument(arg string) error {
+	if arg == "" {
+		return fmt.Errorf("%w: empty value", errInvalidArgument)
+	}
+	if strings.ContainsAny(arg, " \t\r\n") {
+		return fmt.Errorf("%w: whitespace is not allowed: %q", errInvalidArgument, arg)
+	}
+
+	return nil
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, maxSize int, v any) error {
+	body := http.MaxBytesReader(w, r.Body, int64(maxSize))
+
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		return fmt.Errorf("%w: decode body: %w", errInvalidArgument, err)
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,317 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/dump"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeDatabase struct {
+	requests []string
+	result   string
+	err      error
+
+	records   []dump.Record
+	exportErr error // returned after the records
+}
+
+func (f *fakeDatabase) HandleRequest(_ context.Context, text string) (string, error) {
+	f.requests = append(f.requests, text)
+	return f.result, f.err
+}
+
+func (f *fakeDatabase) Export(_ context.Context, write func(key string, value string) error) error {
+	for _, record := range f.records {
+		if err := write(record.Key, record.Value); err != nil {
+			return err
+		}
+	}
+
+	return f.exportErr
+}
+
+func TestServer_Routes(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		body        string
+		db          *fakeDatabase
+		wantStatus  int
+		wantRequest string
+		wantBody    string
+	}{
+		{
+			name:        "get success",
+			method:      http.MethodGet,
+			path:        "/v1/keys/hello",
+			db:          &fakeDatabase{result: "world"},
+			wantStatus:  http.StatusOK,
+			wantRequest: "GET hello",
+			wantBody:    `{"key":"hello","value":"world"}`,
+		},
+		{
+			name:        "get not found",
+			method:      http.MethodGet,
+			path:        "/v1/keys/hello",
+			db:          &fakeDatabase{},
+			wantStatus:  http.StatusNotFound,
+			wantRequest: "GET hello",
+			wantBody:    `"code":"not_found"`,
+		},
+		{
+			name:        "set success",
+			method:      http.MethodPut,
+			path:        "/v1/keys/hello",
+			body:        `{"value":"world"}`,
+			db:          &fakeDatabase{},
+			wantStatus:  http.StatusOK,
+			wantRequest: "SET hello world",
+			wantBody:    `{"key":"hello","value":"world"}`,
+		},
+		{
+			name:       "set invalid body",
+			method:     http.MethodPut,
+			path:       "/v1/keys/hello",
+			body:       `{"value":`,
+			db:         &fakeDatabase{},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `"code":"bad_request"`,
+		},
+		{
+			name:       "set whitespace value",
+			method:     http.MethodPut,
+			path:       "/v1/keys/hello",
+			body:       `{"value":"a b"}`,
+			db:         &fakeDatabase{},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `"code":"bad_request"`,
+		},
+		{
+			name:        "set on slave",
+			method:      http.MethodPut,
+			path:        "/v1/keys/hello",
+			body:        `{"value":"world"}`,
+			db:          &fakeDatabase{err: consts.ErrReadOnly},
+			wantStatus:  http.StatusForbidden,
+			wantRequest: "SET hello world",
+			wantBody:    `"code":"read_only"`,
+		},
+		{
+			name:        "set in recovery mode",
+			method:      http.MethodPut,
+			path:        "/v1/keys/hello",
+			body:        `{"value":"world"}`,
+			db:          &fakeDatabase{err: consts.ErrRecoveryReadOnly},
+			wantStatus:  http.StatusForbidden,
+			wantRequest: "SET hello world",
+			wantBody:    `"code":"read_only"`,
+		},
+		{
+			name:        "get permission denied",
+			method:      http.MethodGet,
+			path:        "/v1/keys/hello",
+			db:          &fakeDatabase{err: consts.ErrPermissionDenied},
+			wantStatus:  http.StatusForbidden,
+			wantRequest: "GET hello",
+			wantBody:    `"code":"permission_denied"`,
+		},
+		{
+			name:        "del success",
+			method:      http.MethodDelete,
+			path:        "/v1/keys/hello",
+			db:          &fakeDatabase{},
+			wantStatus:  http.StatusNoContent,
+			wantRequest: "DEL hello",
+		},
+		{
+			name:        "query success",
+			method:      http.MethodPost,
+			path:        "/v1/query",
+			body:        `{"query":"GET hello"}`,
+			db:          &fakeDatabase{result: "world"},
+			wantStatus:  http.StatusOK,
+			wantRequest: "GET hello",
+			wantBody:    `{"result":"world"}`,
+		},
+		{
+			name:        "query unknown command",
+			method:      http.MethodPost,
+			path:        "/v1/query",
+			body:        `{"query":"PUT hello"}`,
+			db:          &fakeDatabase{err: consts.ErrUnknownCommand},
+			wantStatus:  http.StatusBadRequest,
+			wantRequest: "PUT hello",
+			wantBody:    `"code":"bad_request"`,
+		},
+		{
+			name:        "set request id conflict",
+			method:      http.MethodPut,
+			path:        "/v1/keys/hello",
+			body:        `{"value":"world"}`,
+			db:          &fakeDatabase{err: consts.ErrRequestIDConflict},
+			wantStatus:  http.StatusConflict,
+			wantRequest: "SET hello world",
+			wantBody:    `"code":"request_id_conflict"`,
+		},
+		{
+			name:        "query timeout",
+			method:      http.MethodPost,
+			path:        "/v1/query",
+			body:        `{"query":"SET a b"}`,
+			db:          &fakeDatabase{err: context.DeadlineExceeded},
+			wantStatus:  http.StatusGatewayTimeout,
+			wantRequest: "SET a b",
+			wantBody:    `"code":"timeout"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer("", tt.db, slog.Default())
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+
+			s.server.Handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Contains(t, rec.Body.String(), tt.wantBody)
+			assert.NotEmpty(t, rec.Header().Get(requestIDHeader))
+
+			if tt.wantRequest != "" {
+				assert.Equal(t, []string{tt.wantRequest}, tt.db.requests)
+			} else {
+				assert.Empty(t, tt.db.requests)
+			}
+		})
+	}
+}
+
+func TestServer_BasicAuth(t *testing.T) {
+	db := &fakeDatabase{err: consts.ErrInvalidCredentials}
+	s := NewServer("", db, slog.Default())
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/keys/hello", nil)
+	req.SetBasicAuth("alice", "wrong")
+	rec := httptest.NewRecorder()
+
+	s.server.Handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"code":"invalid_credentials"`)
+	assert.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, []string{"AUTH alice wrong"}, db.requests)
+}
+
+type contextDatabase struct {
+	requestIDs []any
+}
+
+func (f *contextDatabase) HandleRequest(ctx context.Context, _ string) (string, error) {
+	f.requestIDs = append(f.requestIDs, ctx.Value(consts.RequestID))
+	return "", nil
+}
+
+func (f *contextDatabase) Export(context.Context, func(key string, value string) error) error {
+	return nil
+}
+
+func TestServer_ClientRequestID(t *testing.T) {
+	db := &contextDatabase{}
+	s := NewServer("", db, slog.Default())
+
+	req := httptest.NewRequest(http.MethodPut, "/v1/keys/hello", strings.NewReader(`{"value":"world"}`))
+	req.Header.Set(requestIDHeader, "retry-42")
+	rec := httptest.NewRecorder()
+
+	s.server.Handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "retry-42", rec.Header().Get(requestIDHeader))
+	assert.Equal(t, []any{"retry-42"}, db.requestIDs)
+
+	req = httptest.NewRequest(http.MethodPut, "/v1/keys/hello", strings.NewReader(`{"value":"world"}`))
+	req.Header.Set(requestIDHeader, "bad id")
+	rec = httptest.NewRecorder()
+
+	s.server.Handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.NotEqual(t, "bad id", rec.Header().Get(requestIDHeader))
+	assert.Len(t, db.requestIDs, 1)
+}
+
+func TestServer_Export(t *testing.T) {
+	db := &fakeDatabase{records: []dump.Record{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}}
+	s := NewServer("", db, slog.Default())
+
+	rec := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, exportPath, nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "{\"key\":\"a\",\"value\":\"1\"}\n{\"key\":\"b\",\"value\":\"2\"}\n", rec.Body.String())
+
+	// an error before the first key is an error response
+	db = &fakeDatabase{exportErr: consts.ErrPermissionDenied}
+	s = NewServer("", db, slog.Default())
+
+	rec = httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, exportPath, nil))
+
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	// an error after it aborts the response
+	db = &fakeDatabase{records: []dump.Record{{Key: "a", Value: "1"}}, exportErr: errors.New("broken")}
+	s = NewServer("", db, slog.Default())
+
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		s.server.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, exportPath, nil))
+	})
+}
+
+func TestServer_MaxMessageSize(t *testing.T) {
+	db := &fakeDatabase{}
+	s := NewServer("", db, slog.Default())
+	s.SetMaxMessageSize(16)
+
+	req := httptest.NewRequest(http.MethodPut, "/v1/keys/hello", strings.NewReader(`{"value":"a_long_value"}`))
+	rec := httptest.NewRecorder()
+
+	s.server.Handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Empty(t, db.requests)
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	s := NewServer("127.0.0.1:0", &fakeDatabase{}, slog.Default())
+	s.SetIdleTimeout(100 * time.Millisecond)
+	require.NoError(t, s.Start())
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// a client that never finishes its headers is disconnected
+	_, err = conn.Write([]byte("GET /v1/keys/hello HTTP/1.1\r\nHost: db\r\n"))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	_, err = io.ReadAll(conn)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,115 @@
+package text
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts/defaults"
+)
+
+const (
+	networkTCP  = "tcp"
+	networkUnix = "unix"
+
+	unixScheme = defaults.UnixSocketScheme
+
+	staleSocketDialTimeout = 100 * time.Millisecond
+)
+
+// parseAddress splits an address into a network and a dial address:
+// "unix:///path/to.sock" is a unix domain socket, anything else is a tcp address
+func parseAddress(address string) (string, string) {
+	if path, ok := strings.CutPrefix(address, unixScheme); ok {
+		return networkUnix, path
+	}
+
+	return networkTCP, address
+}
+
+// removeStaleSocket removes a socket file left by a server that was not stopped properly.
+// A socket that still accepts connections belongs to a running server and is not removed.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("stat socket: %w", err)
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("'%s' exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout(networkUnix, path, staleSocketDialTimeout)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket '%s' is in use by another process", path)
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return fmt.Errorf("remove stale socket: %w", err)
+	}
+
+	return nil
+}
+
+// listenUnixSocket listens on a socket file at path with permissions mode, 0 keeps the ones of the process umask.
+// The socket is created in a private directory, chmodded and only then linked to path, so it's never reachable
+// with looser permissions. Link doesn't replace an existing file, a socket created meanwhile by another process is kept.
+func listenUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+	if mode == 0 {
+		return net.Listen(networkUnix, path)
+	}
+
+	// a short name in the same directory, socket paths are limited to about 100 bytes
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".sock")
+	if err != nil {
+		return nil, fmt.Errorf("create socket directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "s")
+
+	listener, err := net.Listen(networkUnix, tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(tmp, mode)
+	if err == nil {
+		err = os.Link(tmp, path)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("create socket: %w", err)
+	}
+
+	// the listener would unlink the private name, the socket file at path is removed on close instead
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	return &unixSocketListener{Listener: listener, path: path}, nil
+}
+
+// unixSocketListener removes its socket file when it's closed
+type unixSocketListener struct {
+	net.Listener
+	path string
+}
+
+func (l *unixSocketListener) Close() error {
+	err := l.Listener.Close()
+
+	removeErr := os.Remove(l.path)
+	if err == nil && !errors.Is(removeErr, os.ErrNotExist) {
+		err = removeErr
+	}
+
+	return err
+}
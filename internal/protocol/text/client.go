@@ -1,20 +1,29 @@
 package text
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 )
 
 type Client struct {
-	addr string
-	conn net.Conn
+	addr      string
+	tlsConfig *tls.Config
+	conn      net.Conn
+	reader    *bufio.Reader
 }
 
 func NewTextClient(addr string) *Client {
 	return &Client{addr: addr}
 }
 
+// SetTLSConfig makes the client dial the server over tls
+func (c *Client) SetTLSConfig(cfg *tls.Config) {
+	c.tlsConfig = cfg
+}
+
 func (c *Client) Connect(ctx context.Context) error {
 	type result struct {
 		conn net.Conn
@@ -26,8 +35,18 @@ func (c *Client) Connect(ctx context.Context) error {
 		c.conn.Close()
 	}
 
+	network, address := parseAddress(c.addr)
+
 	go func() {
-		conn, err := net.Dial("tcp", c.addr)
+		var conn net.Conn
+		var err error
+
+		if c.tlsConfig != nil {
+			conn, err = tls.Dial(network, address, c.tlsConfig)
+		} else {
+			conn, err = net.Dial(network, address)
+		}
+
 		done <- result{conn: conn, err: err}
 	}()
 
@@ -39,6 +58,7 @@ func (c *Client) Connect(ctx context.Context) error {
 			return r.err
 		}
 		c.conn = r.conn
+		c.reader = bufio.NewReader(r.conn)
 		return nil
 	}
 }
@@ -57,7 +77,7 @@ func (c *Client) Send(ctx context.Context, data string) (string, error) {
 		return "", fmt.Errorf("failed to write data to client: %w", err)
 	}
 
-	resp, err := readWithContext(ctx, c.conn)
+	resp, err := readWithContext(ctx, c.conn, c.reader)
 	if err != nil {
 		return "", fmt.Errorf("failed to read response from client: %w", err)
 	}
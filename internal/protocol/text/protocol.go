@@ -3,60 +3,127 @@ package text
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/JaneJavannie/in_memory_key_value_db/utils"
 )
 
-func writeWithContext(ctx context.Context, conn net.Conn, data string) error {
-	type result struct {
-		err error
+const (
+	frameDelimiter = '\r'
+
+	// requestIDPrefix starts a client request id in front of a request: "@<id> SET key value"
+	requestIDPrefix = "@"
+)
+
+// FormatResponse builds the response to a query
+func FormatResponse(result string, err error) string {
+	return fmt.Sprintf("query result: [ %s ] error: [ %v ] \n", result, err)
+}
+
+// WithRequestID prepends a client request id to a request
+func WithRequestID(id string, request string) string {
+	return requestIDPrefix + id + " " + request
+}
+
+// splitRequestID cuts a client request id from a request, id is empty when the request has none
+func splitRequestID(request string) (id string, rest string, err error) {
+	if !strings.HasPrefix(request, requestIDPrefix) {
+		return "", request, nil
 	}
-	done := make(chan result, 1)
 
-	go func() {
-		_, err := conn.Write([]byte(data + "\r"))
+	id, rest, _ = strings.Cut(request[len(requestIDPrefix):], " ")
 
-		if err != nil {
-			done <- result{
-				err: fmt.Errorf("failed to write data to client: %w", err),
-			}
+	err = utils.ValidateRequestID(id)
+	if err != nil {
+		return "", "", err
+	}
 
-			return
+	return id, rest, nil
+}
+
+func writeWithContext(ctx context.Context, conn net.Conn, data string) error {
+	return withContext(ctx, conn, func() error {
+		_, err := conn.Write([]byte(data + string(frameDelimiter)))
+		if err != nil {
+			return fmt.Errorf("failed to write data to client: %w", err)
 		}
 
-		done <- result{}
-	}()
+		return nil
+	})
+}
+
+func readWithContext(ctx context.Context, conn net.Conn, reader *bufio.Reader) (string, error) {
+	resp := ""
+
+	err := withContext(ctx, conn, func() error {
+		var err error
+		resp, err = readFrame(reader, 0)
+		return err
+	})
 
-	select {
-	case <-ctx.Done():
+	return resp, err
+}
+
+// withContext interrupts blocking io on conn when ctx is done
+func withContext(ctx context.Context, conn net.Conn, action func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	err := action()
+	if err != nil && ctx.Err() != nil {
 		return ctx.Err()
-	case r := <-done:
-		return r.err
 	}
+
+	return err
 }
 
-func readWithContext(ctx context.Context, conn net.Conn) (string, error) {
-	type result struct {
-		bytes []byte
-		err   error
-	}
-	done := make(chan result, 1)
-
-	go func() {
-		connBuf := bufio.NewReader(conn)
-		bytes, err := connBuf.ReadBytes('\r')
-		done <- result{
-			bytes: bytes,
-			err:   err,
+// readFrame reads one message. A message longer than maxSize is skipped
+// up to its delimiter and consts.ErrMessageTooLarge is returned, so the next message can be read.
+// maxSize <= 0 means no limit.
+func readFrame(reader *bufio.Reader, maxSize int) (string, error) {
+	frame := strings.Builder{}
+	tooLarge := false
+
+	for {
+		chunk, err := reader.ReadSlice(frameDelimiter)
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return "", err
 		}
-	}()
-
-	select {
-	case <-ctx.Done():
-		return "", ctx.Err()
-	case r := <-done:
-		resp := strings.TrimSuffix(string(r.bytes), "\r")
-		return resp, r.err
+
+		if !tooLarge {
+			frame.Write(chunk)
+
+			size := frame.Len()
+			if err == nil {
+				size-- // delimiter
+			}
+
+			tooLarge = maxSize > 0 && size > maxSize
+			if tooLarge {
+				frame.Reset()
+			}
+		}
+
+		if err == nil {
+			break
+		}
+	}
+
+	if tooLarge {
+		return "", fmt.Errorf("%w: limit is %d bytes", consts.ErrMessageTooLarge, maxSize)
 	}
+
+	return strings.TrimSuffix(frame.String(), string(frameDelimiter)), nil
 }
@@ -1,26 +1,79 @@
 package text
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/auth"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/compute"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts/defaults"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/tlsconfig"
 	"github.com/JaneJavannie/in_memory_key_value_db/utils"
 )
 
+const rejectWriteTimeout = time.Second
+
 type TcpServer struct {
-	address  string
-	sem      chan struct{}
-	listener net.Listener
+	address    string
+	socketMode os.FileMode
+	tlsConfig  *tls.Config
+	sem        chan struct{}
+	listener   net.Listener
+
+	// a connection holds its slot during the tls handshake, a client that doesn't finish it in time is closed
+	handshakeTimeout time.Duration
+
+	// connections waiting for a free slot
+	queue        chan struct{}
+	queueTimeout time.Duration
+	stats        serverStats
+
+	maxMessageSize int
+	idleTimeout    time.Duration // 0 - connections are never closed for inactivity
+	requestTimeout time.Duration // 0 - requests have no deadline
 
 	log       *slog.Logger
 	onReceive func(ctx context.Context, request string) string
 
-	wg sync.WaitGroup
+	// clients are served with baseCtx, it is cancelled when shutdown doesn't finish in time
+	baseCtx    context.Context
+	cancelBase context.CancelFunc
+	closing    chan struct{}
+	closeOnce  sync.Once
+
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+
+	wg      sync.WaitGroup // accept loop
+	clients sync.WaitGroup
+}
+
+type serverStats struct {
+	accepted atomic.Int64
+	active   atomic.Int64
+	queued   atomic.Int64
+	rejected atomic.Int64
+	requests atomic.Int64
+}
+
+// ServerStats are connection counters since the server start
+type ServerStats struct {
+	Accepted int64 `json:"accepted"` // connections that got a slot
+	Active   int64 `json:"active"`   // connections currently being served
+	Queued   int64 `json:"queued"`   // connections that had to wait for a slot
+	Rejected int64 `json:"rejected"` // connections closed with "max connections reached"
+	Requests int64 `json:"requests"` // requests served
 }
 
 func NewTcpServer(maxConnections int, address string, logger *slog.Logger) *TcpServer {
@@ -30,35 +83,109 @@ func NewTcpServer(maxConnections int, address string, logger *slog.Logger) *TcpS
 		connectionsCount <- struct{}{}
 	}
 
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+
 	return &TcpServer{
-		address: address,
-		sem:     connectionsCount,
-		log:     logger,
+		address:          address,
+		sem:              connectionsCount,
+		queue:            make(chan struct{}, defaults.AcceptBacklog),
+		queueTimeout:     defaults.QueueTimeout,
+		handshakeTimeout: defaults.TLSHandshakeTimeout,
+		maxMessageSize:   defaults.MaxMessageSize,
+		log:              logger,
+		baseCtx:          baseCtx,
+		cancelBase:       cancelBase,
+		closing:          make(chan struct{}),
+		conns:            make(map[net.Conn]struct{}),
+	}
+}
+
+// SetAcceptBacklog lets up to backlog connections wait for a free slot no longer than timeout,
+// other connections over max connections are rejected immediately. It replaces defaults.AcceptBacklog
+// and defaults.QueueTimeout, a backlog of 0 or less rejects every connection over max connections.
+func (s *TcpServer) SetAcceptBacklog(backlog int, timeout time.Duration) {
+	s.queue = make(chan struct{}, max(backlog, 0))
+	s.queueTimeout = timeout
+}
+
+func (s *TcpServer) Stats() ServerStats {
+	return ServerStats{
+		Accepted: s.stats.accepted.Load(),
+		Active:   s.stats.active.Load(),
+		Queued:   s.stats.queued.Load(),
+		Rejected: s.stats.rejected.Load(),
+		Requests: s.stats.requests.Load(),
 	}
 }
 
+// SetMaxMessageSize limits the size of a request in bytes
+func (s *TcpServer) SetMaxMessageSize(size int) {
+	s.maxMessageSize = size
+}
+
+// SetIdleTimeout closes connections that send no request for the timeout
+func (s *TcpServer) SetIdleTimeout(timeout time.Duration) {
+	s.idleTimeout = timeout
+}
+
+// SetRequestTimeout sets the deadline of a request context passed to onReceive
+func (s *TcpServer) SetRequestTimeout(timeout time.Duration) {
+	s.requestTimeout = timeout
+}
+
 func (s *TcpServer) SetOnReceive(onReceive func(ctx context.Context, request string) string) {
 	s.onReceive = onReceive
 }
 
+// SetSocketPermissions sets file permissions of a unix domain socket, ignored for tcp addresses
+func (s *TcpServer) SetSocketPermissions(mode os.FileMode) {
+	s.socketMode = mode
+}
+
+// SetTLSConfig enables tls on accepted connections
+func (s *TcpServer) SetTLSConfig(cfg *tls.Config) {
+	s.tlsConfig = cfg
+}
+
+// SetHandshakeTimeout limits the tls handshake of a connection
+func (s *TcpServer) SetHandshakeTimeout(timeout time.Duration) {
+	s.handshakeTimeout = timeout
+}
+
 func (s *TcpServer) Start() error {
+	network, address := parseAddress(s.address)
+
+	if network == networkUnix {
+		err := removeStaleSocket(address)
+		if err != nil {
+			return fmt.Errorf("remove stale socket: %w", err)
+		}
+	}
+
 	// Listen for incoming connections
-	listener, err := net.Listen("tcp", s.address)
+	var listener net.Listener
+	var err error
+	if network == networkUnix {
+		listener, err = listenUnixSocket(address, s.socketMode)
+	} else {
+		listener, err = net.Listen(network, address)
+	}
 	if err != nil {
 		return err
 	}
 
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+
 	s.listener = listener
-	s.log.Info("server started", "address", s.address)
+	s.log.Info("server started", "address", s.address, "tls", s.tlsConfig != nil)
 
 	s.wg.Add(1)
 
 	go func() {
 		defer s.wg.Done()
 
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-
 		for {
 			// Accept incoming connections
 			conn, err := listener.Accept()
@@ -70,9 +197,17 @@ func (s *TcpServer) Start() error {
 				continue
 			}
 
+			s.clients.Add(1)
+
 			// Handle client connection in a goroutine
 			go func() {
-				err := s.handleClient(ctx, conn)
+				defer s.clients.Done()
+
+				if !s.admit(conn) {
+					return
+				}
+
+				err := s.handleClient(s.baseCtx, conn)
 				if err != nil {
 					s.log.Error("failed to handle client connection", "error", err)
 				}
@@ -84,40 +219,218 @@ func (s *TcpServer) Start() error {
 }
 
 func (s *TcpServer) Stop() error {
+	return s.Shutdown(context.Background())
+}
+
+// Shutdown stops accepting connections and lets in-flight requests finish.
+// Idle connections are closed at once, busy ones after their response is written.
+// When ctx is done first, remaining requests are cancelled and their connections are closed
+// without waiting for the handlers to return.
+func (s *TcpServer) Shutdown(ctx context.Context) error {
 	if s.listener == nil {
 		return nil
 	}
 
-	err := s.listener.Close()
+	// Shutdown may be called again, e.g. Stop after a timed out Shutdown
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closing)
+		err = s.listener.Close()
+	})
 	s.wg.Wait()
 
-	return err
+	// interrupt connections waiting for a request
+	s.connsMu.Lock()
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.connsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.clients.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.cancelBase()
+		return err
+
+	case <-ctx.Done():
+		s.log.Warn("server shutdown: force close connections", "error", ctx.Err())
+
+		s.cancelBase()
+
+		s.connsMu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.connsMu.Unlock()
+
+		// handlers may still wait for the wal, it releases them when it's stopped
+		return errors.Join(err, ctx.Err())
+	}
+}
+
+func (s *TcpServer) isClosing() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// admit takes a connection slot. When all slots are taken the connection waits in the queue,
+// a connection that doesn't fit in the queue or waits longer than the queue timeout is rejected.
+func (s *TcpServer) admit(conn net.Conn) bool {
+	select {
+	case <-s.sem:
+		s.stats.accepted.Add(1)
+		return true
+	default:
+	}
+
+	select {
+	case s.queue <- struct{}{}:
+	default:
+		s.reject(conn)
+		return false
+	}
+
+	s.stats.queued.Add(1)
+	defer func() { <-s.queue }()
+
+	timer := time.NewTimer(s.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-s.sem:
+		s.stats.accepted.Add(1)
+		return true
+	case <-timer.C:
+		s.reject(conn)
+		return false
+	case <-s.closing:
+		conn.Close()
+		return false
+	}
+}
+
+func (s *TcpServer) reject(conn net.Conn) {
+	defer conn.Close()
+
+	s.stats.rejected.Add(1)
+	s.log.Warn("connection rejected", "error", consts.ErrMaxConnections, "remote_address", conn.RemoteAddr())
+
+	ctx, cancel := context.WithTimeout(context.Background(), rejectWriteTimeout)
+	defer cancel()
+
+	err := writeWithContext(ctx, conn, FormatResponse("", consts.ErrMaxConnections))
+	if err != nil {
+		s.log.Warn("write reject response", "error", err)
+	}
 }
 
 func (s *TcpServer) handleClient(ctx context.Context, conn net.Conn) error {
+	s.stats.active.Add(1)
+
+	s.connsMu.Lock()
+	s.conns[conn] = struct{}{}
+	s.connsMu.Unlock()
+
 	defer func() {
 		s.log.Info("handle client", "msg", "connection close")
 
+		s.connsMu.Lock()
+		delete(s.conns, conn)
+		s.connsMu.Unlock()
+
 		conn.Close()
+		s.stats.active.Add(-1)
 		s.sem <- struct{}{} // release connection
 	}()
 
-	<-s.sem
-
 	slog.Info("accepted new connection")
 
+	identity := ""
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// the connection is closed when the deadline passes, the deferred release frees its slot
+		handshakeCtx, cancel := context.WithTimeout(ctx, s.handshakeTimeout)
+		err := tlsConn.HandshakeContext(handshakeCtx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("tls handshake: %w", err)
+		}
+
+		identity = tlsconfig.Identity(tlsConn.ConnectionState())
+		if identity != "" {
+			ctx = context.WithValue(ctx, consts.ClientIdentity, identity)
+			s.log.Info("handle client: client certificate verified", consts.ClientIdentity, identity)
+		}
+	}
+
+	// connection state for the AUTH command
+	ctx = context.WithValue(ctx, consts.Session, auth.NewSession(identity))
+
+	reader := bufio.NewReader(conn)
+
 	for {
 		requestCtx := context.WithValue(ctx, consts.RequestID, utils.GetRequestUUID())
 		l := s.log.With(consts.RequestID, requestCtx.Value(consts.RequestID))
 
-		request, err := readWithContext(requestCtx, conn)
+		request, err := s.readRequest(conn, reader)
+		if err != nil {
+			var netErr net.Error
+
+			switch {
+			case errors.Is(err, io.EOF), s.isClosing():
+				return nil
+
+			case errors.Is(err, consts.ErrMessageTooLarge):
+				l.Warn("handle client: request rejected", "error", err)
+
+				err = writeWithContext(ctx, conn, FormatResponse("", err))
+				if err != nil {
+					return fmt.Errorf("failed to write response: %w", err)
+				}
+
+				continue
+
+			case errors.As(err, &netErr) && netErr.Timeout():
+				l.Info("handle client: idle timeout", "timeout", s.idleTimeout)
+
+				return writeWithContext(ctx, conn, FormatResponse("", consts.ErrIdleTimeout))
+
+			default:
+				return fmt.Errorf("failed to read data from client: %w", err)
+			}
+		}
+
+		id, request, err := splitRequestID(request)
 		if err != nil {
-			return fmt.Errorf("failed to read data from client: %w", err)
+			l.Warn("handle client: request rejected", "error", err)
+
+			err = writeWithContext(ctx, conn, FormatResponse("", err))
+			if err != nil {
+				return fmt.Errorf("failed to write response: %w", err)
+			}
+
+			continue
+		}
+
+		if id != "" {
+			// a retried request keeps the id of its first attempt
+			requestCtx = context.WithValue(requestCtx, consts.RequestID, id)
+			l = s.log.With(consts.RequestID, id)
 		}
 
-		l.Info("handle client: incoming request", "data", request)
+		l.Info("handle client: incoming request", "data", compute.Redact(request))
 
-		response := s.onReceive(requestCtx, request)
+		response := s.handleRequest(requestCtx, request)
+		s.stats.requests.Add(1)
 
 		err = writeWithContext(ctx, conn, response)
 		if err != nil {
@@ -125,3 +438,28 @@ func (s *TcpServer) handleClient(ctx context.Context, conn net.Conn) error {
 		}
 	}
 }
+
+// readRequest waits for the next request no longer than the idle timeout
+func (s *TcpServer) readRequest(conn net.Conn, reader *bufio.Reader) (string, error) {
+	if s.idleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	// checked after the deadline is set, so a shutdown can't be overwritten by the idle deadline
+	if s.isClosing() {
+		return "", net.ErrClosed
+	}
+
+	return readFrame(reader, s.maxMessageSize)
+}
+
+func (s *TcpServer) handleRequest(ctx context.Context, request string) string {
+	if s.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.requestTimeout)
+		defer cancel()
+	}
+
+	return s.onReceive(ctx, request)
+}
@@ -1,10 +1,26 @@
 package text
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
 	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTcpServer_Start(t *testing.T) {
@@ -15,3 +31,475 @@ func TestTcpServer_Start(t *testing.T) {
 
 	assert.NoError(t, err)
 }
+
+func TestTcpServer_StartUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.sock")
+
+	// leave a stale socket file behind
+	stale, err := net.Listen(networkUnix, path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	server := NewTcpServer(1, unixScheme+path, slog.Default())
+	server.SetSocketPermissions(0600)
+	server.SetOnReceive(func(_ context.Context, request string) string {
+		return "echo " + request
+	})
+
+	require.NoError(t, server.Start())
+	defer server.Stop()
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	client := NewTextClient(unixScheme + path)
+	require.NoError(t, client.Connect(ctx))
+	defer client.Close()
+
+	resp, err := client.Send(ctx, "GET a")
+	require.NoError(t, err)
+	assert.Equal(t, "echo GET a", resp)
+}
+
+func TestTcpServer_StartUnixSocketInUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.sock")
+
+	first := NewTcpServer(1, unixScheme+path, slog.Default())
+	require.NoError(t, first.Start())
+	defer first.Stop()
+
+	second := NewTcpServer(1, unixScheme+path, slog.Default())
+	assert.Error(t, second.Start())
+}
+
+func TestTcpServer_UnixSocketMode(t *testing.T) {
+	for _, mode := range []os.FileMode{0600, 0660, 0777} {
+		t.Run(mode.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "db.sock")
+
+			server := NewTcpServer(1, unixScheme+path, slog.Default())
+			server.SetSocketPermissions(mode)
+			require.NoError(t, server.Start())
+
+			info, err := os.Stat(path)
+			require.NoError(t, err)
+			assert.Equal(t, mode, info.Mode().Perm())
+
+			// the private directory the socket was created in is removed
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+			assert.Equal(t, "db.sock", entries[0].Name())
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			client := NewTextClient(unixScheme + path)
+			require.NoError(t, client.Connect(ctx))
+			client.Close()
+
+			require.NoError(t, server.Stop())
+
+			_, err = os.Stat(path)
+			assert.ErrorIs(t, err, os.ErrNotExist, "socket file must be removed on stop")
+		})
+	}
+}
+
+func startTestServer(t *testing.T, configure func(s *TcpServer)) (*TcpServer, string) {
+	path := filepath.Join(t.TempDir(), "db.sock")
+
+	server := NewTcpServer(1, unixScheme+path, slog.Default())
+	server.SetOnReceive(func(_ context.Context, request string) string {
+		return "echo " + request
+	})
+	configure(server)
+
+	require.NoError(t, server.Start())
+	t.Cleanup(func() { server.Stop() })
+
+	return server, unixScheme + path
+}
+
+func TestTcpServer_MaxMessageSize(t *testing.T) {
+	_, address := startTestServer(t, func(s *TcpServer) {
+		s.SetMaxMessageSize(8)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	client := NewTextClient(address)
+	require.NoError(t, client.Connect(ctx))
+	defer client.Close()
+
+	resp, err := client.Send(ctx, "SET key very_long_value")
+	require.NoError(t, err)
+	assert.Contains(t, resp, consts.ErrMessageTooLarge.Error())
+
+	// the connection is still usable
+	resp, err = client.Send(ctx, "GET key")
+	require.NoError(t, err)
+	assert.Equal(t, "echo GET key", resp)
+}
+
+func TestTcpServer_RequestID(t *testing.T) {
+	_, address := startTestServer(t, func(s *TcpServer) {
+		s.SetOnReceive(func(ctx context.Context, request string) string {
+			return fmt.Sprintf("%s %s", ctx.Value(consts.RequestID), request)
+		})
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	client := NewTextClient(address)
+	require.NoError(t, client.Connect(ctx))
+	defer client.Close()
+
+	resp, err := client.Send(ctx, WithRequestID("retry-1_a", "SET a b"))
+	require.NoError(t, err)
+	assert.Equal(t, "retry-1_a SET a b", resp)
+
+	resp, err = client.Send(ctx, "@bad/id SET a b")
+	require.NoError(t, err)
+	assert.Contains(t, resp, consts.ErrInvalidRequestID.Error())
+
+	// without an id the server generates one
+	resp, err = client.Send(ctx, "GET a")
+	require.NoError(t, err)
+	assert.Regexp(t, `^[0-9a-f-]{36} GET a$`, resp)
+}
+
+func TestTcpServer_IdleTimeout(t *testing.T) {
+	_, address := startTestServer(t, func(s *TcpServer) {
+		s.SetIdleTimeout(50 * time.Millisecond)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	client := NewTextClient(address)
+	require.NoError(t, client.Connect(ctx))
+	defer client.Close()
+
+	resp, err := readWithContext(ctx, client.conn, client.reader)
+	require.NoError(t, err)
+	assert.Contains(t, resp, consts.ErrIdleTimeout.Error())
+
+	_, err = client.Send(ctx, "GET key")
+	assert.Error(t, err)
+}
+
+func TestTcpServer_RequestTimeout(t *testing.T) {
+	_, address := startTestServer(t, func(s *TcpServer) {
+		s.SetRequestTimeout(time.Minute)
+		s.SetOnReceive(func(ctx context.Context, _ string) string {
+			_, ok := ctx.Deadline()
+			return FormatResponse("", fmt.Errorf("has deadline: %v", ok))
+		})
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	client := NewTextClient(address)
+	require.NoError(t, client.Connect(ctx))
+	defer client.Close()
+
+	resp, err := client.Send(ctx, "GET key")
+	require.NoError(t, err)
+	assert.Contains(t, resp, "has deadline: true")
+}
+
+func TestTcpServer_AdmissionControl(t *testing.T) {
+	server, address := startTestServer(t, func(s *TcpServer) {
+		s.SetAcceptBacklog(1, 200*time.Millisecond)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	first := NewTextClient(address)
+	require.NoError(t, first.Connect(ctx))
+	defer first.Close()
+
+	_, err := first.Send(ctx, "GET a")
+	require.NoError(t, err)
+
+	// the second connection waits in the queue, the third one doesn't fit and is rejected at once
+	second := NewTextClient(address)
+	require.NoError(t, second.Connect(ctx))
+	defer second.Close()
+
+	require.Eventually(t, func() bool { return server.Stats().Queued == 1 }, time.Second, 10*time.Millisecond)
+
+	third := NewTextClient(address)
+	require.NoError(t, third.Connect(ctx))
+	defer third.Close()
+
+	resp, err := readWithContext(ctx, third.conn, third.reader)
+	require.NoError(t, err)
+	assert.Contains(t, resp, consts.ErrMaxConnections.Error())
+
+	// the queued connection gets a slot when the first one is closed
+	require.NoError(t, first.Close())
+
+	resp, err = second.Send(ctx, "GET b")
+	require.NoError(t, err)
+	assert.Equal(t, "echo GET b", resp)
+
+	// a queued connection is rejected after the queue timeout
+	fourth := NewTextClient(address)
+	require.NoError(t, fourth.Connect(ctx))
+	defer fourth.Close()
+
+	resp, err = readWithContext(ctx, fourth.conn, fourth.reader)
+	require.NoError(t, err)
+	assert.Contains(t, resp, consts.ErrMaxConnections.Error())
+
+	assert.Equal(t, ServerStats{Accepted: 2, Active: 1, Queued: 2, Rejected: 2, Requests: 2}, server.Stats())
+}
+
+func TestTcpServer_DefaultAcceptBacklog(t *testing.T) {
+	server, address := startTestServer(t, func(s *TcpServer) {})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	first := NewTextClient(address)
+	require.NoError(t, first.Connect(ctx))
+	defer first.Close()
+
+	_, err := first.Send(ctx, "GET a")
+	require.NoError(t, err)
+
+	// without SetAcceptBacklog a connection over the limit still waits in the default queue
+	second := NewTextClient(address)
+	require.NoError(t, second.Connect(ctx))
+	defer second.Close()
+
+	require.Eventually(t, func() bool { return server.Stats().Queued == 1 }, time.Second, 10*time.Millisecond)
+	require.NoError(t, first.Close())
+
+	resp, err := second.Send(ctx, "GET b")
+	require.NoError(t, err)
+	assert.Equal(t, "echo GET b", resp)
+	assert.Equal(t, int64(0), server.Stats().Rejected)
+}
+
+func TestTcpServer_NoAcceptBacklog(t *testing.T) {
+	for _, backlog := range []int{0, -1} {
+		server, address := startTestServer(t, func(s *TcpServer) {
+			s.SetAcceptBacklog(backlog, time.Minute)
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		first := NewTextClient(address)
+		require.NoError(t, first.Connect(ctx))
+		defer first.Close()
+
+		_, err := first.Send(ctx, "GET a")
+		require.NoError(t, err)
+
+		// the connection over the limit doesn't wait for the queue timeout
+		second := NewTextClient(address)
+		require.NoError(t, second.Connect(ctx))
+		defer second.Close()
+
+		resp, err := readWithContext(ctx, second.conn, second.reader)
+		require.NoError(t, err)
+		assert.Contains(t, resp, consts.ErrMaxConnections.Error())
+		assert.Equal(t, int64(0), server.Stats().Queued)
+	}
+}
+
+func TestTcpServer_Shutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	path := filepath.Join(t.TempDir(), "db.sock")
+	server := NewTcpServer(2, unixScheme+path, slog.Default())
+	server.SetOnReceive(func(_ context.Context, request string) string {
+		close(started)
+		<-release
+		return "done " + request
+	})
+	require.NoError(t, server.Start())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	idle := NewTextClient(unixScheme + path)
+	require.NoError(t, idle.Connect(ctx))
+	defer idle.Close()
+
+	busy := NewTextClient(unixScheme + path)
+	require.NoError(t, busy.Connect(ctx))
+	defer busy.Close()
+
+	type result struct {
+		resp string
+		err  error
+	}
+	busyResult := make(chan result, 1)
+	go func() {
+		resp, err := busy.Send(ctx, "SET a b")
+		busyResult <- result{resp: resp, err: err}
+	}()
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- server.Shutdown(ctx)
+	}()
+
+	// the idle connection is closed while the busy one is still being served
+	_, err := readWithContext(ctx, idle.conn, idle.reader)
+	assert.ErrorIs(t, err, io.EOF)
+
+	close(release)
+
+	r := <-busyResult
+	require.NoError(t, r.err)
+	assert.Equal(t, "done SET a b", r.resp)
+
+	require.NoError(t, <-shutdownErr)
+	assert.Equal(t, int64(0), server.Stats().Active)
+}
+
+func TestTcpServer_ShutdownDeadline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.sock")
+	server := NewTcpServer(1, unixScheme+path, slog.Default())
+	server.SetOnReceive(func(ctx context.Context, _ string) string {
+		<-ctx.Done()
+		return "cancelled"
+	})
+	require.NoError(t, server.Start())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	client := NewTextClient(unixScheme + path)
+	require.NoError(t, client.Connect(ctx))
+	defer client.Close()
+
+	require.NoError(t, writeWithContext(ctx, client.conn, "GET a"))
+	require.Eventually(t, func() bool { return server.Stats().Active == 1 }, time.Second, 10*time.Millisecond)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer shutdownCancel()
+
+	err := server.Shutdown(shutdownCtx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestTcpServer_ShutdownTwice(t *testing.T) {
+	// Stop after a timed out Shutdown doesn't close the listener again
+	server, address := startTestServer(t, func(s *TcpServer) {
+		s.SetOnReceive(func(ctx context.Context, _ string) string {
+			<-ctx.Done()
+			return "cancelled"
+		})
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	client := NewTextClient(address)
+	require.NoError(t, client.Connect(ctx))
+	defer client.Close()
+
+	require.NoError(t, writeWithContext(ctx, client.conn, "GET a"))
+	require.Eventually(t, func() bool { return server.Stats().Active == 1 }, time.Second, 10*time.Millisecond)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer shutdownCancel()
+
+	assert.ErrorIs(t, server.Shutdown(shutdownCtx), context.DeadlineExceeded)
+	assert.NoError(t, server.Stop())
+
+	// concurrent shutdowns close the listener once
+	server, _ = startTestServer(t, func(s *TcpServer) {})
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- server.Shutdown(ctx)
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, <-errs)
+	}
+}
+
+func testTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "db"},
+		DNSNames:     []string{"db"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	server := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client := &tls.Config{RootCAs: pool, ServerName: "db"}
+
+	return server, client
+}
+
+func TestTcpServer_HandshakeTimeout(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+
+	server, address := startTestServer(t, func(s *TcpServer) {
+		s.SetTLSConfig(serverTLS)
+		s.SetHandshakeTimeout(100 * time.Millisecond)
+		s.SetAcceptBacklog(1, 2*time.Second)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// the only slot is taken by a connection that never starts the handshake
+	network, path := parseAddress(address)
+	stalled, err := net.Dial(network, path)
+	require.NoError(t, err)
+	defer stalled.Close()
+
+	require.Eventually(t, func() bool { return server.Stats().Active == 1 }, time.Second, 10*time.Millisecond)
+
+	// the stalled connection is closed after the handshake timeout, the queued client gets its slot
+	client := NewTextClient(address)
+	client.SetTLSConfig(clientTLS)
+	require.NoError(t, client.Connect(ctx))
+	defer client.Close()
+
+	resp, err := client.Send(ctx, "GET a")
+	require.NoError(t, err)
+	assert.Equal(t, "echo GET a", resp)
+
+	stalled.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = stalled.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
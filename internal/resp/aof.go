@@ -0,0 +1,105 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const manifestSuffix = ".manifest"
+
+// manifest file types of redis 7 multi part append-only files
+const (
+	aofTypeBase    = "b"
+	aofTypeHistory = "h"
+	aofTypeIncr    = "i"
+)
+
+// AOFFiles returns the files of an append-only file in replay order. A file path is returned as is,
+// a directory of redis 7 is read by its manifest: the base file first, then incremental files.
+// History files are already included in the base file and are skipped.
+func AOFFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("stat: %w", err)
+	}
+
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	manifests, err := filepath.Glob(filepath.Join(path, "*"+manifestSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("find manifest: %w", err)
+	}
+	if len(manifests) != 1 {
+		return nil, fmt.Errorf("want one %s file in %s, found %d", manifestSuffix, path, len(manifests))
+	}
+
+	file, err := os.Open(manifests[0])
+	if err != nil {
+		return nil, fmt.Errorf("open manifest: %w", err)
+	}
+	defer file.Close()
+
+	var base []string
+	var incr []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, fileType, err := parseManifestLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("manifest %s: %w", manifests[0], err)
+		}
+
+		switch fileType {
+		case aofTypeBase:
+			base = append(base, filepath.Join(path, name))
+		case aofTypeIncr:
+			incr = append(incr, filepath.Join(path, name))
+		case aofTypeHistory:
+		default:
+			return nil, fmt.Errorf("manifest %s: unknown file type %q", manifests[0], fileType)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+
+	if len(base) > 1 {
+		return nil, fmt.Errorf("manifest %s: more than one base file", manifests[0])
+	}
+
+	return append(base, incr...), nil
+}
+
+// parseManifestLine parses "file <name> seq <n> type <b|h|i>", the keys may come in any order
+func parseManifestLine(line string) (name string, fileType string, err error) {
+	fields := strings.Fields(line)
+	if len(fields)%2 != 0 {
+		return "", "", fmt.Errorf("invalid line %q", line)
+	}
+
+	for i := 0; i < len(fields); i += 2 {
+		switch fields[i] {
+		case "file":
+			name = fields[i+1]
+		case "type":
+			fileType = fields[i+1]
+		}
+	}
+
+	if name == "" || fileType == "" {
+		return "", "", errors.New("line without file or type: " + line)
+	}
+
+	return name, fileType, nil
+}
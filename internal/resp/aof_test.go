@@ -0,0 +1,44 @@
+package resp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAOFFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	manifest := "file appendonly.aof.2.base.aof seq 2 type b\n" +
+		"file appendonly.aof.1.incr.aof seq 1 type h\n" +
+		"file appendonly.aof.3.incr.aof seq 3 type i\n" +
+		"file appendonly.aof.4.incr.aof seq 4 type i\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "appendonly.aof.manifest"), []byte(manifest), 0o644))
+
+	files, err := AOFFiles(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "appendonly.aof.2.base.aof"),
+		filepath.Join(dir, "appendonly.aof.3.incr.aof"),
+		filepath.Join(dir, "appendonly.aof.4.incr.aof"),
+	}, files)
+
+	// a single file is replayed as is
+	file := filepath.Join(dir, "appendonly.aof.2.base.aof")
+	require.NoError(t, os.WriteFile(file, nil, 0o644))
+
+	files, err = AOFFiles(file)
+	require.NoError(t, err)
+	assert.Equal(t, []string{file}, files)
+}
+
+func TestAOFFiles_InvalidManifest(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "appendonly.aof.manifest"), []byte("file a.aof seq\n"), 0o644))
+
+	_, err := AOFFiles(dir)
+	assert.Error(t, err)
+}
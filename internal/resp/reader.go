@@ -0,0 +1,158 @@
+// Package resp reads redis command streams, such as append-only files, and translates them into queries of this database
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxBulkLength  = 512 << 20 // the redis limit of a string
+	maxArrayLength = 1 << 20
+)
+
+var (
+	ErrProtocol = errors.New("resp protocol error")
+	// ErrTruncated is returned for a command cut off by the end of the stream, e.g. by a crash of redis
+	ErrTruncated = errors.New("truncated command")
+	// ErrRDB is returned for rdb snapshots, including the rdb preamble of an append-only file
+	ErrRDB = errors.New("rdb format is not supported")
+)
+
+// rdbMagic starts rdb files
+var rdbMagic = []byte("REDIS")
+
+// Reader reads commands encoded as arrays of bulk strings, inline commands are accepted too
+type Reader struct {
+	r      *bufio.Reader
+	offset int64 // of the next byte
+	start  int64 // of the last command
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Offset returns the offset of the last command in the stream
+func (r *Reader) Offset() int64 {
+	return r.start
+}
+
+// ReadCommand returns the arguments of the next command, the first one is the command name.
+// It returns io.EOF at the end of the stream.
+func (r *Reader) ReadCommand() ([]string, error) {
+	if r.offset == 0 {
+		magic, _ := r.r.Peek(len(rdbMagic))
+		if bytes.Equal(magic, rdbMagic) {
+			return nil, ErrRDB
+		}
+	}
+
+	for {
+		r.start = r.offset
+
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if line == "" {
+			continue
+		}
+
+		if line[0] != '*' {
+			return strings.Fields(line), nil
+		}
+
+		count, err := r.parseLength(line[1:], maxArrayLength)
+		if err != nil {
+			return nil, err
+		}
+		if count <= 0 {
+			continue
+		}
+
+		args := make([]string, 0, count)
+		for i := 0; i < count; i++ {
+			arg, err := r.readBulk()
+			if err != nil {
+				return nil, err
+			}
+
+			args = append(args, arg)
+		}
+
+		return args, nil
+	}
+}
+
+func (r *Reader) readBulk() (string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return "", r.truncated(err)
+	}
+
+	if line == "" || line[0] != '$' {
+		return "", fmt.Errorf("%w: offset %d: want a bulk string, got %q", ErrProtocol, r.start, line)
+	}
+
+	length, err := r.parseLength(line[1:], maxBulkLength)
+	if err != nil {
+		return "", err
+	}
+	if length < 0 {
+		return "", fmt.Errorf("%w: offset %d: null bulk string in a command", ErrProtocol, r.start)
+	}
+
+	buf := make([]byte, length+2)
+
+	n, err := io.ReadFull(r.r, buf)
+	r.offset += int64(n)
+	if err != nil {
+		return "", r.truncated(err)
+	}
+
+	if buf[length] != '\r' || buf[length+1] != '\n' {
+		return "", fmt.Errorf("%w: offset %d: bulk string is not terminated", ErrProtocol, r.start)
+	}
+
+	return string(buf[:length]), nil
+}
+
+// readLine reads a line without its "\r\n", io.EOF is returned only at the end of the stream
+func (r *Reader) readLine() (string, error) {
+	line, err := r.r.ReadString('\n')
+	r.offset += int64(len(line))
+
+	if err != nil {
+		if errors.Is(err, io.EOF) && line != "" {
+			return "", r.truncated(io.ErrUnexpectedEOF)
+		}
+
+		return "", err
+	}
+
+	return strings.TrimSuffix(line[:len(line)-1], "\r"), nil
+}
+
+func (r *Reader) parseLength(s string, limit int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n > limit {
+		return 0, fmt.Errorf("%w: offset %d: invalid length %q", ErrProtocol, r.start, s)
+	}
+
+	return n, nil
+}
+
+func (r *Reader) truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w at offset %d", ErrTruncated, r.start)
+	}
+
+	return err
+}
@@ -0,0 +1,63 @@
+package resp
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader_ReadCommand(t *testing.T) {
+	stream := "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n" +
+		"*3\r\n$3\r\nSET\r\n$5\r\nhello\r\n$12\r\nhello\r\nworld\r\n" +
+		"\r\n" +
+		"DEL hello\r\n"
+
+	r := NewReader(strings.NewReader(stream))
+
+	args, err := r.ReadCommand()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"SELECT", "0"}, args)
+	assert.Equal(t, int64(0), r.Offset())
+
+	// bulk strings may contain line breaks
+	args, err = r.ReadCommand()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"SET", "hello", "hello\r\nworld"}, args)
+	assert.Equal(t, int64(23), r.Offset())
+
+	// inline command
+	args, err = r.ReadCommand()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"DEL", "hello"}, args)
+
+	_, err = r.ReadCommand()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestReader_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  string
+		wantErr error
+	}{
+		{name: "truncated bulk", stream: "*2\r\n$3\r\nDEL\r\n$5\r\nhel", wantErr: ErrTruncated},
+		{name: "truncated array", stream: "*2\r\n$3\r\nDEL\r\n", wantErr: ErrTruncated},
+		{name: "truncated line", stream: "*2", wantErr: ErrTruncated},
+		{name: "not a bulk", stream: "*1\r\n:1\r\n", wantErr: ErrProtocol},
+		{name: "invalid length", stream: "*1\r\n$x\r\n", wantErr: ErrProtocol},
+		{name: "null bulk", stream: "*1\r\n$-1\r\n", wantErr: ErrProtocol},
+		{name: "not terminated", stream: "*1\r\n$3\r\nDELX\r\n", wantErr: ErrProtocol},
+		{name: "rdb", stream: "REDIS0011\xfa", wantErr: ErrRDB},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewReader(strings.NewReader(tt.stream)).ReadCommand()
+			assert.True(t, errors.Is(err, tt.wantErr), "got %v", err)
+		})
+	}
+}
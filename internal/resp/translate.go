@@ -0,0 +1,278 @@
+package resp
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+)
+
+// Operation is a query of this database, Value is empty for DEL
+type Operation struct {
+	Command string
+	Key     string
+	Value   string
+}
+
+// Summary counts what a Translator did with the commands
+type Summary struct {
+	Commands    int            // commands read
+	Operations  int            // operations produced
+	Ignored     int            // commands without effect on data: MULTI, EXEC, SELECT, PERSIST...
+	Invalid     int            // supported commands with wrong arguments
+	OtherDB     int            // writes to other databases than the imported one
+	TTLDropped  int            // keys imported without their expiration, there are no expirations here
+	Expired     int            // keys already expired, they are deleted instead
+	Unsupported map[string]int // commands that can't be replayed by name
+}
+
+// UnsupportedNames returns names of unsupported commands sorted by name
+func (s Summary) UnsupportedNames() []string {
+	names := make([]string, 0, len(s.Unsupported))
+	for name := range s.Unsupported {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Translator turns redis write commands into SET and DEL operations.
+// Commands of other data types and other databases are counted in the summary and skipped.
+type Translator struct {
+	db      int
+	current int
+	now     func() time.Time
+	summary Summary
+}
+
+// NewTranslator translates writes to the redis database db, the one selected at the start is 0
+func NewTranslator(db int) *Translator {
+	return &Translator{
+		db:      db,
+		now:     time.Now,
+		summary: Summary{Unsupported: make(map[string]int)},
+	}
+}
+
+func (t *Translator) Summary() Summary {
+	return t.summary
+}
+
+// Translate returns the operations of a command, an error means the command has wrong arguments
+func (t *Translator) Translate(args []string) ([]Operation, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+
+	t.summary.Commands++
+
+	name := strings.ToUpper(args[0])
+	args = args[1:]
+
+	switch name {
+	case "SELECT":
+		if len(args) != 1 {
+			return nil, t.invalid(name, args)
+		}
+
+		db, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil, t.invalid(name, args)
+		}
+
+		t.current = db
+		t.summary.Ignored++
+
+		return nil, nil
+
+	case "MULTI", "EXEC", "PING", "PERSIST":
+		t.summary.Ignored++
+		return nil, nil
+	}
+
+	if !supported[name] {
+		t.summary.Unsupported[name]++
+		return nil, nil
+	}
+
+	if t.current != t.db {
+		t.summary.OtherDB++
+		return nil, nil
+	}
+
+	ops, err := t.translateWrite(name, args)
+	if err != nil {
+		return nil, err
+	}
+
+	t.summary.Operations += len(ops)
+
+	return ops, nil
+}
+
+// supported are write commands of strings, other commands are reported as unsupported
+var supported = map[string]bool{
+	"SET": true, "SETNX": true, "SETEX": true, "PSETEX": true, "GETSET": true,
+	"MSET": true, "MSETNX": true,
+	"DEL": true, "UNLINK": true, "GETDEL": true,
+	"EXPIRE": true, "PEXPIRE": true, "EXPIREAT": true, "PEXPIREAT": true,
+}
+
+func (t *Translator) translateWrite(name string, args []string) ([]Operation, error) {
+	switch name {
+	case "SET":
+		if len(args) < 2 {
+			return nil, t.invalid(name, args)
+		}
+
+		expireAt, hasTTL, err := parseSetExpiration(args[2:])
+		if err != nil {
+			return nil, t.invalid(name, args)
+		}
+
+		return t.setWithExpiration(args[0], args[1], expireAt, hasTTL), nil
+
+	case "SETNX", "GETSET":
+		if len(args) != 2 {
+			return nil, t.invalid(name, args)
+		}
+
+		return []Operation{set(args[0], args[1])}, nil
+
+	case "SETEX", "PSETEX":
+		if len(args) != 3 {
+			return nil, t.invalid(name, args)
+		}
+
+		t.summary.TTLDropped++
+
+		return []Operation{set(args[0], args[2])}, nil
+
+	case "MSET", "MSETNX":
+		if len(args) == 0 || len(args)%2 != 0 {
+			return nil, t.invalid(name, args)
+		}
+
+		ops := make([]Operation, 0, len(args)/2)
+		for i := 0; i < len(args); i += 2 {
+			ops = append(ops, set(args[i], args[i+1]))
+		}
+
+		return ops, nil
+
+	case "DEL", "UNLINK", "GETDEL":
+		if len(args) == 0 || (name == "GETDEL" && len(args) != 1) {
+			return nil, t.invalid(name, args)
+		}
+
+		ops := make([]Operation, 0, len(args))
+		for _, key := range args {
+			ops = append(ops, del(key))
+		}
+
+		return ops, nil
+
+	default: // expirations
+		if len(args) < 2 {
+			return nil, t.invalid(name, args)
+		}
+
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil, t.invalid(name, args)
+		}
+
+		var expireAt time.Time
+		switch name {
+		case "EXPIRE":
+			expireAt = t.now().Add(time.Duration(n) * time.Second)
+		case "PEXPIRE":
+			expireAt = t.now().Add(time.Duration(n) * time.Millisecond)
+		case "EXPIREAT":
+			expireAt = time.Unix(n, 0)
+		case "PEXPIREAT":
+			expireAt = time.UnixMilli(n)
+		}
+
+		if !expireAt.After(t.now()) {
+			t.summary.Expired++
+			return []Operation{del(args[0])}, nil
+		}
+
+		t.summary.TTLDropped++
+
+		return nil, nil
+	}
+}
+
+// setWithExpiration deletes a key that has already expired instead of setting it
+func (t *Translator) setWithExpiration(key string, value string, expireAt time.Time, hasTTL bool) []Operation {
+	if !hasTTL {
+		return []Operation{set(key, value)}
+	}
+
+	if !expireAt.IsZero() && !expireAt.After(t.now()) {
+		t.summary.Expired++
+		return []Operation{del(key)}
+	}
+
+	t.summary.TTLDropped++
+
+	return []Operation{set(key, value)}
+}
+
+// parseSetExpiration parses SET options. expireAt is zero for relative expirations (EX, PX),
+// their start is unknown in a log. NX, XX, GET and KEEPTTL don't change the replayed result.
+func parseSetExpiration(options []string) (expireAt time.Time, hasTTL bool, err error) {
+	for i := 0; i < len(options); i++ {
+		option := strings.ToUpper(options[i])
+
+		switch option {
+		case "NX", "XX", "GET", "KEEPTTL":
+			continue
+		case "EX", "PX", "EXAT", "PXAT":
+		default:
+			return time.Time{}, false, fmt.Errorf("unknown option %s", options[i])
+		}
+
+		if i+1 >= len(options) {
+			return time.Time{}, false, fmt.Errorf("%s without a value", option)
+		}
+
+		i++
+
+		n, err := strconv.ParseInt(options[i], 10, 64)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("%s: %w", option, err)
+		}
+
+		hasTTL = true
+
+		switch option {
+		case "EXAT":
+			expireAt = time.Unix(n, 0)
+		case "PXAT":
+			expireAt = time.UnixMilli(n)
+		}
+	}
+
+	return expireAt, hasTTL, nil
+}
+
+func (t *Translator) invalid(name string, args []string) error {
+	t.summary.Invalid++
+	return fmt.Errorf("invalid arguments of %s: %q", name, args)
+}
+
+func set(key string, value string) Operation {
+	return Operation{Command: consts.CommandSet, Key: key, Value: value}
+}
+
+func del(key string) Operation {
+	return Operation{Command: consts.CommandDel, Key: key}
+}
@@ -0,0 +1,75 @@
+package resp
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranslator_Translate(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	past := strconv.FormatInt(now.Add(-time.Minute).UnixMilli(), 10)
+	future := strconv.FormatInt(now.Add(time.Minute).UnixMilli(), 10)
+
+	tests := []struct {
+		name string
+		args []string
+		want []Operation
+	}{
+		{name: "set", args: []string{"set", "a", "1"}, want: []Operation{set("a", "1")}},
+		{name: "set nx", args: []string{"SET", "a", "1", "NX"}, want: []Operation{set("a", "1")}},
+		{name: "set expired", args: []string{"SET", "a", "1", "PXAT", past}, want: []Operation{del("a")}},
+		{name: "set with ttl", args: []string{"SET", "a", "1", "PXAT", future}, want: []Operation{set("a", "1")}},
+		{name: "setex", args: []string{"SETEX", "a", "10", "1"}, want: []Operation{set("a", "1")}},
+		{name: "mset", args: []string{"MSET", "a", "1", "b", "2"}, want: []Operation{set("a", "1"), set("b", "2")}},
+		{name: "del", args: []string{"DEL", "a", "b"}, want: []Operation{del("a"), del("b")}},
+		{name: "unlink", args: []string{"UNLINK", "a"}, want: []Operation{del("a")}},
+		{name: "expired", args: []string{"PEXPIREAT", "a", past}, want: []Operation{del("a")}},
+		{name: "expiration", args: []string{"PEXPIREAT", "a", future}},
+		{name: "multi", args: []string{"MULTI"}},
+		{name: "unsupported", args: []string{"HSET", "h", "f", "v"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := NewTranslator(0)
+			tr.now = func() time.Time { return now }
+
+			ops, err := tr.Translate(tt.args)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, ops)
+		})
+	}
+}
+
+func TestTranslator_Summary(t *testing.T) {
+	tr := NewTranslator(1)
+
+	commands := [][]string{
+		{"SET", "a", "1"},    // db 0
+		{"SELECT", "1"},      // ignored
+		{"SET", "b", "2"},    // applied
+		{"SETEX", "c", "10"}, // invalid
+		{"LPUSH", "l", "x"},
+		{"LPUSH", "l", "y"},
+		{"INCR", "n"},
+		{"SETEX", "d", "10", "4"}, // ttl dropped
+	}
+
+	for _, args := range commands {
+		_, _ = tr.Translate(args)
+	}
+
+	s := tr.Summary()
+	assert.Equal(t, 8, s.Commands)
+	assert.Equal(t, 2, s.Operations)
+	assert.Equal(t, 1, s.Ignored)
+	assert.Equal(t, 1, s.Invalid)
+	assert.Equal(t, 1, s.OtherDB)
+	assert.Equal(t, 1, s.TTLDropped)
+	assert.Equal(t, map[string]int{"LPUSH": 2, "INCR": 1}, s.Unsupported)
+	assert.Equal(t, []string{"INCR", "LPUSH"}, s.UnsupportedNames())
+}
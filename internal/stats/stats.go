@@ -0,0 +1,37 @@
+package stats
+
+import "sync"
+
+// stats - named providers of runtime statistics, reported by the STATS command
+
+type Registry struct {
+	mu        sync.RWMutex
+	providers map[string]func() any
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		providers: make(map[string]func() any),
+	}
+}
+
+// Register adds a provider, a provider with the same name is replaced
+func (r *Registry) Register(name string, provider func() any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.providers[name] = provider
+}
+
+// Snapshot collects the current values of all providers
+func (r *Registry) Snapshot() map[string]any {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	snapshot := make(map[string]any, len(r.providers))
+	for name, provider := range r.providers {
+		snapshot[name] = provider()
+	}
+
+	return snapshot
+}
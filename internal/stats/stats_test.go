@@ -0,0 +1,24 @@
+package stats
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry_Snapshot(t *testing.T) {
+	r := NewRegistry()
+
+	counter := 0
+	r.Register("server", func() any {
+		counter++
+		return counter
+	})
+	r.Register("wal", func() any { return "wal stats" })
+
+	assert.Equal(t, map[string]any{"server": 1, "wal": "wal stats"}, r.Snapshot())
+	assert.Equal(t, map[string]any{"server": 2, "wal": "wal stats"}, r.Snapshot())
+
+	r.Register("server", func() any { return 0 })
+	assert.Equal(t, 0, r.Snapshot()["server"])
+}
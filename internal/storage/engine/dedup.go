@@ -0,0 +1,122 @@
+package engine
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/compute"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+)
+
+// dedup remembers recent writes by request id, so a retried write is not applied twice.
+// The least recently used writes are forgotten when there are more than capacity of them.
+type dedup struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element // of *write
+	order    *list.List               // front is the most recently used
+}
+
+type write struct {
+	id      string
+	payload string
+	done    chan struct{} // closed when the first attempt has finished
+	err     error
+}
+
+func newDedup(capacity int) *dedup {
+	return &dedup{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// begin registers a write. When the id is already known the existing write is returned with first == false,
+// the caller waits for its done and returns its result instead of applying the query again.
+func (d *dedup) begin(id string, query compute.Query) (w *write, first bool, err error) {
+	payload := writePayload(query)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, ok := d.entries[id]; ok {
+		w = e.Value.(*write)
+		if w.payload != payload {
+			return nil, false, fmt.Errorf("%w: %s", consts.ErrRequestIDConflict, id)
+		}
+
+		d.order.MoveToFront(e)
+
+		return w, false, nil
+	}
+
+	w = &write{id: id, payload: payload, done: make(chan struct{})}
+	d.add(w)
+
+	return w, true, nil
+}
+
+// finish stores the result of the first attempt, a failed write is forgotten so it can be retried
+func (d *dedup) finish(w *write, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w.err = err
+	close(w.done)
+
+	if err != nil {
+		if e, ok := d.entries[w.id]; ok && e.Value == w {
+			d.order.Remove(e)
+			delete(d.entries, w.id)
+		}
+	}
+}
+
+// recover registers a write applied from the wal
+func (d *dedup) recover(id string, query compute.Query) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, ok := d.entries[id]; ok {
+		d.order.Remove(e)
+		delete(d.entries, id)
+	}
+
+	w := &write{id: id, payload: writePayload(query), done: make(chan struct{})}
+	close(w.done)
+
+	d.add(w)
+}
+
+func (d *dedup) add(w *write) {
+	d.entries[w.id] = d.order.PushFront(w)
+
+	// writes in progress are kept, their duplicates may be waiting for them
+	for e := d.order.Back(); d.order.Len() > d.capacity && e != nil; {
+		prev := e.Prev()
+
+		old := e.Value.(*write)
+		select {
+		case <-old.done:
+			d.order.Remove(e)
+			delete(d.entries, old.id)
+		default:
+		}
+
+		e = prev
+	}
+}
+
+func (d *dedup) len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.order.Len()
+}
+
+func writePayload(query compute.Query) string {
+	return query.Command + " " + strings.Join(query.Arguments, " ")
+}
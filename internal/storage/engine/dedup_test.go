@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/compute"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setQuery(key string, value string) compute.Query {
+	return compute.Query{Command: consts.CommandSet, Arguments: []string{key, value}}
+}
+
+func TestDedup_WaitsForFirstAttempt(t *testing.T) {
+	d := newDedup(10)
+
+	first, ok, err := d.begin("id", setQuery("a", "1"))
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	retry, ok, err := d.begin("id", setQuery("a", "1"))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	select {
+	case <-retry.done:
+		t.Fatal("retry must wait for the first attempt")
+	default:
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		d.finish(first, nil)
+	}()
+
+	<-retry.done
+	assert.NoError(t, retry.err)
+}
+
+func TestDedup_Conflict(t *testing.T) {
+	d := newDedup(10)
+
+	w, _, err := d.begin("id", setQuery("a", "1"))
+	require.NoError(t, err)
+	d.finish(w, nil)
+
+	_, _, err = d.begin("id", setQuery("a", "2"))
+	assert.ErrorIs(t, err, consts.ErrRequestIDConflict)
+}
+
+func TestDedup_FailedWriteIsForgotten(t *testing.T) {
+	d := newDedup(10)
+
+	w, _, err := d.begin("id", setQuery("a", "1"))
+	require.NoError(t, err)
+	d.finish(w, errors.New("wal is full"))
+
+	_, first, err := d.begin("id", setQuery("a", "1"))
+	require.NoError(t, err)
+	assert.True(t, first)
+}
+
+func TestDedup_Eviction(t *testing.T) {
+	d := newDedup(2)
+
+	for _, id := range []string{"1", "2"} {
+		w, _, err := d.begin(id, setQuery("a", id))
+		require.NoError(t, err)
+		d.finish(w, nil)
+	}
+
+	// a write in progress is not evicted, the least recently used finished one is
+	_, _, err := d.begin("1", setQuery("a", "1"))
+	require.NoError(t, err)
+
+	inProgress, _, err := d.begin("3", setQuery("a", "3"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, d.len())
+
+	_, first, err := d.begin("2", setQuery("a", "2"))
+	require.NoError(t, err)
+	assert.True(t, first, "2 must have been evicted")
+
+	d.finish(inProgress, nil)
+}
@@ -2,13 +2,20 @@ package engine
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/backup"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/compute"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/configs"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts/defaults"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/storage/snapshot"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/wal"
 )
 
@@ -19,8 +26,19 @@ type Engine struct {
 	isWriteWal bool
 	wal        *wal.Wal
 	isSlave    bool
+	readOnly   bool
+
+	// writes hold the barrier for reading, a snapshot takes it to copy the storage at a wal position
+	barrier   sync.RWMutex
+	applying  sync.WaitGroup    // writes of cancelled requests, applied when their wal batch is flushed
+	snapshots *configs.Snapshot // nil when snapshots are disabled
+	saving    atomic.Bool
+	stop      chan struct{}
+	wg        sync.WaitGroup
 }
 
+const backgroundSaveStarted = "Background saving started"
+
 func NewInMemoryEngine(storage *InMemoryStorage, wal *wal.Wal, logger *slog.Logger, cfgWal *configs.Wal, replicationType string) (*Engine, error) {
 	isSlave := replicationType == defaults.ReplicationTypeSlave
 
@@ -38,76 +56,436 @@ func NewInMemoryEngine(storage *InMemoryStorage, wal *wal.Wal, logger *slog.Logg
 func (e *Engine) ProcessCommand(ctx context.Context, query compute.Query) (string, error) {
 	slog.Debug("processing command", consts.RequestID, ctx.Value(consts.RequestID).(string), "command", query.Command)
 
+	// the request may have spent its time waiting in the server
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
 	queryResult := ""
 	var err error
 
 	switch query.Command {
 	case consts.CommandSet:
-		if e.isSlave {
-			return "", fmt.Errorf("cannot perform modifying operation on slave")
+		if err := e.writeRefused(); err != nil {
+			return "", err
 		}
 
-		err = e.processSet(ctx, query)
+		e.barrier.RLock()
+		err = e.processWrite(ctx, query, e.processSet)
+		e.barrier.RUnlock()
 
 	case consts.CommandGet:
 		queryResult = e.processGet(ctx, query)
 
 	case consts.CommandDel:
-		if e.isSlave {
-			return "", fmt.Errorf("cannot perform modifying operation on slave")
+		if err := e.writeRefused(); err != nil {
+			return "", err
+		}
+
+		e.barrier.RLock()
+		err = e.processWrite(ctx, query, e.processDel)
+		e.barrier.RUnlock()
+
+	case consts.CommandSave:
+		queryResult, err = e.Save()
+
+	case consts.CommandBgSave:
+		err = e.BgSave()
+		if err == nil {
+			queryResult = backgroundSaveStarted
 		}
 
-		err = e.processDel(ctx, query)
+	case consts.CommandBackup:
+		queryResult, err = e.Backup(query.Arguments[0])
 	}
 
 	return queryResult, err
 }
 
-func (e *Engine) processSet(ctx context.Context, query compute.Query) error {
-	var err error
-	if e.isWriteWal {
-		err = e.writeWalRecord(ctx, query)
-		if err != nil {
-			return fmt.Errorf("write wal record: %w", err)
+// processWrite applies a write once per request id. A repeated id waits for the first attempt
+// and returns its result, an id repeated with another query is rejected.
+func (e *Engine) processWrite(ctx context.Context, query compute.Query, apply func(query compute.Query)) error {
+	writes := e.storage.writes
+	if writes == nil {
+		return e.writeWalRecord(ctx, query, apply, func(error) {})
+	}
+
+	id := ctx.Value(consts.RequestID).(string)
+
+	w, first, err := writes.begin(id, query)
+	if err != nil {
+		return err
+	}
+
+	if !first {
+		e.logger.Info("duplicate write is not applied", consts.RequestID, id)
+
+		select {
+		case <-w.done:
+			return w.err
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 
-	e.storage.Set(query.Arguments[0], query.Arguments[1])
+	return e.writeWalRecord(ctx, query, apply, func(err error) {
+		writes.finish(w, err)
+	})
+}
+
+// Snapshot returns a point-in-time copy of all keys sorted by key
+func (e *Engine) Snapshot() []KeyValue {
+	return e.storage.Snapshot()
+}
+
+// writeRefused returns why writes are rejected, nil when they are accepted
+func (e *Engine) writeRefused() error {
+	switch {
+	case e.isSlave:
+		return consts.ErrReadOnly
+	case e.readOnly:
+		return consts.ErrRecoveryReadOnly
+	default:
+		return nil
+	}
+}
+
+// SetReadOnly rejects writes, snapshots and backups, e.g. of a state recovered up to a point in time.
+// The wal after the point must stay as it is.
+func (e *Engine) SetReadOnly() {
+	e.readOnly = true
+	e.snapshots = nil
+}
+
+// SetSnapshots enables snapshots of the storage, slaves and engines without the wal don't take them
+func (e *Engine) SetSnapshots(cfg *configs.Snapshot) {
+	if cfg == nil || e.isSlave || e.readOnly || !e.isWriteWal {
+		return
+	}
+
+	e.snapshots = cfg
+}
+
+// Start takes snapshots every snapshot interval
+func (e *Engine) Start() {
+	e.stop = make(chan struct{})
+
+	if e.snapshots == nil || e.snapshots.Interval <= 0 {
+		return
+	}
+
+	e.wg.Add(1)
+
+	go func() {
+		defer e.wg.Done()
+
+		ticker := time.NewTicker(e.snapshots.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-e.stop:
+				return
+
+			case <-ticker.C:
+				if !e.saving.CompareAndSwap(false, true) {
+					e.logger.Info("periodic snapshot is skipped, another one is in progress")
+					continue
+				}
+
+				_, err := e.saveSnapshot()
+				e.saving.Store(false)
+				if err != nil {
+					e.logger.Error("periodic snapshot", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops periodic snapshots and waits for a background save to finish
+func (e *Engine) Stop() {
+	if e.stop != nil {
+		close(e.stop)
+	}
+
+	e.wg.Wait()
+}
+
+// Save takes a snapshot and returns its file name
+func (e *Engine) Save() (string, error) {
+	if e.snapshots == nil {
+		return "", consts.ErrSnapshotsDisabled
+	}
+	if !e.saving.CompareAndSwap(false, true) {
+		return "", consts.ErrSnapshotInProgress
+	}
+	defer e.saving.Store(false)
+
+	return e.saveSnapshot()
+}
+
+// BgSave starts taking a snapshot in the background
+func (e *Engine) BgSave() error {
+	if e.snapshots == nil {
+		return consts.ErrSnapshotsDisabled
+	}
+	if !e.saving.CompareAndSwap(false, true) {
+		return consts.ErrSnapshotInProgress
+	}
+
+	e.wg.Add(1)
+
+	go func() {
+		defer e.wg.Done()
+		defer e.saving.Store(false)
+
+		_, err := e.saveSnapshot()
+		if err != nil {
+			e.logger.Error("background snapshot", "error", err)
+		}
+	}()
 
 	return nil
 }
 
-func (e *Engine) processGet(_ context.Context, query compute.Query) string {
-	val, _ := e.storage.Get(query.Arguments[0])
+type backupResponse struct {
+	Directory string `json:"directory"`
+	Snapshot  string `json:"snapshot"`
+	Keys      int    `json:"keys"`
+	Files     int    `json:"files"`
+	Bytes     int64  `json:"bytes"`
+}
 
-	return val
+// Backup writes the newest valid snapshot, or a new one when there is none, and the wal after it up to now to dir.
+// It returns a summary of the backup as json.
+func (e *Engine) Backup(dir string) (string, error) {
+	// a slave's wal is written by replication, writes of the engine don't hold it back.
+	// A recovered state is not at the end of the wal.
+	if e.isSlave || e.readOnly {
+		return "", consts.ErrSnapshotsDisabled
+	}
+	// snapshots and prunes must not remove the files being copied
+	if !e.saving.CompareAndSwap(false, true) {
+		return "", consts.ErrSnapshotInProgress
+	}
+	defer e.saving.Store(false)
+
+	start := time.Now()
+
+	src := backup.Source{WalDir: e.wal.DataDir(), SnapshotPath: e.latestSnapshot(), OpenSegments: e.wal.OpenSegments}
+
+	var buckets []map[string]string
+
+	e.lockWrites()
+	// records of the snapshot are flushed before it's created, a recovery to a time relies on it
+	createdAt := time.Now()
+	if src.SnapshotPath == "" {
+		buckets = e.storage.copyBuckets()
+	}
+	end, err := e.wal.Position()
+	e.barrier.Unlock()
+
+	if err != nil {
+		return "", fmt.Errorf("wal position: %w", err)
+	}
+
+	src.End = end
+	if src.SnapshotPath == "" {
+		src.Snapshot = &snapshot.Snapshot{Position: end, CreatedAt: createdAt, Buckets: buckets}
+	}
+
+	m, err := backup.Create(dir, src)
+	if err != nil {
+		return "", fmt.Errorf("create backup: %w", err)
+	}
+
+	e.logger.Info("backup created", "directory", dir, "snapshot", m.Snapshot, "keys", m.Keys,
+		"files", len(m.Files), "bytes", m.Size(), "duration", time.Since(start))
+
+	encoded, err := json.Marshal(backupResponse{
+		Directory: dir,
+		Snapshot:  m.Snapshot,
+		Keys:      m.Keys,
+		Files:     len(m.Files),
+		Bytes:     m.Size(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("marshal backup: %w", err)
+	}
+
+	return string(encoded), nil
 }
 
-func (e *Engine) processDel(ctx context.Context, query compute.Query) error {
-	var err error
+// latestSnapshot returns the path of the newest intact snapshot whose wal position exists, empty when there is none
+func (e *Engine) latestSnapshot() string {
+	if e.snapshots == nil {
+		return ""
+	}
 
-	if e.isWriteWal {
-		err = e.writeWalRecord(ctx, query)
+	names, err := snapshot.List(e.snapshots.DataDir)
+	if err != nil {
+		e.logger.Warn("list snapshots", "error", err)
+		return ""
+	}
+
+	for i := len(names) - 1; i >= 0; i-- {
+		path := filepath.Join(e.snapshots.DataDir, names[i])
+
+		header, err := snapshot.ReadHeader(path)
+		if err != nil || !wal.Exists(e.wal.DataDir(), header.Position) {
+			continue
+		}
+
+		_, err = snapshot.Verify(path)
 		if err != nil {
-			return fmt.Errorf("write wal record: %w", err)
+			e.logger.Warn("snapshot is not backed up", "snapshot", names[i], "error", err)
+			continue
 		}
+
+		return path
 	}
 
-	e.storage.Del(query.Arguments[0])
+	return ""
+}
+
+// saveSnapshot blocks writes only while the buckets are copied, the file is written after that
+func (e *Engine) saveSnapshot() (string, error) {
+	start := time.Now()
+
+	e.lockWrites()
+	// records of the snapshot are flushed before it's created, a recovery to a time relies on it
+	createdAt := time.Now()
+	buckets := e.storage.copyBuckets()
+	position, err := e.wal.Position()
+	e.barrier.Unlock()
+
+	if err != nil {
+		return "", fmt.Errorf("wal position: %w", err)
+	}
+
+	s := snapshot.Snapshot{Position: position, CreatedAt: createdAt, Buckets: buckets}
+
+	name, err := snapshot.Write(e.snapshots.DataDir, s)
+	if err != nil {
+		return "", fmt.Errorf("write snapshot: %w", err)
+	}
+
+	e.logger.Info("snapshot saved", "snapshot", name, "keys", s.Keys(),
+		"segment", position.Segment, "offset", position.Offset, "duration", time.Since(start))
+
+	err = e.pruneSnapshots()
+	if err != nil {
+		e.logger.Error("prune snapshots", "error", err)
+	}
+
+	return name, nil
+}
+
+// pruneSnapshots keeps the newest snapshots and, with prune_wal, removes wal segments none of them needs
+func (e *Engine) pruneSnapshots() error {
+	kept, err := snapshot.Prune(e.snapshots.DataDir, e.snapshots.Retain)
+	if err != nil {
+		return err
+	}
+
+	if !e.snapshots.PruneWal || len(kept) == 0 {
+		return nil
+	}
+
+	// the oldest kept snapshot is still a fallback when a newer one is corrupted
+	oldest, err := snapshot.ReadHeader(filepath.Join(e.snapshots.DataDir, kept[0]))
+	if err != nil {
+		return fmt.Errorf("read snapshot %s: %w", kept[0], err)
+	}
+
+	if oldest.Position.Segment == "" {
+		return nil
+	}
+
+	removed, err := e.wal.RemoveSegmentsBefore(oldest.Position.Segment)
+	if err != nil {
+		return fmt.Errorf("remove wal segments: %w", err)
+	}
+
+	if removed > 0 {
+		e.logger.Info("wal segments covered by snapshots are removed", "segments", removed)
+	}
 
 	return nil
 }
 
-func (e *Engine) writeWalRecord(ctx context.Context, query compute.Query) error {
-	id := ctx.Value(consts.RequestID).(string)
+func (e *Engine) processSet(query compute.Query) {
+	e.storage.Set(query.Arguments[0], query.Arguments[1])
+}
+
+func (e *Engine) processGet(_ context.Context, query compute.Query) string {
+	val, _ := e.storage.Get(query.Arguments[0])
+
+	return val
+}
+
+func (e *Engine) processDel(query compute.Query) {
+	e.storage.Del(query.Arguments[0])
+}
+
+// writeWalRecord applies the query after its wal batch is flushed and calls finish with the result.
+// When ctx is done first the request fails with its error, but the log is already in a batch: it's applied
+// in the background once the batch is flushed, so the storage matches the wal.
+func (e *Engine) writeWalRecord(ctx context.Context, query compute.Query, apply func(query compute.Query), finish func(err error)) error {
+	if !e.isWriteWal {
+		apply(query)
+		finish(nil)
+
+		return nil
+	}
+
 	log := wal.Log{
-		ID:    id,
+		ID:    ctx.Value(consts.RequestID).(string),
 		Query: query,
 	}
 
-	e.logger.Debug("WAIT WAL")
-	err := e.wal.WriteLog(ctx, log)
-	e.logger.Debug("WAIT DONE")
+	future, err := e.wal.Submit(ctx, log)
+	if err != nil {
+		finish(err)
+		return fmt.Errorf("write wal record: %w", err)
+	}
+
+	complete := func() error {
+		err := future.Err()
+		if err == nil {
+			apply(query)
+		}
+		finish(err)
+
+		return err
+	}
+
+	select {
+	case <-future.Done():
+		err = complete()
+		if err != nil {
+			return fmt.Errorf("write wal record: %w", err)
+		}
+
+		return nil
+
+	case <-ctx.Done():
+		e.logger.Warn("request is cancelled before its wal batch is flushed, the write is applied in the background",
+			consts.RequestID, log.ID)
+
+		e.applying.Add(1)
+		go func() {
+			defer e.applying.Done()
+			_ = complete()
+		}()
+
+		return ctx.Err()
+	}
+}
 
-	return err
+// lockWrites blocks new writes and waits for the running ones, including writes applied in the background
+func (e *Engine) lockWrites() {
+	e.barrier.Lock()
+	e.applying.Wait()
 }
@@ -1,16 +1,19 @@
 package engine
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"log/slog"
+	"maps"
+	"slices"
 	"strings"
 	"sync"
 
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/configs"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts/defaults"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/storage/snapshot"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/wal"
 	"github.com/cespare/xxhash/v2"
 )
 
@@ -21,11 +24,28 @@ const (
 
 type InMemoryStorage struct {
 	data [bucketCount]*kvStorage
+
+	// recent writes by request id, recovered from the wal. nil when disabled
+	writes *dedup
 }
 
 func NewInMemoryStorage(cfg *configs.Config) (*InMemoryStorage, error) {
+	return RecoverInMemoryStorage(cfg, wal.Target{})
+}
+
+// RecoverInMemoryStorage loads the state as of the target: the newest snapshot taken before it and the wal up to it.
+// The zero target loads all of the wal.
+func RecoverInMemoryStorage(cfg *configs.Config, until wal.Target) (*InMemoryStorage, error) {
 	c := &InMemoryStorage{}
 
+	dedupSize := defaults.EngineDedupSize
+	if cfg != nil && cfg.Engine.DedupSize != 0 {
+		dedupSize = cfg.Engine.DedupSize
+	}
+	if dedupSize > 0 {
+		c.writes = newDedup(dedupSize)
+	}
+
 	for i := 0; i < bucketCount; i++ {
 		c.data[i] = &kvStorage{
 			mu: sync.Mutex{},
@@ -49,15 +69,44 @@ func NewInMemoryStorage(cfg *configs.Config) (*InMemoryStorage, error) {
 		dataDir = cfg.Wal.DataDir
 	}
 
-	if replication != nil && replication.Type == defaults.ReplicationTypeSlave {
+	isSlave := replication != nil && replication.Type == defaults.ReplicationTypeSlave
+	if isSlave {
 		dataDir = replication.ReplicatedDataDir
 	}
 
-	err := c.loadWal(dataDir)
+	from := wal.Position{}
+	var err error
+
+	// slaves don't compact, their segments come from the master
+	if !isSlave {
+		err = wal.RecoverCompaction(dataDir)
+		if err != nil {
+			return nil, fmt.Errorf("recover compaction: %w", err)
+		}
+	}
+
+	// slaves don't take snapshots, their state comes from the master's wal
+	if cfg.Snapshot != nil && !isSlave {
+		from, err = c.loadSnapshot(cfg.Snapshot.DataDir, dataDir, until)
+		if err != nil {
+			return nil, fmt.Errorf("load snapshot: %w", err)
+		}
+	}
+
+	end, reached, err := c.loadWal(dataDir, from, until)
 	if err != nil {
 		return nil, fmt.Errorf("load WAL: %v", err)
 	}
 
+	if until.IsZero() {
+		slog.Info("wal loaded", "lsn", end.String())
+	} else {
+		slog.Info("recovered", "until", until.String(), "lsn", end.String(), "target_reached", reached)
+		if !reached {
+			slog.Warn("the wal ends before the recovery target, all of it is replayed", "until", until.String())
+		}
+	}
+
 	return c, nil
 }
 
@@ -87,50 +136,68 @@ func (c *InMemoryStorage) Del(key string) {
 	bucket.del(key)
 }
 
-func (c *InMemoryStorage) loadWal(dir string) error {
-	logs, err := os.ReadDir(dir)
+// loadSnapshot loads the newest snapshot before the target whose wal position still exists
+// and returns the position to replay the wal from
+func (c *InMemoryStorage) loadSnapshot(dir string, walDir string, until wal.Target) (wal.Position, error) {
+	s, name, found, err := snapshot.LoadLatest(dir, func(header snapshot.Snapshot) error {
+		if !until.Includes(header.Position, header.CreatedAt) {
+			return errors.New("taken after the recovery target")
+		}
+		if !wal.Exists(walDir, header.Position) {
+			return errors.New("its wal position is gone")
+		}
+
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("read dir %s: %v", dir, err)
+		return wal.Position{}, err
 	}
 
-	for _, log := range logs {
-		if log.IsDir() {
-			continue
-		}
-
-		file, err := os.Open(filepath.Join(dir, log.Name()))
-		if err != nil {
-			return fmt.Errorf("error opening file: %v\n", err)
+	if !found {
+		names, _ := snapshot.List(dir)
+		if len(names) > 0 {
+			slog.Warn("no usable snapshot, the whole wal is replayed", "snapshots", len(names))
 		}
 
-		scanner := bufio.NewScanner(file)
+		return wal.Position{}, nil
+	}
 
-		for scanner.Scan() {
-			entries := strings.Split(scanner.Text(), " ")
+	if len(s.Buckets) == bucketCount {
+		for i, bucket := range s.Buckets {
+			c.data[i].m = bucket
+		}
+	} else {
+		for _, bucket := range s.Buckets {
+			for key, value := range bucket {
+				c.Set(key, value)
+			}
+		}
+	}
 
-			args := make([]string, 0)
-			args = append(args, entries[2:]...)
+	slog.Info("snapshot loaded", "snapshot", name, "keys", s.Keys(), "segment", s.Position.Segment, "offset", s.Position.Offset)
 
-			command := entries[1]
+	return s.Position, nil
+}
 
-			switch command {
-			case consts.CommandSet:
-				c.Set(args[0], args[1])
+// loadWal replays the wal after from up to the target. Request ids of writes covered by a snapshot are not recovered.
+func (c *InMemoryStorage) loadWal(dir string, from wal.Position, until wal.Target) (wal.Position, bool, error) {
+	return wal.Replay(dir, from, until, func(record wal.Record) error {
+		args := record.Query.Arguments
 
-			case consts.CommandDel:
-				c.Del(args[0])
+		switch record.Query.Command {
+		case consts.CommandSet:
+			c.Set(args[0], args[1])
 
-			default:
-				return fmt.Errorf("unknown command: %s", command)
-			}
-		}
-		if err := scanner.Err(); err != nil {
-			return fmt.Errorf("scan file: %s: %w", file.Name(), err)
+		case consts.CommandDel:
+			c.Del(args[0])
 		}
 
-	}
+		if c.writes != nil {
+			c.writes.recover(record.ID, record.Query)
+		}
 
-	return nil
+		return nil
+	})
 }
 
 func getHash(key string, bucketCount int) int {
@@ -138,3 +205,60 @@ func getHash(key string, bucketCount int) int {
 
 	return int(h)
 }
+
+// KeyValue is a key with its value
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// Snapshot returns a point-in-time copy of all keys sorted by key.
+// All buckets are locked while they are copied, so a snapshot never sees a write to one bucket without an earlier write to another.
+func (c *InMemoryStorage) Snapshot() []KeyValue {
+	c.lockAll()
+
+	size := 0
+	for _, bucket := range c.data {
+		size += len(bucket.m)
+	}
+
+	snapshot := make([]KeyValue, 0, size)
+	for _, bucket := range c.data {
+		for key, value := range bucket.m {
+			snapshot = append(snapshot, KeyValue{Key: key, Value: value})
+		}
+	}
+
+	c.unlockAll()
+
+	slices.SortFunc(snapshot, func(a, b KeyValue) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	return snapshot
+}
+
+// copyBuckets returns a point-in-time copy of every bucket
+func (c *InMemoryStorage) copyBuckets() []map[string]string {
+	c.lockAll()
+	defer c.unlockAll()
+
+	buckets := make([]map[string]string, len(c.data))
+	for i, bucket := range c.data {
+		buckets[i] = maps.Clone(bucket.m)
+	}
+
+	return buckets
+}
+
+func (c *InMemoryStorage) lockAll() {
+	for _, bucket := range c.data {
+		bucket.mu.Lock()
+	}
+}
+
+func (c *InMemoryStorage) unlockAll() {
+	for _, bucket := range c.data {
+		bucket.mu.Unlock()
+	}
+}
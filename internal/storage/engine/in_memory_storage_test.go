@@ -16,3 +16,20 @@ func TestLoadWal(t *testing.T) {
 
 	require.Equal(t, res, "test123")
 }
+
+func TestInMemoryStorage_Snapshot(t *testing.T) {
+	c, err := NewInMemoryStorage(nil)
+	require.NoError(t, err)
+
+	c.Set("b", "2")
+	c.Set("a", "1")
+	c.Set("c", "3")
+	c.Del("c")
+
+	snapshot := c.Snapshot()
+	require.Equal(t, []KeyValue{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}, snapshot)
+
+	// the snapshot is a copy
+	c.Set("a", "changed")
+	require.Equal(t, "1", snapshot[0].Value)
+}
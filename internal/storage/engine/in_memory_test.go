@@ -4,12 +4,17 @@ import (
 	"context"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/backup"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/compute"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/configs"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts/defaults"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/storage/snapshot"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/wal"
 	"github.com/stretchr/testify/require"
 
@@ -161,10 +166,364 @@ func TestEngine_writeWalRecord(t *testing.T) {
 	w, err := wal.NewWal(logger, cfg, "master")
 	assert.NoError(t, err)
 
-	engine := &Engine{logger: logger, wal: w}
+	engine := &Engine{logger: logger, wal: w, isWriteWal: true}
 
 	w.Start(cfg)
 
-	err = engine.writeWalRecord(ctx, query)
+	applied := false
+	var result error
+
+	err = engine.writeWalRecord(ctx, query, func(compute.Query) { applied = true }, func(err error) { result = err })
 	assert.NoError(t, err)
+	assert.True(t, applied)
+	assert.NoError(t, result)
+}
+
+func TestEngine_CancelledWriteIsApplied(t *testing.T) {
+	cfg := &configs.Wal{
+		FlushingBatchSize:    100,
+		FlushingBatchTimeout: time.Hour,
+		MaxSegmentSizeBytes:  1024,
+		DataDir:              t.TempDir(),
+	}
+
+	storage, err := NewInMemoryStorage(&configs.Config{Wal: cfg, Engine: configs.Engine{DedupSize: 10}})
+	require.NoError(t, err)
+
+	w, err := wal.NewWal(slog.Default(), cfg, "")
+	require.NoError(t, err)
+	w.Start(cfg)
+
+	e, err := NewInMemoryEngine(storage, w, slog.Default(), cfg, "")
+	require.NoError(t, err)
+
+	// the batch is flushed only on stop, the request times out first
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), consts.RequestID, "1"), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = e.ProcessCommand(ctx, compute.Query{Command: consts.CommandSet, Arguments: []string{"a", "1"}})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, found := storage.Get("a")
+	assert.False(t, found)
+
+	require.NoError(t, w.Stop(cfg))
+
+	e.lockWrites()
+	e.barrier.Unlock()
+
+	value, _ := storage.Get("a")
+	assert.Equal(t, "1", value)
+
+	// a retry gets the result of the first attempt
+	ctx = context.WithValue(context.Background(), consts.RequestID, "1")
+	_, err = e.ProcessCommand(ctx, compute.Query{Command: consts.CommandSet, Arguments: []string{"a", "1"}})
+	assert.NoError(t, err)
+}
+
+func TestEngine_ProcessCommandDuplicateWrite(t *testing.T) {
+	storage, err := NewInMemoryStorage(nil)
+	require.NoError(t, err)
+
+	e := &Engine{storage: storage, logger: slog.Default()}
+
+	withID := func(id string) context.Context {
+		return context.WithValue(context.Background(), consts.RequestID, id)
+	}
+
+	_, err = e.ProcessCommand(withID("first"), compute.Query{Command: "SET", Arguments: []string{"a", "1"}})
+	require.NoError(t, err)
+
+	_, err = e.ProcessCommand(withID("second"), compute.Query{Command: "SET", Arguments: []string{"a", "2"}})
+	require.NoError(t, err)
+
+	// a retry of the first write is not applied again
+	_, err = e.ProcessCommand(withID("first"), compute.Query{Command: "SET", Arguments: []string{"a", "1"}})
+	require.NoError(t, err)
+
+	value, _ := storage.Get("a")
+	assert.Equal(t, "2", value)
+
+	_, err = e.ProcessCommand(withID("first"), compute.Query{Command: "DEL", Arguments: []string{"a"}})
+	assert.ErrorIs(t, err, consts.ErrRequestIDConflict)
+}
+
+func TestNewInMemoryStorage_RecoversRequestIDs(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.WriteFile(dir+"/wal_1", []byte("first SET a 1\nsecond SET a 2\n"), 0644)
+	require.NoError(t, err)
+
+	storage, err := NewInMemoryStorage(&configs.Config{Wal: &configs.Wal{DataDir: dir}})
+	require.NoError(t, err)
+
+	e := &Engine{storage: storage, logger: slog.Default()}
+
+	// the write is in the wal, a retry after a restart is not applied again
+	ctx := context.WithValue(context.Background(), consts.RequestID, "first")
+	_, err = e.ProcessCommand(ctx, compute.Query{Command: "SET", Arguments: []string{"a", "1"}})
+	require.NoError(t, err)
+
+	value, _ := storage.Get("a")
+	assert.Equal(t, "2", value)
+}
+
+func TestEngine_SaveAndLoadSnapshot(t *testing.T) {
+	walDir := t.TempDir()
+	cfg := &configs.Config{
+		Wal: &configs.Wal{
+			FlushingBatchSize:    1,
+			FlushingBatchTimeout: time.Second,
+			MaxSegmentSizeBytes:  1024,
+			DataDir:              walDir,
+		},
+		Snapshot: &configs.Snapshot{DataDir: t.TempDir(), Retain: 1, PruneWal: true},
+	}
+
+	storage, err := NewInMemoryStorage(cfg)
+	require.NoError(t, err)
+
+	w, err := wal.NewWal(slog.Default(), cfg.Wal, "")
+	require.NoError(t, err)
+	w.Start(cfg.Wal)
+
+	e, err := NewInMemoryEngine(storage, w, slog.Default(), cfg.Wal, "")
+	require.NoError(t, err)
+	e.SetSnapshots(cfg.Snapshot)
+
+	set := func(id string, key string, value string) {
+		ctx := context.WithValue(context.Background(), consts.RequestID, id)
+		_, err := e.ProcessCommand(ctx, compute.Query{Command: consts.CommandSet, Arguments: []string{key, value}})
+		require.NoError(t, err)
+	}
+
+	set("1", "a", "1")
+	set("2", "b", "2")
+
+	ctx := context.WithValue(context.Background(), consts.RequestID, "3")
+	name, err := e.ProcessCommand(ctx, compute.Query{Command: consts.CommandSave})
+	require.NoError(t, err)
+	assert.FileExists(t, cfg.Snapshot.DataDir+"/"+name)
+
+	// writes after the snapshot are replayed from the wal
+	set("4", "a", "changed")
+
+	require.NoError(t, w.Stop(cfg.Wal))
+
+	loaded, err := NewInMemoryStorage(cfg)
+	require.NoError(t, err)
+
+	value, _ := loaded.Get("a")
+	assert.Equal(t, "changed", value)
+	value, _ = loaded.Get("b")
+	assert.Equal(t, "2", value)
+}
+
+func TestEngine_SaveDisabled(t *testing.T) {
+	storage, err := NewInMemoryStorage(nil)
+	require.NoError(t, err)
+
+	e, err := NewInMemoryEngine(storage, &wal.Wal{}, slog.Default(), nil, "")
+	require.NoError(t, err)
+	e.SetSnapshots(&configs.Snapshot{DataDir: t.TempDir()})
+
+	ctx := context.WithValue(context.Background(), consts.RequestID, "1")
+
+	_, err = e.ProcessCommand(ctx, compute.Query{Command: consts.CommandSave})
+	assert.ErrorIs(t, err, consts.ErrSnapshotsDisabled)
+
+	_, err = e.ProcessCommand(ctx, compute.Query{Command: consts.CommandBgSave})
+	assert.ErrorIs(t, err, consts.ErrSnapshotsDisabled)
+}
+
+func TestEngine_BackupAndRestore(t *testing.T) {
+	cfg := &configs.Config{
+		Wal: &configs.Wal{
+			FlushingBatchSize:    1,
+			FlushingBatchTimeout: time.Second,
+			MaxSegmentSizeBytes:  1024,
+			DataDir:              t.TempDir(),
+		},
+		Snapshot: &configs.Snapshot{DataDir: t.TempDir(), Retain: 2},
+	}
+
+	storage, err := NewInMemoryStorage(cfg)
+	require.NoError(t, err)
+
+	w, err := wal.NewWal(slog.Default(), cfg.Wal, "")
+	require.NoError(t, err)
+	w.Start(cfg.Wal)
+
+	e, err := NewInMemoryEngine(storage, w, slog.Default(), cfg.Wal, "")
+	require.NoError(t, err)
+	e.SetSnapshots(cfg.Snapshot)
+
+	process := func(id string, command string, args ...string) string {
+		ctx := context.WithValue(context.Background(), consts.RequestID, id)
+		result, err := e.ProcessCommand(ctx, compute.Query{Command: command, Arguments: args})
+		require.NoError(t, err)
+
+		return result
+	}
+
+	process("1", consts.CommandSet, "a", "1")
+	process("2", consts.CommandSave)
+	// the backup copies the snapshot and the wal written after it
+	process("3", consts.CommandSet, "b", "2")
+
+	dir := t.TempDir() + "/backup"
+	result := process("4", consts.CommandBackup, dir)
+	assert.Contains(t, result, `"keys":1`)
+
+	process("5", consts.CommandSet, "c", "3")
+	require.NoError(t, w.Stop(cfg.Wal))
+
+	restored := &configs.Config{
+		Wal:      &configs.Wal{DataDir: t.TempDir() + "/wal"},
+		Snapshot: &configs.Snapshot{DataDir: t.TempDir() + "/snapshots"},
+	}
+
+	_, err = backup.Restore(dir, restored.Wal.DataDir, restored.Snapshot.DataDir)
+	require.NoError(t, err)
+
+	loaded, err := NewInMemoryStorage(restored)
+	require.NoError(t, err)
+
+	assert.Equal(t, []KeyValue{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}, loaded.Snapshot())
+}
+
+func TestRecoverInMemoryStorage(t *testing.T) {
+	walDir := t.TempDir()
+	snapshotDir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(walDir+"/20240601_153053.00000",
+		[]byte("old SET a 0 \n2024-06-01T15:30:53Z 1 SET a 1 \n2024-06-01T15:30:54Z 2 SET b 2 \n"), 0644))
+	require.NoError(t, os.WriteFile(walDir+"/20240601_153055.00000",
+		[]byte("2024-06-01T15:30:55Z 3 DEL a \n"), 0644))
+
+	// the snapshot was taken after the target, recovery replays the wal from the start
+	_, err := snapshot.Write(snapshotDir, snapshot.Snapshot{
+		Position:  wal.Position{Segment: "20240601_153055.00000", Offset: 29},
+		CreatedAt: time.Date(2024, 6, 1, 15, 30, 55, 0, time.UTC),
+		Buckets:   []map[string]string{{"b": "2"}},
+	})
+	require.NoError(t, err)
+
+	cfg := &configs.Config{Wal: &configs.Wal{DataDir: walDir}, Snapshot: &configs.Snapshot{DataDir: snapshotDir}}
+
+	until, err := wal.ParseTarget("2024-06-01T15:30:53Z")
+	require.NoError(t, err)
+
+	storage, err := RecoverInMemoryStorage(cfg, until)
+	require.NoError(t, err)
+	assert.Equal(t, []KeyValue{{Key: "a", Value: "1"}}, storage.Snapshot())
+
+	until, err = wal.ParseTarget("20240601_153055.00000:0")
+	require.NoError(t, err)
+
+	storage, err = RecoverInMemoryStorage(cfg, until)
+	require.NoError(t, err)
+	assert.Equal(t, []KeyValue{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}, storage.Snapshot())
+
+	e, err := NewInMemoryEngine(storage, &wal.Wal{}, slog.Default(), nil, "")
+	require.NoError(t, err)
+	e.SetReadOnly()
+
+	ctx := context.WithValue(context.Background(), consts.RequestID, "4")
+	_, err = e.ProcessCommand(ctx, compute.Query{Command: consts.CommandSet, Arguments: []string{"a", "2"}})
+	assert.ErrorIs(t, err, consts.ErrRecoveryReadOnly)
+	assert.NotErrorIs(t, err, consts.ErrReadOnly)
+
+	_, err = e.ProcessCommand(ctx, compute.Query{Command: consts.CommandDel, Arguments: []string{"a"}})
+	assert.ErrorIs(t, err, consts.ErrRecoveryReadOnly)
+
+	value, err := e.ProcessCommand(ctx, compute.Query{Command: consts.CommandGet, Arguments: []string{"b"}})
+	require.NoError(t, err)
+	assert.Equal(t, "2", value)
+}
+
+func TestEngine_LoneWriteWithShippedConfig(t *testing.T) {
+	cfg, err := configs.NewConfig("../../../config.yaml")
+	require.NoError(t, err)
+	cfg.Wal.DataDir = t.TempDir()
+
+	storage, err := NewInMemoryStorage(cfg)
+	require.NoError(t, err)
+
+	w, err := wal.NewWal(slog.Default(), cfg.Wal, "")
+	require.NoError(t, err)
+	w.Start(cfg.Wal)
+	defer w.Stop(cfg.Wal)
+
+	e, err := NewInMemoryEngine(storage, w, slog.Default(), cfg.Wal, "")
+	require.NoError(t, err)
+
+	// a single write on an idle server doesn't fill a batch, it's flushed by the batch timeout
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), consts.RequestID, "1"), cfg.App.Timeout)
+	defer cancel()
+
+	_, err = e.ProcessCommand(ctx, compute.Query{Command: consts.CommandSet, Arguments: []string{"a", "1"}})
+	require.NoError(t, err)
+
+	value, _ := storage.Get("a")
+	assert.Equal(t, "1", value)
+}
+
+func TestEngine_BackupWhileCompressing(t *testing.T) {
+	cfg := &configs.Config{
+		Wal: &configs.Wal{
+			FlushingBatchSize:    1,
+			FlushingBatchTimeout: time.Second,
+			MaxSegmentSizeBytes:  200,
+			DataDir:              t.TempDir(),
+			Compression:          defaults.CompressionSegments,
+		},
+		Snapshot: &configs.Snapshot{DataDir: t.TempDir(), Retain: 1},
+	}
+
+	storage, err := NewInMemoryStorage(cfg)
+	require.NoError(t, err)
+
+	w, err := wal.NewWal(slog.Default(), cfg.Wal, "")
+	require.NoError(t, err)
+	w.Start(cfg.Wal)
+
+	e, err := NewInMemoryEngine(storage, w, slog.Default(), cfg.Wal, "")
+	require.NoError(t, err)
+	e.SetSnapshots(cfg.Snapshot)
+
+	// backups copy the segments after this snapshot, they are compressed while being copied
+	ctx := context.WithValue(context.Background(), consts.RequestID, "save")
+	_, err = e.ProcessCommand(ctx, compute.Query{Command: consts.CommandSave})
+	require.NoError(t, err)
+
+	// every few writes close a segment, the wal compresses it in the background
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 300; i++ {
+			ctx := context.WithValue(context.Background(), consts.RequestID, strconv.Itoa(i))
+			_, err := e.ProcessCommand(ctx, compute.Query{Command: consts.CommandSet, Arguments: []string{"k" + strconv.Itoa(i), "v"}})
+			assert.NoError(t, err)
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		dir := filepath.Join(t.TempDir(), "backup")
+		_, err := e.Backup(dir)
+		require.NoError(t, err)
+
+		_, err = backup.Verify(dir)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, w.Stop(cfg.Wal))
+	assert.Greater(t, w.Stats().CompressedSegments, int64(0))
 }
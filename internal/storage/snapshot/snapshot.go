@@ -0,0 +1,556 @@
+// Package snapshot stores point-in-time copies of the storage buckets tagged with the wal position they cover
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/encryption"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/wal"
+)
+
+// file layout, integers are little endian:
+//
+//	magic "KVSNAP", version uint16
+//	created at unix nanos int64
+//	wal segment name length uint16, name, wal offset int64
+//	keys uint64, buckets uint32
+//	per bucket: keys uint32, per key: uvarint length and key, uvarint length and value
+//	crc32c of everything above uint32
+//
+// When encryption is on, the whole file is encrypted by the encryption package.
+const (
+	magic   = "KVSNAP"
+	version = 1
+
+	filePrefix     = "snapshot_"
+	tempSuffix     = ".tmp"
+	fileTimeFormat = "20060102_150405.000000000"
+
+	maxStringLength = 1 << 30
+	maxBuckets      = 1 << 16
+)
+
+var (
+	// ErrCorrupted is returned for snapshots that can't be trusted: truncated, altered or of an unknown version
+	ErrCorrupted = errors.New("snapshot is corrupted")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Snapshot is a copy of the storage buckets taken when the wal ended at Position
+type Snapshot struct {
+	Position  wal.Position
+	CreatedAt time.Time
+	Buckets   []map[string]string
+}
+
+// Keys returns the number of keys in all buckets
+func (s Snapshot) Keys() int {
+	keys := 0
+	for _, bucket := range s.Buckets {
+		keys += len(bucket)
+	}
+
+	return keys
+}
+
+// Write saves the snapshot to a new file in dir and returns the file name.
+// The file appears under its final name only after it's fully written and synced.
+func Write(dir string, s Snapshot) (string, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", fmt.Errorf("mkdir all: %w", err)
+	}
+
+	name := filePrefix + s.CreatedAt.UTC().Format(fileTimeFormat)
+	path := filepath.Join(dir, name)
+
+	file, err := os.OpenFile(path+tempSuffix, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", fmt.Errorf("create file: %w", err)
+	}
+
+	var w io.Writer = file
+	if keyring := encryption.Current(); keyring != nil {
+		w, err = encryption.NewWriter(file, keyring)
+	}
+	if err == nil {
+		err = encode(w, s)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path + tempSuffix)
+		return "", fmt.Errorf("write %s: %w", name, err)
+	}
+
+	err = os.Rename(path+tempSuffix, path)
+	if err != nil {
+		_ = os.Remove(path + tempSuffix)
+		return "", fmt.Errorf("rename: %w", err)
+	}
+
+	err = syncDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("sync dir: %w", err)
+	}
+
+	return name, nil
+}
+
+func encode(w io.Writer, s Snapshot) error {
+	crc := crc32.New(crcTable)
+	buf := bufio.NewWriterSize(io.MultiWriter(w, crc), 64*1024)
+
+	header := bytes.Buffer{}
+	header.WriteString(magic)
+	_ = binary.Write(&header, binary.LittleEndian, uint16(version))
+	_ = binary.Write(&header, binary.LittleEndian, s.CreatedAt.UnixNano())
+	_ = binary.Write(&header, binary.LittleEndian, uint16(len(s.Position.Segment)))
+	header.WriteString(s.Position.Segment)
+	_ = binary.Write(&header, binary.LittleEndian, s.Position.Offset)
+	_ = binary.Write(&header, binary.LittleEndian, uint64(s.Keys()))
+	_ = binary.Write(&header, binary.LittleEndian, uint32(len(s.Buckets)))
+
+	_, err := buf.Write(header.Bytes())
+	if err != nil {
+		return err
+	}
+
+	scratch := make([]byte, binary.MaxVarintLen64)
+
+	for _, bucket := range s.Buckets {
+		binary.LittleEndian.PutUint32(scratch, uint32(len(bucket)))
+		if _, err = buf.Write(scratch[:4]); err != nil {
+			return err
+		}
+
+		for key, value := range bucket {
+			for _, str := range []string{key, value} {
+				n := binary.PutUvarint(scratch, uint64(len(str)))
+				if _, err = buf.Write(scratch[:n]); err != nil {
+					return err
+				}
+				if _, err = buf.WriteString(str); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	err = buf.Flush()
+	if err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.LittleEndian, crc.Sum32())
+}
+
+// Read loads a snapshot and verifies its checksum
+func Read(path string) (Snapshot, error) {
+	s, _, err := decode(path, true)
+
+	return s, err
+}
+
+// Verify checks a snapshot file without keeping its keys in memory and returns the number of keys
+func Verify(path string) (int, error) {
+	_, keys, err := decode(path, false)
+
+	return keys, err
+}
+
+// decode reads a snapshot file and returns the number of read keys. Without keep the buckets stay empty.
+func decode(path string, keep bool) (Snapshot, int, error) {
+	file, in, err := openFile(path)
+	if err != nil {
+		return Snapshot{}, 0, err
+	}
+	defer file.Close()
+
+	r := newReader(in)
+
+	s, buckets, err := r.header()
+	if err != nil {
+		return Snapshot{}, 0, err
+	}
+
+	s.Buckets = make([]map[string]string, buckets)
+	total := 0
+
+	for i := range s.Buckets {
+		keys, err := r.uint32()
+		if err != nil {
+			return Snapshot{}, 0, err
+		}
+
+		size := 0
+		if keep {
+			size = int(keys)
+		}
+
+		s.Buckets[i] = make(map[string]string, size)
+		total += int(keys)
+
+		for j := uint32(0); j < keys; j++ {
+			key, err := r.string()
+			if err != nil {
+				return Snapshot{}, 0, err
+			}
+
+			value, err := r.string()
+			if err != nil {
+				return Snapshot{}, 0, err
+			}
+
+			if keep {
+				s.Buckets[i][key] = value
+			}
+		}
+	}
+
+	err = r.verify()
+	if err != nil {
+		return Snapshot{}, 0, err
+	}
+
+	return s, total, nil
+}
+
+// ReadHeader reads the position and the creation time of a snapshot without its buckets and checksum
+func ReadHeader(path string) (Snapshot, error) {
+	file, in, err := openFile(path)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer file.Close()
+
+	s, _, err := newReader(in).header()
+
+	return s, err
+}
+
+// openFile opens a snapshot file for reading, an encrypted one is decrypted with the keyring of the process
+func openFile(path string) (*os.File, io.Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open: %w", err)
+	}
+
+	in := bufio.NewReader(file)
+
+	// a short file is not encrypted, the snapshot reader reports it
+	head, _ := in.Peek(encryption.MagicLength)
+	if !encryption.IsEncrypted(head) {
+		return file, in, nil
+	}
+
+	decrypted, err := encryption.NewReader(in, encryption.Current())
+	if err != nil {
+		file.Close()
+		return nil, nil, corrupted(err)
+	}
+
+	return file, decryptedFile{decrypted}, nil
+}
+
+// decryptedFile reports altered encrypted data as a corrupted snapshot
+type decryptedFile struct {
+	r *encryption.Reader
+}
+
+func (f decryptedFile) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+
+	return n, corrupted(err)
+}
+
+func corrupted(err error) error {
+	if errors.Is(err, encryption.ErrCorrupted) {
+		return fmt.Errorf("%w: %w", ErrCorrupted, err)
+	}
+
+	return err
+}
+
+// List returns names of the snapshots in dir from the oldest, a missing directory has none
+func List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, filePrefix) || strings.HasSuffix(name, tempSuffix) {
+			continue
+		}
+
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// LoadLatest returns the newest snapshot in dir that can be read and is accepted by usable, which gets the snapshot header.
+// Found is false when there is no such snapshot, skipped snapshots are logged.
+func LoadLatest(dir string, usable func(header Snapshot) error) (s Snapshot, name string, found bool, err error) {
+	names, err := List(dir)
+	if err != nil {
+		return Snapshot{}, "", false, err
+	}
+
+	for i := len(names) - 1; i >= 0; i-- {
+		path := filepath.Join(dir, names[i])
+
+		header, err := ReadHeader(path)
+		if err != nil {
+			slog.Warn("snapshot is skipped", "snapshot", names[i], "error", err)
+			continue
+		}
+
+		err = usable(header)
+		if err != nil {
+			slog.Info("snapshot is skipped", "snapshot", names[i], "reason", err)
+			continue
+		}
+
+		s, err = Read(path)
+		if err != nil {
+			slog.Warn("snapshot is skipped", "snapshot", names[i], "error", err)
+			continue
+		}
+
+		return s, names[i], true, nil
+	}
+
+	return Snapshot{}, "", false, nil
+}
+
+// Prune removes all but the newest retain snapshots and unfinished snapshot files. It returns the kept snapshots from the oldest.
+func Prune(dir string, retain int) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), filePrefix) && strings.HasSuffix(entry.Name(), tempSuffix) {
+			// a save in progress never runs together with a prune
+			_ = os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	names, err := List(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(names) <= retain {
+		return names, nil
+	}
+
+	for _, name := range names[:len(names)-retain] {
+		err = os.Remove(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("remove %s: %w", name, err)
+		}
+	}
+
+	return names[len(names)-retain:], nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// reader decodes a snapshot file and checksums everything it reads
+type reader struct {
+	buf *bufio.Reader
+	crc hash.Hash32
+	in  io.Reader
+
+	scratch [8]byte
+}
+
+func newReader(r io.Reader) *reader {
+	buf := bufio.NewReaderSize(r, 64*1024)
+	crc := crc32.New(crcTable)
+
+	return &reader{buf: buf, crc: crc, in: io.TeeReader(buf, crc)}
+}
+
+func (r *reader) header() (Snapshot, uint32, error) {
+	head := make([]byte, len(magic))
+	if err := r.read(head); err != nil {
+		return Snapshot{}, 0, err
+	}
+	if string(head) != magic {
+		return Snapshot{}, 0, fmt.Errorf("%w: not a snapshot file", ErrCorrupted)
+	}
+
+	v, err := r.uint16()
+	if err != nil {
+		return Snapshot{}, 0, err
+	}
+	if v != version {
+		return Snapshot{}, 0, fmt.Errorf("%w: unknown version %d", ErrCorrupted, v)
+	}
+
+	created, err := r.uint64()
+	if err != nil {
+		return Snapshot{}, 0, err
+	}
+
+	segmentLength, err := r.uint16()
+	if err != nil {
+		return Snapshot{}, 0, err
+	}
+
+	segment := make([]byte, segmentLength)
+	if err = r.read(segment); err != nil {
+		return Snapshot{}, 0, err
+	}
+
+	offset, err := r.uint64()
+	if err != nil {
+		return Snapshot{}, 0, err
+	}
+
+	// the number of keys is informational, buckets carry their own counts
+	if _, err = r.uint64(); err != nil {
+		return Snapshot{}, 0, err
+	}
+
+	buckets, err := r.uint32()
+	if err != nil {
+		return Snapshot{}, 0, err
+	}
+	if buckets > maxBuckets {
+		return Snapshot{}, 0, fmt.Errorf("%w: %d buckets", ErrCorrupted, buckets)
+	}
+
+	s := Snapshot{
+		Position:  wal.Position{Segment: string(segment), Offset: int64(offset)},
+		CreatedAt: time.Unix(0, int64(created)),
+	}
+
+	return s, buckets, nil
+}
+
+func (r *reader) read(p []byte) error {
+	_, err := io.ReadFull(r.in, p)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: unexpected end of file", ErrCorrupted)
+	}
+
+	return err
+}
+
+func (r *reader) uint16() (uint16, error) {
+	b := r.scratch[:2]
+	err := r.read(b)
+
+	return binary.LittleEndian.Uint16(b), err
+}
+
+func (r *reader) uint32() (uint32, error) {
+	b := r.scratch[:4]
+	err := r.read(b)
+
+	return binary.LittleEndian.Uint32(b), err
+}
+
+func (r *reader) uint64() (uint64, error) {
+	b := r.scratch[:8]
+	err := r.read(b)
+
+	return binary.LittleEndian.Uint64(b), err
+}
+
+func (r *reader) string() (string, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return "", fmt.Errorf("%w: unexpected end of file", ErrCorrupted)
+		}
+
+		return "", fmt.Errorf("%w: %w", ErrCorrupted, err)
+	}
+	if length > maxStringLength {
+		return "", fmt.Errorf("%w: string of %d bytes", ErrCorrupted, length)
+	}
+
+	b := make([]byte, length)
+	if err = r.read(b); err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// verify compares the checksum at the end of the file with the checksum of the read data
+func (r *reader) verify() error {
+	sum := r.crc.Sum32()
+
+	b := make([]byte, 4)
+	_, err := io.ReadFull(r.buf, b)
+	if err != nil {
+		return fmt.Errorf("%w: missing checksum", ErrCorrupted)
+	}
+	if binary.LittleEndian.Uint32(b) != sum {
+		return fmt.Errorf("%w: checksum mismatch", ErrCorrupted)
+	}
+
+	_, err = r.buf.ReadByte()
+	if !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: data after the checksum", ErrCorrupted)
+	}
+
+	return nil
+}
+
+// ReadByte lets binary.ReadUvarint read lengths through the checksum
+func (r *reader) ReadByte() (byte, error) {
+	b, err := r.buf.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	r.scratch[0] = b
+	r.crc.Write(r.scratch[:1])
+
+	return b, nil
+}
@@ -0,0 +1,199 @@
+package snapshot
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/encryption"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/wal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSnapshot(createdAt time.Time) Snapshot {
+	return Snapshot{
+		Position:  wal.Position{Segment: "20240601_153053.00000", Offset: 120},
+		CreatedAt: createdAt,
+		Buckets: []map[string]string{
+			{"a": "1", "b": "2"},
+			{},
+			{"key_with_longer_name": "value"},
+		},
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	dir := t.TempDir()
+	s := testSnapshot(time.Unix(0, 1717255853000000123))
+
+	name, err := Write(dir, s)
+	require.NoError(t, err)
+	assert.Equal(t, "snapshot_20240601_153053.000000123", name)
+
+	read, err := Read(filepath.Join(dir, name))
+	require.NoError(t, err)
+
+	assert.Equal(t, s.Position, read.Position)
+	assert.True(t, s.CreatedAt.Equal(read.CreatedAt))
+	assert.Equal(t, s.Buckets, read.Buckets)
+	assert.Equal(t, 3, read.Keys())
+
+	header, err := ReadHeader(filepath.Join(dir, name))
+	require.NoError(t, err)
+	assert.Equal(t, s.Position, header.Position)
+	assert.Nil(t, header.Buckets)
+}
+
+func TestRead_Corrupted(t *testing.T) {
+	dir := t.TempDir()
+
+	name, err := Write(dir, testSnapshot(time.Now()))
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, name)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	tests := map[string][]byte{
+		"truncated":      data[:len(data)-7],
+		"no checksum":    data[:len(data)-4],
+		"flipped byte":   append(append([]byte{}, data[:40]...), append([]byte{data[40] ^ 0xff}, data[41:]...)...),
+		"trailing data":  append(append([]byte{}, data...), 0),
+		"not a snapshot": []byte("first SET a 1\n"),
+		"empty":          {},
+	}
+
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := os.WriteFile(path, content, 0644)
+			require.NoError(t, err)
+
+			_, err = Read(path)
+			assert.ErrorIs(t, err, ErrCorrupted)
+		})
+	}
+}
+
+func TestLoadLatest(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now()
+
+	oldest, err := Write(dir, testSnapshot(start))
+	require.NoError(t, err)
+
+	invalid := testSnapshot(start.Add(time.Second))
+	invalid.Position.Segment = "removed"
+	_, err = Write(dir, invalid)
+	require.NoError(t, err)
+
+	corrupted, err := Write(dir, testSnapshot(start.Add(2*time.Second)))
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(filepath.Join(dir, corrupted), 10))
+
+	// unfinished saves are ignored
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "snapshot_99999999_999999.000000000.tmp"), nil, 0644))
+
+	s, name, found, err := LoadLatest(dir, func(header Snapshot) error {
+		if header.Position.Segment == "removed" {
+			return errors.New("wal position is gone")
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, oldest, name)
+	assert.Equal(t, testSnapshot(start).Buckets, s.Buckets)
+
+	_, _, found, err = LoadLatest(filepath.Join(dir, "missing"), func(Snapshot) error { return nil })
+	require.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now()
+
+	names := make([]string, 0)
+	for i := 0; i < 4; i++ {
+		name, err := Write(dir, testSnapshot(start.Add(time.Duration(i)*time.Second)))
+		require.NoError(t, err)
+
+		names = append(names, name)
+	}
+
+	tmp := filepath.Join(dir, "snapshot_20240601_153053.000000000.tmp")
+	require.NoError(t, os.WriteFile(tmp, nil, 0644))
+
+	kept, err := Prune(dir, 2)
+	require.NoError(t, err)
+	assert.Equal(t, names[2:], kept)
+
+	listed, err := List(dir)
+	require.NoError(t, err)
+	assert.Equal(t, names[2:], listed)
+	assert.NoFileExists(t, tmp)
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+
+	name, err := Write(dir, testSnapshot(time.Now()))
+	require.NoError(t, err)
+
+	keys, err := Verify(filepath.Join(dir, name))
+	require.NoError(t, err)
+	assert.Equal(t, 3, keys)
+
+	require.NoError(t, os.Truncate(filepath.Join(dir, name), 30))
+
+	_, err = Verify(filepath.Join(dir, name))
+	assert.ErrorIs(t, err, ErrCorrupted)
+}
+
+func TestWriteRead_Encrypted(t *testing.T) {
+	keyring, err := encryption.NewKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	require.NoError(t, err)
+
+	encryption.SetKeyring(keyring)
+	t.Cleanup(func() { encryption.SetKeyring(nil) })
+
+	dir := t.TempDir()
+	s := testSnapshot(time.Now())
+
+	name, err := Write(dir, s)
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, name)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.True(t, encryption.IsEncrypted(data))
+	assert.NotContains(t, string(data), "key_with_longer_name")
+
+	read, err := Read(path)
+	require.NoError(t, err)
+	assert.Equal(t, s.Buckets, read.Buckets)
+
+	header, err := ReadHeader(path)
+	require.NoError(t, err)
+	assert.Equal(t, s.Position, header.Position)
+
+	// altered ciphertext is a corrupted snapshot, LoadLatest skips it
+	altered := append([]byte{}, data...)
+	altered[len(altered)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, altered, 0644))
+
+	_, err = Read(path)
+	assert.ErrorIs(t, err, ErrCorrupted)
+
+	// without the key the snapshot can't be read
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	encryption.SetKeyring(nil)
+
+	_, err = Read(path)
+	assert.ErrorIs(t, err, encryption.ErrUnknownKey)
+}
@@ -0,0 +1,159 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/configs"
+)
+
+// Reloader keeps the server certificate and the client CA pool in memory
+// and swaps them on Reload, so certificates can be rotated without a restart
+type Reloader struct {
+	cfg        configs.TLS
+	minVersion uint16
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func NewReloader(cfg *configs.TLS) (*Reloader, error) {
+	if cfg == nil {
+		return nil, errors.New("empty tls config")
+	}
+
+	minVersion, err := ParseVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, fmt.Errorf("parse min version: %w", err)
+	}
+
+	r := &Reloader{
+		cfg:        *cfg,
+		minVersion: minVersion,
+	}
+
+	err = r.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload reads certificate, key and CA files again. On error the previously loaded files stay in use.
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load key pair: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.cfg.CAFile != "" {
+		clientCAs, err = loadCertPool(r.cfg.CAFile)
+		if err != nil {
+			return fmt.Errorf("load client ca: %w", err)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.mu.Unlock()
+
+	return nil
+}
+
+// ServerConfig returns a server tls config that always uses the latest reloaded files
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: r.minVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			return &tls.Config{
+				MinVersion:   r.minVersion,
+				Certificates: []tls.Certificate{*r.cert},
+				ClientCAs:    r.clientCAs,
+				ClientAuth:   r.clientAuth(),
+			}, nil
+		},
+	}
+}
+
+func (r *Reloader) clientAuth() tls.ClientAuthType {
+	switch {
+	case r.cfg.RequireClientCert:
+		return tls.RequireAndVerifyClientCert
+	case r.clientCAs != nil:
+		return tls.VerifyClientCertIfGiven
+	default:
+		return tls.NoClientCert
+	}
+}
+
+// NewClientConfig builds a client tls config. caFile verifies the server, certFile and keyFile
+// are presented to servers that require mutual tls. Every argument is optional.
+func NewClientConfig(caFile string, certFile string, keyFile string, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("load ca: %w", err)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load key pair: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// Identity returns the common name of a verified client certificate, or an empty string
+func Identity(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+func ParseVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("tls version not supported: %s", version)
+	}
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return pool, nil
+}
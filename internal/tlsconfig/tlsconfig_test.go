@@ -0,0 +1,199 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/configs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", der)
+
+	return &testCA{cert: cert, key: key}
+}
+
+// issue writes a certificate signed by the ca to <dir>/<name>.pem and <dir>/<name>.key
+func (ca *testCA) issue(t *testing.T, dir string, name string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	writePEM(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+	writePEM(t, filepath.Join(dir, name+".key"), "EC PRIVATE KEY", keyDer)
+}
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	require.NoError(t, err)
+}
+
+// handshake connects a client to a server over a loopback connection
+func handshake(t *testing.T, serverCfg *tls.Config, clientCfg *tls.Config) (tls.ConnectionState, tls.ConnectionState, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	type result struct {
+		state tls.ConnectionState
+		err   error
+	}
+	done := make(chan result, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer conn.Close()
+
+		server := tls.Server(conn, serverCfg)
+		err = server.Handshake()
+		done <- result{state: server.ConnectionState(), err: err}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client := tls.Client(conn, clientCfg)
+	clientErr := client.Handshake()
+
+	r := <-done
+	if clientErr != nil {
+		return r.state, client.ConnectionState(), clientErr
+	}
+
+	return r.state, client.ConnectionState(), r.err
+}
+
+func TestReloader_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	ca.issue(t, dir, "server", 2)
+	ca.issue(t, dir, "alice", 3)
+
+	reloader, err := NewReloader(&configs.TLS{
+		CertFile:          filepath.Join(dir, "server.pem"),
+		KeyFile:           filepath.Join(dir, "server.key"),
+		CAFile:            filepath.Join(dir, "ca.pem"),
+		MinVersion:        "1.3",
+		RequireClientCert: true,
+	})
+	require.NoError(t, err)
+
+	clientCfg, err := NewClientConfig(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "alice.pem"), filepath.Join(dir, "alice.key"), "localhost")
+	require.NoError(t, err)
+
+	serverState, clientState, err := handshake(t, reloader.ServerConfig(), clientCfg)
+	require.NoError(t, err)
+
+	assert.Equal(t, "alice", Identity(serverState))
+	assert.Equal(t, uint16(tls.VersionTLS13), clientState.Version)
+
+	// a client without a certificate is rejected
+	anonymousCfg, err := NewClientConfig(filepath.Join(dir, "ca.pem"), "", "", "localhost")
+	require.NoError(t, err)
+
+	_, _, err = handshake(t, reloader.ServerConfig(), anonymousCfg)
+	assert.Error(t, err)
+}
+
+func TestReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	ca.issue(t, dir, "server", 2)
+
+	reloader, err := NewReloader(&configs.TLS{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server.key"),
+	})
+	require.NoError(t, err)
+
+	serverCfg := reloader.ServerConfig()
+
+	clientCfg, err := NewClientConfig(filepath.Join(dir, "ca.pem"), "", "", "localhost")
+	require.NoError(t, err)
+
+	_, clientState, err := handshake(t, serverCfg, clientCfg)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), clientState.PeerCertificates[0].SerialNumber.Int64())
+
+	// rotate the certificate, the same server config picks it up
+	ca.issue(t, dir, "server", 4)
+	require.NoError(t, reloader.Reload())
+
+	_, clientState, err = handshake(t, serverCfg, clientCfg)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), clientState.PeerCertificates[0].SerialNumber.Int64())
+
+	// broken files keep the previous certificate in use
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "server.pem"), []byte("broken"), 0600))
+	assert.Error(t, reloader.Reload())
+
+	_, clientState, err = handshake(t, serverCfg, clientCfg)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), clientState.PeerCertificates[0].SerialNumber.Int64())
+}
+
+func TestParseVersion(t *testing.T) {
+	version, err := ParseVersion("1.3")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), version)
+
+	_, err = ParseVersion("1.0")
+	assert.Error(t, err)
+}
@@ -0,0 +1,389 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/encryption"
+)
+
+// Compaction merges a window of adjacent closed segments into the last segment of the window, keeping the last record
+// of every key. The active segment is never merged, writes go on while segments are merged.
+//
+// The merged file is written next to the segments and swapped in by a manifest: once the manifest is written the swap
+// is finished on start after a crash, before the wal is read.
+const (
+	compactionManifest = "compaction.manifest"
+	compactionSuffix   = ".compact.tmp" // ends the merged file until it replaces the last segment of the window
+
+	compactionChunkSize = 64 * 1024 // merged records are compressed and encrypted in chunks
+)
+
+// compactionSwap is the manifest of a swap
+type compactionSwap struct {
+	Inputs []string `json:"inputs"` // merged segments from the oldest, the last one is replaced
+	Output string   `json:"output"` // file name of the merged segment
+}
+
+// mergedRecord is the last record of a key in a window
+type mergedRecord struct {
+	order  int // in the window, merged records are written in the wal order
+	record Record
+}
+
+func (w *Wal) compactWals() error {
+	window, older, err := w.compactionWindow()
+	if err != nil {
+		return fmt.Errorf("compaction window: %w", err)
+	}
+	if len(window) < 2 {
+		return nil
+	}
+
+	records, err := mergeSegments(w.dataDir, window, older)
+	if err != nil {
+		return fmt.Errorf("merge segments: %w", err)
+	}
+
+	output := window[len(window)-1]
+	swap := compactionSwap{Inputs: window, Output: output + w.segments.suffix()}
+
+	size, err := writeMerged(filepath.Join(w.dataDir, swap.Output+compactionSuffix), records, w.segments.compressBatches, w.segments.keyring)
+	if err != nil {
+		return fmt.Errorf("write merged segment: %w", err)
+	}
+
+	// pruning and the compression of segments replace files under segmentMu too
+	w.segmentMu.Lock()
+	defer w.segmentMu.Unlock()
+
+	err = writeCompactionManifest(w.dataDir, swap)
+	if err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+
+	err = finishCompaction(w.dataDir, swap)
+	if err != nil {
+		return fmt.Errorf("swap segments: %w", err)
+	}
+
+	for _, segment := range window {
+		delete(w.compactionSizes, segment)
+	}
+	w.compactionSizes[output] = size
+
+	w.logger.Debug("wal segments compacted", "segments", len(window), "output", output, "records", len(records), "bytes", size)
+
+	return nil
+}
+
+// compactionWindow returns the oldest run of at least two adjacent closed segments of at most
+// defaults.WalCompactionWindow segment sizes in total, and the segments before it
+func (w *Wal) compactionWindow() ([]string, []string, error) {
+	w.segmentMu.Lock()
+	segments, err := Segments(w.dataDir)
+	w.segmentMu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the latest segment is active or continued by the next write
+	if len(segments) < 3 {
+		return nil, nil, nil
+	}
+	closed := segments[:len(segments)-1]
+
+	// closed segments don't change, compressing one keeps its uncompressed size
+	known := make(map[string]int64, len(closed))
+	sizes := make([]int64, len(closed))
+
+	for i, segment := range closed {
+		size, ok := w.compactionSizes[segment]
+		if !ok {
+			size, err = segmentLength(w.dataDir, segment)
+			if err != nil {
+				return nil, nil, fmt.Errorf("segment length: %s: %w", segment, err)
+			}
+		}
+
+		known[segment] = size
+		sizes[i] = size
+	}
+
+	w.compactionSizes = known
+
+	budget := int64(w.maxLogFileSegmentSize) * int64(w.compactionSegments)
+
+	for start := 0; start < len(closed)-1; start++ {
+		end := start + 1
+		total := sizes[start]
+
+		for end < len(closed) && total+sizes[end] <= budget {
+			total += sizes[end]
+			end++
+		}
+
+		if end-start >= 2 {
+			return closed[start:end], closed[:start], nil
+		}
+	}
+
+	return nil, nil, nil
+}
+
+// mergeSegments returns the last record of every key in window in the wal order. A DEL is kept while a segment
+// before the window leaves the key set, it would come back on replay without it.
+func mergeSegments(dir string, window []string, older []string) ([]Record, error) {
+	last := make(map[string]mergedRecord)
+	order := 0
+
+	for _, segment := range window {
+		_, err := replaySegment(dir, segment, 0, func(record Record, _ int64) error {
+			last[record.Query.Arguments[0]] = mergedRecord{order: order, record: record}
+			order++
+
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("replay %s: %w", segment, err)
+		}
+	}
+
+	// keys deleted in the window, true while the older segments leave them set
+	tombstones := make(map[string]bool)
+	for key, merged := range last {
+		if merged.record.Query.Command == consts.CommandDel {
+			tombstones[key] = false
+		}
+	}
+
+	if len(tombstones) > 0 {
+		for _, segment := range older {
+			_, err := replaySegment(dir, segment, 0, func(record Record, _ int64) error {
+				key := record.Query.Arguments[0]
+				if _, ok := tombstones[key]; ok {
+					tombstones[key] = record.Query.Command == consts.CommandSet
+				}
+
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("replay %s: %w", segment, err)
+			}
+		}
+	}
+
+	merged := make([]mergedRecord, 0, len(last))
+	for key, record := range last {
+		if set, ok := tombstones[key]; ok && !set {
+			continue
+		}
+
+		merged = append(merged, record)
+	}
+
+	sort.Slice(merged, func(i, j int) bool { return merged[i].order < merged[j].order })
+
+	records := make([]Record, 0, len(merged))
+	for _, record := range merged {
+		records = append(records, record.record)
+	}
+
+	return records, nil
+}
+
+// formatRecord returns the wal line of a record, the time and the id are kept
+func formatRecord(record Record) string {
+	line := fmt.Sprintf("%s %s %s \n", record.ID, record.Query.Command, strings.Join(record.Query.Arguments, " "))
+	if record.Time.IsZero() {
+		return line
+	}
+
+	return record.Time.UTC().Format(time.RFC3339Nano) + " " + line
+}
+
+// writeMerged writes records to a new file at path, compressed and encrypted as new segments are, and fsyncs it.
+// It returns the uncompressed size.
+func writeMerged(path string, records []Record, compress bool, keyring *encryption.Keyring) (int64, error) {
+	return writeSegmentFile(path, compress, keyring, func(w io.Writer) (int64, error) {
+		return writeMergedRecords(w, records)
+	})
+}
+
+// writeMergedRecords writes records in chunks, every chunk is a gzip member and an encrypted frame
+func writeMergedRecords(w io.Writer, records []Record) (int64, error) {
+	size := int64(0)
+	chunk := bytes.Buffer{}
+
+	flush := func() error {
+		size += int64(chunk.Len())
+
+		_, err := w.Write(chunk.Bytes())
+		if err != nil {
+			return err
+		}
+
+		chunk.Reset()
+
+		return nil
+	}
+
+	for _, record := range records {
+		chunk.WriteString(formatRecord(record))
+
+		if chunk.Len() >= compactionChunkSize {
+			err := flush()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if chunk.Len() > 0 {
+		err := flush()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return size, nil
+}
+
+func writeCompactionManifest(dir string, swap compactionSwap) error {
+	data, err := json.Marshal(swap)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, compactionManifest)
+
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path + ".tmp")
+		return err
+	}
+
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// finishCompaction swaps the merged file in and removes the merged segments, it's repeated after a crash.
+// The merged file replaces the last segment first, replaying the older segments of the window before it
+// gives the same state.
+func finishCompaction(dir string, swap compactionSwap) error {
+	if len(swap.Inputs) == 0 {
+		return fmt.Errorf("no merged segments")
+	}
+
+	output := swap.Inputs[len(swap.Inputs)-1]
+
+	err := os.Rename(filepath.Join(dir, swap.Output+compactionSuffix), filepath.Join(dir, swap.Output))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("rename: %w", err)
+	}
+
+	// the last segment may have been stored compressed or encrypted differently
+	for _, fileName := range segmentFiles(output) {
+		if fileName == swap.Output {
+			continue
+		}
+
+		err = removeFileWithRetries(dir, fileName)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	err = syncDir(dir)
+	if err != nil {
+		return fmt.Errorf("sync dir: %w", err)
+	}
+
+	for _, segment := range swap.Inputs[:len(swap.Inputs)-1] {
+		err = removeSegment(dir, segment)
+		if err != nil {
+			return fmt.Errorf("remove segment: %s: %w", segment, err)
+		}
+	}
+
+	err = syncDir(dir)
+	if err != nil {
+		return fmt.Errorf("sync dir: %w", err)
+	}
+
+	err = os.Remove(filepath.Join(dir, compactionManifest))
+	if err != nil {
+		return fmt.Errorf("remove manifest: %w", err)
+	}
+
+	return syncDir(dir)
+}
+
+// RecoverCompaction finishes a compaction interrupted by a crash, it must run before the wal in dir is read.
+// Merged files of compactions that didn't reach the swap are removed.
+func RecoverCompaction(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, compactionManifest))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("read manifest: %w", err)
+	}
+
+	if err == nil {
+		swap := compactionSwap{}
+
+		err = json.Unmarshal(data, &swap)
+		if err != nil {
+			return fmt.Errorf("decode manifest: %w", err)
+		}
+
+		err = finishCompaction(dir, swap)
+		if err != nil {
+			return fmt.Errorf("finish compaction: %w", err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return fmt.Errorf("read dir: %w", err)
+	}
+
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), compactionSuffix) {
+			err = removeFileWithRetries(dir, entry.Name())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
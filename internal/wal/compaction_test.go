@@ -0,0 +1,219 @@
+package wal
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testCompactionWal(t *testing.T, maxSize int, windowSegments int, segments ...string) *Wal {
+	dataDir := t.TempDir()
+
+	for i, records := range segments {
+		require.NoError(t, os.WriteFile(filepath.Join(dataDir, segmentName(uint64(i+1))), []byte(records), 0644))
+	}
+
+	return &Wal{
+		dataDir:               dataDir,
+		maxLogFileSegmentSize: maxSize,
+		compactionSegments:    windowSegments,
+		segments:              newSegmentManager(dataDir, maxSize, ""),
+		logger:                slog.Default(),
+	}
+}
+
+func replayedState(t *testing.T, dir string) map[string]string {
+	state := make(map[string]string)
+
+	_, _, err := Replay(dir, Position{}, Target{}, func(record Record) error {
+		switch record.Query.Command {
+		case consts.CommandSet:
+			state[record.Query.Arguments[0]] = record.Query.Arguments[1]
+		case consts.CommandDel:
+			delete(state, record.Query.Arguments[0])
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	return state
+}
+
+func TestCompaction_MergesClosedSegments(t *testing.T) {
+	active := "2024-06-01T15:30:56Z 6 SET c 1 \n"
+	w := testCompactionWal(t, 1024, 8,
+		"2024-06-01T15:30:53Z 1 SET a 1 \n2024-06-01T15:30:53Z 2 SET b 1 \n",
+		"2024-06-01T15:30:54Z 3 SET a 2 \n2024-06-01T15:30:54Z 4 DEL b \n",
+		"2024-06-01T15:30:55Z 5 SET d 1 \n",
+		active,
+	)
+	before := replayedState(t, w.dataDir)
+
+	require.NoError(t, w.compactWals())
+
+	segments, err := Segments(w.dataDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{segmentName(3), segmentName(4)}, segments)
+
+	// the last record of every key keeps its time and id, nothing is older than the window, so the DEL is dropped
+	data, err := ReadSegment(w.dataDir, segmentName(3))
+	require.NoError(t, err)
+	assert.Equal(t, "2024-06-01T15:30:54Z 3 SET a 2 \n2024-06-01T15:30:55Z 5 SET d 1 \n", string(data))
+
+	data, err = ReadSegment(w.dataDir, segmentName(4))
+	require.NoError(t, err)
+	assert.Equal(t, active, string(data))
+
+	assert.Equal(t, before, replayedState(t, w.dataDir))
+	assert.NoFileExists(t, filepath.Join(w.dataDir, compactionManifest))
+
+	// a single closed segment is left alone
+	require.NoError(t, w.compactWals())
+
+	segments, err = Segments(w.dataDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{segmentName(3), segmentName(4)}, segments)
+}
+
+func TestCompaction_KeepsTombstones(t *testing.T) {
+	// the first segment doesn't fit the window with the next one, it stays and still sets b
+	w := testCompactionWal(t, 100, 1,
+		"1 SET b 0 \n"+strings.Repeat("2 SET filler value_that_fills_the_first_segment \n", 2),
+		"3 SET b 1 \n4 SET e 1 \n",
+		"5 DEL b \n6 DEL e \n7 SET f 1 \n",
+		"8 SET g 1 \n",
+	)
+	before := replayedState(t, w.dataDir)
+
+	require.NoError(t, w.compactWals())
+
+	segments, err := Segments(w.dataDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{segmentName(1), segmentName(3), segmentName(4)}, segments)
+
+	data, err := ReadSegment(w.dataDir, segmentName(3))
+	require.NoError(t, err)
+	assert.Equal(t, "5 DEL b \n7 SET f 1 \n", string(data))
+
+	assert.Equal(t, before, replayedState(t, w.dataDir))
+}
+
+func TestRecoverCompaction(t *testing.T) {
+	w := testCompactionWal(t, 1024, 8,
+		"1 SET a 1 \n",
+		"2 SET a 2 \n",
+		"3 SET b 1 \n",
+	)
+
+	// the crash came after the manifest was written and the merged file was renamed
+	swap := compactionSwap{Inputs: []string{segmentName(1), segmentName(2)}, Output: segmentName(2) + compressedSuffix}
+	merged, err := compressBatch([]byte("2 SET a 2 \n"))
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(w.dataDir, swap.Output+compactionSuffix), merged, 0644))
+	require.NoError(t, writeCompactionManifest(w.dataDir, swap))
+	require.NoError(t, os.Rename(filepath.Join(w.dataDir, swap.Output+compactionSuffix), filepath.Join(w.dataDir, swap.Output)))
+
+	// a merge that didn't reach the swap
+	stale := filepath.Join(w.dataDir, segmentName(3)+compactionSuffix)
+	require.NoError(t, os.WriteFile(stale, []byte("partial"), 0644))
+
+	segments, err := Segments(w.dataDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{segmentName(1), segmentName(2), segmentName(3)}, segments)
+
+	require.NoError(t, RecoverCompaction(w.dataDir))
+
+	segments, err = Segments(w.dataDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{segmentName(2), segmentName(3)}, segments)
+
+	fileName, err := SegmentFile(w.dataDir, segmentName(2))
+	require.NoError(t, err)
+	assert.Equal(t, swap.Output, fileName)
+
+	assert.NoFileExists(t, filepath.Join(w.dataDir, segmentName(2)))
+	assert.NoFileExists(t, filepath.Join(w.dataDir, compactionManifest))
+	assert.NoFileExists(t, stale)
+	assert.Equal(t, map[string]string{"a": "2", "b": "1"}, replayedState(t, w.dataDir))
+
+	// nothing to finish
+	require.NoError(t, RecoverCompaction(w.dataDir))
+	require.NoError(t, RecoverCompaction(filepath.Join(w.dataDir, "missing")))
+}
+
+func TestCompaction_StaleCompressedCopy(t *testing.T) {
+	w := testCompactionWal(t, 1024, 8,
+		"1 SET b 1 \n2 SET a 1 \n",
+		"3 SET a 2 \n",
+		"4 SET c 1 \n",
+	)
+	before := replayedState(t, w.dataDir)
+
+	// the compression of the second segment is copying it when a compaction merges the first one into it
+	path := filepath.Join(w.dataDir, segmentName(2))
+	source, err := os.Stat(path)
+	require.NoError(t, err)
+
+	tmp := path + compressedSuffix + ".tmp"
+	raw, compressed, err := compressFile(path, tmp)
+	require.NoError(t, err)
+
+	require.NoError(t, w.compactWals())
+	require.NoError(t, w.swapCompressed(segmentName(2), source, tmp, raw, compressed))
+
+	fileName, err := SegmentFile(w.dataDir, segmentName(2))
+	require.NoError(t, err)
+	assert.Equal(t, segmentName(2), fileName)
+	assert.NoFileExists(t, tmp)
+	assert.Equal(t, before, replayedState(t, w.dataDir))
+
+	// the merged segment is compressed by the next pass
+	require.NoError(t, w.compressSegment(segmentName(2)))
+
+	fileName, err = SegmentFile(w.dataDir, segmentName(2))
+	require.NoError(t, err)
+	assert.Equal(t, segmentName(2)+compressedSuffix, fileName)
+	assert.Equal(t, before, replayedState(t, w.dataDir))
+}
+
+func TestCompaction_ConcurrentCompression(t *testing.T) {
+	segments := make([]string, 0, 40)
+	for i := 0; i < cap(segments); i++ {
+		// every segment sets its own key and overwrites a shared one
+		segments = append(segments, fmt.Sprintf("%d SET key_%d %d \n%d SET shared %d \n", 2*i, i, i, 2*i+1, i))
+	}
+
+	w := testCompactionWal(t, 64, 3, segments...)
+	before := replayedState(t, w.dataDir)
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, w.compactWals())
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			w.compressSegments()
+		}
+	}()
+
+	wg.Wait()
+
+	assert.Equal(t, before, replayedState(t, w.dataDir))
+}
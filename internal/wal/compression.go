@@ -0,0 +1,358 @@
+package wal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/encryption"
+)
+
+// compressedSuffix ends names of compressed segment files. Positions and Segments use the name without it,
+// offsets are in uncompressed bytes.
+const compressedSuffix = ".gz"
+
+// Stats are wal compression counters since the start
+type Stats struct {
+	Compression        string  `json:"compression"`
+	CompressedSegments int64   `json:"compressed_segments"` // closed segments compressed
+	RawBytes           int64   `json:"raw_bytes"`           // bytes before compression
+	CompressedBytes    int64   `json:"compressed_bytes"`    // bytes after compression
+	CompressionRatio   float64 `json:"compression_ratio"`   // raw to compressed bytes, 0 before anything is compressed
+}
+
+type compressionStats struct {
+	segments   atomic.Int64
+	raw        atomic.Int64
+	compressed atomic.Int64
+}
+
+func (s *compressionStats) add(raw int, compressed int) {
+	s.raw.Add(int64(raw))
+	s.compressed.Add(int64(compressed))
+}
+
+// SegmentFile returns the name of the file of a segment in dir, compressed, encrypted or plain
+func SegmentFile(dir string, name string) (string, error) {
+	// a segment is renamed to the compressed file before the plain one is removed
+	for _, fileName := range segmentFiles(name) {
+		_, err := os.Stat(filepath.Join(dir, fileName))
+		if err == nil {
+			return fileName, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("segment %s: %w", name, os.ErrNotExist)
+}
+
+// segmentFiles returns the names a file of a segment can have, the plain one first
+func segmentFiles(name string) []string {
+	return []string{name, name + compressedSuffix, name + encryptedSuffix, name + compressedSuffix + encryptedSuffix}
+}
+
+// OpenSegment opens a segment for reading, encrypted segments are decrypted and compressed ones decompressed
+func OpenSegment(dir string, name string) (io.ReadCloser, error) {
+	fileName, err := SegmentFile(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filepath.Join(dir, fileName))
+	if err != nil {
+		return nil, err
+	}
+
+	if fileName == name {
+		return file, nil
+	}
+
+	reader, err := decodeSegment(fileName, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &decodedSegment{Reader: reader, file: file}, nil
+}
+
+// OpenedSegment is an open segment file. It's read as it was when opened, also after the file
+// is compressed, compacted or removed.
+type OpenedSegment struct {
+	Name     string
+	FileName string
+	File     *os.File
+}
+
+// Records returns the records of the segment, decrypted and decompressed
+func (s OpenedSegment) Records() (io.Reader, error) {
+	if s.FileName == s.Name {
+		return s.File, nil
+	}
+
+	return decodeSegment(s.FileName, s.File)
+}
+
+// OpenSegments opens the files of the segments from..to in dir, the segments must be closed with CloseSegments
+func OpenSegments(dir string, from string, to string) ([]OpenedSegment, error) {
+	segments, err := Segments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	opened := make([]OpenedSegment, 0)
+
+	for _, name := range segments {
+		if name < from {
+			continue
+		}
+		if name > to {
+			break
+		}
+
+		fileName, err := SegmentFile(dir, name)
+		if err == nil {
+			var file *os.File
+			file, err = os.Open(filepath.Join(dir, fileName))
+			opened = append(opened, OpenedSegment{Name: name, FileName: fileName, File: file})
+		}
+		if err != nil {
+			CloseSegments(opened)
+			return nil, fmt.Errorf("open segment %s: %w", name, err)
+		}
+	}
+
+	return opened, nil
+}
+
+// CloseSegments closes segments opened by OpenSegments
+func CloseSegments(segments []OpenedSegment) {
+	for _, segment := range segments {
+		if segment.File != nil {
+			segment.File.Close()
+		}
+	}
+}
+
+// decodeSegment returns the records of a segment file read from r, the suffixes of the file name tell how it's stored
+func decodeSegment(fileName string, r io.Reader) (io.Reader, error) {
+	reader := r
+
+	if strings.HasSuffix(fileName, encryptedSuffix) {
+		decrypted, err := encryption.NewReader(reader, encryption.Current())
+		if err != nil {
+			return nil, fmt.Errorf("decrypt: %s: %w", fileName, err)
+		}
+
+		reader = decrypted
+	}
+
+	if strings.HasSuffix(strings.TrimSuffix(fileName, encryptedSuffix), compressedSuffix) {
+		// batches compressed one by one are concatenated gzip members, the reader reads them as one stream
+		decompressed, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("gzip reader: %s: %w", fileName, err)
+		}
+
+		reader = decompressed
+	}
+
+	return reader, nil
+}
+
+type decodedSegment struct {
+	io.Reader
+	file *os.File
+}
+
+func (s *decodedSegment) Close() error {
+	return s.file.Close()
+}
+
+// ReadSegment returns the uncompressed records of a segment
+func ReadSegment(dir string, name string) ([]byte, error) {
+	reader, err := OpenSegment(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+// segmentLength returns the uncompressed size of a segment, a compressed or encrypted one is read to the end
+func segmentLength(dir string, name string) (int64, error) {
+	fileName, err := SegmentFile(dir, name)
+	if err != nil {
+		return 0, err
+	}
+
+	if fileName == name {
+		info, err := os.Stat(filepath.Join(dir, fileName))
+		if err != nil {
+			return 0, err
+		}
+
+		return info.Size(), nil
+	}
+
+	reader, err := OpenSegment(dir, name)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	return io.Copy(io.Discard, reader)
+}
+
+// compressBatch returns data as a gzip member, members appended to a segment read as one stream
+func compressBatch(data []byte) ([]byte, error) {
+	buf := bytes.Buffer{}
+
+	writer := gzip.NewWriter(&buf)
+
+	_, err := writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// compressFile writes the compressed copy of a closed segment to path and fsyncs it.
+// It returns the sizes before and after compression.
+func compressFile(src string, path string) (int64, int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, 0, fmt.Errorf("open: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, 0, fmt.Errorf("create: %w", err)
+	}
+
+	writer := gzip.NewWriter(out)
+
+	raw, err := io.Copy(writer, in)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return 0, 0, fmt.Errorf("compress: %w", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("stat: %w", err)
+	}
+
+	return raw, info.Size(), nil
+}
+
+// encodedWriter writes to a segment file compressed and encrypted as the file name tells, every write is a gzip member
+// and an encrypted frame
+type encodedWriter struct {
+	w         io.Writer
+	compress  bool
+	encrypter *encryption.Writer // nil when the file is not encrypted
+}
+
+func newEncodedWriter(w io.Writer, compress bool, keyring *encryption.Keyring) (*encodedWriter, error) {
+	writer := &encodedWriter{w: w, compress: compress}
+
+	if keyring != nil {
+		encrypter, err := encryption.NewWriter(w, keyring)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt file: %w", err)
+		}
+
+		writer.encrypter = encrypter
+	}
+
+	return writer, nil
+}
+
+func (w *encodedWriter) Write(data []byte) (int, error) {
+	encoded := data
+
+	if w.compress {
+		compressed, err := compressBatch(data)
+		if err != nil {
+			return 0, fmt.Errorf("compress: %w", err)
+		}
+
+		encoded = compressed
+	}
+
+	var err error
+	if w.encrypter != nil {
+		_, err = w.encrypter.Write(encoded)
+	} else {
+		_, err = w.w.Write(encoded)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("write file: %w", err)
+	}
+
+	return len(data), nil
+}
+
+// writeSegmentFile creates a segment file at path, write gets the writer of uncompressed records and returns their size.
+// The file is fsynced, on a failure it's removed.
+func writeSegmentFile(path string, compress bool, keyring *encryption.Keyring, write func(w io.Writer) (int64, error)) (int64, error) {
+	// a write interrupted by a crash or a failure left its file behind
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("create file: %w", err)
+	}
+
+	var size int64
+
+	writer, err := newEncodedWriter(file, compress, keyring)
+	if err == nil {
+		size, err = write(writer)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return 0, err
+	}
+
+	return size, nil
+}
@@ -0,0 +1,141 @@
+package wal
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/compute"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts/defaults"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testCompressedWal(t *testing.T, compression string) *Wal {
+	dataDir := t.TempDir()
+
+	w := &Wal{
+		dataDir:               dataDir,
+		maxLogFileSegmentSize: 200,
+		compression:           compression,
+		compressSignal:        make(chan struct{}, 1),
+		stop:                  make(chan struct{}),
+		logger:                slog.Default(),
+	}
+	w.segments = newSegmentManager(dataDir, 200, "")
+	w.segments.compressBatches = compression == defaults.CompressionBatches
+	w.segments.stats = &w.compressionStats
+
+	return w
+}
+
+func flushTestRecords(t *testing.T, w *Wal, from int, to int) {
+	for i := from; i < to; i++ {
+		value := fmt.Sprintf("a_repetitive_value_%d", i%2)
+		w.batch = []Log{{ID: fmt.Sprint(i), Query: compute.Query{Command: "SET", Arguments: []string{"key", value}}}}
+		require.NoError(t, w.flushRecords())
+	}
+	w.batch = nil
+}
+
+func replayedIDs(t *testing.T, dir string, from Position) []string {
+	ids := make([]string, 0)
+
+	_, _, err := Replay(dir, from, Target{}, func(record Record) error {
+		ids = append(ids, record.ID)
+		return nil
+	})
+	require.NoError(t, err)
+
+	return ids
+}
+
+func TestCompression_Segments(t *testing.T) {
+	w := testCompressedWal(t, defaults.CompressionSegments)
+
+	flushTestRecords(t, w, 0, 10)
+
+	position, err := w.Position()
+	require.NoError(t, err)
+
+	w.compressSegments()
+
+	segments, err := Segments(w.dataDir)
+	require.NoError(t, err)
+	require.Greater(t, len(segments), 2)
+
+	// closed segments are compressed, the active one is not
+	for i, segment := range segments {
+		fileName, err := SegmentFile(w.dataDir, segment)
+		require.NoError(t, err)
+
+		if i < len(segments)-1 {
+			assert.Equal(t, segment+compressedSuffix, fileName)
+		} else {
+			assert.Equal(t, segment, fileName)
+		}
+	}
+
+	assert.Equal(t, []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}, replayedIDs(t, w.dataDir, Position{}))
+
+	// positions are in uncompressed bytes
+	assert.True(t, Exists(w.dataDir, Position{Segment: segments[0], Offset: 100}))
+	assert.False(t, Exists(w.dataDir, Position{Segment: segments[0], Offset: 1000}))
+	data, err := ReadSegment(w.dataDir, segments[0])
+	require.NoError(t, err)
+
+	second := int64(strings.IndexByte(string(data), '\n') + 1)
+	assert.Equal(t, []string{"1", "2", "3", "4", "5", "6", "7", "8", "9"},
+		replayedIDs(t, w.dataDir, Position{Segment: segments[0], Offset: second}))
+
+	flushTestRecords(t, w, 10, 11)
+	assert.Equal(t, position.Segment, segments[len(segments)-1])
+
+	stats := w.Stats()
+	assert.Equal(t, int64(len(segments)-1), stats.CompressedSegments)
+	assert.Greater(t, stats.CompressionRatio, 1.0)
+
+	removed, err := w.RemoveSegmentsBefore(segments[1])
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.NoFileExists(t, filepath.Join(w.dataDir, segments[0]+compressedSuffix))
+}
+
+func TestCompression_Batches(t *testing.T) {
+	w := testCompressedWal(t, defaults.CompressionBatches)
+
+	// a plain segment of an older config is not appended to
+	require.NoError(t, os.WriteFile(filepath.Join(w.dataDir, segmentName(1)), []byte("old SET a 0 \n"), 0644))
+
+	flushTestRecords(t, w, 0, 3)
+	assert.FileExists(t, filepath.Join(w.dataDir, segmentName(2)+compressedSuffix))
+
+	position, err := w.Position()
+	require.NoError(t, err)
+	require.NoError(t, w.segments.close())
+
+	// a reopened wal continues the compressed segment, its uncompressed size is the position
+	w.segments = newSegmentManager(w.dataDir, 200, "")
+	w.segments.compressBatches = true
+	w.segments.stats = &w.compressionStats
+
+	require.NoError(t, w.segments.open())
+	active, ok := w.segments.position()
+	require.True(t, ok)
+	assert.Equal(t, position, active)
+
+	flushTestRecords(t, w, 3, 4)
+	require.NoError(t, w.segments.close())
+
+	assert.Equal(t, []string{"old", "0", "1", "2", "3"}, replayedIDs(t, w.dataDir, Position{}))
+	assert.Equal(t, []string{"3"}, replayedIDs(t, w.dataDir, position))
+
+	data, err := ReadSegment(w.dataDir, position.Segment)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "1 SET key a_repetitive_value_1 \n")
+
+	assert.Greater(t, w.Stats().RawBytes, int64(0))
+}
@@ -0,0 +1,65 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// encryptedSuffix ends names of encrypted segment files, after the suffix of a compressed one.
+// The key id is in the file header, a segment is encrypted with one key.
+const encryptedSuffix = ".enc"
+
+// IsEncryptedSegment reports whether a segment file name is of an encrypted segment
+func IsEncryptedSegment(fileName string) bool {
+	return strings.HasSuffix(fileName, encryptedSuffix)
+}
+
+// ExportSegment returns a segment as it's shipped to replicas: encrypted segments as they are stored,
+// under the file name, so the records stay encrypted on the way and on the replica. Other segments
+// are returned decompressed under the segment name.
+func ExportSegment(dir string, name string) (string, []byte, error) {
+	fileName, err := SegmentFile(dir, name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if !IsEncryptedSegment(fileName) {
+		data, err := ReadSegment(dir, name)
+		return name, data, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, fileName))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return fileName, data, nil
+}
+
+// DecodeSegment returns the records of a segment exported by ExportSegment, the keyring of the process decrypts them
+func DecodeSegment(fileName string, data []byte) ([]byte, error) {
+	if fileName == strings.TrimSuffix(strings.TrimSuffix(fileName, encryptedSuffix), compressedSuffix) {
+		return data, nil
+	}
+
+	reader, err := decodeSegment(fileName, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("read: %s: %w", fileName, err)
+	}
+
+	return records, nil
+}
+
+// EncryptedFile returns the name of the file of an encrypted segment that is not compressed
+func EncryptedFile(name string) string {
+	return name + encryptedSuffix
+}
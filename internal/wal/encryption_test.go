@@ -0,0 +1,171 @@
+package wal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts/defaults"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/encryption"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKeyring(t *testing.T, active string) *encryption.Keyring {
+	keyring, err := encryption.NewKeyring(active, map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 32),
+	})
+	require.NoError(t, err)
+
+	encryption.SetKeyring(keyring)
+	t.Cleanup(func() { encryption.SetKeyring(nil) })
+
+	return keyring
+}
+
+func testEncryptedWal(t *testing.T, compression string, keyring *encryption.Keyring) *Wal {
+	w := testCompressedWal(t, compression)
+	w.segments.keyring = keyring
+
+	return w
+}
+
+func reopenSegments(t *testing.T, w *Wal, keyring *encryption.Keyring) {
+	require.NoError(t, w.segments.close())
+
+	compressBatches := w.segments.compressBatches
+	w.segments = newSegmentManager(w.dataDir, 200, "")
+	w.segments.compressBatches = compressBatches
+	w.segments.stats = &w.compressionStats
+	w.segments.keyring = keyring
+}
+
+func TestEncryption_Segments(t *testing.T) {
+	for _, compression := range []string{defaults.CompressionNone, defaults.CompressionBatches} {
+		t.Run(compression, func(t *testing.T) {
+			keyring := testKeyring(t, "k1")
+			w := testEncryptedWal(t, compression, keyring)
+
+			// a plain segment written before encryption was turned on is not appended to
+			require.NoError(t, os.WriteFile(filepath.Join(w.dataDir, segmentName(1)), []byte("old SET a 0 \n"), 0644))
+
+			flushTestRecords(t, w, 0, 3)
+
+			position, err := w.Position()
+			require.NoError(t, err)
+			assert.Equal(t, segmentName(2), position.Segment)
+
+			fileName, err := SegmentFile(w.dataDir, position.Segment)
+			require.NoError(t, err)
+			assert.True(t, IsEncryptedSegment(fileName))
+
+			data, err := os.ReadFile(filepath.Join(w.dataDir, fileName))
+			require.NoError(t, err)
+			assert.NotContains(t, string(data), "a_repetitive_value")
+
+			// a reopened wal continues the encrypted segment
+			reopenSegments(t, w, keyring)
+			require.NoError(t, w.segments.open())
+			active, ok := w.segments.position()
+			require.True(t, ok)
+			assert.Equal(t, position, active)
+
+			flushTestRecords(t, w, 3, 4)
+			require.NoError(t, w.segments.close())
+
+			assert.Equal(t, []string{"old", "0", "1", "2", "3"}, replayedIDs(t, w.dataDir, Position{}))
+			assert.Equal(t, []string{"3"}, replayedIDs(t, w.dataDir, position))
+		})
+	}
+}
+
+func TestEncryption_Rotation(t *testing.T) {
+	w := testEncryptedWal(t, defaults.CompressionNone, testKeyring(t, "k1"))
+
+	flushTestRecords(t, w, 0, 2)
+
+	// after a rotation writes go to a new segment, the old one is read with the old key
+	rotated := testKeyring(t, "k2")
+	reopenSegments(t, w, rotated)
+
+	flushTestRecords(t, w, 2, 3)
+	require.NoError(t, w.segments.close())
+
+	segments, err := Segments(w.dataDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{segmentName(1), segmentName(2)}, segments)
+
+	for i, keyID := range []string{"k1", "k2"} {
+		file, err := os.Open(filepath.Join(w.dataDir, segments[i]+encryptedSuffix))
+		require.NoError(t, err)
+
+		reader, err := encryption.NewReader(file, rotated)
+		require.NoError(t, err)
+		assert.Equal(t, keyID, reader.KeyID())
+		require.NoError(t, file.Close())
+	}
+
+	assert.Equal(t, []string{"0", "1", "2"}, replayedIDs(t, w.dataDir, Position{}))
+
+	// compaction rewrites closed segments with the active key
+	require.NoError(t, w.segments.rollover())
+	w.compactionSegments = defaults.WalCompactionWindow
+
+	require.NoError(t, w.compactWals())
+
+	segments, err = Segments(w.dataDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{segmentName(2), segmentName(3)}, segments)
+
+	file, err := os.Open(filepath.Join(w.dataDir, segments[0]+encryptedSuffix))
+	require.NoError(t, err)
+	defer file.Close()
+
+	reader, err := encryption.NewReader(file, rotated)
+	require.NoError(t, err)
+	assert.Equal(t, "k2", reader.KeyID())
+
+	// all records set the same key, the last one is kept
+	assert.Equal(t, []string{"2"}, replayedIDs(t, w.dataDir, Position{}))
+}
+
+func TestExportDecodeSegment(t *testing.T) {
+	w := testEncryptedWal(t, defaults.CompressionBatches, testKeyring(t, "k1"))
+
+	flushTestRecords(t, w, 0, 2)
+	require.NoError(t, w.segments.close())
+
+	require.NoError(t, os.WriteFile(filepath.Join(w.dataDir, segmentName(9)), []byte("plain SET a 0 \n"), 0644))
+
+	segments, err := Segments(w.dataDir)
+	require.NoError(t, err)
+	require.Len(t, segments, 2)
+
+	// encrypted segments are shipped as they are stored
+	encryptedName, encrypted, err := ExportSegment(w.dataDir, segments[0])
+	require.NoError(t, err)
+	assert.Equal(t, segments[0]+compressedSuffix+encryptedSuffix, encryptedName)
+
+	records, err := DecodeSegment(encryptedName, encrypted)
+	require.NoError(t, err)
+
+	expected, err := ReadSegment(w.dataDir, segments[0])
+	require.NoError(t, err)
+	assert.Equal(t, expected, records)
+
+	fileName, data, err := ExportSegment(w.dataDir, segments[1])
+	require.NoError(t, err)
+	assert.Equal(t, segments[1], fileName)
+
+	records, err = DecodeSegment(fileName, data)
+	require.NoError(t, err)
+	assert.Equal(t, "plain SET a 0 \n", string(records))
+
+	// a replica without the key can't read the records
+	encryption.SetKeyring(nil)
+
+	_, err = DecodeSegment(encryptedName, encrypted)
+	assert.ErrorIs(t, err, encryption.ErrUnknownKey)
+}
@@ -0,0 +1,39 @@
+package wal
+
+import "context"
+
+// Future is the result of a submitted log: the result of the flush of the batch that contains it
+type Future struct {
+	done chan struct{}
+	err  error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+func (f *Future) complete(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// Done is closed when the batch containing the log is flushed
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns the result of the flush, it's set when Done is closed
+func (f *Future) Err() error {
+	<-f.done
+	return f.err
+}
+
+// Wait waits for the flush. When ctx is done first its error is returned, the log is still written.
+func (f *Future) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,494 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/encryption"
+)
+
+// ErrDamaged is returned for a segment with a record that doesn't parse, an incomplete last record, a gzip member
+// that fails its checksum or an encrypted frame that fails authentication. The records before the damage are valid.
+var ErrDamaged = errors.New("wal segment is damaged")
+
+// ErrDamagedHistory is returned by RepairWal for damage before the last segment: the later segments would be
+// replayed over the records lost in the damage
+var ErrDamagedHistory = errors.New("wal is damaged before its last segment")
+
+// rewriteSuffix ends a segment file written by a repair or a conversion until it replaces the old file
+const rewriteSuffix = ".rewrite.tmp"
+
+// SegmentInfo describes a segment read by InspectSegment, up to the damage in a damaged one
+type SegmentInfo struct {
+	Name       string    `json:"name"`
+	File       string    `json:"file"`
+	FileSize   int64     `json:"file_size"` // on the disk
+	Size       int64     `json:"size"`      // uncompressed bytes of the valid records
+	Records    int       `json:"records"`
+	Start      Position  `json:"start"`
+	End        Position  `json:"end"`        // after the last valid record
+	FirstTime  time.Time `json:"first_time"` // zero for records written before timestamps
+	LastTime   time.Time `json:"last_time"`
+	Compressed bool      `json:"compressed"`
+	Encrypted  bool      `json:"encrypted"`
+	KeyID      string    `json:"key_id,omitempty"`
+}
+
+// Format returns the format of the segment file: plain, gz, enc or gz.enc
+func (i SegmentInfo) Format() string {
+	format := strings.TrimPrefix(strings.TrimPrefix(i.File, i.Name), ".")
+	if format == "" {
+		return "plain"
+	}
+
+	return format
+}
+
+// InspectSegment reads a segment to the end or to the damage and passes its records to apply, nil is allowed.
+// Gzip checksums and encrypted frames are verified before their records are parsed. A damaged segment
+// returns ErrDamaged with the info of the valid records, other errors mean the segment can't be read.
+func InspectSegment(dir string, name string, apply func(Record, Position) error) (SegmentInfo, error) {
+	fileName, err := SegmentFile(dir, name)
+	if err != nil {
+		return SegmentInfo{}, err
+	}
+
+	file, err := os.Open(filepath.Join(dir, fileName))
+	if err != nil {
+		return SegmentInfo{}, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return SegmentInfo{}, err
+	}
+
+	info := SegmentInfo{
+		Name:       name,
+		File:       fileName,
+		FileSize:   stat.Size(),
+		Start:      Position{Segment: name},
+		End:        Position{Segment: name},
+		Compressed: strings.HasSuffix(strings.TrimSuffix(fileName, encryptedSuffix), compressedSuffix),
+		Encrypted:  IsEncryptedSegment(fileName),
+	}
+
+	scanner := &recordScanner{info: &info, apply: apply}
+
+	var source io.Reader = file
+	if info.Encrypted {
+		reader, err := encryption.NewReader(file, encryption.Current())
+		if errors.Is(err, encryption.ErrCorrupted) {
+			return info, fmt.Errorf("%w: %s: %w", ErrDamaged, fileName, err)
+		}
+		if err != nil {
+			return info, fmt.Errorf("decrypt: %s: %w", fileName, err)
+		}
+
+		info.KeyID = reader.KeyID()
+		source = reader
+	}
+
+	if info.Compressed {
+		err = scanner.readMembers(source)
+	} else {
+		err = scanner.read(source)
+	}
+	if err == nil {
+		err = scanner.finish()
+	}
+
+	return info, err
+}
+
+// recordScanner parses verified data of a segment line by line, a line is a record once it ends with a newline
+type recordScanner struct {
+	info    *SegmentInfo
+	apply   func(Record, Position) error
+	pending []byte // the start of a line that is not complete yet
+}
+
+func (s *recordScanner) damaged(format string, args ...any) error {
+	return fmt.Errorf("%w: %s: offset %d: %s", ErrDamaged, s.info.File, s.info.Size, fmt.Sprintf(format, args...))
+}
+
+// read scans a plain or encrypted stream, frames are authenticated before they are returned
+func (s *recordScanner) read(r io.Reader) error {
+	buf := make([]byte, compactionChunkSize)
+
+	for {
+		n, err := r.Read(buf)
+
+		feedErr := s.feed(buf[:n])
+		if feedErr != nil {
+			return feedErr
+		}
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if errors.Is(err, encryption.ErrCorrupted) {
+			return s.damaged("%v", err)
+		}
+		if err != nil {
+			return fmt.Errorf("read: %s: %w", s.info.File, err)
+		}
+	}
+}
+
+// readMembers scans gzip members one by one, a member is parsed only after its checksum is verified
+func (s *recordScanner) readMembers(r io.Reader) error {
+	// the gzip reader keeps reading from the same buffered reader between members
+	buffered := bufio.NewReader(r)
+
+	reader, err := gzip.NewReader(buffered)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return s.damaged("gzip member: %v", err)
+	}
+
+	for {
+		reader.Multistream(false)
+
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return s.damaged("gzip member: %v", err)
+		}
+
+		err = s.feed(data)
+		if err != nil {
+			return err
+		}
+
+		err = reader.Reset(buffered)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return s.damaged("gzip member: %v", err)
+		}
+	}
+}
+
+func (s *recordScanner) feed(data []byte) error {
+	s.pending = append(s.pending, data...)
+
+	start := 0
+	for {
+		end := bytes.IndexByte(s.pending[start:], '\n')
+		if end < 0 {
+			break
+		}
+
+		err := s.record(string(s.pending[start : start+end+1]))
+		if err != nil {
+			return err
+		}
+
+		start += end + 1
+	}
+
+	s.pending = append(s.pending[:0], s.pending[start:]...)
+
+	return nil
+}
+
+func (s *recordScanner) record(line string) error {
+	start := s.info.Size
+
+	if strings.TrimSpace(line) != "" {
+		record, err := ParseRecord(line)
+		if err != nil {
+			return s.damaged("%v", err)
+		}
+
+		if s.apply != nil {
+			err = s.apply(record, Position{Segment: s.info.Name, Offset: start})
+			if err != nil {
+				return err
+			}
+		}
+
+		s.info.Records++
+		if !record.Time.IsZero() {
+			if s.info.FirstTime.IsZero() {
+				s.info.FirstTime = record.Time
+			}
+			s.info.LastTime = record.Time
+		}
+	}
+
+	s.info.Size += int64(len(line))
+	s.info.End.Offset = s.info.Size
+
+	return nil
+}
+
+// finish reports a record cut by a crash in the middle of a write, records always end with a newline
+func (s *recordScanner) finish() error {
+	if len(s.pending) > 0 {
+		return s.damaged("incomplete record of %d bytes", len(s.pending))
+	}
+
+	return nil
+}
+
+// RepairSegment cuts a damaged segment after its last valid record. A plain segment is truncated, a compressed
+// or encrypted one is rewritten with the valid records, encrypted with the active key. It returns the info of
+// the valid records and whether the segment was damaged. The wal must not be in use.
+func RepairSegment(dir string, name string) (SegmentInfo, bool, error) {
+	info, err := InspectSegment(dir, name, nil)
+	if err == nil {
+		return info, false, nil
+	}
+	if !errors.Is(err, ErrDamaged) {
+		return info, false, err
+	}
+
+	if info.File == name {
+		err = truncateFile(filepath.Join(dir, name), info.Size)
+		if err != nil {
+			return info, true, fmt.Errorf("truncate: %w", err)
+		}
+
+		return info, true, nil
+	}
+
+	var keyring *encryption.Keyring
+	if info.Encrypted {
+		keyring = encryption.Current()
+	}
+
+	fileName, err := rewriteSegment(dir, info, info.Compressed, keyring)
+	if err != nil {
+		return info, true, err
+	}
+
+	info.File = fileName
+
+	return info, true, nil
+}
+
+// WalRepair is the result of RepairWal
+type WalRepair struct {
+	Damaged SegmentInfo // the valid records of the damaged segment
+	End     Position    // the wal ends here after the repair
+	Dropped []string    // segments after the damaged one, removed
+}
+
+// RepairWal cuts the wal after its last valid record, it returns nil when nothing is damaged. Damage in the last
+// segment is a write cut by a crash, the segment is cut. Damage in an earlier segment fails with ErrDamagedHistory,
+// with dropLater the segments after it are removed as well and the wal ends at the damage. The wal must not be in use.
+func RepairWal(dir string, dropLater bool) (*WalRepair, error) {
+	segments, err := Segments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, segment := range segments {
+		info, err := InspectSegment(dir, segment, nil)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrDamaged) {
+			return nil, fmt.Errorf("inspect %s: %w", segment, err)
+		}
+
+		later := segments[i+1:]
+		if len(later) > 0 && !dropLater {
+			return nil, fmt.Errorf("%w: %w, the valid records end at lsn %s, %d later segments follow",
+				ErrDamagedHistory, err, info.End, len(later))
+		}
+
+		// the newest segments go first, a repair interrupted by a crash leaves no gap
+		for j := len(later) - 1; j >= 0; j-- {
+			err = removeSegment(dir, later[j])
+			if err != nil {
+				return nil, fmt.Errorf("remove segment: %s: %w", later[j], err)
+			}
+
+			err = syncDir(dir)
+			if err != nil {
+				return nil, fmt.Errorf("sync dir: %w", err)
+			}
+		}
+
+		info, _, err = RepairSegment(dir, segment)
+		if err != nil {
+			return nil, fmt.Errorf("repair %s: %w", segment, err)
+		}
+
+		return &WalRepair{Damaged: info, End: info.End, Dropped: later}, nil
+	}
+
+	return nil, nil
+}
+
+// ConvertSegment rewrites a segment compressed in batches and encrypted with the active key or not, a segment
+// already in the format is left as it is. It returns the file names before and after. A damaged segment
+// must be repaired first, the wal must not be in use.
+func ConvertSegment(dir string, name string, compress bool, encrypt bool) (string, string, error) {
+	info, err := InspectSegment(dir, name, nil)
+	if err != nil {
+		return info.File, info.File, err
+	}
+
+	var keyring *encryption.Keyring
+	if encrypt {
+		keyring = encryption.Current()
+		if keyring == nil {
+			return info.File, info.File, fmt.Errorf("%w: encryption keys are not configured", encryption.ErrUnknownKey)
+		}
+	}
+
+	if info.Compressed == compress && info.Encrypted == encrypt {
+		return info.File, info.File, nil
+	}
+
+	fileName, err := rewriteSegment(dir, info, compress, keyring)
+	if err != nil {
+		return info.File, info.File, err
+	}
+
+	return info.File, fileName, nil
+}
+
+// rewriteSegment writes the valid records of a segment to a new file and swaps it in, the old file is removed
+// when the new one has another name. It returns the name of the new file.
+func rewriteSegment(dir string, info SegmentInfo, compress bool, keyring *encryption.Keyring) (string, error) {
+	fileName := info.Name
+	if compress {
+		fileName += compressedSuffix
+	}
+	if keyring != nil {
+		fileName += encryptedSuffix
+	}
+
+	reader, err := OpenSegment(dir, info.Name)
+	if err != nil {
+		return "", fmt.Errorf("open: %w", err)
+	}
+	defer reader.Close()
+
+	// the records past the size are damaged, they are never read
+	records := &prefixReader{r: reader, remaining: info.Size}
+
+	path := filepath.Join(dir, fileName)
+
+	_, err = writeSegmentFile(path+rewriteSuffix, compress, keyring, func(w io.Writer) (int64, error) {
+		size, err := copyChunks(w, records)
+		if err == nil && size != info.Size {
+			err = fmt.Errorf("read %d of %d bytes of valid records", size, info.Size)
+		}
+
+		return size, err
+	})
+	if err != nil {
+		return "", fmt.Errorf("write segment: %w", err)
+	}
+
+	err = os.Rename(path+rewriteSuffix, path)
+	if err != nil {
+		return "", fmt.Errorf("rename: %w", err)
+	}
+
+	// the new file is read first while both exist, as with the compression of a segment
+	if fileName != info.File {
+		err = syncDir(dir)
+		if err != nil {
+			return "", fmt.Errorf("sync dir: %w", err)
+		}
+
+		err = removeFileWithRetries(dir, info.File)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = syncDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("sync dir: %w", err)
+	}
+
+	return fileName, nil
+}
+
+// prefixReader reads the first remaining bytes of r. The reader of a damaged segment may return the error of the
+// damage with the last valid bytes, errors once they are read are not returned.
+type prefixReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (p *prefixReader) Read(b []byte) (int, error) {
+	if p.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > p.remaining {
+		b = b[:p.remaining]
+	}
+
+	n, err := p.r.Read(b)
+	p.remaining -= int64(n)
+
+	if p.remaining <= 0 {
+		return n, io.EOF
+	}
+
+	return n, err
+}
+
+// copyChunks copies r to w in writes of compactionChunkSize, every write is a gzip member and an encrypted frame
+func copyChunks(w io.Writer, r io.Reader) (int64, error) {
+	buf := make([]byte, compactionChunkSize)
+	size := int64(0)
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			_, writeErr := w.Write(buf[:n])
+			if writeErr != nil {
+				return size, writeErr
+			}
+
+			size += int64(n)
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return size, nil
+		}
+		if err != nil {
+			return size, fmt.Errorf("read: %w", err)
+		}
+	}
+}
+
+func truncateFile(path string, size int64) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = file.Truncate(size)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
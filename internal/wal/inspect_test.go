@@ -0,0 +1,209 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts/defaults"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectSegment(t *testing.T) {
+	dir := t.TempDir()
+	records := "2024-06-01T15:30:53Z 1 SET a 1 \n\n2024-06-01T15:30:54Z 2 DEL a \n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, segmentName(1)), []byte(records), 0644))
+
+	positions := make([]Position, 0)
+	info, err := InspectSegment(dir, segmentName(1), func(record Record, position Position) error {
+		positions = append(positions, position)
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []Position{{Segment: segmentName(1), Offset: 0}, {Segment: segmentName(1), Offset: 33}}, positions)
+	assert.Equal(t, 2, info.Records)
+	assert.Equal(t, int64(len(records)), info.Size)
+	assert.Equal(t, Position{Segment: segmentName(1), Offset: int64(len(records))}, info.End)
+	assert.Equal(t, time.Date(2024, 6, 1, 15, 30, 53, 0, time.UTC), info.FirstTime)
+	assert.Equal(t, time.Date(2024, 6, 1, 15, 30, 54, 0, time.UTC), info.LastTime)
+	assert.Equal(t, "plain", info.Format())
+}
+
+func TestRepairSegment_Plain(t *testing.T) {
+	dir := t.TempDir()
+	valid := "1 SET a 1 \n2 SET b 1 \n"
+
+	for _, tail := range []string{"3 SET c", "3 SET c 1 2 \n4 SET d 1 \n", "3 SET c 1"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, segmentName(1)), []byte(valid+tail), 0644))
+
+		info, err := InspectSegment(dir, segmentName(1), nil)
+		require.ErrorIs(t, err, ErrDamaged, tail)
+		assert.Equal(t, int64(len(valid)), info.Size)
+		assert.Equal(t, 2, info.Records)
+
+		info, repaired, err := RepairSegment(dir, segmentName(1))
+		require.NoError(t, err)
+		assert.True(t, repaired)
+		assert.Equal(t, segmentName(1), info.File)
+
+		data, err := os.ReadFile(filepath.Join(dir, segmentName(1)))
+		require.NoError(t, err)
+		assert.Equal(t, valid, string(data))
+
+		_, repaired, err = RepairSegment(dir, segmentName(1))
+		require.NoError(t, err)
+		assert.False(t, repaired)
+	}
+}
+
+func TestRepairSegment_Encoded(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		w := testCompressedWal(t, defaults.CompressionBatches)
+		if encrypted {
+			w.segments.keyring = testKeyring(t, "k1")
+		}
+
+		w.segments.maxSize = 1024
+		flushTestRecords(t, w, 0, 4)
+		require.NoError(t, w.segments.close())
+
+		fileName, err := SegmentFile(w.dataDir, segmentName(1))
+		require.NoError(t, err)
+
+		// the last batch is cut by a crash
+		path := filepath.Join(w.dataDir, fileName)
+		stat, err := os.Stat(path)
+		require.NoError(t, err)
+		require.NoError(t, os.Truncate(path, stat.Size()-5))
+
+		info, err := InspectSegment(w.dataDir, segmentName(1), nil)
+		require.ErrorIs(t, err, ErrDamaged)
+		assert.Equal(t, 3, info.Records)
+		assert.Equal(t, encrypted, info.Encrypted)
+
+		_, repaired, err := RepairSegment(w.dataDir, segmentName(1))
+		require.NoError(t, err)
+		assert.True(t, repaired)
+
+		info, err = InspectSegment(w.dataDir, segmentName(1), nil)
+		require.NoError(t, err)
+		assert.Equal(t, fileName, info.File)
+		assert.Equal(t, []string{"0", "1", "2"}, replayedIDs(t, w.dataDir, Position{}))
+	}
+}
+
+func TestRepairSegment_GzipMembers(t *testing.T) {
+	first, err := compressBatch([]byte("1 SET a 1 \n2 SET b 1 \n"))
+	require.NoError(t, err)
+	second, err := compressBatch([]byte("3 SET c 1 \n"))
+	require.NoError(t, err)
+
+	for name, damage := range map[string]int{
+		"checksum": len(first) + len(second) - 8, // the crc32 in the trailer of the second member
+		"header":   len(first),                   // the magic of the second member
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			data := append(append([]byte{}, first...), second...)
+			data[damage] ^= 0xff
+			require.NoError(t, os.WriteFile(filepath.Join(dir, segmentName(1)+compressedSuffix), data, 0644))
+
+			info, err := InspectSegment(dir, segmentName(1), nil)
+			require.ErrorIs(t, err, ErrDamaged)
+			assert.Equal(t, 2, info.Records)
+
+			info, repaired, err := RepairSegment(dir, segmentName(1))
+			require.NoError(t, err)
+			assert.True(t, repaired)
+			assert.Equal(t, segmentName(1)+compressedSuffix, info.File)
+
+			info, err = InspectSegment(dir, segmentName(1), nil)
+			require.NoError(t, err)
+			assert.Equal(t, 2, info.Records)
+			assert.Equal(t, []string{"1", "2"}, replayedIDs(t, dir, Position{}))
+		})
+	}
+}
+
+func TestRepairWal(t *testing.T) {
+	dir := t.TempDir()
+
+	repair, err := RepairWal(dir, false)
+	require.NoError(t, err)
+	assert.Nil(t, repair)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, segmentName(1)), []byte("1 SET a 1 \n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, segmentName(2)), []byte("2 SET b 1 \n3 SET"), 0644))
+
+	// a write cut by a crash in the last segment
+	repair, err = RepairWal(dir, false)
+	require.NoError(t, err)
+	assert.Equal(t, Position{Segment: segmentName(2), Offset: 11}, repair.End)
+	assert.Empty(t, repair.Dropped)
+	assert.Equal(t, []string{"1", "2"}, replayedIDs(t, dir, Position{}))
+
+	// damage in the middle of the wal
+	require.NoError(t, os.WriteFile(filepath.Join(dir, segmentName(2)), []byte("2 SET b 1 \n3 SET c \n4 SET d 1 \n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, segmentName(3)), []byte("5 SET e 1 \n"), 0644))
+
+	_, err = RepairWal(dir, false)
+	require.ErrorIs(t, err, ErrDamagedHistory)
+	assert.ErrorContains(t, err, segmentName(2)+":11")
+
+	segments, err := Segments(dir)
+	require.NoError(t, err)
+	assert.Len(t, segments, 3)
+
+	repair, err = RepairWal(dir, true)
+	require.NoError(t, err)
+	assert.Equal(t, Position{Segment: segmentName(2), Offset: 11}, repair.End)
+	assert.Equal(t, []string{segmentName(3)}, repair.Dropped)
+
+	segments, err = Segments(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{segmentName(1), segmentName(2)}, segments)
+	assert.Equal(t, []string{"1", "2"}, replayedIDs(t, dir, Position{}))
+}
+
+func TestConvertSegment(t *testing.T) {
+	dir := t.TempDir()
+	testKeyring(t, "k1")
+
+	records := "2024-06-01T15:30:53Z 1 SET a 1 \n2024-06-01T15:30:54Z 2 SET b 1 \n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, segmentName(1)), []byte(records), 0644))
+
+	for _, format := range []struct {
+		compress bool
+		encrypt  bool
+		file     string
+	}{
+		{true, false, segmentName(1) + compressedSuffix},
+		{true, true, segmentName(1) + compressedSuffix + encryptedSuffix},
+		{true, true, segmentName(1) + compressedSuffix + encryptedSuffix},
+		{false, true, segmentName(1) + encryptedSuffix},
+		{false, false, segmentName(1)},
+	} {
+		_, fileName, err := ConvertSegment(dir, segmentName(1), format.compress, format.encrypt)
+		require.NoError(t, err)
+		assert.Equal(t, format.file, fileName)
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, format.file, entries[0].Name())
+
+		data, err := ReadSegment(dir, segmentName(1))
+		require.NoError(t, err)
+		assert.Equal(t, records, string(data))
+	}
+
+	// a damaged segment is not converted
+	require.NoError(t, os.WriteFile(filepath.Join(dir, segmentName(1)), []byte(records+"3 SET"), 0644))
+
+	_, _, err := ConvertSegment(dir, segmentName(1), true, false)
+	assert.ErrorIs(t, err, ErrDamaged)
+}
@@ -0,0 +1,24 @@
+package wal
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fallocFlKeepSize allocates blocks without changing the file size, readers see only the written records
+const fallocFlKeepSize = 0x1
+
+func preallocate(file *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+
+	err := syscall.Fallocate(int(file.Fd()), fallocFlKeepSize, 0, size)
+	// not every filesystem supports it, the segment grows with the appends then
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package wal
+
+import "os"
+
+// preallocate is a no-op where fallocate is not available, the segment grows with the appends
+func preallocate(_ *os.File, _ int64) error {
+	return nil
+}
@@ -0,0 +1,221 @@
+package wal
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/compute"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/dirlock"
+)
+
+// Position is a place in the wal: the records of segments before Segment and the first Offset bytes of Segment.
+// The zero position is the start of the wal.
+type Position struct {
+	Segment string `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// Exists reports whether the wal in dir still has all records up to the position
+func Exists(dir string, p Position) bool {
+	if p.Segment == "" {
+		return true
+	}
+
+	length, err := segmentLength(dir, p.Segment)
+
+	return err == nil && length >= p.Offset
+}
+
+// String formats the position as "<segment>:<offset>", the lsn accepted by ParseTarget
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d", p.Segment, p.Offset)
+}
+
+// Compare returns -1, 0 or +1 when p is before, at or after other
+func (p Position) Compare(other Position) int {
+	if c := strings.Compare(p.Segment, other.Segment); c != 0 {
+		return c
+	}
+
+	return cmp.Compare(p.Offset, other.Offset)
+}
+
+// Record is a log read back from the wal
+type Record struct {
+	Time  time.Time // when the record was flushed, zero for records written before timestamps
+	ID    string
+	Query compute.Query
+}
+
+// ParseRecord parses a record line "[<time>] <id> <command> <arguments...>".
+// The time is in RFC 3339 format, ids never contain ':', so a first field with it is a time.
+func ParseRecord(line string) (Record, error) {
+	entries := strings.Fields(line)
+
+	record := Record{}
+
+	if len(entries) > 0 && strings.Contains(entries[0], ":") {
+		t, err := time.Parse(time.RFC3339Nano, entries[0])
+		if err != nil {
+			return Record{}, fmt.Errorf("invalid record time: %q: %w", line, err)
+		}
+
+		record.Time = t
+		entries = entries[1:]
+	}
+
+	if len(entries) < 2 {
+		return Record{}, fmt.Errorf("invalid record: %q", line)
+	}
+
+	record.ID = entries[0]
+	record.Query = compute.Query{Command: entries[1], Arguments: entries[2:]}
+
+	switch record.Query.Command {
+	case consts.CommandSet:
+		if len(record.Query.Arguments) != 2 {
+			return Record{}, fmt.Errorf("%w: %q", consts.ErrInvalidSetQueryArgs, line)
+		}
+
+	case consts.CommandDel:
+		if len(record.Query.Arguments) != 1 {
+			return Record{}, fmt.Errorf("%w: %q", consts.ErrInvalidDelQueryArgs, line)
+		}
+
+	default:
+		return Record{}, fmt.Errorf("unknown command: %s", record.Query.Command)
+	}
+
+	return record, nil
+}
+
+// Segments returns names of wal segments from the oldest, a missing directory has none.
+// A compressed segment is named without the suffix of its file.
+func Segments(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		// unfinished compressions and compactions, the lock of the directory
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") || entry.Name() == compactionManifest || entry.Name() == dirlock.FileName {
+			continue
+		}
+
+		names = append(names, strings.TrimSuffix(strings.TrimSuffix(entry.Name(), encryptedSuffix), compressedSuffix))
+	}
+
+	sort.Strings(names)
+
+	// a segment that is being compressed has both files for a moment
+	return slices.Compact(names), nil
+}
+
+// errStopReplay stops a replay at the recovery target
+var errStopReplay = errors.New("stop replay")
+
+// Replay calls apply for every record after from in the wal order until the target.
+// It returns the position after the last applied record and whether the target was reached before the end of the wal.
+func Replay(dir string, from Position, until Target, apply func(Record) error) (Position, bool, error) {
+	segments, err := Segments(dir)
+	if err != nil {
+		return from, false, err
+	}
+
+	end := from
+
+	for _, segment := range segments {
+		if segment < from.Segment {
+			continue
+		}
+
+		offset := int64(0)
+		if segment == from.Segment {
+			offset = from.Offset
+		}
+
+		size, err := replaySegment(dir, segment, offset, func(record Record, start int64) error {
+			if until.reached(record, Position{Segment: segment, Offset: start}) {
+				return errStopReplay
+			}
+
+			return apply(record)
+		})
+		if errors.Is(err, errStopReplay) {
+			return Position{Segment: segment, Offset: size}, true, nil
+		}
+		if err != nil {
+			return end, false, fmt.Errorf("replay %s: %w", segment, err)
+		}
+
+		end = Position{Segment: segment, Offset: size}
+	}
+
+	return end, false, nil
+}
+
+// replaySegment applies records of a segment starting at offset, apply gets the offset of a record too.
+// It returns the segment size, or the offset of the record that stopped the replay with errStopReplay.
+func replaySegment(dir string, name string, offset int64, apply func(record Record, start int64) error) (int64, error) {
+	file, err := OpenSegment(dir, name)
+	if err != nil {
+		return 0, fmt.Errorf("open: %w", err)
+	}
+	defer file.Close()
+
+	// compressed segments can't seek, the records before the offset are skipped
+	if seeker, ok := file.(io.Seeker); ok {
+		_, err = seeker.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, file, offset)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("seek: %w", err)
+	}
+
+	size := offset
+	reader := bufio.NewReader(file)
+
+	for {
+		line, err := reader.ReadString('\n')
+		start := size
+		size += int64(len(line))
+
+		if strings.TrimSpace(line) != "" {
+			record, parseErr := ParseRecord(line)
+			if parseErr != nil {
+				return size, fmt.Errorf("offset %d: %w", start, parseErr)
+			}
+
+			applyErr := apply(record, start)
+			if errors.Is(applyErr, errStopReplay) {
+				return start, applyErr
+			}
+			if applyErr != nil {
+				return size, applyErr
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return size, nil
+		}
+		if err != nil {
+			return size, fmt.Errorf("read: %w", err)
+		}
+	}
+}
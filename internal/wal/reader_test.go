@@ -0,0 +1,139 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/compute"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRecord(t *testing.T) {
+	record, err := ParseRecord("id1 SET a 1 \n")
+	require.NoError(t, err)
+	assert.Equal(t, Record{ID: "id1", Query: compute.Query{Command: "SET", Arguments: []string{"a", "1"}}}, record)
+
+	record, err = ParseRecord("id2 DEL a")
+	require.NoError(t, err)
+	assert.Equal(t, Record{ID: "id2", Query: compute.Query{Command: "DEL", Arguments: []string{"a"}}}, record)
+
+	_, err = ParseRecord("id3 SET a")
+	assert.ErrorIs(t, err, consts.ErrInvalidSetQueryArgs)
+
+	_, err = ParseRecord("id4 GET a")
+	assert.Error(t, err)
+
+	_, err = ParseRecord("id5")
+	assert.Error(t, err)
+}
+
+func TestParseRecord_Time(t *testing.T) {
+	record, err := ParseRecord("2024-06-01T15:30:53.5Z id1 SET a 1 \n")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 6, 1, 15, 30, 53, 500000000, time.UTC), record.Time)
+	assert.Equal(t, "id1", record.ID)
+	assert.Equal(t, compute.Query{Command: "SET", Arguments: []string{"a", "1"}}, record.Query)
+
+	_, err = ParseRecord("2024-06-01T15:30 id1 SET a 1")
+	assert.Error(t, err)
+}
+
+func TestParseTarget(t *testing.T) {
+	target, err := ParseTarget("2024-06-01T15:30:00+03:00")
+	require.NoError(t, err)
+	assert.True(t, target.Time.Equal(time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC)))
+
+	target, err = ParseTarget("20240601_153053.00000:120")
+	require.NoError(t, err)
+	assert.Equal(t, Target{Position: Position{Segment: "20240601_153053.00000", Offset: 120}}, target)
+	assert.Equal(t, "20240601_153053.00000:120", target.String())
+
+	for _, invalid := range []string{"yesterday", "segment:-1", "segment:", ":10"} {
+		_, err = ParseTarget(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestReplay_Until(t *testing.T) {
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "20240601_153053.00000"),
+		[]byte("old SET a 0 \n2024-06-01T15:30:53Z 1 SET a 1 \n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "20240601_153054.00000"),
+		[]byte("2024-06-01T15:30:54Z 2 SET b 2 \n2024-06-01T15:30:55Z 3 DEL a \n"), 0644))
+
+	replay := func(until Target) ([]string, Position, bool) {
+		replayed := make([]string, 0)
+
+		end, reached, err := Replay(dir, Position{}, until, func(record Record) error {
+			replayed = append(replayed, record.ID)
+			return nil
+		})
+		require.NoError(t, err)
+
+		return replayed, end, reached
+	}
+
+	ids, end, reached := replay(Target{Time: time.Date(2024, 6, 1, 15, 30, 54, 0, time.UTC)})
+	assert.Equal(t, []string{"old", "1", "2"}, ids)
+	assert.True(t, reached)
+	// the position of the first record after the target
+	assert.Equal(t, Position{Segment: "20240601_153054.00000", Offset: 32}, end)
+
+	ids, _, reached = replay(Target{Position: end})
+	assert.Equal(t, []string{"old", "1", "2"}, ids)
+	assert.True(t, reached)
+
+	ids, _, reached = replay(Target{Time: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)})
+	assert.Equal(t, []string{"old", "1", "2", "3"}, ids)
+	assert.False(t, reached)
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "20240601_153053.00000"), []byte("1 SET a 1 \n2 SET b 2 \n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "20240601_153054.00000"), []byte("3 DEL a \n\n4 SET c 3 \n"), 0644))
+
+	ids := func(from Position) ([]string, Position) {
+		replayed := make([]string, 0)
+
+		end, reached, err := Replay(dir, from, Target{}, func(record Record) error {
+			replayed = append(replayed, record.ID)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.False(t, reached)
+
+		return replayed, end
+	}
+
+	all, end := ids(Position{})
+	assert.Equal(t, []string{"1", "2", "3", "4"}, all)
+	assert.Equal(t, Position{Segment: "20240601_153054.00000", Offset: 21}, end)
+
+	w := &Wal{dataDir: dir}
+	position, err := w.Position()
+	require.NoError(t, err)
+	assert.Equal(t, end, position)
+
+	// after the first record of the second segment
+	tail, _ := ids(Position{Segment: "20240601_153054.00000", Offset: 8})
+	assert.Equal(t, []string{"4"}, tail)
+
+	// the end of a segment
+	tail, _ = ids(Position{Segment: "20240601_153053.00000", Offset: 22})
+	assert.Equal(t, []string{"3", "4"}, tail)
+
+	removed, err := w.RemoveSegmentsBefore("20240601_153054.00000")
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+
+	segments, err := Segments(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"20240601_153054.00000"}, segments)
+}
@@ -0,0 +1,375 @@
+package wal
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts/defaults"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/encryption"
+)
+
+// segmentPrefix starts names of segments, "segment_<sequence>" with the sequence padded to 20 digits sorts
+// in the wal order. Segments named by time by older versions sort before them.
+const segmentPrefix = "segment_"
+
+// segmentManager keeps the active segment open and rolls over to a new segment at the size limit.
+// It's not safe for concurrent use, the wal guards it with segmentMu.
+type segmentManager struct {
+	dir     string
+	maxSize int
+	fsync   string
+
+	compressBatches bool              // every batch is written as a gzip member to a compressed segment
+	stats           *compressionStats // nil when compression is off
+
+	keyring   *encryption.Keyring // segments are encrypted with the active key, nil when encryption is off
+	encrypter *encryption.Writer  // of the active segment when it's encrypted
+
+	file     *os.File // the active segment, nil until the first write or after close
+	name     string   // without the suffix of a compressed or encrypted file
+	size     int      // uncompressed
+	sequence uint64   // of the latest segment, valid when loaded
+	loaded   bool
+	unsynced bool // the active segment has writes that are not fsynced
+}
+
+func newSegmentManager(dir string, maxSize int, fsync string) *segmentManager {
+	return &segmentManager{dir: dir, maxSize: maxSize, fsync: fsync}
+}
+
+func segmentName(sequence uint64) string {
+	return fmt.Sprintf("%s%020d", segmentPrefix, sequence)
+}
+
+// segmentSequence returns the sequence of a segment, false for segments named by time
+func segmentSequence(name string) (uint64, bool) {
+	digits, ok := strings.CutPrefix(name, segmentPrefix)
+	if !ok {
+		return 0, false
+	}
+
+	sequence, err := strconv.ParseUint(digits, 10, 64)
+
+	return sequence, err == nil
+}
+
+// suffix returns the suffix of files of new segments
+func (m *segmentManager) suffix() string {
+	suffix := ""
+	if m.compressBatches {
+		suffix += compressedSuffix
+	}
+	if m.keyring != nil {
+		suffix += encryptedSuffix
+	}
+
+	return suffix
+}
+
+// syncAlways reports whether writes are fsynced before they are acknowledged, the zero mode is always
+func (m *segmentManager) syncAlways() bool {
+	return m.fsync != defaults.FsyncInterval && m.fsync != defaults.FsyncNever
+}
+
+// write appends data to the active segment, a new segment is started when the data doesn't fit
+func (m *segmentManager) write(data []byte) error {
+	if m.file == nil {
+		err := m.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.file == nil || m.size+len(data) >= m.maxSize {
+		err := m.rollover()
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.compressBatches || m.encrypter != nil {
+		err := m.writeEncoded(data)
+		if err != nil {
+			return err
+		}
+	} else {
+		n, err := m.file.Write(data)
+		m.size += n
+		if err != nil {
+			return fmt.Errorf("write file: %s: %w", m.name, err)
+		}
+	}
+
+	if !m.syncAlways() {
+		m.unsynced = true
+		return nil
+	}
+
+	err := m.file.Sync()
+	if err != nil {
+		return fmt.Errorf("sync file: %s: %w", m.name, err)
+	}
+
+	return nil
+}
+
+// writeEncoded writes data compressed as a gzip member and encrypted as a frame, as the segment is configured
+func (m *segmentManager) writeEncoded(data []byte) error {
+	encoded := data
+
+	if m.compressBatches {
+		compressed, err := compressBatch(data)
+		if err != nil {
+			return fmt.Errorf("compress batch: %w", err)
+		}
+
+		m.stats.add(len(data), len(compressed))
+		encoded = compressed
+	}
+
+	var err error
+	if m.encrypter != nil {
+		_, err = m.encrypter.Write(encoded)
+	} else {
+		_, err = m.file.Write(encoded)
+	}
+	if err != nil {
+		return fmt.Errorf("write file: %s: %w", m.name, err)
+	}
+
+	m.size += len(data)
+
+	return nil
+}
+
+// open reads the directory once and opens the latest segment for appending
+func (m *segmentManager) open() error {
+	segments, err := Segments(m.dir)
+	if err != nil {
+		return err
+	}
+
+	m.loadSequence(segments)
+
+	if len(segments) == 0 {
+		return nil
+	}
+
+	latest := segments[len(segments)-1]
+
+	fileName, err := SegmentFile(m.dir, latest)
+	if err != nil {
+		return fmt.Errorf("segment file: %w", err)
+	}
+
+	// plain records, gzip members and encrypted frames can't be mixed in a file,
+	// a segment of another kind is continued in a new one
+	if fileName != latest+m.suffix() {
+		return nil
+	}
+
+	var (
+		size    int64
+		resumed *encryption.Reader
+	)
+
+	if m.keyring != nil {
+		resumed, size, err = m.readEncrypted(fileName)
+		if err != nil {
+			return fmt.Errorf("read segment: %s: %w", latest, err)
+		}
+
+		// a segment is encrypted with one key, after a rotation writes go to a new segment
+		if resumed.KeyID() != m.keyring.Active() {
+			return nil
+		}
+	} else {
+		size, err = segmentLength(m.dir, latest)
+		if err != nil {
+			return fmt.Errorf("segment length: %s: %w", latest, err)
+		}
+	}
+
+	file, err := os.OpenFile(filepath.Join(m.dir, fileName), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+
+	if resumed != nil {
+		m.encrypter = encryption.ResumeWriter(file, resumed)
+	}
+
+	m.file = file
+	m.name = latest
+	m.size = int(size)
+
+	return nil
+}
+
+// readEncrypted reads an encrypted segment to the end, frames are appended after the read ones.
+// The size is not read when the segment is encrypted with a rotated key.
+func (m *segmentManager) readEncrypted(fileName string) (*encryption.Reader, int64, error) {
+	file, err := os.Open(filepath.Join(m.dir, fileName))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	reader, err := encryption.NewReader(file, m.keyring)
+	if err != nil {
+		return nil, 0, err
+	}
+	if reader.KeyID() != m.keyring.Active() {
+		return reader, 0, nil
+	}
+
+	var records io.Reader = reader
+	if m.compressBatches {
+		// the gzip reader reads the frames to the end looking for the next member
+		records, err = gzip.NewReader(reader)
+		if err != nil {
+			return nil, 0, fmt.Errorf("gzip reader: %w", err)
+		}
+	}
+
+	size, err := io.Copy(io.Discard, records)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return reader, size, nil
+}
+
+func (m *segmentManager) loadSequence(segments []string) {
+	m.sequence = 0
+	for _, name := range segments {
+		if sequence, ok := segmentSequence(name); ok && sequence > m.sequence {
+			m.sequence = sequence
+		}
+	}
+
+	m.loaded = true
+}
+
+// rollover closes the active segment and creates the next one. The name comes from the sequence and the file
+// is created exclusively, so two rollovers never write to the same segment.
+func (m *segmentManager) rollover() error {
+	err := m.close()
+	if err != nil {
+		return err
+	}
+
+	name, err := m.next()
+	if err != nil {
+		return err
+	}
+
+	fileName := name + m.suffix()
+
+	file, err := os.OpenFile(filepath.Join(m.dir, fileName), os.O_APPEND|os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+
+	// the size limit is known, allocating it at once keeps the segment contiguous and the appends cheap.
+	// Compressed segments are smaller than the limit.
+	if !m.compressBatches {
+		err = preallocate(file, int64(m.maxSize))
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("preallocate file: %s: %w", name, err)
+		}
+	}
+
+	if m.keyring != nil {
+		m.encrypter, err = encryption.NewWriter(file, m.keyring)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("encrypt file: %s: %w", name, err)
+		}
+	}
+
+	m.file = file
+	m.name = name
+	m.size = 0
+
+	// the new segment must survive a crash in the always mode
+	if m.syncAlways() {
+		err = syncDir(m.dir)
+		if err != nil {
+			return fmt.Errorf("sync dir: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// next reserves the name of the next segment
+func (m *segmentManager) next() (string, error) {
+	if !m.loaded {
+		segments, err := Segments(m.dir)
+		if err != nil {
+			return "", err
+		}
+
+		m.loadSequence(segments)
+	}
+
+	m.sequence++
+
+	return segmentName(m.sequence), nil
+}
+
+// sync fsyncs writes to the active segment in the interval mode
+func (m *segmentManager) sync() error {
+	if m.file == nil || !m.unsynced {
+		return nil
+	}
+
+	err := m.file.Sync()
+	if err != nil {
+		return fmt.Errorf("sync file: %s: %w", m.name, err)
+	}
+
+	m.unsynced = false
+
+	return nil
+}
+
+// close fsyncs and closes the active segment, closed segments are durable in every fsync mode
+func (m *segmentManager) close() error {
+	if m.file == nil {
+		return nil
+	}
+
+	err := m.sync()
+
+	closeErr := m.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	m.file = nil
+	m.encrypter = nil
+	m.unsynced = false
+
+	if err != nil {
+		return fmt.Errorf("close file: %s: %w", m.name, err)
+	}
+
+	return nil
+}
+
+// position returns the end of the active segment, false when no segment is open
+func (m *segmentManager) position() (Position, bool) {
+	if m.file == nil {
+		return Position{}, false
+	}
+
+	return Position{Segment: m.name, Offset: int64(m.size)}, true
+}
@@ -0,0 +1,97 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts/defaults"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentManager_Rollover(t *testing.T) {
+	dir := t.TempDir()
+
+	// segments named by time by older versions come first
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "20240601_153053.00000"), []byte("old SET a 0 \n"), 0644))
+
+	m := newSegmentManager(dir, 80, defaults.FsyncInterval)
+	record := []byte("2024-06-01T15:30:53Z 1 SET key value \n")
+
+	// the old segment is appended to while the records fit
+	require.NoError(t, m.write(record))
+	assert.Equal(t, "20240601_153053.00000", m.name)
+	assert.True(t, m.unsynced)
+
+	file := m.file
+	require.NoError(t, m.sync())
+	assert.False(t, m.unsynced)
+
+	require.NoError(t, m.write(record))
+	assert.Equal(t, segmentName(1), m.name)
+	assert.NotSame(t, file, m.file)
+
+	require.NoError(t, m.write(record))
+	require.NoError(t, m.write(record))
+	assert.Equal(t, segmentName(2), m.name)
+
+	position, ok := m.position()
+	require.True(t, ok)
+	assert.Equal(t, Position{Segment: segmentName(2), Offset: int64(len(record))}, position)
+
+	// preallocated blocks are not visible to readers
+	info, err := os.Stat(filepath.Join(dir, segmentName(2)))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(record)), info.Size())
+
+	require.NoError(t, m.close())
+
+	_, ok = m.position()
+	assert.False(t, ok)
+
+	// a restarted wal continues the latest segment and the sequence
+	m = newSegmentManager(dir, 80, "")
+	require.NoError(t, m.write(record))
+	assert.Equal(t, segmentName(2), m.name)
+	require.NoError(t, m.write(record))
+	assert.Equal(t, segmentName(3), m.name)
+	require.NoError(t, m.close())
+
+	segments, err := Segments(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"20240601_153053.00000", segmentName(1), segmentName(2), segmentName(3)}, segments)
+}
+
+func TestSegmentManager_NeverReusesSegment(t *testing.T) {
+	dir := t.TempDir()
+
+	m := newSegmentManager(dir, 10, "")
+	require.NoError(t, m.write([]byte("1 SET a 1 \n")))
+
+	// a segment that appeared behind the manager's back is not appended to
+	require.NoError(t, os.WriteFile(filepath.Join(dir, segmentName(2)), nil, 0644))
+
+	err := m.write([]byte("2 SET a 2 \n"))
+	assert.ErrorIs(t, err, os.ErrExist)
+	require.NoError(t, m.close())
+
+	names := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		name, err := m.next()
+		require.NoError(t, err)
+		require.False(t, names[name], name)
+
+		names[name] = true
+	}
+}
+
+func TestSegmentSequence(t *testing.T) {
+	sequence, ok := segmentSequence(segmentName(42))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(42), sequence)
+	assert.Equal(t, "segment_00000000000000000042", segmentName(42))
+
+	_, ok = segmentSequence("20240601_153053.00000")
+	assert.False(t, ok)
+}
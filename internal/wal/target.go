@@ -0,0 +1,74 @@
+package wal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Target is the point a recovery replays the wal up to: a time or a position (lsn). The zero target is the end of the wal.
+type Target struct {
+	Time     time.Time
+	Position Position
+}
+
+// ParseTarget parses a time in RFC 3339 format, e.g. "2024-06-01T15:30:00+03:00",
+// or an lsn "<segment>:<offset>" as reported by the server
+func ParseTarget(s string) (Target, error) {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err == nil {
+		return Target{Time: t}, nil
+	}
+
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		return Target{}, fmt.Errorf("recovery target %q is neither a time nor an lsn", s)
+	}
+
+	offset, err := strconv.ParseInt(s[i+1:], 10, 64)
+	if err != nil || offset < 0 || strings.Contains(s[:i], ":") {
+		return Target{}, fmt.Errorf("recovery target %q is neither a time nor an lsn", s)
+	}
+
+	return Target{Position: Position{Segment: s[:i], Offset: offset}}, nil
+}
+
+// IsZero reports whether the target is the end of the wal
+func (t Target) IsZero() bool {
+	return t.Time.IsZero() && t.Position.Segment == ""
+}
+
+func (t Target) String() string {
+	if !t.Time.IsZero() {
+		return t.Time.Format(time.RFC3339Nano)
+	}
+
+	return t.Position.String()
+}
+
+// Includes reports whether the state at the position, written until the time, is before the target.
+// Snapshots are taken by it.
+func (t Target) Includes(position Position, at time.Time) bool {
+	if !t.Time.IsZero() {
+		return !at.After(t.Time)
+	}
+	if t.Position.Segment != "" {
+		return position.Compare(t.Position) <= 0
+	}
+
+	return true
+}
+
+// reached reports whether a record starting at the position is after the target.
+// Records without a time were written before timestamps, they are before any time target.
+func (t Target) reached(record Record, start Position) bool {
+	if !t.Time.IsZero() {
+		return !record.Time.IsZero() && record.Time.After(t.Time)
+	}
+	if t.Position.Segment != "" {
+		return start.Compare(t.Position) >= 0
+	}
+
+	return false
+}
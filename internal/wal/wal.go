@@ -1,15 +1,13 @@
 package wal
 
 import (
-	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -18,29 +16,37 @@ import (
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/configs"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts/defaults"
-	"github.com/JaneJavannie/in_memory_key_value_db/utils"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/encryption"
 )
 
-const fileTimeFormat = "20060102_150405.00000"
-
 type Wal struct {
 	logger *slog.Logger
 
 	compaction         bool
 	compactionInterval time.Duration
+	compactionSegments int              // a compaction window is at most this many max size segments
+	compactionSizes    map[string]int64 // uncompressed sizes of closed segments, used by compaction only
 
 	batchSize             int
 	batchTimeout          time.Duration
 	maxLogFileSegmentSize int
 	dataDir               string
+	fsync                 string
+	fsyncInterval         time.Duration
+	compression           string
+	compressionStats      compressionStats
+	compressSignal        chan struct{} // a segment was closed
+
+	// flushes write to the active segment, compaction replaces segments under segmentMu
+	segmentMu sync.Mutex
+	segments  *segmentManager
 
 	// channel that contains users' modifying operations - set, del
 	operations chan Log
 	batch      []Log
+	stop       chan struct{}
 
-	flushErr error
-	xCond    *sync.Mutex
-	cond     *sync.Cond
+	flushErr error // the last flush error, read after the flushing goroutine is stopped
 
 	wg sync.WaitGroup
 }
@@ -48,6 +54,8 @@ type Wal struct {
 type Log struct {
 	ID    string
 	Query compute.Query
+
+	future *Future // completed by the flush that contains the log
 }
 
 func NewWal(logger *slog.Logger, cfg *configs.Wal, replicationType string) (*Wal, error) {
@@ -60,16 +68,24 @@ func NewWal(logger *slog.Logger, cfg *configs.Wal, replicationType string) (*Wal
 
 		compaction:         cfg.Compaction,
 		compactionInterval: cfg.CompactionInterval,
+		compactionSegments: defaults.WalCompactionWindow,
 
 		batchSize:             cfg.FlushingBatchSize,
 		batchTimeout:          cfg.FlushingBatchTimeout,
 		maxLogFileSegmentSize: cfg.MaxSegmentSizeBytes,
 		dataDir:               cfg.DataDir,
+		fsync:                 cfg.Fsync,
+		fsyncInterval:         cfg.FsyncInterval,
+		compression:           cfg.Compression,
+		compressSignal:        make(chan struct{}, 1),
 
-		operations: make(chan Log, 1), // client writes a value, and waits for its acknowledgment
-		xCond:      &sync.Mutex{},
+		operations: make(chan Log), // client writes a value, and waits for its acknowledgment
+		stop:       make(chan struct{}),
 	}
-	wal.cond = sync.NewCond(wal.xCond)
+	wal.segments = newSegmentManager(wal.dataDir, wal.maxLogFileSegmentSize, wal.fsync)
+	wal.segments.compressBatches = wal.compression == defaults.CompressionBatches
+	wal.segments.stats = &wal.compressionStats
+	wal.segments.keyring = encryption.Current()
 
 	if _, err := os.Stat(wal.dataDir); err != nil {
 		if os.IsNotExist(err) {
@@ -86,7 +102,7 @@ func NewWal(logger *slog.Logger, cfg *configs.Wal, replicationType string) (*Wal
 }
 
 func (w *Wal) Start(wal *configs.Wal) {
-	if wal == nil {
+	if wal == nil || w.operations == nil {
 		return
 	}
 
@@ -98,10 +114,31 @@ func (w *Wal) Start(wal *configs.Wal) {
 		timer := time.NewTimer(w.batchTimeout)
 		defer timer.Stop()
 
+		var fsyncTick <-chan time.Time
+		if w.fsync == defaults.FsyncInterval {
+			ticker := time.NewTicker(w.fsyncInterval)
+			defer ticker.Stop()
+
+			fsyncTick = ticker.C
+		}
+
 		for {
 			flush := false
 
 			select {
+			case <-w.stop:
+				// flush logs that were sent before the stop
+				w.drainOperations(timer)
+				w.handleFlush(timer)
+				w.handleClose()
+				return
+
+			case <-fsyncTick:
+				err := w.syncSegment()
+				if err != nil {
+					w.logger.Error("fsync wal segment", "error", err)
+				}
+
 			case <-timer.C:
 				flush = w.handleTimerEvent()
 
@@ -115,6 +152,25 @@ func (w *Wal) Start(wal *configs.Wal) {
 		}
 	}()
 
+	if w.compressed() {
+		w.wg.Add(1)
+
+		go func() {
+			defer w.wg.Done()
+
+			for {
+				// segments closed before the start are compressed too
+				w.compressSegments()
+
+				select {
+				case <-w.stop:
+					return
+				case <-w.compressSignal:
+				}
+			}
+		}()
+	}
+
 	if wal.Compaction {
 		w.wg.Add(1)
 
@@ -124,10 +180,16 @@ func (w *Wal) Start(wal *configs.Wal) {
 			timer := time.NewTicker(w.compactionInterval)
 			defer timer.Stop()
 
-			for range timer.C {
-				err := w.compactWals()
-				if err != nil {
-					w.logger.Error("compaction wals: ", err)
+			for {
+				select {
+				case <-w.stop:
+					return
+
+				case <-timer.C:
+					err := w.compactWals()
+					if err != nil {
+						w.logger.Error("compaction wals", "error", err)
+					}
 				}
 			}
 		}()
@@ -158,138 +220,308 @@ func (w *Wal) handleFlush(timer *time.Timer) {
 
 	err := w.flushRecords()
 	if err != nil {
-		w.logger.Error("flush records: %w", err)
+		w.logger.Error("flush records", "error", err)
+	}
+
+	// every log gets the result of the flush of its own batch
+	for _, wl := range w.batch {
+		if wl.future != nil {
+			wl.future.complete(err)
+		}
 	}
 
 	timer.Stop()
 	w.batch = nil
-
-	w.xCond.Lock()
 	w.flushErr = err
-	w.cond.Broadcast()
-	w.xCond.Unlock()
 }
 
-func (w *Wal) Stop(wal *configs.Wal) {
-	if wal == nil {
-		return
+// handleClose fsyncs and closes the active segment in every fsync mode
+func (w *Wal) handleClose() {
+	w.segmentMu.Lock()
+	defer w.segmentMu.Unlock()
+
+	err := w.segments.close()
+	if err != nil {
+		w.logger.Error("close wal segment", "error", err)
+
+		if w.flushErr == nil {
+			w.flushErr = err
+		}
 	}
+}
 
+func (w *Wal) drainOperations(timer *time.Timer) {
+	for {
+		select {
+		case wl := <-w.operations:
+			w.handleWALEvent(timer, wl)
+		default:
+			return
+		}
+	}
+}
+
+// Stop flushes the pending batch, fsyncs the active segment and stops background goroutines.
+// It returns the error of the last flush.
+func (w *Wal) Stop(wal *configs.Wal) error {
+	if wal == nil || w.operations == nil {
+		return nil
+	}
+
+	close(w.stop)
 	w.wg.Wait()
+
+	return w.flushErr
 }
 
-func (w *Wal) WriteLog(_ context.Context, log Log) error {
-	// do not handle ctx otherwise one request can cancel other requests
-	w.operations <- log
+// Stats returns the compression counters
+func (w *Wal) Stats() Stats {
+	stats := Stats{
+		Compression:        w.compression,
+		CompressedSegments: w.compressionStats.segments.Load(),
+		RawBytes:           w.compressionStats.raw.Load(),
+		CompressedBytes:    w.compressionStats.compressed.Load(),
+	}
+	if stats.CompressedBytes > 0 {
+		stats.CompressionRatio = float64(stats.RawBytes) / float64(stats.CompressedBytes)
+	}
 
-	var err error
-	w.xCond.Lock()
-	w.cond.Wait()
-	err = w.flushErr
-	w.xCond.Unlock()
+	return stats
+}
 
-	return err
+func (w *Wal) compressed() bool {
+	return w.compression == defaults.CompressionSegments || w.compression == defaults.CompressionBatches
 }
 
-func (w *Wal) flushRecords() error {
-	if len(w.batch) == 0 {
+// compressSegments compresses closed plain segments, all but the latest one
+func (w *Wal) compressSegments() {
+	segments, err := Segments(w.dataDir)
+	if err != nil {
+		w.logger.Error("compress wal segments", "error", err)
+		return
+	}
+
+	for i := 0; i < len(segments)-1; i++ {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+
+		err = w.compressSegment(segments[i])
+		if err != nil {
+			w.logger.Error("compress wal segment", "segment", segments[i], "error", err)
+		}
+	}
+}
+
+// compressSegment replaces a closed segment with its compressed copy, readers see either of them
+func (w *Wal) compressSegment(segment string) error {
+	fileName, err := SegmentFile(w.dataDir, segment)
+	if err != nil || fileName != segment {
+		// removed or compressed already
 		return nil
 	}
 
-	dirEntries, err := os.ReadDir(w.dataDir)
+	path := filepath.Join(w.dataDir, segment)
+	tmp := path + compressedSuffix + ".tmp"
+
+	source, err := os.Stat(path)
 	if err != nil {
-		return fmt.Errorf("read dir: %w", err)
+		return nil
 	}
 
-	sort.Slice(dirEntries, func(i, j int) bool {
-		return dirEntries[i].Name() < dirEntries[j].Name()
-	})
+	raw, compressed, err := compressFile(path, tmp)
+	if err != nil {
+		return err
+	}
 
-	walRecords := buildWalRecords(w.batch)
+	return w.swapCompressed(segment, source, tmp, raw, compressed)
+}
+
+// swapCompressed replaces a segment with its compressed copy in tmp, made of the file described by source
+func (w *Wal) swapCompressed(segment string, source os.FileInfo, tmp string, raw int64, compressed int64) error {
+	path := filepath.Join(w.dataDir, segment)
+
+	// compaction and pruning remove segments under segmentMu, a removed segment is not brought back.
+	// Compaction swaps its merged file in under the name of the segment, the copy of the replaced file is stale.
+	w.segmentMu.Lock()
+	defer w.segmentMu.Unlock()
 
-	if err = writeWalRecords(w.dataDir, dirEntries, walRecords, w.maxLogFileSegmentSize); err != nil {
-		return fmt.Errorf("write wal records: %w", err)
+	current, err := os.Stat(path)
+	if err != nil || !os.SameFile(source, current) || current.Size() != source.Size() || !current.ModTime().Equal(source.ModTime()) {
+		_ = os.Remove(tmp)
+		return nil
 	}
 
-	return nil
-}
+	err = os.Rename(tmp, path+compressedSuffix)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("rename: %w", err)
+	}
+
+	err = syncDir(w.dataDir)
+	if err != nil {
+		return fmt.Errorf("sync dir: %w", err)
+	}
 
-func (w *Wal) compactWals() error {
-	dirEntries, err := os.ReadDir(w.dataDir)
+	err = os.Remove(path)
 	if err != nil {
-		return fmt.Errorf("read dir: %w", err)
+		return fmt.Errorf("remove: %w", err)
 	}
 
-	compactedMap := make(map[string]string)
+	w.compressionStats.segments.Add(1)
+	w.compressionStats.add(int(raw), int(compressed))
 
-	for _, dirEntry := range dirEntries {
-		if dirEntry.IsDir() {
-			continue
-		}
+	w.logger.Debug("wal segment compressed", "segment", segment, "raw_bytes", raw, "compressed_bytes", compressed)
 
-		err = handleDirs(w.dataDir, dirEntry, compactedMap)
-		if err != nil {
-			return fmt.Errorf("handle dirs: %w", err)
+	return nil
+}
+
+// DataDir returns the directory of wal segments, empty when the wal is disabled
+func (w *Wal) DataDir() string {
+	return w.dataDir
+}
+
+// Position returns the end of the wal. It's stable only while no log is being written.
+func (w *Wal) Position() (Position, error) {
+	if w.segments != nil {
+		w.segmentMu.Lock()
+		position, ok := w.segments.position()
+		w.segmentMu.Unlock()
+
+		if ok {
+			return position, nil
 		}
 	}
 
-	walRecords := buildWalRecordsFromMap(compactedMap)
+	segments, err := Segments(w.dataDir)
+	if err != nil {
+		return Position{}, err
+	}
 
-	if walRecords.Len() == 0 {
-		return nil
+	if len(segments) == 0 {
+		return Position{}, nil
 	}
 
-	fileName := fmt.Sprintf("%s", time.Now().Format(fileTimeFormat))
+	latest := segments[len(segments)-1]
+
+	length, err := segmentLength(w.dataDir, latest)
+	if err != nil {
+		return Position{}, fmt.Errorf("segment length: %w", err)
+	}
+
+	return Position{Segment: latest, Offset: length}, nil
+}
+
+// OpenSegments opens the files of the segments from..to at once, compression, compaction and pruning
+// replace or remove segment files under segmentMu, so the opened files are a consistent wal.
+func (w *Wal) OpenSegments(from string, to string) ([]OpenedSegment, error) {
+	w.segmentMu.Lock()
+	defer w.segmentMu.Unlock()
 
-	err = WriteRecord(w.dataDir, fileName, walRecords)
+	return OpenSegments(w.dataDir, from, to)
+}
+
+// RemoveSegmentsBefore removes segments older than segment, e.g. covered by a snapshot. It returns the number of removed segments.
+func (w *Wal) RemoveSegmentsBefore(segment string) (int, error) {
+	segments, err := Segments(w.dataDir)
 	if err != nil {
-		return fmt.Errorf("write record: %s: %w", fileName, err)
+		return 0, err
 	}
 
-	for _, entry := range dirEntries {
-		err = removeFileWithRetries(w.dataDir, entry.Name())
+	// the compression of a removed segment must not bring it back
+	w.segmentMu.Lock()
+	defer w.segmentMu.Unlock()
+
+	removed := 0
+	for _, name := range segments {
+		if name >= segment {
+			break
+		}
+
+		err = removeSegment(w.dataDir, name)
 		if err != nil {
-			return fmt.Errorf("remove file: %s: %w", entry.Name(), err)
+			return removed, fmt.Errorf("remove segment %s: %w", name, err)
 		}
+
+		removed++
 	}
 
-	w.logger.Debug("WAL compaction completed")
+	return removed, nil
+}
 
-	return nil
+// WriteLog queues the log and waits until the batch containing it is flushed or ctx is done. An acknowledged log is
+// written to the segment file, it's fsynced before the acknowledgement only in the always fsync mode.
+func (w *Wal) WriteLog(ctx context.Context, log Log) error {
+	future, err := w.Submit(ctx, log)
+	if err != nil {
+		return err
+	}
+
+	return future.Wait(ctx)
 }
 
-func handleDirs(dataDir string, dirEntry fs.DirEntry, compactedMap map[string]string) error {
-	filename := dirEntry.Name()
-	path := filepath.Join(dataDir, filename)
+// Submit queues the log to the current batch. A log that isn't queued because ctx is done or the wal is stopped
+// is not written. A queued log stays in its batch and is written even when nobody waits for its future.
+func (w *Wal) Submit(ctx context.Context, log Log) (*Future, error) {
+	// select picks a ready case at random, a done ctx must not queue the log
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	file, err := os.Open(path)
-	if err != nil {
-		return fmt.Errorf("error opening file: %v\n", err)
+	log.future = newFuture()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-w.stop:
+		return nil, consts.ErrWalClosed
+	case w.operations <- log:
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
+	return log.future, nil
+}
 
-	for scanner.Scan() {
-		entries := strings.Split(scanner.Text(), " ")
+func (w *Wal) flushRecords() error {
+	if len(w.batch) == 0 {
+		return nil
+	}
 
-		args := entries[2:]
-		command := entries[1]
+	w.segmentMu.Lock()
+	defer w.segmentMu.Unlock()
 
-		switch command {
-		case consts.CommandSet:
-			compactedMap[args[0]] = args[1]
+	walRecords := buildWalRecords(w.batch)
 
-		case consts.CommandDel:
-			delete(compactedMap, args[0])
+	active := w.segments.name
 
+	err := w.segments.write(walRecords.Bytes())
+
+	if w.segments.name != active && w.compressed() {
+		select {
+		case w.compressSignal <- struct{}{}:
 		default:
-			return fmt.Errorf("unknown command: %s", command)
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("scan file: %s: %w", path, err)
+	return err
+}
+
+// syncSegment fsyncs writes to the active segment in the interval mode
+func (w *Wal) syncSegment() error {
+	w.segmentMu.Lock()
+	defer w.segmentMu.Unlock()
+
+	return w.segments.sync()
+}
+
+// removeSegment removes the files of a segment, compressed, encrypted or plain
+func removeSegment(dataDir string, segment string) error {
+	for _, name := range segmentFiles(segment) {
+		err := removeFileWithRetries(dataDir, name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
 	}
 
 	return nil
@@ -306,55 +538,21 @@ func removeFileWithRetries(dataDir string, fileName string) error {
 	return nil
 }
 
-func buildWalRecordsFromMap(logs map[string]string) bytes.Buffer {
-	walRecords := bytes.Buffer{}
-
-	for k, v := range logs {
-		record := fmt.Sprintf("%s %s %s \n", utils.GetRequestUUID(), consts.CommandSet, strings.Join([]string{k, v}, " "))
-		walRecords.WriteString(record)
-	}
-
-	return walRecords
-}
-
+// buildWalRecords stamps every record of a batch with the flush time
 func buildWalRecords(batch []Log) bytes.Buffer {
 	walRecords := bytes.Buffer{}
+	now := recordTime()
 
 	for _, log := range batch {
-		record := fmt.Sprintf("%s %s %s \n", log.ID, log.Query.Command, strings.Join(log.Query.Arguments, " "))
+		record := fmt.Sprintf("%s %s %s %s \n", now, log.ID, log.Query.Command, strings.Join(log.Query.Arguments, " "))
 		walRecords.WriteString(record)
 	}
 
 	return walRecords
 }
 
-func writeWalRecords(dataDir string, dirEntries []fs.DirEntry, walRecords bytes.Buffer, maxLogFileSegmentSize int) error {
-	if len(dirEntries) > 0 {
-		latest := dirEntries[len(dirEntries)-1]
-		info, err := latest.Info()
-		if err != nil {
-			return fmt.Errorf("get info: %s: %w", latest.Name(), err)
-		}
-
-		// write to an existing file
-		if int(info.Size())+walRecords.Len() < maxLogFileSegmentSize {
-			err := WriteRecord(dataDir, latest.Name(), walRecords)
-			if err != nil {
-				return fmt.Errorf("write record: %s: %w", latest.Name(), err)
-			}
-
-			return nil
-		}
-	}
-
-	// write to a new file
-	fileName := fmt.Sprintf("%s", time.Now().Format(fileTimeFormat))
-	err := WriteRecord(dataDir, fileName, walRecords)
-	if err != nil {
-		return fmt.Errorf("write record: %s: %w", fileName, err)
-	}
-
-	return nil
+func recordTime() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
 }
 
 func WriteRecord(dataDir string, filename string, walRecords bytes.Buffer) error {
@@ -378,3 +576,13 @@ func WriteRecord(dataDir string, filename string, walRecords bytes.Buffer) error
 
 	return nil
 }
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
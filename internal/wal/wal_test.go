@@ -2,15 +2,20 @@ package wal
 
 import (
 	"bytes"
+	"context"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/compute"
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/configs"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts/defaults"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestStart(t *testing.T) {
@@ -27,6 +32,7 @@ func TestStart(t *testing.T) {
 		},
 		dataDir:               dataDir,
 		maxLogFileSegmentSize: 1024,
+		segments:              newSegmentManager(dataDir, 1024, ""),
 		batchTimeout:          5 * time.Second,
 		batchSize:             2,
 		operations:            make(chan Log),
@@ -43,6 +49,7 @@ func TestFlushRecords(t *testing.T) {
 		batch:                 []Log{{ID: strconv.Itoa(1), Query: compute.Query{Command: "SET", Arguments: []string{"aa", "bb"}}}},
 		dataDir:               dataDir,
 		maxLogFileSegmentSize: 1024,
+		segments:              newSegmentManager(dataDir, 1024, ""),
 	}
 
 	err := w.flushRecords()
@@ -86,17 +93,6 @@ func TestWriteRecord_WriteFileError(t *testing.T) {
 	assert.Error(t, err)
 }
 
-func TestBuildWalRecordsFromMap(t *testing.T) {
-	logs := map[string]string{
-		"key1": "value1",
-		"key2": "value2",
-	}
-
-	walRecords := buildWalRecordsFromMap(logs)
-
-	assert.Contains(t, walRecords.String(), "SET key1 value1 \n", "SET key2 value2 \n")
-}
-
 func TestRemoveFileWithRetries(t *testing.T) {
 	dataDir := "./"
 	fileName := "testfile"
@@ -110,3 +106,136 @@ func TestRemoveFileWithRetries(t *testing.T) {
 
 	assert.NoError(t, err)
 }
+
+func TestStop_FlushesPendingBatch(t *testing.T) {
+	dataDir := t.TempDir()
+
+	w := &Wal{
+		dataDir:               dataDir,
+		maxLogFileSegmentSize: 1024,
+		segments:              newSegmentManager(dataDir, 1024, ""),
+		batchTimeout:          time.Hour,
+		batchSize:             100,
+		operations:            make(chan Log),
+		stop:                  make(chan struct{}),
+		logger:                slog.Default(),
+	}
+	cfg := &configs.Wal{}
+
+	w.Start(cfg)
+
+	// operations is unbuffered, so the log is in the batch once it's sent.
+	// The batch is neither full nor timed out, only Stop can flush it.
+	future := newFuture()
+	w.operations <- Log{ID: "1", Query: compute.Query{Command: "SET", Arguments: []string{"a", "b"}}, future: future}
+
+	require.NoError(t, w.Stop(cfg))
+	require.NoError(t, future.Err())
+
+	entries, err := os.ReadDir(dataDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	data, err := os.ReadFile(filepath.Join(dataDir, entries[0].Name()))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "SET a b")
+
+	err = w.WriteLog(context.Background(), Log{ID: "2", Query: compute.Query{Command: "DEL", Arguments: []string{"a"}}})
+	assert.ErrorIs(t, err, consts.ErrWalClosed)
+}
+
+func TestSubmit_FuturePerLog(t *testing.T) {
+	cfg := &configs.Wal{}
+
+	dataDir := t.TempDir()
+
+	w := &Wal{
+		dataDir:               dataDir,
+		maxLogFileSegmentSize: 1024,
+		segments:              newSegmentManager(dataDir, 1024, ""),
+		batchTimeout:          time.Hour,
+		batchSize:             2,
+		operations:            make(chan Log),
+		stop:                  make(chan struct{}),
+		logger:                slog.Default(),
+	}
+	w.Start(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	first, err := w.Submit(ctx, Log{ID: "1", Query: compute.Query{Command: "SET", Arguments: []string{"a", "1"}}})
+	require.NoError(t, err)
+
+	// the waiter gives up, the log stays in the batch
+	cancel()
+	assert.ErrorIs(t, first.Wait(ctx), context.Canceled)
+
+	_, err = w.Submit(ctx, Log{ID: "2", Query: compute.Query{Command: "SET", Arguments: []string{"a", "2"}}})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	second, err := w.Submit(context.Background(), Log{ID: "3", Query: compute.Query{Command: "SET", Arguments: []string{"a", "3"}}})
+	require.NoError(t, err)
+
+	require.NoError(t, second.Wait(context.Background()))
+	require.NoError(t, first.Err())
+	require.NoError(t, w.Stop(cfg))
+
+	ids := make([]string, 0)
+	_, _, err = Replay(w.dataDir, Position{}, Target{}, func(record Record) error {
+		ids = append(ids, record.ID)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "3"}, ids)
+}
+
+func TestFlushRecords_KeepsSegmentOpen(t *testing.T) {
+	dataDir := t.TempDir()
+
+	w := &Wal{dataDir: dataDir, maxLogFileSegmentSize: 120, segments: newSegmentManager(dataDir, 120, defaults.FsyncInterval)}
+
+	flush := func(id string) {
+		w.batch = []Log{{ID: id, Query: compute.Query{Command: "SET", Arguments: []string{"key", "value"}}}}
+		require.NoError(t, w.flushRecords())
+	}
+
+	flush("1")
+	segment := w.segments.file
+	assert.Equal(t, segmentName(1), w.segments.name)
+	assert.True(t, w.segments.unsynced)
+
+	flush("2")
+	assert.Same(t, segment, w.segments.file)
+
+	require.NoError(t, w.segments.sync())
+	assert.False(t, w.segments.unsynced)
+
+	// the third record doesn't fit, the next segment is opened
+	flush("3")
+	assert.NotSame(t, segment, w.segments.file)
+	assert.Equal(t, segmentName(2), w.segments.name)
+
+	segments, err := Segments(dataDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{segmentName(1), segmentName(2)}, segments)
+
+	position, err := w.Position()
+	require.NoError(t, err)
+	assert.Equal(t, Position{Segment: segmentName(2), Offset: int64(w.segments.size)}, position)
+
+	require.NoError(t, w.segments.close())
+	assert.Nil(t, w.segments.file)
+
+	// a reopened wal appends to the latest segment
+	flush("4")
+	assert.Equal(t, segmentName(2), w.segments.name)
+	require.NoError(t, w.segments.close())
+
+	ids := make([]string, 0)
+	_, _, err = Replay(dataDir, Position{}, Target{}, func(record Record) error {
+		ids = append(ids, record.ID)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "2", "3", "4"}, ids)
+}
@@ -9,9 +9,9 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
-	"path/filepath"
-	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/JaneJavannie/in_memory_key_value_db/internal/configs"
@@ -33,6 +33,12 @@ type Replication struct {
 	client          *text.Client
 	server          *text.TcpServer
 	logger          *slog.Logger
+
+	// unix nano time of the last successful sync with the master, start time before the first one
+	lastSync atomic.Int64
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
 type replicatedWal struct {
@@ -63,6 +69,9 @@ func NewReplication(cfg *configs.Config, client *text.Client, server *text.TcpSe
 }
 
 func (r *Replication) Start(ctx context.Context, syncInterval time.Duration) error {
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.lastSync.Store(time.Now().UnixNano())
+
 	switch r.replicationType {
 	case defaults.ReplicationTypeSlave:
 		err := r.startSlave(ctx, syncInterval)
@@ -83,20 +92,57 @@ func (r *Replication) Start(ctx context.Context, syncInterval time.Duration) err
 	return nil
 }
 
-func (r *Replication) startSlave(ctx context.Context, syncInterval time.Duration) error {
-	ticker := time.NewTicker(syncInterval)
-	defer ticker.Stop()
+// Role returns the replication type and, on a slave, the time since the last successful sync with the master
+func (r *Replication) Role() (string, time.Duration) {
+	if r.replicationType != defaults.ReplicationTypeSlave {
+		return r.replicationType, 0
+	}
+
+	return r.replicationType, time.Since(time.Unix(0, r.lastSync.Load()))
+}
 
+// Stop stops syncing with the master on a slave and drains replica connections on a master
+func (r *Replication) Stop(ctx context.Context) error {
+	if r.cancel != nil {
+		r.cancel()
+	}
+
+	var err error
+	if r.replicationType == defaults.ReplicationTypeMaster {
+		err = r.server.Shutdown(ctx)
+	}
+
+	r.wg.Wait()
+
+	return err
+}
+
+func (r *Replication) startSlave(ctx context.Context, syncInterval time.Duration) error {
 	err := r.client.Connect(ctx)
 	if err != nil {
 		return fmt.Errorf("connect: %w", err)
 	}
 
+	r.wg.Add(1)
+
+	go func() {
+		defer r.wg.Done()
+
+		r.syncWithMaster(ctx, syncInterval)
+	}()
+
+	return nil
+}
+
+func (r *Replication) syncWithMaster(ctx context.Context, syncInterval time.Duration) {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
 			r.client.Close()
-			return nil
+			return
 
 		case <-ticker.C:
 			err := r.GetWalsFromMaster(ctx)
@@ -109,10 +155,13 @@ func (r *Replication) startSlave(ctx context.Context, syncInterval time.Duration
 				} else {
 					r.logger.Error("error", "get master wals", err)
 				}
+
+				continue
 			}
+
+			r.lastSync.Store(time.Now().UnixNano())
 		}
 	}
-
 }
 
 type walMessage struct {
@@ -156,25 +205,19 @@ func (r *Replication) startMaster() error {
 
 func (r *Replication) GetWalsFromMaster(ctx context.Context) error {
 	// read wals that were already copied from master
-	dirEntries, err := os.ReadDir(r.walDir)
+	segments, err := wal.Segments(r.walDir)
 	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			return fmt.Errorf("read dir: %w", err)
-		}
-
-		err = os.MkdirAll(r.walDir, os.ModePerm)
-		if err != nil {
-			return fmt.Errorf("create dir: %w", err)
-		}
+		return fmt.Errorf("segments: %w", err)
 	}
 
-	sort.Slice(dirEntries, func(i, j int) bool {
-		return dirEntries[i].Name() < dirEntries[j].Name()
-	})
+	err = os.MkdirAll(r.walDir, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("create dir: %w", err)
+	}
 
 	latest := ""
-	if len(dirEntries) > 0 {
-		latest = dirEntries[len(dirEntries)-1].Name()
+	if len(segments) > 0 {
+		latest = segments[len(segments)-1]
 	}
 
 	encoded, err := r.client.Send(ctx, latest)
@@ -200,29 +243,35 @@ func (r *Replication) GetWalsFromMaster(ctx context.Context) error {
 			return fmt.Errorf("write record: %w", err)
 		}
 
+		// encrypted segments are stored as they came and decrypted with the keys of the replica
+		records, err := wal.DecodeSegment(w.FileName, w.Records)
+		if err != nil {
+			return fmt.Errorf("decode segment: %w", err)
+		}
+
 		// apply new records
-		reader := bytes.NewReader(w.Records)
+		reader := bytes.NewReader(records)
 		scanner := bufio.NewScanner(reader)
 		for scanner.Scan() {
-			entries := strings.Split(scanner.Text(), " ")
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
 
-			args := make([]string, 0)
-			args = append(args, entries[2:]...)
+			record, err := wal.ParseRecord(scanner.Text())
+			if err != nil {
+				return fmt.Errorf("parse record: %w", err)
+			}
 
-			id := entries[0]
-			command := entries[1]
+			r.logger.Debug("processing log", "id", record.ID)
 
-			r.logger.Debug("processing log", "id", id)
+			args := record.Query.Arguments
 
-			switch command {
+			switch record.Query.Command {
 			case consts.CommandSet:
 				r.storage.Set(args[0], args[1])
 
 			case consts.CommandDel:
 				r.storage.Del(args[0])
-
-			default:
-				return fmt.Errorf("unknown command: %s", command)
 			}
 		}
 	}
@@ -231,45 +280,41 @@ func (r *Replication) GetWalsFromMaster(ctx context.Context) error {
 }
 
 func (r *Replication) SendWalsToReplica(ctx context.Context, latestReplicatedEntry string) ([]replicatedWal, error) {
-	dirEntries, err := os.ReadDir(r.walDir)
+	// compressed segments are sent decompressed under their segment names, encrypted ones are sent encrypted
+	// under their file names, replicas store them as is
+	segments, err := wal.Segments(r.walDir)
 	if err != nil {
-		return nil, fmt.Errorf("read dir: %w", err)
+		return nil, fmt.Errorf("segments: %w", err)
 	}
 
-	sort.Slice(dirEntries, func(i, j int) bool {
-		return dirEntries[i].Name() < dirEntries[j].Name()
-	})
-
 	walsToSend := make([]replicatedWal, 0)
 
-	if len(dirEntries) == 0 {
+	if len(segments) == 0 {
 		return nil, nil
 	}
 
-	latest := dirEntries[len(dirEntries)-1]
+	latest := segments[len(segments)-1]
 
 	// nothing to send
-	if latestReplicatedEntry == latest.Name() {
+	if latestReplicatedEntry == latest {
 		return nil, nil
 	}
 
 	// collect wal entries from the end till encounter already sent latestReplicatedEntry
-	for i := len(dirEntries) - 1; i >= 0; i-- {
-		fileName := dirEntries[i].Name()
-
-		path := filepath.Join(r.walDir, fileName)
+	for i := len(segments) - 1; i >= 0; i-- {
+		fileName := segments[i]
 
 		if latestReplicatedEntry == fileName {
 			break
 		}
 
-		fileBytes, err := os.ReadFile(path)
+		exportedName, fileBytes, err := wal.ExportSegment(r.walDir, fileName)
 		if err != nil {
 			return nil, fmt.Errorf("read file %s: %w", fileName, err)
 		}
 
 		walsToSend = append(walsToSend, replicatedWal{
-			FileName: fileName,
+			FileName: exportedName,
 			Records:  fileBytes,
 		})
 	}
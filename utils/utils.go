@@ -3,16 +3,41 @@ package utils
 import (
 	"context"
 	"errors"
+	"fmt"
+	"math/rand/v2"
 	"time"
 
+	"github.com/JaneJavannie/in_memory_key_value_db/internal/consts"
 	"github.com/google/uuid"
 )
 
+const (
+	maxBackoff         = 30 * time.Second
+	maxRequestIDLength = 64
+)
+
 func GetRequestUUID() string {
 	return uuid.New().String()
 }
 
-func WithRetries(ctx context.Context, retriesNumber int, initialDelayMs time.Duration, action func() error) error {
+// ValidateRequestID checks a client request id: 1-64 letters, digits, '-' and '_'
+func ValidateRequestID(id string) error {
+	if id == "" || len(id) > maxRequestIDLength {
+		return fmt.Errorf("%w: must be 1-%d characters", consts.ErrInvalidRequestID, maxRequestIDLength)
+	}
+
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return fmt.Errorf("%w: unexpected symbol %q", consts.ErrInvalidRequestID, r)
+		}
+	}
+
+	return nil
+}
+
+// WithRetries runs action until it succeeds, at most retriesNumber times.
+// Delays between attempts grow exponentially from initialDelay with random jitter.
+func WithRetries(ctx context.Context, retriesNumber int, initialDelay time.Duration, action func() error) error {
 	if action == nil {
 		return errors.New("incorrect action")
 	}
@@ -24,11 +49,37 @@ func WithRetries(ctx context.Context, retriesNumber int, initialDelayMs time.Dur
 		}
 
 		if err = action(); err == nil {
+			return nil
+		}
+
+		if retry == retriesNumber {
 			break
 		}
 
-		time.Sleep(initialDelayMs * time.Duration(retry))
+		timer := time.NewTimer(Backoff(initialDelay, retry))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
 	}
 
 	return err
 }
+
+// Backoff returns the delay before the next attempt: a random duration
+// from half to the whole of initialDelay * 2^(attempt-1), capped at maxBackoff
+func Backoff(initialDelay time.Duration, attempt int) time.Duration {
+	if initialDelay <= 0 {
+		return 0
+	}
+
+	delay := initialDelay << min(attempt-1, 30)
+	if delay <= 0 || delay > maxBackoff {
+		delay = maxBackoff
+	}
+
+	return delay/2 + time.Duration(rand.Int64N(int64(delay/2)+1))
+}